@@ -21,6 +21,7 @@ import (
 	"github.com/couchbase/gometa/message"
 	"github.com/couchbase/gometa/protocol"
 	repo "github.com/couchbase/gometa/repository"
+	"strings"
 )
 
 ////////////////////////////////////////////////////////////////////////////
@@ -34,6 +35,31 @@ type ServerCallback interface {
 	UpdateWinningEpoch(epoch uint32)
 	GetEnsembleSize() uint64
 	GetFollowerId() string
+	GetPriority() uint32
+	GetFollowerPriority(fid string) uint32
+	GetSlowFollowerPolicy() *protocol.SlowFollowerPolicy
+	GetClock() common.Clock
+	GetLogger() *common.NodeLogger
+	GetTracer() *common.NodeTracer
+	GetMetricLabels() common.MetricLabels
+}
+
+//
+// A ServerCallback can implement EpochTracker to be told about the current
+// epoch agreed with the leader (or the followers) at the end of every
+// synchronization, even if the epoch does not change.
+//
+type EpochTracker interface {
+	OnNewCurrentEpoch(epoch uint32)
+}
+
+//
+// A ServerCallback can implement CommitTracker to be told about every
+// change committed to the repository, in txnid order.  This includes the
+// changes committed while synchronizing with the leader.
+//
+type CommitTracker interface {
+	OnCommitted(txid common.Txnid, op common.OpCode, key string, content []byte)
 }
 
 type DefaultServerCallback interface {
@@ -66,6 +92,9 @@ func NewDefaultServerAction(repository *repo.Repository,
 	txn *common.TxnState) *ServerAction {
 
 	log := repo.NewCommitLog(repository)
+	if _, err := log.Upgrade(); err != nil {
+		common.Errorf("NewDefaultServerAction() : Fail to upgrade the commit log : %v", err)
+	}
 	config := repo.NewServerConfig(repository)
 	factory := message.NewConcreteMsgFactory()
 
@@ -143,6 +172,34 @@ func (a *ServerAction) GetQuorumVerifier() protocol.QuorumVerifier {
 	return a.verifier
 }
 
+func (a *ServerAction) GetPriority() uint32 {
+	return a.server.GetPriority()
+}
+
+func (a *ServerAction) GetFollowerPriority(fid string) uint32 {
+	return a.server.GetFollowerPriority(fid)
+}
+
+func (a *ServerAction) GetSlowFollowerPolicy() *protocol.SlowFollowerPolicy {
+	return a.server.GetSlowFollowerPolicy()
+}
+
+func (a *ServerAction) GetClock() common.Clock {
+	return a.server.GetClock()
+}
+
+func (a *ServerAction) GetLogger() *common.NodeLogger {
+	return a.server.GetLogger()
+}
+
+func (a *ServerAction) GetTracer() *common.NodeTracer {
+	return a.server.GetTracer()
+}
+
+func (a *ServerAction) GetMetricLabels() common.MetricLabels {
+	return a.server.GetMetricLabels()
+}
+
 ////////////////////////////////////////////////////////////////////////////
 // Server Action for Broadcast stage (normal execution)
 /////////////////////////////////////////////////////////////////////////////
@@ -168,6 +225,7 @@ func (a *ServerAction) Commit(txid common.Txnid) error {
 	}
 
 	a.log.MarkCommitted(txid)
+	a.notifyCommitted(txid, opCode, key, content)
 	a.server.UpdateStateOnCommit(txid, key)
 
 	return nil
@@ -238,8 +296,8 @@ func (a *ServerAction) GetAcceptedEpoch() (uint32, error) {
 func (a *ServerAction) NotifyNewAcceptedEpoch(epoch uint32) error {
 	oldEpoch, _ := a.GetAcceptedEpoch()
 
-	// update only if the new epoch is larger
-	if oldEpoch < epoch {
+	// update only if the new epoch is more recent
+	if common.CompareEpoch(epoch, oldEpoch) == common.MORE_RECENT {
 		err := a.config.SetAcceptedEpoch(epoch)
 		if err != nil {
 			return err
@@ -252,8 +310,8 @@ func (a *ServerAction) NotifyNewAcceptedEpoch(epoch uint32) error {
 func (a *ServerAction) NotifyNewCurrentEpoch(epoch uint32) error {
 	oldEpoch, _ := a.GetCurrentEpoch()
 
-	// update only if the new epoch is larger
-	if oldEpoch < epoch {
+	// update only if the new epoch is more recent
+	if common.CompareEpoch(epoch, oldEpoch) == common.MORE_RECENT {
 		err := a.config.SetCurrentEpoch(epoch)
 		if err != nil {
 			return err
@@ -261,6 +319,11 @@ func (a *ServerAction) NotifyNewCurrentEpoch(epoch uint32) error {
 		a.server.UpdateWinningEpoch(epoch)
 	}
 
+	if tracker, ok := a.server.(EpochTracker); ok {
+		current, _ := a.GetCurrentEpoch()
+		tracker.OnNewCurrentEpoch(current)
+	}
+
 	return nil
 }
 
@@ -277,6 +340,18 @@ func (a *ServerAction) GetCommitedEntries(txid1, txid2 common.Txnid) (<-chan pro
 		return nil, nil, nil, err
 	}
 
+	// The entries up to the compacted txnid are removed.  A peer that
+	// falls behind must be seeded from a snapshot of the repository.
+	// The log is not compacted above txid1 once the iterator is open, so
+	// check after opening it.
+	if compacted := a.config.GetLogCompactedTxid(); common.CompareTxnid(txid1, compacted) == common.LESS_RECENT {
+		iter.Close()
+		a.server.GetLogger().Warnf("ServerAction.GetCommitedEntries() : Entries after txnid %d are requested, but the log is compacted up to txnid %d",
+			uint64(txid1), uint64(compacted))
+		return nil, nil, nil, common.NewError(common.COMPACTED_ERROR,
+			fmt.Sprintf("The commit log is compacted up to txnid %d", uint64(compacted)))
+	}
+
 	logChan := make(chan protocol.LogEntryMsg, 100)
 	errChan := make(chan error, 10)
 	killChan := make(chan bool, 1)
@@ -302,7 +377,7 @@ func (a *ServerAction) startLogStreamer(startTxid common.Txnid,
 		// only stream entry with a txid greater than the given one.  The caller would already
 		// have the entry for startTxid. If the caller use the boostrap value for txnid (0),
 		// then this will stream everything.
-		if txnid > startTxid {
+		if common.CompareTxnid(txnid, startTxid) == common.MORE_RECENT {
 			msg := a.factory.CreateLogEntry(uint64(txnid), uint32(op), key, body)
 			select {
 			case logChan <- msg:
@@ -336,6 +411,7 @@ func (a *ServerAction) LogAndCommit(txid common.Txnid, op uint32, key string, co
 		}
 
 		a.log.MarkCommitted(txid)
+		a.notifyCommitted(txid, common.OpCode(op), key, content)
 	}
 
 	return nil
@@ -348,7 +424,11 @@ func (a *ServerAction) LogAndCommit(txid common.Txnid, op uint32, key string, co
 func (a *ServerAction) Get(key string) ([]byte, error) {
 
 	newKey := fmt.Sprintf("%s%s", common.PREFIX_DATA_PATH, key)
-	return a.repo.Get(newKey)
+	value, err := a.repo.Get(newKey)
+	if repo.IsKeyNotFound(err) {
+		return nil, common.NewError(common.KEY_NOT_FOUND_ERROR, "Key "+key+" does not exist")
+	}
+	return value, err
 }
 
 func (a *ServerAction) Set(key string, content []byte) error {
@@ -356,6 +436,33 @@ func (a *ServerAction) Set(key string, content []byte) error {
 	return a.repo.Set(newKey, content)
 }
 
+//
+// Return the keys with the given prefix and their values, in key order.
+//
+func (a *ServerAction) List(prefix string) ([]string, [][]byte, error) {
+
+	startKey := fmt.Sprintf("%s%s", common.PREFIX_DATA_PATH, prefix)
+	iter, err := a.repo.NewIterator(startKey, startKey+"\xff")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iter.Close()
+
+	var keys []string
+	var values [][]byte
+
+	key, content, err := iter.Next()
+	for err == nil {
+		if strings.HasPrefix(key, startKey) {
+			keys = append(keys, key[len(common.PREFIX_DATA_PATH):])
+			values = append(values, content)
+		}
+		key, content, err = iter.Next()
+	}
+
+	return keys, values, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////
 // Private Function
 /////////////////////////////////////////////////////////////////////////////
@@ -379,6 +486,13 @@ func (a *ServerAction) persistChange(op common.OpCode, key string, content []byt
 	return common.NewError(common.PROTOCOL_ERROR, fmt.Sprintf("ServerAction.persistChange() : Unknown op code %d", op))
 }
 
+func (a *ServerAction) notifyCommitted(txid common.Txnid, op common.OpCode, key string, content []byte) {
+
+	if tracker, ok := a.server.(CommitTracker); ok {
+		tracker.OnCommitted(txid, op, key, content)
+	}
+}
+
 func (a *ServerAction) appendCommitLog(txnid common.Txnid, opCode common.OpCode, key string, content []byte) error {
 
 	// TODO: Make the whole func transactional
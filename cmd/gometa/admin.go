@@ -0,0 +1,713 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	json "encoding/json"
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/protocol"
+	"github.com/couchbase/gometa/server"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// The admin subcommands (e.g. "gometa admin status -config=config.json").
+// The servers given by -servers or -config are only used to find the
+// members of the ensemble.  The members are then contacted directly at
+// their request address.
+//
+var adminCommands = map[string]*subcommand{
+	"status":              {usage: "admin status [flags]", run: runAdminStatus},
+	"members":             {usage: "admin members [flags]", run: runAdminMembers},
+	"leader":              {usage: "admin leader [flags]", run: runAdminLeader},
+	"transfer-leadership": {usage: "admin transfer-leadership [flags] member", run: runTransferLeadership},
+	"add-member":          {usage: "admin add-member [flags]", run: runAddMember},
+	"remove-member":       {usage: "admin remove-member [flags] member", run: runRemoveMember},
+	"compact-log":         {usage: "admin compact-log [flags]", run: runCompactLog},
+	"snapshot":            {usage: "admin snapshot [flags] path", run: runSnapshot},
+	"backup":              {usage: "admin backup [flags] file", run: runBackup},
+}
+
+//
+// The status of a member, or the error if the member cannot be reached.
+//
+type memberStatus struct {
+	Member string
+	Status []*server.NodeStatus `json:",omitempty"`
+	Error  string               `json:",omitempty"`
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Main Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Run the admin subcommand given by the first argument.
+//
+func runAdminCommand(args []string) int {
+
+	if len(args) == 0 || adminCommands[args[0]] == nil {
+		names := make([]string, 0, len(adminCommands))
+		for name := range adminCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(os.Stderr, "usage: gometa admin command [flags] [args]\n\ncommands:\n")
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  gometa %s\n", adminCommands[name].usage)
+		}
+		return EXIT_USAGE
+	}
+
+	return runCommand(adminCommands[args[0]], "admin "+args[0], args[1:])
+}
+
+func addAdminFlags(name string, flags *cliFlags) {
+
+	flags.set.StringVar(&flags.group, "group", "", "consensus group, if the nodes host multiple groups")
+
+	switch name {
+	case "admin transfer-leadership", "admin add-member", "admin remove-member":
+		flags.set.IntVar(&flags.wait, "wait", int(common.LEADERSHIP_TRANSFER_TIMEOUT),
+			"time to wait for each member to be ready (millisecond)")
+	}
+
+	switch name {
+	case "admin add-member":
+		flags.set.StringVar(&flags.member.ElectionAddr, "election-addr", "", "election address of the new member")
+		flags.set.StringVar(&flags.member.MessageAddr, "message-addr", "", "message address of the new member")
+		flags.set.StringVar(&flags.member.RequestAddr, "request-addr", "", "request address of the new member")
+		flags.set.StringVar(&flags.member.AdminAddr, "admin-addr", "", "address for the four-letter commands of the new member (optional)")
+		flags.set.UintVar(&flags.priority, "priority", 0, "election priority of the new member")
+		flags.set.Uint64Var(&flags.member.Weight, "weight", 0, "voting weight of the new member (weighted or hierarchical quorum)")
+		flags.set.StringVar(&flags.member.Group, "quorum-group", "", "group of the new member (hierarchical quorum)")
+	case "admin compact-log":
+		flags.set.Uint64Var(&flags.txnid, "txnid", 0,
+			"remove the log entries up to this txnid (default is the last txnid logged by every member)")
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Subcommands
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Print the status of every member, one line per member (and group), or
+// as a JSON array.  The members that cannot be reached are unreachable.
+//
+func runAdminStatus(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 0 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	members, err := c.getMembers(flags.group)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	result := make([]*memberStatus, 0, len(members.Members))
+	for _, member := range members.Members {
+		entry := &memberStatus{Member: member.ElectionAddr}
+
+		var reply *server.StatusReply
+		if err := c.callMember(member, "RequestReceiver.GetStatus", &server.Request{}, &reply); err != nil {
+			entry.Error = common.ParseError(err).Error()
+		} else if reply != nil {
+			for _, status := range reply.Status {
+				if len(flags.group) == 0 || status.Group == flags.group {
+					entry.Status = append(entry.Status, status)
+				}
+			}
+		}
+		result = append(result, entry)
+	}
+
+	if c.jsonOutput {
+		c.printJSON(result)
+		return EXIT_OK
+	}
+
+	for _, entry := range result {
+		if len(entry.Error) != 0 {
+			fmt.Printf("%s\tunreachable\n", entry.Member)
+		}
+		for _, status := range entry.Status {
+			member := entry.Member
+			if len(status.Group) != 0 {
+				member = member + "/" + status.Group
+			}
+			fmt.Printf("%s\t%s\tleader %s\tepoch %d\tcommitted %d\n", member, status.Status, status.Leader,
+				status.CurrentEpoch, uint64(status.LastCommittedTxnid))
+		}
+	}
+	return EXIT_OK
+}
+
+//
+// Print the members, one per line (election, message and request address,
+// and priority), or as JSON.
+//
+func runAdminMembers(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 0 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	members, err := c.getMembers(flags.group)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if c.jsonOutput {
+		c.printJSON(members)
+		return EXIT_OK
+	}
+
+	leader := findMember(members.Members, members.Leader)
+	for _, member := range members.Members {
+		role := ""
+		if member == leader {
+			role = "\tleader"
+		}
+		fmt.Printf("%s\t%s\t%s\tpriority %d%s\n", member.ElectionAddr, member.MessageAddr, member.RequestAddr,
+			member.Priority, role)
+	}
+	return EXIT_OK
+}
+
+func runAdminLeader(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 0 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	members, err := c.getMembers(flags.group)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	leader, err := getLeader(members)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if c.jsonOutput {
+		c.printJSON(leader)
+	} else {
+		fmt.Printf("%s\t%s\n", leader.ElectionAddr, leader.RequestAddr)
+	}
+	return EXIT_OK
+}
+
+//
+// Move the leadership to the member, and wait until the member is elected.
+// The leader steps down once the member has caught up.
+//
+func runTransferLeadership(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 1 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	members, err := c.getMembers(flags.group)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	target := findMember(members.Members, args[0])
+	if target == nil {
+		return c.fail(common.NewError(common.INVALID_REQUEST_ERROR, "Unknown member "+args[0]))
+	}
+
+	leader, err := getLeader(members)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if leader != target {
+		var reply *server.AdminReply
+		request := &server.AdminRequest{Group: flags.group, Target: target.ElectionAddr}
+		if err := c.callMember(target, "RequestReceiver.AcceptLeadership", request, &reply); err != nil {
+			return c.fail(err)
+		}
+		if err := c.callMember(leader, "RequestReceiver.TransferLeadership", request, &reply); err != nil {
+			return c.fail(err)
+		}
+
+		deadline := time.Now().Add(time.Duration(flags.wait) * time.Millisecond)
+		for {
+			status, err := c.getMemberStatus(target, flags.group)
+			if err == nil && status.Status == protocol.LEADING.String() {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				return c.fail(common.NewError(common.TIMEOUT_ERROR,
+					"Member "+target.ElectionAddr+" is not elected as the leader in time"))
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+
+	if c.jsonOutput {
+		c.printJSON(target)
+	} else {
+		fmt.Printf("%s\tleader\n", target.ElectionAddr)
+	}
+	return EXIT_OK
+}
+
+//
+// Add the member given by the flags.  The new member is updated first if
+// it is running (it cannot join until the other members are updated).
+// Otherwise, it must be started with the members printed by "gometa admin
+// members".  A member cannot be added once the commit log of a member is
+// compacted.
+//
+func runAddMember(c *cliClient, args []string, flags *cliFlags) int {
+
+	member := flags.member
+	member.Priority = uint32(flags.priority)
+
+	if len(args) != 0 || len(member.ElectionAddr) == 0 || len(member.MessageAddr) == 0 || len(member.RequestAddr) == 0 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	members, err := c.getMembers("")
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if findMember(members.Members, member.ElectionAddr) != nil {
+		return c.fail(common.NewError(common.INVALID_REQUEST_ERROR, "Node "+member.ElectionAddr+" is already a member"))
+	}
+
+	leader, err := getLeader(members)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	// A new member synchronizes from the commit log of the leader, which
+	// must have every entry.
+	for _, m := range members.Members {
+		var reply *server.StatusReply
+		if err := c.callMember(m, "RequestReceiver.GetStatus", &server.Request{}, &reply); err != nil {
+			return c.fail(common.WrapError(common.NO_QUORUM_ERROR, "Member "+m.ElectionAddr+" is not reachable", err))
+		}
+		for _, status := range reply.Status {
+			if status.LogCompactedTxnid != common.Txnid(0) {
+				return c.fail(common.NewError(common.INVALID_REQUEST_ERROR,
+					fmt.Sprintf("The commit log of member %s is compacted up to txnid %d.  A new member cannot synchronize with it.",
+						m.ElectionAddr, uint64(status.LogCompactedTxnid))))
+			}
+		}
+	}
+
+	newMembers := append(append([]*server.Node(nil), members.Members...), &member)
+
+	status, err := c.getMemberStatus(&member, "")
+	if err == nil {
+		var reply *server.AdminReply
+		if err := c.callMember(&member, "RequestReceiver.SetMembers", &server.AdminRequest{Members: newMembers}, &reply); err != nil {
+			return c.fail(err)
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "gometa : Node %s is not running.  Start it with the new members.\n", member.ElectionAddr)
+	}
+
+	if err := c.setMembers(followersThenLeader(members.Members, leader), newMembers, flags); err != nil {
+		return c.fail(err)
+	}
+
+	if status != nil {
+		if err := c.waitRestarted(&member, getLastElection(status), flags); err != nil {
+			return c.fail(err)
+		}
+	}
+
+	if c.jsonOutput {
+		c.printJSON(newMembers)
+	} else {
+		fmt.Printf("%s\tadded\n", member.ElectionAddr)
+	}
+	return EXIT_OK
+}
+
+//
+// Remove the member, and stop it.  The leader cannot be removed.  Transfer
+// the leadership first.
+//
+func runRemoveMember(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 1 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	members, err := c.getMembers("")
+	if err != nil {
+		return c.fail(err)
+	}
+
+	target := findMember(members.Members, args[0])
+	if target == nil {
+		return c.fail(common.NewError(common.INVALID_REQUEST_ERROR, "Unknown member "+args[0]))
+	}
+
+	leader, err := getLeader(members)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if target == leader {
+		return c.fail(common.NewError(common.INVALID_REQUEST_ERROR,
+			"Member "+target.ElectionAddr+" is the leader.  Transfer the leadership first."))
+	}
+
+	var newMembers []*server.Node
+	for _, member := range members.Members {
+		if member != target {
+			newMembers = append(newMembers, member)
+		}
+	}
+
+	if err := c.setMembers(followersThenLeader(newMembers, leader), newMembers, flags); err != nil {
+		return c.fail(err)
+	}
+
+	var reply *server.AdminReply
+	if err := c.callMember(target, "RequestReceiver.Shutdown", &server.AdminRequest{}, &reply); err != nil {
+		fmt.Fprintf(os.Stderr, "gometa : Fail to stop node %s : %s\n", target.ElectionAddr, common.ParseError(err).Error())
+	}
+
+	if c.jsonOutput {
+		c.printJSON(newMembers)
+	} else {
+		fmt.Printf("%s\tremoved\n", target.ElectionAddr)
+	}
+	return EXIT_OK
+}
+
+//
+// Compact the commit log of the leader.  By default, the log is compacted
+// up to the last txnid logged by every member, so that no member needs a
+// snapshot to catch up.  The leader does not compact the log further than
+// that, even with -txnid.
+//
+func runCompactLog(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 0 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	members, err := c.getMembers(flags.group)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	leader, err := getLeader(members)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	var reply *server.AdminReply
+	request := &server.AdminRequest{Group: flags.group, Txnid: flags.txnid}
+	if err := c.callMember(leader, "RequestReceiver.CompactLog", request, &reply); err != nil {
+		return c.fail(err)
+	}
+
+	if c.jsonOutput {
+		c.printJSON(map[string]interface{}{"member": leader.ElectionAddr, "txnid": reply.Txnid, "removed": reply.Count})
+	} else {
+		fmt.Printf("%s\tcompacted up to %d\tremoved %d\n", leader.ElectionAddr, reply.Txnid, reply.Count)
+	}
+	return EXIT_OK
+}
+
+//
+// Copy the repository of the server to a new repository file on the same
+// host.  The copy can be the repository of a new member.
+//
+func runSnapshot(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 1 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	var reply *server.AdminReply
+	request := &server.AdminRequest{Group: flags.group, Path: args[0]}
+	if err := c.call("RequestReceiver.Snapshot", request, &reply, 0, false); err != nil {
+		return c.fail(err)
+	}
+
+	if c.jsonOutput {
+		c.printJSON(map[string]interface{}{"server": c.getAddr(), "path": args[0], "txnid": reply.Txnid})
+	} else {
+		fmt.Printf("%s\t%s\ttxnid %d\n", c.getAddr(), args[0], reply.Txnid)
+	}
+	return EXIT_OK
+}
+
+//
+// Write every key and its value (base64) to the file, or to stdout if the
+// file is "-", as JSON.
+//
+func runBackup(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 1 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	// The pages are read from the same server, and from the same snapshot.
+	backup := &server.BackupReply{}
+	request := &server.AdminRequest{Group: flags.group}
+	for {
+		var reply *server.BackupReply
+		if err := c.call("RequestReceiver.Backup", request, &reply, 0, request.Backup == 0); err != nil {
+			return c.fail(err)
+		}
+
+		backup.Entries = append(backup.Entries, reply.Entries...)
+		backup.Txnid = reply.Txnid
+		if reply.Backup == 0 {
+			break
+		}
+		request.Backup = reply.Backup
+	}
+
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if args[0] == "-" {
+		fmt.Println(string(data))
+		return EXIT_OK
+	}
+
+	if err := ioutil.WriteFile(args[0], data, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "gometa : Fail to write the backup : %s\n", err.Error())
+		return EXIT_FAILURE
+	}
+
+	if c.jsonOutput {
+		c.printJSON(map[string]interface{}{"file": args[0], "keys": len(backup.Entries), "txnid": backup.Txnid})
+	} else {
+		fmt.Printf("%s\t%d keys\ttxnid %d\n", args[0], len(backup.Entries), backup.Txnid)
+	}
+	return EXIT_OK
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// cliClient
+/////////////////////////////////////////////////////////////////////////////
+
+func (c *cliClient) getMembers(group string) (*server.MembersReply, error) {
+
+	var reply *server.MembersReply
+	if err := c.call("RequestReceiver.GetMembers", &server.AdminRequest{Group: group}, &reply, 0, true); err != nil {
+		return nil, err
+	}
+	if reply == nil || len(reply.Members) == 0 {
+		return nil, common.NewError(common.SERVER_ERROR, "The server does not know the members")
+	}
+	return reply, nil
+}
+
+//
+// Call the method on the member, at its request address.
+//
+func (c *cliClient) callMember(member *server.Node, method string, args interface{}, reply interface{}) error {
+
+	if len(member.RequestAddr) == 0 {
+		return common.NewError(common.CLIENT_ERROR, "Member "+member.ElectionAddr+" does not have a request address")
+	}
+
+	node := &cliClient{servers: []string{member.RequestAddr},
+		tlsConfig:  c.tlsConfig,
+		credential: c.credential,
+		timeout:    c.timeout}
+	defer node.close()
+
+	return node.call(method, args, reply, 0, true)
+}
+
+//
+// Return the status of the member (for the group, if the member hosts
+// multiple consensus groups).
+//
+func (c *cliClient) getMemberStatus(member *server.Node, group string) (*server.NodeStatus, error) {
+
+	var reply *server.StatusReply
+	if err := c.callMember(member, "RequestReceiver.GetStatus", &server.Request{}, &reply); err != nil {
+		return nil, err
+	}
+
+	if reply != nil {
+		for _, status := range reply.Status {
+			if len(group) == 0 || status.Group == group {
+				return status, nil
+			}
+		}
+	}
+	return nil, common.NewError(common.INVALID_REQUEST_ERROR, "Member "+member.ElectionAddr+" does not have group "+group)
+}
+
+//
+// Send the members to each node in turn.  A node restarts with the new
+// members, and the next node is only updated once the node is leading or
+// following again.
+//
+func (c *cliClient) setMembers(nodes []*server.Node, members []*server.Node, flags *cliFlags) error {
+
+	for _, node := range nodes {
+		status, err := c.getMemberStatus(node, "")
+		if err != nil {
+			return err
+		}
+		since := getLastElection(status)
+
+		var reply *server.AdminReply
+		if err := c.callMember(node, "RequestReceiver.SetMembers", &server.AdminRequest{Members: members}, &reply); err != nil {
+			return err
+		}
+
+		if err := c.waitRestarted(node, since, flags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// Wait until the node has run an election after the given time, and is
+// leading or following with the ensemble.
+//
+func (c *cliClient) waitRestarted(node *server.Node, since time.Time, flags *cliFlags) error {
+
+	deadline := time.Now().Add(time.Duration(flags.wait) * time.Millisecond)
+	for {
+		status, err := c.getMemberStatus(node, "")
+		if err == nil && getLastElection(status).After(since) && status.Ready &&
+			(status.Status == protocol.LEADING.String() || status.Status == protocol.FOLLOWING.String()) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return common.NewError(common.TIMEOUT_ERROR, "Node "+node.ElectionAddr+" is not ready in time after the update")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	if !c.jsonOutput {
+		fmt.Printf("%s\tupdated\n", node.ElectionAddr)
+	}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Find the member with the given address (election, message, request or
+// admin address).
+//
+func findMember(members []*server.Node, addr string) *server.Node {
+
+	for _, member := range members {
+		if sameAddr("udp", member.ElectionAddr, addr) ||
+			sameAddr("tcp", member.MessageAddr, addr) ||
+			sameAddr("tcp", member.RequestAddr, addr) ||
+			sameAddr("tcp", member.AdminAddr, addr) {
+			return member
+		}
+	}
+	return nil
+}
+
+func sameAddr(network string, addr1 string, addr2 string) bool {
+
+	if len(addr1) == 0 || len(addr2) == 0 {
+		return false
+	}
+	if addr1 == addr2 {
+		return true
+	}
+
+	var resolved1, resolved2 net.Addr
+	var err1, err2 error
+	if network == "udp" {
+		resolved1, err1 = net.ResolveUDPAddr(network, addr1)
+		resolved2, err2 = net.ResolveUDPAddr(network, addr2)
+	} else {
+		resolved1, err1 = net.ResolveTCPAddr(network, addr1)
+		resolved2, err2 = net.ResolveTCPAddr(network, addr2)
+	}
+
+	return err1 == nil && err2 == nil && resolved1.String() == resolved2.String()
+}
+
+func getLeader(members *server.MembersReply) (*server.Node, error) {
+
+	leader := findMember(members.Members, members.Leader)
+	if leader == nil {
+		return nil, common.NewError(common.NO_QUORUM_ERROR, "The ensemble does not have a leader")
+	}
+	return leader, nil
+}
+
+//
+// Return the followers, then the leader.
+//
+func followersThenLeader(members []*server.Node, leader *server.Node) []*server.Node {
+
+	result := make([]*server.Node, 0, len(members))
+	for _, member := range members {
+		if member != leader {
+			result = append(result, member)
+		}
+	}
+	return append(result, leader)
+}
+
+func getLastElection(status *server.NodeStatus) time.Time {
+
+	if len(status.Elections) == 0 {
+		return time.Time{}
+	}
+	return status.Elections[len(status.Elections)-1].Start
+}
@@ -17,18 +17,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	json "encoding/json"
 	"fmt"
+	"github.com/couchbase/gometa/common"
 	"github.com/couchbase/gometa/server"
 	"log"
-	"net/rpc"
 	"os"
 )
 
 type Request struct {
-	OpCode string
-	Key    string
-	Value  []byte
+	OpCode   string
+	Key      string
+	Value    []byte
+	User     string
+	Password string
 }
 
 type Reply struct {
@@ -39,6 +42,8 @@ func runTestClient(path string) {
 
 	// connect to the server
 	var host string
+	var tlsConfig *tls.Config
+	var credential server.Credential
 
 	if path == "" {
 		fmt.Printf("Enter server host\n")
@@ -83,9 +88,21 @@ func runTestClient(path string) {
 		}
 
 		host = config.Peer[idx].RequestAddr
+
+		if config.TLS != nil {
+			tlsConfig, err = common.NewTLSConfig(config.TLS.CertFile, config.TLS.KeyFile, config.TLS.CAFile)
+			if err != nil {
+				fmt.Printf("Error : %s", err.Error())
+				return
+			}
+		}
+
+		if config.Admin != nil {
+			credential = *config.Admin
+		}
 	}
 
-	client, err := rpc.DialHTTP("tcp", host)
+	client, err := server.DialClient(host, tlsConfig)
 	if err != nil {
 		fmt.Printf("Fail to create connection to server %s.  Error %s", host, err.Error())
 		return
@@ -153,7 +170,8 @@ func runTestClient(path string) {
 				content = nil
 			}
 
-			request := &Request{OpCode: command, Key: sendKey, Value: content}
+			request := &Request{OpCode: command, Key: sendKey, Value: content,
+				User: credential.User, Password: credential.Password}
 			var reply *Reply
 			err = client.Call("RequestReceiver.NewRequest", request, &reply)
 			if err != nil {
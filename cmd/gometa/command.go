@@ -0,0 +1,551 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	json "encoding/json"
+	"flag"
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/server"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Exit codes of the subcommands
+//
+const (
+	EXIT_OK          = 0
+	EXIT_FAILURE     = 1 // the request fails
+	EXIT_USAGE       = 2 // invalid arguments or config
+	EXIT_NOT_FOUND   = 3 // the key does not exist
+	EXIT_UNAVAILABLE = 4 // no server can take the request (not reachable, or no quorum)
+)
+
+//
+// A subcommand (e.g. "gometa get -servers=host:port key").  The
+// arguments are the ones after the name of the subcommand.
+//
+type subcommand struct {
+	usage string
+	run   func(c *cliClient, args []string, flags *cliFlags) int
+}
+
+type cliFlags struct {
+	set      *flag.FlagSet
+	servers  string
+	config   string
+	user     string
+	password string
+	json     bool
+	timeout  int
+	file     string
+	since    uint64
+	count    int
+	group    string      // admin : consensus group
+	wait     int         // admin : time to wait for the members to be ready
+	txnid    uint64      // admin compact-log
+	member   server.Node // admin add-member
+	priority uint        // admin add-member
+}
+
+//
+// A client of the request port.  The servers are tried in order until one
+// of them takes the request.
+//
+type cliClient struct {
+	servers    []string
+	tlsConfig  *tls.Config
+	credential server.Credential
+	timeout    time.Duration
+	jsonOutput bool
+
+	current int // index of the server in use
+	client  *rpc.Client
+}
+
+var subcommands = map[string]*subcommand{
+	"get":    {usage: "get [flags] key", run: runGet},
+	"set":    {usage: "set [flags] key [value]", run: runSet},
+	"add":    {usage: "add [flags] key [value]", run: runAdd},
+	"delete": {usage: "delete [flags] key", run: runDelete},
+	"list":   {usage: "list [flags] [prefix]", run: runList},
+	"watch":  {usage: "watch [flags] [prefix]", run: runWatch},
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Main Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Tell if the argument is the name of a subcommand.
+//
+func isSubcommand(name string) bool {
+	_, ok := subcommands[name]
+	return ok || name == "admin"
+}
+
+//
+// Run the subcommand, and return the exit code.
+//
+func runSubcommand(name string, args []string) int {
+
+	if name == "admin" {
+		return runAdminCommand(args)
+	}
+	return runCommand(subcommands[name], name, args)
+}
+
+func runCommand(cmd *subcommand, name string, args []string) int {
+
+	flags := &cliFlags{set: flag.NewFlagSet(name, flag.ContinueOnError)}
+	flags.set.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gometa %s\n", cmd.usage)
+		flags.set.PrintDefaults()
+	}
+	flags.set.StringVar(&flags.servers, "servers", "", "comma separated request addresses of the servers (host:port)")
+	flags.set.StringVar(&flags.config, "config", "", "configuration file of the ensemble, for the servers, TLS and credential")
+	flags.set.StringVar(&flags.user, "user", "", "user of the client (default is the administrator of the config)")
+	flags.set.StringVar(&flags.password, "password", "", "password of the user")
+	flags.set.BoolVar(&flags.json, "json", false, "print the result (and the error) as JSON")
+	flags.set.IntVar(&flags.timeout, "timeout", 10000, "timeout of a request (millisecond)")
+	if name == "set" || name == "add" {
+		flags.set.StringVar(&flags.file, "file", "", "read the value from this file (- for stdin)")
+	}
+	if name == "watch" {
+		flags.set.Uint64Var(&flags.since, "since", 0, "print the changes committed after this txnid (default is from now on)")
+		flags.set.IntVar(&flags.count, "count", 0, "exit after this number of changes (0 : never exit)")
+	}
+	if strings.HasPrefix(name, "admin ") {
+		addAdminFlags(name, flags)
+	}
+
+	if err := flags.set.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	c, err := newCLIClient(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gometa %s : %s\n", name, err.Error())
+		return EXIT_USAGE
+	}
+	defer c.close()
+
+	return cmd.run(c, flags.set.Args(), flags)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Subcommands
+/////////////////////////////////////////////////////////////////////////////
+
+func runGet(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 1 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	var reply *server.Reply
+	request := &server.Request{OpCode: "Get", Key: args[0]}
+	if err := c.call("RequestReceiver.NewRequest", request, &reply, 0, true); err != nil {
+		return c.fail(err)
+	}
+
+	var value []byte
+	if reply != nil {
+		value = reply.Result
+	}
+
+	if c.jsonOutput {
+		c.printJSON(map[string]string{"key": args[0], "value": string(value)})
+	} else {
+		os.Stdout.Write(value)
+		fmt.Println()
+	}
+	return EXIT_OK
+}
+
+func runSet(c *cliClient, args []string, flags *cliFlags) int {
+	return runUpdate(c, "Set", args, flags)
+}
+
+func runAdd(c *cliClient, args []string, flags *cliFlags) int {
+	return runUpdate(c, "Add", args, flags)
+}
+
+func runDelete(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) != 1 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+	return c.update("Delete", args[0], nil)
+}
+
+//
+// Set or add the key.  The value is the second argument, or the content
+// of the file given with -file.
+//
+func runUpdate(c *cliClient, opCode string, args []string, flags *cliFlags) int {
+
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2) == (len(flags.file) != 0) {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	var value []byte
+	if len(args) == 2 {
+		value = []byte(args[1])
+	} else {
+		var err error
+		if value, err = readValue(flags.file); err != nil {
+			fmt.Fprintf(os.Stderr, "gometa %s : Fail to read the value : %s\n", strings.ToLower(opCode), err.Error())
+			return EXIT_USAGE
+		}
+	}
+
+	return c.update(opCode, args[0], value)
+}
+
+//
+// Print the keys with the prefix, one per line (key and value separated by
+// a tab), or as a JSON array.
+//
+func runList(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) > 1 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	var prefix string
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	var reply *server.ListReply
+	request := &server.ListRequest{Prefix: prefix}
+	if err := c.call("RequestReceiver.List", request, &reply, 0, true); err != nil {
+		return c.fail(err)
+	}
+
+	entries := []map[string]string{}
+	if reply != nil {
+		for _, entry := range reply.Entries {
+			entries = append(entries, map[string]string{"key": entry.Key, "value": string(entry.Value)})
+		}
+	}
+
+	if c.jsonOutput {
+		c.printJSON(entries)
+	} else {
+		for _, entry := range entries {
+			fmt.Printf("%s\t%s\n", entry["key"], entry["value"])
+		}
+	}
+	return EXIT_OK
+}
+
+//
+// Print the changes to the keys with the prefix, one per line (op code, key
+// and value separated by a tab), or one JSON object per line.
+//
+func runWatch(c *cliClient, args []string, flags *cliFlags) int {
+
+	if len(args) > 1 || flags.count < 0 {
+		flags.set.Usage()
+		return EXIT_USAGE
+	}
+
+	var prefix string
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	since := flags.since
+	count := 0
+	for {
+		var reply *server.WatchReply
+		request := &server.WatchRequest{Prefix: prefix, Since: since, Timeout: int(common.WATCH_TIMEOUT)}
+		if err := c.call("RequestReceiver.Watch", request, &reply, common.WATCH_TIMEOUT*time.Millisecond, true); err != nil {
+			return c.fail(err)
+		}
+		if reply == nil {
+			continue
+		}
+
+		for _, event := range reply.Events {
+			if c.jsonOutput {
+				c.printJSON(map[string]interface{}{"txnid": event.Txnid,
+					"op":    event.OpCode,
+					"key":   event.Key,
+					"value": string(event.Value)})
+			} else {
+				fmt.Printf("%s\t%s\t%s\n", event.OpCode, event.Key, string(event.Value))
+			}
+
+			count++
+			if flags.count != 0 && count >= flags.count {
+				return EXIT_OK
+			}
+		}
+		since = reply.Txnid
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// cliClient
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a client from the flags.  The servers are given by -servers, or
+// by the request addresses of the config file (see server.Config).
+//
+func newCLIClient(flags *cliFlags) (*cliClient, error) {
+
+	c := &cliClient{timeout: time.Duration(flags.timeout) * time.Millisecond,
+		jsonOutput: flags.json}
+
+	if len(flags.config) != 0 {
+		config, err := server.LoadConfig(flags.config)
+		if err != nil {
+			return nil, err
+		}
+
+		if config.Host != nil && len(config.Host.RequestAddr) != 0 {
+			c.servers = append(c.servers, config.Host.RequestAddr)
+		}
+		for _, peer := range config.Peer {
+			if len(peer.RequestAddr) != 0 {
+				c.servers = append(c.servers, peer.RequestAddr)
+			}
+		}
+
+		if config.TLS != nil {
+			if c.tlsConfig, err = common.NewTLSConfig(config.TLS.CertFile, config.TLS.KeyFile, config.TLS.CAFile); err != nil {
+				return nil, err
+			}
+		}
+
+		if config.Admin != nil {
+			c.credential = *config.Admin
+		}
+	}
+
+	if len(flags.servers) != 0 {
+		c.servers = nil
+		for _, addr := range strings.Split(flags.servers, ",") {
+			if addr = strings.TrimSpace(addr); len(addr) != 0 {
+				c.servers = append(c.servers, addr)
+			}
+		}
+	}
+
+	if len(flags.user) != 0 {
+		c.credential = server.Credential{User: flags.user, Password: flags.password}
+	}
+
+	if len(c.servers) == 0 {
+		return nil, common.NewError(common.ARG_ERROR, "No server.  Use -servers or -config.")
+	}
+	if c.timeout <= 0 {
+		return nil, common.NewError(common.ARG_ERROR, "The timeout must be positive")
+	}
+
+	return c, nil
+}
+
+//
+// Send the Add, Set or Delete request, and print the result.
+//
+func (c *cliClient) update(opCode string, key string, value []byte) int {
+
+	var reply *server.Reply
+	request := &server.Request{OpCode: opCode, Key: key, Value: value}
+	if err := c.call("RequestReceiver.NewRequest", request, &reply, 0, false); err != nil {
+		return c.fail(err)
+	}
+
+	if c.jsonOutput {
+		c.printJSON(map[string]string{"op": opCode, "key": key})
+	}
+	return EXIT_OK
+}
+
+//
+// Call the method on a server, with the credential of the client.  The
+// next server is tried if the server cannot be reached or has no quorum.
+// If the request is not idempotent, it is not sent again once the
+// connection fails after sending it (the outcome is unknown).  The call
+// waits for the timeout of the client on top of the given wait.
+//
+func (c *cliClient) call(method string, args interface{}, reply interface{}, wait time.Duration, idempotent bool) error {
+
+	setCredential(args, c.credential)
+
+	var err error
+	for i := 0; i < len(c.servers); i++ {
+
+		if c.client == nil {
+			if err = c.dial(); err != nil {
+				c.current++
+				continue
+			}
+		}
+
+		call := c.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(c.timeout + wait):
+			c.close()
+			return common.NewError(common.TIMEOUT_ERROR, fmt.Sprintf("No reply from %s in time", c.getAddr()))
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if _, ok := err.(rpc.ServerError); ok {
+			code := common.ParseError(err).Code()
+			if code != common.NO_QUORUM_ERROR && code != common.NOT_LEADER_ERROR {
+				return err
+			}
+		} else if !idempotent {
+			c.close()
+			return err
+		}
+
+		c.close()
+		c.current++
+	}
+
+	return common.WrapError(common.NO_QUORUM_ERROR, "No server can take the request", err)
+}
+
+//
+// Connect to the current server.
+//
+func (c *cliClient) dial() error {
+
+	addr := c.getAddr()
+
+	type result struct {
+		client *rpc.Client
+		err    error
+	}
+	resultch := make(chan result, 1)
+	go func() {
+		client, err := server.DialClient(addr, c.tlsConfig)
+		resultch <- result{client, err}
+	}()
+
+	select {
+	case r := <-resultch:
+		if r.err != nil {
+			return r.err
+		}
+		c.client = r.client
+		return nil
+	case <-time.After(c.timeout):
+		return common.NewError(common.TIMEOUT_ERROR, "Fail to connect to "+addr+" in time")
+	}
+}
+
+func (c *cliClient) getAddr() string {
+	return c.servers[c.current%len(c.servers)]
+}
+
+func (c *cliClient) close() {
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+//
+// Print the error on stderr, and return the exit code for the error.
+//
+func (c *cliClient) fail(err error) int {
+
+	e := common.ParseError(err)
+	if _, ok := err.(rpc.ServerError); !ok && e.Code() == common.SERVER_ERROR {
+		e = common.WrapError(common.CLIENT_ERROR, "Fail to reach the server", err)
+	}
+
+	if c.jsonOutput {
+		data, _ := json.Marshal(map[string]string{"error": e.Error(), "code": e.Code().String()})
+		fmt.Fprintln(os.Stderr, string(data))
+	} else {
+		fmt.Fprintf(os.Stderr, "gometa : %s\n", e.Error())
+	}
+
+	switch e.Code() {
+	case common.KEY_NOT_FOUND_ERROR:
+		return EXIT_NOT_FOUND
+	case common.NO_QUORUM_ERROR, common.NOT_LEADER_ERROR, common.CLIENT_ERROR:
+		return EXIT_UNAVAILABLE
+	}
+	return EXIT_FAILURE
+}
+
+func (c *cliClient) printJSON(value interface{}) {
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gometa : Fail to encode the result : %s\n", err.Error())
+		return
+	}
+	fmt.Println(string(data))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+func setCredential(args interface{}, credential server.Credential) {
+
+	switch req := args.(type) {
+	case *server.Request:
+		req.User, req.Password = credential.User, credential.Password
+	case *server.ListRequest:
+		req.User, req.Password = credential.User, credential.Password
+	case *server.WatchRequest:
+		req.User, req.Password = credential.User, credential.Password
+	case *server.AdminRequest:
+		req.User, req.Password = credential.User, credential.Password
+	}
+}
+
+//
+// Read the value from the file, or from stdin if the path is "-".
+//
+func readValue(path string) ([]byte, error) {
+
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
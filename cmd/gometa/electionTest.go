@@ -0,0 +1,549 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/message"
+	"github.com/couchbase/gometa/protocol"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// An election participant with an in-memory state.  All the participants
+// are running in the same process.
+//
+type electionPeer struct {
+	addr     string
+	peers    []string
+	verifier protocol.QuorumVerifier
+	site     *protocol.ElectionSite
+
+	// state of the candidate (zero for a new repository)
+	epoch    uint32
+	txnid    common.Txnid // last logged and committed txnid
+	priority uint32
+
+	// mutex protected variable
+	mutex  sync.Mutex
+	status protocol.PeerStatus
+	winner string
+}
+
+//
+// A messenger that drops, delays and reorders the packets sent to the
+// peers.  A delayed packet is sent by its own goroutine after a random
+// delay, so it can be overtaken by the packets sent after it.
+//
+type lossyMessenger struct {
+	common.Messenger
+	drop     float64       // probability that a packet is dropped
+	delay    float64       // probability that a packet is delayed
+	maxDelay time.Duration // longest delay
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Election Test
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Run leader election among the given number of participants on localhost
+// using the given transport ("udp", "tcp", or "mem" for an in-memory
+// network).  The test covers:
+// 1) All the participants start election at the same time.
+// 2) A majority of participants elect a leader first.  The remaining
+//    participants join late, and have to rely on retransmission of votes
+//    to find the established leader.
+// 3) The network drops, delays and reorders the votes.  The participants
+//    have to rely on retransmission and timeouts to converge.
+// 4) The candidates have different epochs, txnids and priorities.  The
+//    order of the candidates must be the same in every election.
+//
+func runElectionTest(participants int, transport string, basePort int) bool {
+
+	if participants < 1 || participants > common.MAX_PARTICIPANTS {
+		fmt.Printf("Number of participants must be between 1 and %d\n", common.MAX_PARTICIPANTS)
+		return false
+	}
+
+	fmt.Printf("Election Test : %d participants, transport %s\n", participants, transport)
+
+	success := runElectionScenario("all peers start together", participants, participants,
+		transport, basePort, false)
+
+	success = runElectionScenario("late joiners", participants, participants/2+1,
+		transport, basePort+participants, false) && success
+
+	success = runElectionScenario("lossy network", participants, participants,
+		transport, basePort+participants*2, true) && success
+
+	success = runOrderingScenarios(transport, basePort+participants*3) && success
+
+	if success {
+		fmt.Printf("Election Test : PASS\n")
+	} else {
+		fmt.Printf("Election Test : FAIL\n")
+	}
+	return success
+}
+
+//
+// Run a single election scenario.  The first "initial" participants start
+// the election immediately.  The rest starts after the initial participants
+// have elected a leader.  If lossy is true, the votes are sent through a
+// lossyMessenger.
+//
+func runElectionScenario(name string, participants int, initial int, transport string, basePort int,
+	lossy bool) bool {
+
+	fmt.Printf("Scenario '%s' : start\n", name)
+
+	addrs := make([]string, participants)
+	for i := 0; i < participants; i++ {
+		addrs[i] = "127.0.0.1:" + strconv.Itoa(basePort+i)
+	}
+
+	factory := message.NewConcreteMsgFactory()
+	network := common.NewMemNetwork()
+
+	peers := createElectionPeers(addrs)
+	defer closeElectionPeers(peers)
+
+	start := time.Now()
+
+	// start the initial participants and wait for them to converge
+	if !startElection(peers[:initial], factory, transport, network, lossy) {
+		return false
+	}
+	if !waitForLeader(name, peers[:initial], start) {
+		return false
+	}
+
+	if initial == participants {
+		return true
+	}
+
+	// start the late participants and wait for everyone to converge
+	start = time.Now()
+	if !startElection(peers[initial:], factory, transport, network, lossy) {
+		return false
+	}
+	return waitForLeader(name, peers, start)
+}
+
+//
+// Run the elections among the candidates A (epoch 6, txnid X, priority 0),
+// B (epoch 5, txnid X, priority 2) and D (epoch 5, txnid Z > X, priority
+// 0), where each pair and all three run their own election.  The epoch
+// comes before the txnid, and the txnid before the priority, so A must win
+// over D, D over B, and A over B.  If the priority of B could override the
+// epoch of A, there would be a cycle (A > D > B > A).
+//
+func runOrderingScenarios(transport string, basePort int) bool {
+
+	type candidate struct {
+		name     string
+		epoch    uint32
+		txnid    common.Txnid
+		priority uint32
+	}
+
+	x := common.Txnid(uint64(5)<<32 | 3)
+	z := common.Txnid(uint64(5)<<32 | 7)
+	a := &candidate{name: "A", epoch: 6, txnid: x, priority: 0}
+	b := &candidate{name: "B", epoch: 5, txnid: x, priority: 2}
+	d := &candidate{name: "D", epoch: 5, txnid: z, priority: 0}
+
+	elections := []struct {
+		candidates []*candidate
+		winner     *candidate
+	}{
+		{[]*candidate{a, d}, a},
+		{[]*candidate{d, b}, d},
+		{[]*candidate{a, b}, a},
+		{[]*candidate{a, b, d}, a},
+	}
+
+	factory := message.NewConcreteMsgFactory()
+	network := common.NewMemNetwork()
+
+	success := true
+	for _, election := range elections {
+		names := ""
+		addrs := make([]string, len(election.candidates))
+		for i, candidate := range election.candidates {
+			names += candidate.name
+			addrs[i] = "127.0.0.1:" + strconv.Itoa(basePort+i)
+		}
+		name := "ordering " + names
+		basePort += len(election.candidates)
+
+		fmt.Printf("Scenario '%s' : start\n", name)
+
+		peers := createElectionPeers(addrs)
+		var expected string
+		for i, candidate := range election.candidates {
+			peers[i].epoch = candidate.epoch
+			peers[i].txnid = candidate.txnid
+			peers[i].priority = candidate.priority
+			if candidate == election.winner {
+				expected = peers[i].addr
+			}
+		}
+
+		ok := startElection(peers, factory, transport, network, false) && waitForLeader(name, peers, time.Now())
+		if ok && peers[0].getWinner() != expected {
+			fmt.Printf("Scenario '%s' : FAIL.  %s is elected instead of %s (%s)\n",
+				name, peers[0].getWinner(), expected, election.winner.name)
+			ok = false
+		}
+		closeElectionPeers(peers)
+
+		success = ok && success
+	}
+
+	return success
+}
+
+//
+// Create a participant for each address.  Every participant has all the
+// other addresses as peers.
+//
+func createElectionPeers(addrs []string) []*electionPeer {
+
+	verifier := protocol.NewMajorityQuorumVerifier(uint64(len(addrs)))
+
+	peers := make([]*electionPeer, len(addrs))
+	for i := range addrs {
+		others := make([]string, 0, len(addrs)-1)
+		others = append(others, addrs[:i]...)
+		others = append(others, addrs[i+1:]...)
+
+		peers[i] = &electionPeer{addr: addrs[i],
+			peers:    others,
+			verifier: verifier,
+			status:   protocol.ELECTING}
+	}
+
+	return peers
+}
+
+//
+// Close the election site of the participants.
+//
+func closeElectionPeers(peers []*electionPeer) {
+
+	for _, peer := range peers {
+		if peer.site != nil {
+			peer.site.Close()
+		}
+	}
+}
+
+//
+// Create an election site for each participant and start the election.
+// If lossy is true, 20% of the votes are dropped, and another 20% are
+// delayed by up to 300ms.
+//
+func startElection(peers []*electionPeer, factory protocol.MsgFactory, transport string,
+	network *common.MemNetwork, lossy bool) bool {
+
+	for _, peer := range peers {
+		var site *protocol.ElectionSite
+		var messenger common.Messenger
+		var err error
+
+		if transport == "mem" {
+			messenger, err = protocol.NewElectionMessengerWithTransport(peer.addr, "udp", network)
+		} else {
+			messenger, err = protocol.NewElectionMessenger(peer.addr, transport)
+		}
+		if err == nil {
+			if lossy {
+				messenger = &lossyMessenger{Messenger: messenger,
+					drop:     0.2,
+					delay:    0.2,
+					maxDelay: 300 * time.Millisecond,
+					rand:     rand.New(rand.NewSource(time.Now().UnixNano()))}
+			}
+			site, err = protocol.CreateElectionSiteWithMessenger(messenger, peer.peers, factory, peer, false,
+				protocol.NewElectionState())
+		}
+		if err != nil {
+			fmt.Printf("Fail to create election site %s.  Error = %s\n", peer.addr, err.Error())
+			return false
+		}
+		peer.site = site
+	}
+
+	for _, peer := range peers {
+		resultch := peer.site.StartElection()
+		if resultch == nil {
+			fmt.Printf("Fail to start election for %s\n", peer.addr)
+			return false
+		}
+		go peer.waitForResult(resultch)
+	}
+
+	return true
+}
+
+//
+// Wait until every participant has a winner, and check that all the
+// participants agree on the same winner.
+//
+func waitForLeader(name string, peers []*electionPeer, start time.Time) bool {
+
+	timeout := time.After(common.MAX_RETRY_BACKOFF * 6 * time.Millisecond)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			done := true
+			for _, peer := range peers {
+				if peer.getWinner() == "" {
+					done = false
+					break
+				}
+			}
+
+			if done {
+				leader := peers[0].getWinner()
+				for _, peer := range peers {
+					if peer.getWinner() != leader {
+						fmt.Printf("Scenario '%s' : FAIL.  %s elects %s, %s elects %s\n",
+							name, peers[0].addr, leader, peer.addr, peer.getWinner())
+						return false
+					}
+				}
+
+				fmt.Printf("Scenario '%s' : %d peers elect %s in %v\n", name, len(peers), leader, time.Since(start))
+				return true
+			}
+
+		case <-timeout:
+			count := 0
+			for _, peer := range peers {
+				if peer.getWinner() != "" {
+					count++
+				}
+			}
+			fmt.Printf("Scenario '%s' : FAIL.  Timeout.  Only %d out of %d peers have a winner.\n",
+				name, count, len(peers))
+			return false
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// electionPeer
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Wait for the election result.  Once there is a winner, the peer
+// becomes the leader or a follower, so that it responds to the
+// participants that are still electing.
+//
+func (p *electionPeer) waitForResult(resultch <-chan string) {
+
+	winner, ok := <-resultch
+	if !ok {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.winner = winner
+	if winner == p.addr {
+		p.status = protocol.LEADING
+	} else {
+		p.status = protocol.FOLLOWING
+	}
+}
+
+func (p *electionPeer) getWinner() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.winner
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// lossyMessenger
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *lossyMessenger) Send(packet common.Packet, peer net.Addr) bool {
+
+	drop, delay := m.next()
+	if drop {
+		return true
+	}
+
+	if delay > 0 {
+		go func() {
+			time.Sleep(delay)
+			m.Messenger.Send(packet, peer)
+		}()
+		return true
+	}
+
+	return m.Messenger.Send(packet, peer)
+}
+
+func (m *lossyMessenger) SendByName(packet common.Packet, peer string) bool {
+
+	addr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		return false
+	}
+	return m.Send(packet, addr)
+}
+
+func (m *lossyMessenger) Multicast(packet common.Packet, peers []net.Addr) bool {
+
+	for _, peer := range peers {
+		m.Send(packet, peer)
+	}
+	return true
+}
+
+//
+// Decide whether the next packet is dropped, or how long it is delayed.
+//
+func (m *lossyMessenger) next() (bool, time.Duration) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	n := m.rand.Float64()
+	if n < m.drop {
+		return true, 0
+	}
+	if n < m.drop+m.delay {
+		return false, time.Duration(m.rand.Int63n(int64(m.maxDelay)))
+	}
+	return false, 0
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// ActionHandler Interface
+/////////////////////////////////////////////////////////////////////////////
+
+func (p *electionPeer) GetEnsembleSize() uint64 {
+	return uint64(len(p.peers)) + 1
+}
+
+func (p *electionPeer) GetClock() common.Clock {
+	return common.GetClock()
+}
+
+func (p *electionPeer) GetLogger() *common.NodeLogger {
+	return nil
+}
+
+func (p *electionPeer) GetTracer() *common.NodeTracer {
+	return nil
+}
+
+func (p *electionPeer) GetMetricLabels() common.MetricLabels {
+	return common.MetricLabels{Node: p.addr}
+}
+
+func (p *electionPeer) GetLastLoggedTxid() (common.Txnid, error) {
+	return p.txnid, nil
+}
+
+func (p *electionPeer) GetLastCommittedTxid() (common.Txnid, error) {
+	return p.txnid, nil
+}
+
+func (p *electionPeer) GetStatus() protocol.PeerStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.status
+}
+
+func (p *electionPeer) GetQuorumVerifier() protocol.QuorumVerifier {
+	return p.verifier
+}
+
+func (p *electionPeer) GetPriority() uint32 {
+	return p.priority
+}
+
+func (p *electionPeer) GetCurrentEpoch() (uint32, error) {
+	return p.epoch, nil
+}
+
+func (p *electionPeer) GetAcceptedEpoch() (uint32, error) {
+	return p.epoch, nil
+}
+
+func (p *electionPeer) GetCommitedEntries(txid1, txid2 common.Txnid) (<-chan protocol.LogEntryMsg, <-chan error, chan<- bool, error) {
+	return nil, nil, nil, common.NewError(common.SERVER_ERROR, "Not supported in election test")
+}
+
+func (p *electionPeer) LogAndCommit(txid common.Txnid, op uint32, key string, content []byte, toCommit bool) error {
+	return nil
+}
+
+func (p *electionPeer) NotifyNewAcceptedEpoch(epoch uint32) error {
+	return nil
+}
+
+func (p *electionPeer) NotifyNewCurrentEpoch(epoch uint32) error {
+	return nil
+}
+
+func (p *electionPeer) GetNextTxnId() common.Txnid {
+	return common.Txnid(0)
+}
+
+func (p *electionPeer) GetFollowerId() string {
+	return p.addr
+}
+
+func (p *electionPeer) GetFollowerPriority(fid string) uint32 {
+	return 0
+}
+
+func (p *electionPeer) GetSlowFollowerPolicy() *protocol.SlowFollowerPolicy {
+	return nil
+}
+
+func (p *electionPeer) LogProposal(proposal protocol.ProposalMsg) error {
+	return nil
+}
+
+func (p *electionPeer) Commit(txid common.Txnid) error {
+	return nil
+}
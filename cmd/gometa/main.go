@@ -17,6 +17,7 @@ package main
 
 import (
 	"flag"
+	"github.com/couchbase/gometa/common"
 	"github.com/couchbase/gometa/server"
 	"log"
 	"os"
@@ -45,23 +46,96 @@ func stdinWatcher() {
 // main function
 //
 func main() {
+	// Subcommands for scripts (e.g. "gometa get -servers=host:port key")
+	if len(os.Args) > 1 && isSubcommand(os.Args[1]) {
+		os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
+
 	var isClient bool
 	var isWatcher bool
 	var config string
 	var watchStdin bool
+	var isElectionTest bool
+	var participants int
+	var transport string
+	var basePort int
+	var isSimulationTest bool
+	var seed int64
+	var secret string
+	var isTLSTest bool
+	var isVersionTest bool
+	var genCert string
+	var certDir string
+	var hosts string
+	var logLevel string
 
 	flag.BoolVar(&isClient, "client", false, "run as test client")
 	flag.BoolVar(&isWatcher, "watcher", false, "run as watcher")
 	flag.StringVar(&config, "config", "", "path for configuration file")
 	flag.BoolVar(&watchStdin, "watch-stdin", true,
 		"watch standard input and terminate on EOL or EOF")
+	flag.BoolVar(&isElectionTest, "election-test", false, "run leader election test on localhost")
+	flag.IntVar(&participants, "participants", common.MAX_PARTICIPANTS, "number of participants for election test")
+	flag.StringVar(&transport, "transport", common.ELECTION_TRANSPORT_TYPE, "election transport (udp, tcp or mem) for election test")
+	flag.IntVar(&basePort, "base-port", 19000, "first port used by election test")
+	flag.BoolVar(&isSimulationTest, "simulation-test", false, "run fault-injection scenarios on a simulated cluster")
+	flag.Int64Var(&seed, "seed", 1, "seed of the faults for simulation test")
+	flag.StringVar(&secret, "secret", "", "secret for authenticating the messages in simulation test")
+	flag.BoolVar(&isTLSTest, "tls-test", false, "run a TLS ensemble on localhost with self-signed certificates")
+	flag.BoolVar(&isVersionTest, "version-test", false, "run nodes hosting consensus groups with peers of an older protocol version")
+	flag.StringVar(&genCert, "gen-cert", "", "generate a certificate with the given name, signed by the CA of cert-dir")
+	flag.StringVar(&certDir, "cert-dir", "certs", "directory of the CA and the generated certificates")
+	flag.StringVar(&hosts, "hosts", "127.0.0.1,localhost", "comma separated hosts of the generated certificate")
+	flag.StringVar(&logLevel, "log-level", common.LOG_INFO.String(), "log level (error, warn, info, debug or trace)")
 	flag.Parse()
 
+	level, err := common.ParseLogLevel(logLevel)
+	if err != nil {
+		log.Printf("Invalid log level %s", logLevel)
+		os.Exit(1)
+	}
+	common.SetLogLevel(level)
+
 	if isClient {
 		runTestClient(config)
 		os.Exit(0)
 	}
 
+	if isElectionTest {
+		if !runElectionTest(participants, transport, basePort) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if isSimulationTest {
+		if !runSimulationTest(seed, transport, secret) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if isTLSTest {
+		if !runTLSTest(basePort) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if isVersionTest {
+		if !runVersionTest(basePort) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if genCert != "" {
+		if !runGenerateCertificate(certDir, genCert, hosts) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if isWatcher {
 		runWatcher(config)
 		os.Exit(0)
@@ -71,7 +145,7 @@ func main() {
 		go stdinWatcher()
 	}
 
-	err := server.RunServer(config)
+	err = server.RunServer(config)
 	if err != nil {
 		log.Printf("Encounter Error = %s. Terminate server", err.Error())
 		os.Exit(1)
@@ -0,0 +1,66 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/couchbase/gometa/simulation"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Simulation Test
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Run the fault-injection scenarios (leader crash, follower rejoin and
+// split brain) on a simulated cluster.  The faults and delays are drawn
+// from the seed, so a failing run can be replayed with the same seed.
+//
+func runSimulationTest(seed int64, transport string, secret string) bool {
+
+	if transport != "udp" && transport != "tcp" {
+		fmt.Printf("Election transport for simulation test must be udp or tcp\n")
+		return false
+	}
+
+	fmt.Printf("Simulation Test : seed %d, election transport %s\n", seed, transport)
+
+	options := simulation.Options{Seed: seed,
+		DropRate:          0.05,
+		MinDelay:          1 * time.Millisecond,
+		MaxDelay:          20 * time.Millisecond,
+		ElectionTransport: transport,
+		Secret:            secret}
+
+	success := true
+	for _, result := range simulation.RunScenarios(options) {
+		if result.Err != nil {
+			fmt.Printf("Scenario '%s' : FAIL (seed %d) : %s\n", result.Name, result.Seed, result.Err.Error())
+			success = false
+			continue
+		}
+		fmt.Printf("Scenario '%s' : pass in %v (simulated), %d messages delivered, %d dropped\n",
+			result.Name, result.Elapsed, result.Delivered, result.Dropped)
+	}
+
+	if success {
+		fmt.Printf("Simulation Test : PASS\n")
+	} else {
+		fmt.Printf("Simulation Test : FAIL\n")
+	}
+	return success
+}
@@ -0,0 +1,373 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/message"
+	"github.com/couchbase/gometa/protocol"
+	"github.com/couchbase/gometa/server"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Certificate
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Generate a certificate for a node, signed by the CA of the directory
+// (the CA is created if needed).
+//
+func runGenerateCertificate(dir string, name string, hosts string) bool {
+
+	files, err := common.GenerateCertificate(dir, name, strings.Split(hosts, ","))
+	if err != nil {
+		fmt.Printf("Fail to generate certificate : %s\n", err.Error())
+		return false
+	}
+
+	fmt.Printf("CertFile : %s\nKeyFile : %s\nCAFile : %s\n", files.CertFile, files.KeyFile, files.CAFile)
+	return true
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// TLS Test
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Run a three-node ensemble on localhost with TLS, using self-signed
+// certificates.  The test checks that:
+// 1) The nodes elect a leader and replicate a write over TLS.
+// 2) A client without TLS is refused by the request listener.
+// 3) A peer with a certificate from another CA is refused.
+// 4) A peer with a certificate from the CA of the ensemble, but for a
+//    host outside of the ensemble, is refused.
+// 5) A follower whose id is not valid for its certificate is refused by
+//    the leader.
+// 6) The four-letter commands are served over TLS only.
+//
+func runTLSTest(basePort int) bool {
+
+	fmt.Printf("TLS Test : 3 nodes on localhost, first port %d\n", basePort)
+
+	dir, err := ioutil.TempDir("", "gometa-tls-test")
+	if err != nil {
+		fmt.Printf("TLS Test : FAIL : %s\n", err.Error())
+		return false
+	}
+	defer os.RemoveAll(dir)
+
+	success := runTLSScenario(dir, basePort)
+
+	if success {
+		fmt.Printf("TLS Test : PASS\n")
+	} else {
+		fmt.Printf("TLS Test : FAIL\n")
+	}
+	return success
+}
+
+func runTLSScenario(dir string, basePort int) bool {
+
+	node, err := common.GenerateCertificate(filepath.Join(dir, "certs"), "node", []string{"127.0.0.1", "localhost"})
+	if err != nil {
+		fmt.Printf("Fail to generate certificate : %s\n", err.Error())
+		return false
+	}
+	intruder, err := common.GenerateCertificate(filepath.Join(dir, "certs"), "intruder", []string{"10.255.255.1"})
+	if err != nil {
+		fmt.Printf("Fail to generate certificate : %s\n", err.Error())
+		return false
+	}
+	rogue, err := common.GenerateCertificate(filepath.Join(dir, "rogue"), "rogue", []string{"127.0.0.1", "localhost"})
+	if err != nil {
+		fmt.Printf("Fail to generate certificate : %s\n", err.Error())
+		return false
+	}
+
+	// start the ensemble
+	configs := newTLSConfigs(dir, basePort, node)
+	var servers []*server.Server
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	for _, config := range configs {
+		s, err := server.New(config)
+		if err == nil {
+			err = s.Start()
+		}
+		if err != nil {
+			fmt.Printf("Fail to start server %s : %s\n", config.Host.ElectionAddr, err.Error())
+			return false
+		}
+		servers = append(servers, s)
+	}
+
+	success := true
+	check := func(name string, ok bool) {
+		if ok {
+			fmt.Printf("Scenario '%s' : pass\n", name)
+		} else {
+			fmt.Printf("Scenario '%s' : FAIL\n", name)
+			success = false
+		}
+	}
+
+	check("elect a leader over TLS", waitForTLSLeader(servers, 30*time.Second))
+	check("replicate a write over TLS", checkTLSWrite(configs[0].Host.RequestAddr, node))
+	check("refuse plaintext client", checkPlaintextRefused(configs[0].Host.RequestAddr))
+	check("refuse peer from another CA", checkPeerRefused(configs[0].Host.MessageAddr, rogue, node.CAFile))
+	check("refuse peer outside of ensemble", checkPeerRefused(configs[0].Host.MessageAddr, intruder, node.CAFile))
+	check("refuse follower with another id", checkFollowerRefused(servers, configs, node, "10.255.255.1:9999"))
+	check("serve commands over TLS only", checkTLSCommand(configs[0].Host.AdminAddr, node))
+
+	return success
+}
+
+func newTLSConfigs(dir string, basePort int, files *common.CertificateFiles) []*server.Config {
+
+	nodes := make([]*server.Node, 3)
+	for i := range nodes {
+		port := basePort + i*3
+		nodes[i] = &server.Node{ElectionAddr: "127.0.0.1:" + strconv.Itoa(port),
+			MessageAddr: "127.0.0.1:" + strconv.Itoa(port+1),
+			RequestAddr: "127.0.0.1:" + strconv.Itoa(port+2),
+			AdminAddr:   "127.0.0.1:" + strconv.Itoa(basePort+9+i)}
+	}
+
+	configs := make([]*server.Config, 3)
+	for i := range configs {
+		configs[i] = &server.Config{Host: nodes[i],
+			ElectionTransport: "tcp",
+			DataDir:           filepath.Join(dir, "node"+strconv.Itoa(i)),
+			TLS: &server.TLSConfig{CertFile: files.CertFile,
+				KeyFile: files.KeyFile,
+				CAFile:  files.CAFile}}
+		os.MkdirAll(configs[i].DataDir, 0755)
+
+		for j := range nodes {
+			if j != i {
+				configs[i].Peer = append(configs[i].Peer, nodes[j])
+			}
+		}
+	}
+	return configs
+}
+
+func waitForTLSLeader(servers []*server.Server, timeout time.Duration) bool {
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		leaders, followers := 0, 0
+		for _, s := range servers {
+			switch s.GetStatus() {
+			case protocol.LEADING:
+				leaders++
+			case protocol.FOLLOWING:
+				followers++
+			}
+		}
+		if leaders == 1 && leaders+followers == len(servers) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func checkTLSWrite(addr string, files *common.CertificateFiles) bool {
+
+	config, err := common.NewTLSConfig(files.CertFile, files.KeyFile, files.CAFile)
+	if err != nil {
+		fmt.Printf("Fail to load certificate : %s\n", err.Error())
+		return false
+	}
+
+	client, err := server.DialClient(addr, config)
+	if err != nil {
+		fmt.Printf("Fail to connect to %s : %s\n", addr, err.Error())
+		return false
+	}
+	defer client.Close()
+
+	var reply *server.Reply
+	request := &server.Request{OpCode: "Set", Key: "/tls", Value: []byte("secret")}
+	if err := client.Call("RequestReceiver.NewRequest", request, &reply); err != nil {
+		fmt.Printf("Fail to set /tls : %s\n", err.Error())
+		return false
+	}
+
+	request = &server.Request{OpCode: "Get", Key: "/tls"}
+	if err := client.Call("RequestReceiver.NewRequest", request, &reply); err != nil {
+		fmt.Printf("Fail to get /tls : %s\n", err.Error())
+		return false
+	}
+	return reply != nil && string(reply.Result) == "secret"
+}
+
+func checkPlaintextRefused(addr string) bool {
+
+	client, err := rpc.DialHTTP(common.MESSAGE_TRANSPORT_TYPE, addr)
+	if err != nil {
+		return true
+	}
+	defer client.Close()
+
+	var reply *server.Reply
+	request := &server.Request{OpCode: "Get", Key: "/tls"}
+	return client.Call("RequestReceiver.NewRequest", request, &reply) != nil
+}
+
+//
+// Connect to the peer port with the given certificate.  The peer is
+// refused if the handshake fails, or if the connection is closed by
+// the node right after the handshake.
+//
+func checkPeerRefused(addr string, files *common.CertificateFiles, caFile string) bool {
+
+	config, err := common.NewTLSConfig(files.CertFile, files.KeyFile, caFile)
+	if err != nil {
+		fmt.Printf("Fail to load certificate : %s\n", err.Error())
+		return false
+	}
+
+	conn, err := tls.Dial(common.MESSAGE_TRANSPORT_TYPE, addr, config)
+	if err != nil {
+		return true
+	}
+	defer conn.Close()
+
+	// An accepted peer is left open by the node, waiting for the
+	// follower to send its first message.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	if err == nil {
+		return false
+	}
+	if netErr, ok := err.(interface {
+		Timeout() bool
+	}); ok && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
+//
+// Connect to the leader with the certificate of the ensemble, and claim
+// the given follower id.  The follower is refused if the leader closes
+// the connection instead of replying with LeaderInfo.
+//
+func checkFollowerRefused(servers []*server.Server, configs []*server.Config, files *common.CertificateFiles, fid string) bool {
+
+	addr := ""
+	for i, s := range servers {
+		if s.GetStatus() == protocol.LEADING {
+			addr = configs[i].Host.MessageAddr
+		}
+	}
+	if len(addr) == 0 {
+		fmt.Printf("No leader\n")
+		return false
+	}
+
+	config, err := common.NewTLSConfig(files.CertFile, files.KeyFile, files.CAFile)
+	if err != nil {
+		fmt.Printf("Fail to load certificate : %s\n", err.Error())
+		return false
+	}
+
+	conn, err := tls.Dial(common.MESSAGE_TRANSPORT_TYPE, addr, config)
+	if err != nil {
+		fmt.Printf("Fail to connect to %s : %s\n", addr, err.Error())
+		return false
+	}
+	defer conn.Close()
+
+	msg, err := common.Marshall(message.NewConcreteMsgFactory().CreateFollowerInfo(0, fid, true))
+	if err != nil {
+		fmt.Printf("Fail to marshall FollowerInfo : %s\n", err.Error())
+		return false
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return true
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	if err == nil {
+		return false
+	}
+	if netErr, ok := err.(interface {
+		Timeout() bool
+	}); ok && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
+//
+// Send ruok to the command listener, without and with TLS.  Only the
+// command sent over TLS is answered.
+//
+func checkTLSCommand(addr string, files *common.CertificateFiles) bool {
+
+	config, err := common.NewTLSConfig(files.CertFile, files.KeyFile, files.CAFile)
+	if err != nil {
+		fmt.Printf("Fail to load certificate : %s\n", err.Error())
+		return false
+	}
+
+	if conn, err := net.Dial(common.MESSAGE_TRANSPORT_TYPE, addr); err == nil {
+		reply := sendCommand(conn, "ruok")
+		if reply == "imok" {
+			fmt.Printf("Command without TLS is answered\n")
+			return false
+		}
+	}
+
+	conn, err := tls.Dial(common.MESSAGE_TRANSPORT_TYPE, addr, config)
+	if err != nil {
+		fmt.Printf("Fail to connect to %s : %s\n", addr, err.Error())
+		return false
+	}
+	return sendCommand(conn, "ruok") == "imok"
+}
+
+func sendCommand(conn net.Conn, command string) string {
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return ""
+	}
+	reply, _ := ioutil.ReadAll(conn)
+	return strings.TrimSpace(string(reply))
+}
@@ -0,0 +1,269 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/message"
+	"github.com/couchbase/gometa/protocol"
+	"net"
+	"strconv"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Version Test
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Run the nodes hosting consensus groups (protocol version 3) with peers
+// running protocol version 2 on an in-memory network.  A peer running
+// version 2 sends its votes and messages without group, and does not
+// know about the shared connections.  The test covers:
+// 1) Two nodes hosting groups share a connection.
+// 2) A node hosting groups refuses to share a connection with an old peer.
+// 3) An old peer cannot connect to the shared connections of a node.
+// 4) A node hosting groups stops sending its votes to an old peer once
+//    the old peer has voted, but keeps sending to the other nodes.
+//
+func runVersionTest(basePort int) bool {
+
+	fmt.Printf("Version Test : protocol version %d with peers at version %d\n",
+		common.PROTOCOL_VERSION, common.PROTOCOL_VERSION_2)
+
+	addr := func(i int) string {
+		return "127.0.0.1:" + strconv.Itoa(basePort+i)
+	}
+
+	success := runVersionScenario("share connection between new nodes", func(network *common.MemNetwork) error {
+		return testMuxBetweenNewNodes(network, addr(0), addr(1))
+	})
+
+	success = runVersionScenario("refuse to share connection with old peer", func(network *common.MemNetwork) error {
+		return testMuxToOldPeer(network, addr(0), addr(1))
+	}) && success
+
+	success = runVersionScenario("refuse connection from old peer", func(network *common.MemNetwork) error {
+		return testMuxFromOldPeer(network, addr(0), addr(1))
+	}) && success
+
+	success = runVersionScenario("do not send group votes to old peer", func(network *common.MemNetwork) error {
+		return testGroupVotes(network, addr(0), addr(1), addr(2))
+	}) && success
+
+	if success {
+		fmt.Printf("Version Test : PASS\n")
+	} else {
+		fmt.Printf("Version Test : FAIL\n")
+	}
+	return success
+}
+
+//
+// Run a single scenario on its own in-memory network.
+//
+func runVersionScenario(name string, scenario func(network *common.MemNetwork) error) bool {
+
+	if err := scenario(common.NewMemNetwork()); err != nil {
+		fmt.Printf("Scenario '%s' : FAIL.  %s\n", name, err.Error())
+		return false
+	}
+
+	fmt.Printf("Scenario '%s' : pass\n", name)
+	return true
+}
+
+func testMuxBetweenNewNodes(network *common.MemNetwork, addr1 string, addr2 string) error {
+
+	mux1, err := common.NewConnMuxWithTransport(addr1, network)
+	if err != nil {
+		return err
+	}
+	defer mux1.Close()
+
+	mux2, err := common.NewConnMuxWithTransport(addr2, network)
+	if err != nil {
+		return err
+	}
+	defer mux2.Close()
+
+	listener, err := mux2.Listen("group")
+	if err != nil {
+		return err
+	}
+
+	conn, err := mux1.Dial("group", addr2)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	select {
+	case conn, ok := <-listener.ConnChannel():
+		if !ok {
+			return fmt.Errorf("The listener is closed")
+		}
+		conn.Close()
+		return nil
+	case <-time.After(common.MUX_HANDSHAKE_TIMEOUT * time.Millisecond):
+		return fmt.Errorf("The connection is not accepted")
+	}
+}
+
+func testMuxToOldPeer(network *common.MemNetwork, addr string, oldAddr string) error {
+
+	mux, err := common.NewConnMuxWithTransport(addr, network)
+	if err != nil {
+		return err
+	}
+	defer mux.Close()
+
+	// The old peer reads the packets of a PeerPipe from each connection.
+	listener, err := network.Listen(oldAddr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	go func() {
+		for conn := range listener.ConnChannel() {
+			common.NewPeerPipe(conn)
+		}
+	}()
+
+	conn, err := mux.Dial("group", oldAddr)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("The connection to the old peer is shared")
+	}
+	if common.ParseError(err).Code() != common.VERSION_MISMATCH_ERROR {
+		return fmt.Errorf("Unexpected error : %s", err.Error())
+	}
+	return nil
+}
+
+func testMuxFromOldPeer(network *common.MemNetwork, addr string, oldAddr string) error {
+
+	mux, err := common.NewConnMuxWithTransport(addr, network)
+	if err != nil {
+		return err
+	}
+	defer mux.Close()
+
+	if _, err := mux.Listen("group"); err != nil {
+		return err
+	}
+
+	conn, err := network.Dial(addr)
+	if err != nil {
+		return err
+	}
+
+	// The old peer sends a vote through a PeerPipe.
+	pipe := common.NewPeerPipe(conn)
+	defer pipe.Close()
+	pipe.Send(createOldVote(oldAddr))
+
+	select {
+	case _, ok := <-pipe.ReceiveChannel():
+		if ok {
+			return fmt.Errorf("The old peer receives a packet")
+		}
+		return nil
+	case <-time.After(common.MUX_HANDSHAKE_TIMEOUT * 2 * time.Millisecond):
+		return fmt.Errorf("The connection from the old peer is not closed")
+	}
+}
+
+func testGroupVotes(network *common.MemNetwork, addr string, newAddr string, oldAddr string) error {
+
+	factory := message.NewConcreteMsgFactory()
+
+	createGroup := func(laddr string) (*protocol.MessengerDemux, *protocol.GroupMessenger, error) {
+		messenger, err := protocol.NewElectionMessengerWithTransport(laddr, "udp", network)
+		if err != nil {
+			return nil, nil, err
+		}
+		demux := protocol.NewMessengerDemux(messenger, factory)
+		group, err := demux.NewGroupMessenger("group")
+		if err != nil {
+			demux.Close()
+			return nil, nil, err
+		}
+		return demux, group, nil
+	}
+
+	demux, group, err := createGroup(addr)
+	if err != nil {
+		return err
+	}
+	defer demux.Close()
+
+	newDemux, newGroup, err := createGroup(newAddr)
+	if err != nil {
+		return err
+	}
+	defer newDemux.Close()
+
+	old, err := protocol.NewElectionMessengerWithTransport(oldAddr, "udp", network)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	// The old peer votes.
+	old.SendByName(createOldVote(oldAddr), addr)
+	time.Sleep(100 * time.Millisecond)
+
+	peers := make([]net.Addr, 0, 2)
+	for _, peer := range []string{newAddr, oldAddr} {
+		udpAddr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, udpAddr)
+	}
+	group.Multicast(factory.CreateVote(1, uint32(protocol.ELECTING), 0, addr, 0, 0, false, 0), peers)
+
+	select {
+	case <-newGroup.DefaultReceiveChannel():
+	case <-time.After(time.Second):
+		return fmt.Errorf("The new node does not receive the vote")
+	}
+
+	select {
+	case msg := <-old.DefaultReceiveChannel():
+		return fmt.Errorf("The old peer receives %s", msg.Content.Name())
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+//
+// Create a vote of a node running protocol version 2, which does not
+// send its lowest supported version.
+//
+func createOldVote(cndId string) protocol.VoteMsg {
+
+	vote := message.NewConcreteMsgFactory().CreateVote(1, uint32(protocol.ELECTING), 0, cndId, 0, 0, false, 0).(*message.Vote)
+
+	version := common.PROTOCOL_VERSION_2
+	vote.Version = &version
+	vote.MinVersion = nil
+
+	return vote
+}
@@ -26,6 +26,7 @@ import (
 )
 
 type fakeServer struct {
+	env     *server.Env
 	repo    *repo.Repository
 	factory protocol.MsgFactory
 	handler *action.ServerAction
@@ -43,25 +44,29 @@ func runWatcher(path string) {
 	}
 
 	// setup env
-	if err := server.NewEnv(path); err != nil {
+	env, err := server.NewEnv(path)
+	if err != nil {
 		return
 	}
 
 	// create a fake server
 	fs := new(fakeServer)
+	fs.env = env
 	fs.bootstrap()
 
 	readych := make(chan bool) // blocking
 
-	go protocol.RunWatcherServerWithElection(
-		server.GetHostUDPAddr(),
-		server.GetPeerUDPAddr(),
-		server.GetPeerTCPAddr(),
+	go protocol.RunWatcherServerWithTransport(
+		env.GetHostUDPAddr(),
+		env.GetPeerUDPAddr(),
+		env.GetPeerTCPAddr(),
 		nil,
 		fs.handler,
 		fs.factory,
 		fs.killch,
-		readych)
+		readych,
+		env.GetElectionTransport(),
+		env.GetTransport())
 
 	<-readych
 
@@ -130,18 +135,48 @@ func (s *fakeServer) UpdateWinningEpoch(epoch uint32) {
 }
 
 func (s *fakeServer) GetEnsembleSize() uint64 {
-	return uint64(len(server.GetPeerUDPAddr())) + 1 // including myself
+	return uint64(len(s.env.GetPeerUDPAddr())) + 1 // including myself
 }
 
 func (s *fakeServer) GetFollowerId() string {
-	return server.GetHostTCPAddr()
+	return s.env.GetHostTCPAddr()
+}
+
+func (s *fakeServer) GetPriority() uint32 {
+	// A watcher never runs for leader.
+	return 0
+}
+
+func (s *fakeServer) GetFollowerPriority(fid string) uint32 {
+	return 0
+}
+
+func (s *fakeServer) GetSlowFollowerPolicy() *protocol.SlowFollowerPolicy {
+	// A watcher never runs as leader.
+	return nil
+}
+
+func (s *fakeServer) GetClock() common.Clock {
+	return s.env.GetClock()
+}
+
+func (s *fakeServer) GetLogger() *common.NodeLogger {
+	return s.env.GetLogger()
+}
+
+func (s *fakeServer) GetTracer() *common.NodeTracer {
+	return s.env.GetTracer()
+}
+
+func (s *fakeServer) GetMetricLabels() common.MetricLabels {
+	return common.MetricLabels{Node: s.env.GetHostTCPAddr()}
 }
 
 /////////////////////////////////////////////////////////////////////////////
 // QuorumVerifier
 /////////////////////////////////////////////////////////////////////////////
 
-func (s *fakeServer) HasQuorum(count int) bool {
+func (s *fakeServer) HasQuorum(voters []string) bool {
 	ensembleSz := s.handler.GetEnsembleSize() - 1
-	return count > int(ensembleSz/2)
+	return len(voters) > int(ensembleSz/2)
 }
@@ -0,0 +1,492 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////
+
+//
+// AuthTransport authenticates the messages sent over another transport
+// with an HMAC (SHA-256) computed from a secret shared by the ensemble.
+// A message that cannot be authenticated is dropped and counted.
+//
+// Each datagram (election over UDP) is sent as:
+//  n bytes  : datagram
+//  8 bytes  : random identifier of the sender (new at each restart)
+//  8 bytes  : sequence number of the sender
+// 32 bytes  : HMAC of the above
+//
+// The receiver keeps a window of the latest sequence numbers received
+// from each sender identifier, and rejects a datagram that has already
+// been received, or that is too old for the window.  The sender is not
+// identified by the source address, since the source address is not
+// authenticated.  As the votes are sent to all the peers, a vote
+// replayed to another peer is rejected as well.
+//
+// The windows are kept in memory, so a datagram recorded before the
+// receiver restarts passes the window.  The election round and the epoch
+// are part of the authenticated vote.  The election does not count a vote
+// for a candidate of an older epoch than the receiver's persisted epoch
+// (see protocol.ElectionSite.isStaleVote), nor the vote of an electing
+// peer from an older round than the current one.  It only sends its own
+// vote back.
+//
+// On a stream connection, each end first sends a random nonce.  Then each
+// write is sent as a frame:
+//  8 bytes  : length of the content
+//  n bytes  : content
+// 32 bytes  : HMAC of the content, the nonce of the receiver and the
+//             sequence number of the frame
+//
+// A frame recorded from another connection (with another nonce), or
+// replayed within the connection (with another sequence number) does not
+// authenticate, and the connection is closed.
+//
+type AuthTransport struct {
+	transport Transport
+	secret    []byte
+	id        uint64
+	seq       uint64 // atomic
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	windows  map[uint64]*replayWindow // key : identifier of the sender
+	rejected uint64
+}
+
+//
+// The latest sequence numbers received from a sender.  The bitmap tells
+// which of the 64 sequence numbers before max have been received.
+//
+type replayWindow struct {
+	max    uint64
+	bitmap uint64
+}
+
+type authPacketConn struct {
+	net.PacketConn
+	transport *AuthTransport
+}
+
+type authConn struct {
+	net.Conn
+	transport  *AuthTransport
+	localNonce []byte
+	peerNonce  []byte
+
+	writeMutex sync.Mutex
+	writeSeq   uint64
+
+	readMutex sync.Mutex
+	readSeq   uint64
+	buffer    []byte
+}
+
+type authListener struct {
+	listener  ConnListener
+	transport *AuthTransport
+	connch    chan net.Conn
+	mutex     sync.Mutex
+	isClosed  bool
+}
+
+const (
+	authMacSize    = sha256.Size
+	authNonceSize  = 16
+	authWindowSize = 64
+)
+
+/////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////
+
+//
+// Create a transport that authenticates the messages with the secret.
+// All the nodes of the ensemble must use the same secret.
+//
+func NewAuthTransport(transport Transport, secret []byte) (*AuthTransport, error) {
+
+	if len(secret) == 0 {
+		return nil, NewError(SERVER_CONFIG_ERROR, "Secret for message authentication is empty")
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &AuthTransport{transport: transport,
+		secret:  secret,
+		id:      binary.BigEndian.Uint64(id),
+		windows: make(map[uint64]*replayWindow)}, nil
+}
+
+func (t *AuthTransport) Dial(addr string) (net.Conn, error) {
+
+	conn, err := t.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.newConn(conn)
+}
+
+func (t *AuthTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+
+	conn, err := t.transport.DialTimeout(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return t.newConn(conn)
+}
+
+func (t *AuthTransport) Listen(laddr string) (ConnListener, error) {
+
+	listener, err := t.transport.Listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	li := &authListener{listener: listener,
+		transport: t,
+		connch:    make(chan net.Conn, MAX_PEERS)}
+
+	go li.listen()
+	return li, nil
+}
+
+func (t *AuthTransport) ListenPacket(laddr string) (net.PacketConn, error) {
+
+	conn, err := t.transport.ListenPacket(laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &authPacketConn{PacketConn: conn, transport: t}, nil
+}
+
+//
+// Return the number of messages (or connections) rejected because they
+// cannot be authenticated or are replayed.
+//
+func (t *AuthTransport) GetRejected() uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.rejected
+}
+
+/////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////
+
+func (t *AuthTransport) reject(format string, args ...interface{}) {
+
+	t.mutex.Lock()
+	t.rejected++
+	t.mutex.Unlock()
+
+	Warnf("AuthTransport : "+format, args...)
+}
+
+func (t *AuthTransport) mac(parts ...[]byte) []byte {
+
+	h := hmac.New(sha256.New, t.secret)
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+//
+// Tell if the datagram is new.  If so, the datagram is recorded in
+// the window of the sender.
+//
+func (t *AuthTransport) isFresh(sender uint64, seq uint64) bool {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	w, ok := t.windows[sender]
+	if !ok {
+		t.windows[sender] = &replayWindow{max: seq, bitmap: 1}
+		return true
+	}
+
+	if seq > w.max {
+		shift := seq - w.max
+		if shift >= authWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.max = seq
+		return true
+	}
+
+	diff := w.max - seq
+	if diff >= authWindowSize || w.bitmap&(1<<diff) != 0 {
+		return false
+	}
+	w.bitmap |= 1 << diff
+	return true
+}
+
+//
+// Exchange the nonces with the peer.  The nonce is sent while the nonce
+// of the peer is read, since a write may block until the peer reads
+// (e.g. net.Pipe).
+//
+func (t *AuthTransport) newConn(conn net.Conn) (net.Conn, error) {
+
+	nonce := make([]byte, authNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &authConn{Conn: conn, transport: t, localNonce: nonce}
+
+	conn.SetDeadline(time.Now().Add(AUTH_HANDSHAKE_TIMEOUT * time.Millisecond))
+
+	donech := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(nonce)
+		donech <- err
+	}()
+
+	c.peerNonce = make([]byte, authNonceSize)
+	if _, err := io.ReadFull(conn, c.peerNonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := <-donech; err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+/////////////////////////////////////////////////
+// authPacketConn
+/////////////////////////////////////////////////
+
+func (c *authPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+
+	trailer := make([]byte, 16)
+	binary.BigEndian.PutUint64(trailer, c.transport.id)
+	binary.BigEndian.PutUint64(trailer[8:], atomic.AddUint64(&c.transport.seq, 1))
+
+	datagram := make([]byte, 0, len(b)+16+authMacSize)
+	datagram = append(datagram, b...)
+	datagram = append(datagram, trailer...)
+	datagram = append(datagram, c.transport.mac(datagram)...)
+
+	if _, err := c.PacketConn.WriteTo(datagram, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+//
+// Read the next datagram that can be authenticated.  The other datagrams
+// are dropped.
+//
+func (c *authPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+
+	buf := make([]byte, len(b)+16+authMacSize)
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+
+		if n < 16+authMacSize {
+			c.transport.reject("Drop datagram from %s : too short", addr)
+			continue
+		}
+
+		content := buf[:n-authMacSize]
+		if !hmac.Equal(buf[n-authMacSize:n], c.transport.mac(content)) {
+			c.transport.reject("Drop datagram from %s : invalid HMAC", addr)
+			continue
+		}
+
+		trailer := content[len(content)-16:]
+		sender := binary.BigEndian.Uint64(trailer)
+		seq := binary.BigEndian.Uint64(trailer[8:])
+		if !c.transport.isFresh(sender, seq) {
+			c.transport.reject("Drop datagram from %s : replayed (sequence %d)", addr, seq)
+			continue
+		}
+
+		return copy(b, content[:len(content)-16]), addr, nil
+	}
+}
+
+/////////////////////////////////////////////////
+// authConn
+/////////////////////////////////////////////////
+
+func (c *authConn) Write(b []byte) (int, error) {
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, c.writeSeq)
+	c.writeSeq++
+
+	frame := make([]byte, 8, 8+len(b)+authMacSize)
+	binary.BigEndian.PutUint64(frame, uint64(len(b)))
+	frame = append(frame, b...)
+	frame = append(frame, c.transport.mac(b, c.peerNonce, seq)...)
+
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+//
+// Read the content of the frames.  The connection is closed if a frame
+// cannot be authenticated.
+//
+func (c *authConn) Read(b []byte) (int, error) {
+
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	if len(c.buffer) == 0 {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+
+		size := binary.BigEndian.Uint64(header)
+		if size > uint64(MAX_AUTH_FRAME_SIZE) {
+			c.transport.reject("Close connection from %s : frame too large (%d bytes)", c.RemoteAddr(), size)
+			c.Conn.Close()
+			return 0, NewError(SERVER_ERROR, "AuthTransport : frame too large")
+		}
+
+		frame := make([]byte, size+authMacSize)
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, err
+		}
+
+		seq := make([]byte, 8)
+		binary.BigEndian.PutUint64(seq, c.readSeq)
+		c.readSeq++
+
+		content := frame[:size]
+		if !hmac.Equal(frame[size:], c.transport.mac(content, c.localNonce, seq)) {
+			c.transport.reject("Close connection from %s : invalid HMAC", c.RemoteAddr())
+			c.Conn.Close()
+			return 0, NewError(SERVER_ERROR, "AuthTransport : invalid HMAC")
+		}
+		c.buffer = content
+	}
+
+	n := copy(b, c.buffer)
+	c.buffer = c.buffer[n:]
+	return n, nil
+}
+
+/////////////////////////////////////////////////
+// authListener
+/////////////////////////////////////////////////
+
+func (l *authListener) ConnChannel() <-chan net.Conn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.isClosed {
+		return (<-chan net.Conn)(l.connch)
+	}
+	return nil
+}
+
+func (l *authListener) Close() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.isClosed {
+		l.isClosed = true
+		close(l.connch)
+		l.listener.Close()
+		return true
+	}
+
+	return false
+}
+
+//
+// Goroutine.  Exchange the nonces on each new connection.
+//
+func (l *authListener) listen() {
+	defer l.Close()
+
+	connch := l.listener.ConnChannel()
+	if connch == nil {
+		return
+	}
+
+	for conn := range connch {
+		go l.accept(conn)
+	}
+}
+
+func (l *authListener) accept(conn net.Conn) {
+
+	authConn, err := l.transport.newConn(conn)
+	if err != nil {
+		Warnf("AuthTransport.accept() : Fail to exchange nonce with %s.  Error = %s.", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isClosed {
+		authConn.Close()
+		return
+	}
+
+	// Do not block while holding the mutex, or Close() would wait for
+	// the consumer of the connections.
+	select {
+	case l.connch <- authConn:
+	default:
+		Warnf("AuthTransport.accept() : Too many pending connections.  Close connection from %s.", conn.RemoteAddr())
+		authConn.Close()
+	}
+}
@@ -0,0 +1,153 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////
+
+//
+// The PEM files of a certificate generated by GenerateCertificate.
+//
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+/////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////
+
+//
+// Generate a self-signed CA in the directory (ca.pem and ca-key.pem),
+// unless the directory already has one.  Then generate a certificate
+// signed by the CA (<name>.pem and <name>-key.pem), which is valid for
+// the given hosts (names or IP addresses).  This is meant for testing:
+// a production ensemble should use certificates issued by its own CA.
+//
+func GenerateCertificate(dir string, name string, hosts []string) (*CertificateFiles, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files := &CertificateFiles{CertFile: filepath.Join(dir, name+".pem"),
+		KeyFile: filepath.Join(dir, name+"-key.pem"),
+		CAFile:  filepath.Join(dir, "ca.pem")}
+	caKeyFile := filepath.Join(dir, "ca-key.pem")
+
+	if _, err := os.Stat(files.CAFile); os.IsNotExist(err) {
+		template := newCertTemplate("gometa CA")
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+
+		if err := writeCertificate(template, nil, nil, files.CAFile, caKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	ca, err := tls.LoadX509KeyPair(files.CAFile, caKeyFile)
+	if err != nil {
+		return nil, WrapError(SERVER_CONFIG_ERROR, "Fail to load CA from "+dir+".", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	template := newCertTemplate(name)
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	if err := writeCertificate(template, caCert, ca.PrivateKey, files.CertFile, files.KeyFile); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+/////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////
+
+func newCertTemplate(name string) *x509.Certificate {
+
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	now := time.Now()
+
+	return &x509.Certificate{SerialNumber: serial,
+		Subject:   pkix.Name{CommonName: name, Organization: []string{"gometa"}},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(TLS_CERT_VALIDITY)}
+}
+
+//
+// Create a new key, and sign the certificate with the key of the parent.
+// If parent is nil, the certificate is self-signed.
+//
+func writeCertificate(template *x509.Certificate, parent *x509.Certificate, parentKey interface{},
+	certFile string, keyFile string) error {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return WrapError(SERVER_ERROR, "Fail to create certificate "+certFile+".", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
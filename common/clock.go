@@ -0,0 +1,127 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Clock is the source of time for the protocol timers (e.g. BALLOT_TIMEOUT,
+// SYNC_TIMEOUT).  Each server can have its own clock.
+// The process clock (see SetClock) is used by the servers that do not
+// have one, and it is the system clock by default.  A simulation can give
+// a fake clock to its servers, such that the timers only fire when the
+// simulation advances the time.
+//
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+type Timer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct {
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+var gClock Clock = &systemClock{}
+var gClockMutex sync.RWMutex
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Return the process clock.  This is the default clock of the servers.
+//
+func GetClock() Clock {
+	gClockMutex.RLock()
+	defer gClockMutex.RUnlock()
+
+	return gClock
+}
+
+//
+// Replace the process clock.  The clock applies to the servers that do
+// not have their own clock.  It should be set before any of them is
+// started.  Setting a nil clock restores the system clock.
+//
+func SetClock(clock Clock) {
+	gClockMutex.Lock()
+	defer gClockMutex.Unlock()
+
+	if clock == nil {
+		clock = &systemClock{}
+	}
+	gClock = clock
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// System Clock
+/////////////////////////////////////////////////////////////////////////////
+
+func (c *systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (c *systemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{time.NewTimer(d)}
+}
+
+func (c *systemClock) NewTicker(d time.Duration) Ticker {
+	return &systemTicker{time.NewTicker(d)}
+}
+
+func (t *systemTimer) Chan() <-chan time.Time {
+	return t.C
+}
+
+func (t *systemTicker) Chan() <-chan time.Time {
+	return t.C
+}
@@ -0,0 +1,864 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////
+
+//
+// ConnListener is implemented by the listeners that hand
+// out new connections through a channel (PeerListener and
+// MuxListener).
+//
+type ConnListener interface {
+	ConnChannel() <-chan net.Conn
+	Close() bool
+}
+
+//
+// ConnMux shares the TCP connections between the nodes among
+// multiple consensus groups.  Each group gets its own virtual
+// connection (MuxConn) over a shared TCP connection, and its own
+// listener (MuxListener) over a shared PeerListener.  A node
+// has at most one outgoing TCP connection to each peer.
+//
+// Each frame on the TCP connection has the format:
+//  8 bytes : length of the frame (excluding the length itself)
+//  1 byte  : frame type (hello, open, data or close)
+//  8 bytes : length of the group name
+//  n bytes : group name
+//  n bytes : payload
+//
+// The first frame in each direction is a hello frame, which carries
+// the range of protocol versions of the node.  A connection is closed
+// unless both nodes support the version of the consensus groups (see
+// GetMessageVersion("GroupMessage")).  A node running an older protocol
+// does not send a hello frame, so it cannot share a connection.
+//
+type ConnMux struct {
+	laddr     string
+	transport Transport
+	listener  ConnListener
+
+	// mutex protected variable
+	mutex     sync.Mutex
+	outgoing  map[string]*muxSession // key : peer addr
+	incoming  map[*muxSession]bool
+	listeners map[string]*MuxListener // key : group
+	isClosed  bool
+}
+
+//
+// MuxListener hands out the virtual connections opened by
+// the peers for a single group.
+//
+type MuxListener struct {
+	group  string
+	mux    *ConnMux
+	connch chan net.Conn
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	isClosed bool
+}
+
+//
+// MuxConn is a virtual connection for a single group.  It
+// implements net.Conn, so it can be used by PeerPipe.  Deadlines
+// are not supported.
+//
+type MuxConn struct {
+	group   string
+	id      uint64
+	session *muxSession
+	readch  chan []byte
+	closech chan bool
+	pending []byte
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	isClosed bool
+}
+
+type muxSession struct {
+	mux        *ConnMux
+	conn       net.Conn
+	peer       string // peer addr for outgoing session
+	writeMutex sync.Mutex
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	streams  map[string]*MuxConn // key : group
+	nextId   uint64
+	isClosed bool
+}
+
+//
+// The address of a virtual connection.  Each virtual connection has a
+// distinct address, even though it shares the TCP connection.
+//
+type muxAddr struct {
+	addr   net.Addr
+	stream string
+}
+
+type muxDialer struct {
+	mux   *ConnMux
+	group string
+}
+
+type muxFrameType byte
+
+const (
+	MUX_FRAME_OPEN muxFrameType = iota
+	MUX_FRAME_DATA
+	MUX_FRAME_CLOSE
+	MUX_FRAME_HELLO
+)
+
+// The group name of a hello frame
+const MUX_HELLO = "gometa-mux"
+
+/////////////////////////////////////////////////
+// ConnMux - Public Function
+/////////////////////////////////////////////////
+
+//
+// Create a new ConnMux listening to the given address.
+//
+func NewConnMux(laddr string) (*ConnMux, error) {
+
+	return NewConnMuxWithTransport(laddr, NewNetTransport())
+}
+
+//
+// Create a new ConnMux using the stream connections of the
+// given transport.
+//
+func NewConnMuxWithTransport(laddr string, transport Transport) (*ConnMux, error) {
+
+	listener, err := transport.Listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := &ConnMux{laddr: laddr,
+		transport: transport,
+		listener:  listener,
+		outgoing:  make(map[string]*muxSession),
+		incoming:  make(map[*muxSession]bool),
+		listeners: make(map[string]*MuxListener),
+		isClosed:  false}
+
+	go mux.listen()
+	return mux, nil
+}
+
+//
+// Create a listener for the group.  There can only be one
+// listener for each group.
+//
+func (m *ConnMux) Listen(group string) (*MuxListener, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.isClosed {
+		return nil, NewError(SERVER_ERROR, "ConnMux is closed")
+	}
+
+	if _, ok := m.listeners[group]; ok {
+		return nil, NewError(SERVER_ERROR, "ConnMux : Listener already exists for group "+group)
+	}
+
+	listener := &MuxListener{group: group,
+		mux:      m,
+		connch:   make(chan net.Conn, MAX_PEERS),
+		isClosed: false}
+	m.listeners[group] = listener
+
+	return listener, nil
+}
+
+//
+// Open a virtual connection for the group to the peer.  The TCP
+// connection to the peer is shared by all the groups.  If there is
+// already a connection for the group to the peer, the old connection
+// is closed.
+//
+func (m *ConnMux) Dial(group string, peer string) (net.Conn, error) {
+
+	session, err := m.getSession(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := session.open(group)
+	if err != nil {
+		// The TCP connection may have been closed.  Reconnect and try once more.
+		session.close()
+		if session, err = m.getSession(peer); err != nil {
+			return nil, err
+		}
+		return session.open(group)
+	}
+
+	return conn, nil
+}
+
+//
+// Return a Dialer that opens virtual connections for the group.
+//
+func (m *ConnMux) GroupDialer(group string) Dialer {
+	return &muxDialer{mux: m, group: group}
+}
+
+//
+// Close the ConnMux.  All the connections and listeners will be closed.
+//
+func (m *ConnMux) Close() bool {
+	m.mutex.Lock()
+
+	if m.isClosed {
+		m.mutex.Unlock()
+		return false
+	}
+	m.isClosed = true
+
+	Infof("ConnMux.Close() : Local Addr %s", m.laddr)
+	if Debug() {
+		Tracef("ConnMux.Close() : Diagnostic Stack ...")
+		Tracef("%s", debug.Stack())
+	}
+
+	sessions := make([]*muxSession, 0, len(m.outgoing)+len(m.incoming))
+	for _, session := range m.outgoing {
+		sessions = append(sessions, session)
+	}
+	for session := range m.incoming {
+		sessions = append(sessions, session)
+	}
+
+	listeners := make([]*MuxListener, 0, len(m.listeners))
+	for _, listener := range m.listeners {
+		listeners = append(listeners, listener)
+	}
+	m.mutex.Unlock()
+
+	// Close outside of the mutex, since the sessions and the listeners
+	// remove themselves from the ConnMux when they are closed.
+	m.listener.Close()
+
+	for _, session := range sessions {
+		session.close()
+	}
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	return true
+}
+
+/////////////////////////////////////////////////
+// ConnMux - Private Function
+/////////////////////////////////////////////////
+
+//
+// Goroutine.  Accept new TCP connection from the peers.
+//
+func (m *ConnMux) listen() {
+	defer func() {
+		if r := recover(); r != nil {
+			Errorf("panic in ConnMux.listen() : %s", r)
+		}
+	}()
+
+	connch := m.listener.ConnChannel()
+	if connch == nil {
+		return
+	}
+
+	for {
+		conn, ok := <-connch
+		if !ok {
+			Infof("ConnMux.listen() : Listener closed.  Terminate.")
+			return
+		}
+
+		m.mutex.Lock()
+		if m.isClosed {
+			m.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		session := newMuxSession(m, conn, "")
+		m.incoming[session] = true
+		m.mutex.Unlock()
+
+		go session.accept()
+	}
+}
+
+//
+// Get the outgoing session to the peer.  Connect to the
+// peer if there is no session.
+//
+func (m *ConnMux) getSession(peer string) (*muxSession, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.isClosed {
+		return nil, NewError(SERVER_ERROR, "ConnMux is closed")
+	}
+
+	if session, ok := m.outgoing[peer]; ok {
+		return session, nil
+	}
+
+	conn, err := m.transport.Dial(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	Infof("ConnMux.getSession() : Connected to peer %s, local address %s", peer, conn.LocalAddr())
+
+	session := newMuxSession(m, conn, peer)
+	if err := session.handshake(); err != nil {
+		Warnf("ConnMux.getSession() : Fail to share connection with peer %s.  Error = %s", peer, err.Error())
+		SafeRun("ConnMux.getSession()",
+			func() {
+				conn.Close()
+			})
+		return nil, err
+	}
+
+	m.outgoing[peer] = session
+	go session.run()
+
+	return session, nil
+}
+
+//
+// Remove the session after it is closed.
+//
+func (m *ConnMux) removeSession(session *muxSession) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if session.peer != "" {
+		if m.outgoing[session.peer] == session {
+			delete(m.outgoing, session.peer)
+		}
+	} else {
+		delete(m.incoming, session)
+	}
+}
+
+//
+// Hand out a new virtual connection to the listener of the group.
+// Return false if there is no listener for the group.
+//
+func (m *ConnMux) accept(conn *MuxConn) bool {
+	m.mutex.Lock()
+	listener, ok := m.listeners[conn.group]
+	m.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+	return listener.queue(conn)
+}
+
+/////////////////////////////////////////////////
+// muxDialer
+/////////////////////////////////////////////////
+
+func (d *muxDialer) Dial(addr string) (net.Conn, error) {
+	return d.mux.Dial(d.group, addr)
+}
+
+/////////////////////////////////////////////////
+// MuxListener
+/////////////////////////////////////////////////
+
+//
+// Get the channel for new connection for the group.  Return nil
+// if the listener is closed.
+//
+func (l *MuxListener) ConnChannel() <-chan net.Conn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.isClosed {
+		return (<-chan net.Conn)(l.connch)
+	}
+	return nil
+}
+
+//
+// Close the listener.  The TCP connections are not closed, since
+// they are shared with the other groups.
+//
+func (l *MuxListener) Close() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isClosed {
+		return false
+	}
+	l.isClosed = true
+
+	l.mux.mutex.Lock()
+	if l.mux.listeners[l.group] == l {
+		delete(l.mux.listeners, l.group)
+	}
+	l.mux.mutex.Unlock()
+
+	SafeRun("MuxListener.Close()",
+		func() {
+			close(l.connch)
+		})
+
+	return true
+}
+
+func (l *MuxListener) queue(conn net.Conn) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isClosed {
+		return false
+	}
+
+	select {
+	case l.connch <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+/////////////////////////////////////////////////
+// MuxConn
+/////////////////////////////////////////////////
+
+func newMuxConn(group string, id uint64, session *muxSession) *MuxConn {
+	return &MuxConn{group: group,
+		id:       id,
+		session:  session,
+		readch:   make(chan []byte, MAX_PROPOSALS),
+		closech:  make(chan bool),
+		isClosed: false}
+}
+
+func (c *MuxConn) Read(b []byte) (int, error) {
+
+	if len(c.pending) == 0 {
+		select {
+		case data := <-c.readch:
+			c.pending = data
+		default:
+			select {
+			case data := <-c.readch:
+				c.pending = data
+			case <-c.closech:
+				// return the data received before close
+				select {
+				case data := <-c.readch:
+					c.pending = data
+				default:
+					return 0, io.EOF
+				}
+			}
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *MuxConn) Write(b []byte) (int, error) {
+
+	if c.isConnClosed() {
+		return 0, NewError(SERVER_ERROR, "MuxConn is closed")
+	}
+
+	if err := c.session.writeFrame(MUX_FRAME_DATA, c.group, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+//
+// Close the virtual connection.  The peer will be notified.
+//
+func (c *MuxConn) Close() error {
+	if c.closeConn() {
+		c.session.removeStream(c)
+		c.session.writeFrame(MUX_FRAME_CLOSE, c.group, nil)
+	}
+	return nil
+}
+
+func (c *MuxConn) LocalAddr() net.Addr {
+	return &muxAddr{addr: c.session.conn.LocalAddr(), stream: c.streamName()}
+}
+
+func (c *MuxConn) RemoteAddr() net.Addr {
+	return &muxAddr{addr: c.session.conn.RemoteAddr(), stream: c.streamName()}
+}
+
+func (c *MuxConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *MuxConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *MuxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//
+// Mark the connection as closed.  Return false if it
+// is already closed.
+//
+func (c *MuxConn) closeConn() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isClosed {
+		return false
+	}
+	c.isClosed = true
+	close(c.closech)
+	return true
+}
+
+func (c *MuxConn) isConnClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.isClosed
+}
+
+func (c *MuxConn) streamName() string {
+	return c.group + "#" + strconv.FormatUint(c.id, 10)
+}
+
+/////////////////////////////////////////////////
+// muxAddr
+/////////////////////////////////////////////////
+
+func (a *muxAddr) Network() string {
+	return a.addr.Network()
+}
+
+func (a *muxAddr) String() string {
+	return a.addr.String() + "/" + a.stream
+}
+
+/////////////////////////////////////////////////
+// muxSession
+/////////////////////////////////////////////////
+
+func newMuxSession(mux *ConnMux, conn net.Conn, peer string) *muxSession {
+	return &muxSession{mux: mux,
+		conn:     conn,
+		peer:     peer,
+		streams:  make(map[string]*MuxConn),
+		isClosed: false}
+}
+
+//
+// Open a new virtual connection for the group.
+//
+func (s *muxSession) open(group string) (*MuxConn, error) {
+
+	s.mutex.Lock()
+	if s.isClosed {
+		s.mutex.Unlock()
+		return nil, NewError(SERVER_ERROR, "ConnMux : Connection to peer is closed")
+	}
+	old := s.streams[group]
+	s.nextId++
+	conn := newMuxConn(group, s.nextId, s)
+	s.streams[group] = conn
+	s.mutex.Unlock()
+
+	if old != nil {
+		old.closeConn()
+	}
+
+	if err := s.writeFrame(MUX_FRAME_OPEN, group, nil); err != nil {
+		conn.closeConn()
+		s.removeStream(conn)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (s *muxSession) removeStream(conn *MuxConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.streams[conn.group] == conn {
+		delete(s.streams, conn.group)
+	}
+}
+
+func (s *muxSession) getStream(group string) *MuxConn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.streams[group]
+}
+
+//
+// Write a frame to the TCP connection.  Frames from different
+// groups are serialized.
+//
+func (s *muxSession) writeFrame(ty muxFrameType, group string, payload []byte) error {
+
+	frame := make([]byte, 8+1+8+len(group)+len(payload))
+	binary.BigEndian.PutUint64(frame, uint64(len(frame)-8))
+	frame[8] = byte(ty)
+	binary.BigEndian.PutUint64(frame[9:], uint64(len(group)))
+	copy(frame[17:], group)
+	copy(frame[17+len(group):], payload)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	for len(frame) > 0 {
+		n, err := s.conn.Write(frame)
+		if err != nil {
+			return err
+		}
+		frame = frame[n:]
+	}
+	return nil
+}
+
+//
+// Send the hello frame to the peer, and check the hello frame of the
+// peer (outgoing session).
+//
+func (s *muxSession) handshake() error {
+
+	if err := s.writeHello(); err != nil {
+		return err
+	}
+
+	return s.readHello()
+}
+
+//
+// Goroutine.  Check the hello frame of the peer and send the hello
+// frame back (incoming session).  Then read the frames from the peer.
+//
+func (s *muxSession) accept() {
+
+	if err := s.readHello(); err != nil {
+		Warnf("muxSession.accept() : Reject connection from %s.  Error = %s", s.conn.RemoteAddr(), err.Error())
+		s.close()
+		return
+	}
+
+	if err := s.writeHello(); err != nil {
+		Warnf("muxSession.accept() : Connection to %s closed.  Error = %s", s.conn.RemoteAddr(), err.Error())
+		s.close()
+		return
+	}
+
+	s.run()
+}
+
+//
+// Send the range of protocol versions of this node.
+//
+func (s *muxSession) writeHello() error {
+
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload, MIN_PROTOCOL_VERSION)
+	binary.BigEndian.PutUint32(payload[4:], PROTOCOL_VERSION)
+
+	s.conn.SetWriteDeadline(time.Now().Add(MUX_HANDSHAKE_TIMEOUT * time.Millisecond))
+	defer s.conn.SetWriteDeadline(time.Time{})
+
+	return s.writeFrame(MUX_FRAME_HELLO, MUX_HELLO, payload)
+}
+
+//
+// Read the hello frame of the peer, and check that the peer supports
+// consensus groups.
+//
+func (s *muxSession) readHello() error {
+
+	s.conn.SetReadDeadline(time.Now().Add(MUX_HANDSHAKE_TIMEOUT * time.Millisecond))
+	defer s.conn.SetReadDeadline(time.Time{})
+
+	ty, group, payload, err := s.readFrame()
+	if err != nil {
+		return WrapError(VERSION_MISMATCH_ERROR, "Peer does not support shared connections.", err)
+	}
+	if ty != MUX_FRAME_HELLO || group != MUX_HELLO || len(payload) != 8 {
+		return NewError(VERSION_MISMATCH_ERROR, "Peer does not support shared connections")
+	}
+
+	version, err := NegotiateVersion(binary.BigEndian.Uint32(payload), binary.BigEndian.Uint32(payload[4:]))
+	if err != nil {
+		return err
+	}
+
+	if required := GetMessageVersion("GroupMessage"); version < required {
+		return NewError(VERSION_MISMATCH_ERROR,
+			fmt.Sprintf("Peer runs at protocol version %d.  Consensus groups require protocol version %d.", version, required))
+	}
+
+	return nil
+}
+
+//
+// Read a frame from the TCP connection.
+//
+func (s *muxSession) readFrame() (muxFrameType, string, []byte, error) {
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return 0, "", nil, err
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint64(header))
+	if _, err := io.ReadFull(s.conn, frame); err != nil {
+		return 0, "", nil, err
+	}
+
+	if len(frame) < 9 {
+		return 0, "", nil, NewError(PROTOCOL_ERROR, "Invalid frame")
+	}
+
+	groupLen := binary.BigEndian.Uint64(frame[1:9])
+	if uint64(len(frame)-9) < groupLen {
+		return 0, "", nil, NewError(PROTOCOL_ERROR, "Invalid frame")
+	}
+
+	return muxFrameType(frame[0]), string(frame[9 : 9+groupLen]), frame[9+groupLen:], nil
+}
+
+//
+// Goroutine.  Read the frames from the TCP connection and
+// dispatch them to the virtual connections.
+//
+func (s *muxSession) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			Errorf("panic in muxSession.run() : %s", r)
+		}
+
+		s.close()
+	}()
+
+	for {
+		ty, group, payload, err := s.readFrame()
+		if err != nil {
+			Warnf("muxSession.run() : Connection to %s closed.  Error = %s", s.conn.RemoteAddr(), err.Error())
+			return
+		}
+
+		switch ty {
+		case MUX_FRAME_OPEN:
+			s.handleOpen(group)
+		case MUX_FRAME_DATA:
+			if conn := s.getStream(group); conn != nil {
+				select {
+				case conn.readch <- payload:
+				case <-conn.closech:
+				}
+			}
+		case MUX_FRAME_CLOSE:
+			if conn := s.getStream(group); conn != nil {
+				conn.closeConn()
+				s.removeStream(conn)
+			}
+		}
+	}
+}
+
+//
+// The peer opens a new virtual connection for the group.
+//
+func (s *muxSession) handleOpen(group string) {
+
+	s.mutex.Lock()
+	old := s.streams[group]
+	s.nextId++
+	conn := newMuxConn(group, s.nextId, s)
+	s.streams[group] = conn
+	s.mutex.Unlock()
+
+	if old != nil {
+		old.closeConn()
+	}
+
+	if !s.mux.accept(conn) {
+		Warnf("muxSession.handleOpen() : No listener for group %s.  Close connection from %s.",
+			group, s.conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+//
+// Close the TCP connection and all the virtual connections.
+//
+func (s *muxSession) close() {
+	s.mutex.Lock()
+	if s.isClosed {
+		s.mutex.Unlock()
+		return
+	}
+	s.isClosed = true
+
+	streams := s.streams
+	s.streams = make(map[string]*MuxConn)
+	s.mutex.Unlock()
+
+	for _, conn := range streams {
+		conn.closeConn()
+	}
+
+	SafeRun("muxSession.close()",
+		func() {
+			s.conn.Close()
+		})
+
+	s.mux.removeSession(s)
+}
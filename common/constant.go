@@ -33,11 +33,19 @@ var MESSAGE_PORT = 9999                                              // port for
 var ELECTION_PORT = 9998                                             // port for receving election votes from peer
 var MESSAGE_TRANSPORT_TYPE = "tcp"                                   // network protocol for message transport
 var ELECTION_TRANSPORT_TYPE = "udp"                                  // network protocol for election vote transport
+var ELECTION_DIAL_TIMEOUT time.Duration = 500                        // timeout for connecting to peer for election over tcp (millisecond)
 var BALLOT_TIMEOUT time.Duration = 50                                // timeout for a ballot (millisecond)
 var BALLOT_MAX_TIMEOUT time.Duration = 500                           // max timeout for a ballot (millisecond)
 var BALLOT_FINALIZE_WAIT time.Duration = 200                         // wait this much for new votes before completing leader election
+var PREVOTE_TIMEOUT time.Duration = 200                              // timeout for collecting pre-votes before starting a new round (millisecond)
 var SYNC_TIMEOUT time.Duration = 10000                               // timeout for synchronization (millisecond)
 var LEADER_TIMEOUT time.Duration = 100000                            // timeout for leader (millisecond)
+var LEADER_PRIORITY_CHECK_INTERVAL time.Duration = 5000              // interval for checking if leadership should move to a higher priority follower (millisecond)
+var LEADERSHIP_TRANSFER_TIMEOUT time.Duration = 30000                // time for the target of a leadership transfer to catch up and be elected (millisecond)
+var LEADER_HANDOVER_BACKOFF time.Duration = 30000                    // wait before handing over the leadership again after a handover that does not move it (millisecond)
+var MAX_LEADER_HANDOVER_BACKOFF time.Duration = 600000               // max wait before handing over the leadership again (millisecond)
+var SLOW_FOLLOWER_CHECK_INTERVAL time.Duration = 1000                // interval for checking if a follower falls behind the leader (millisecond)
+var ACCEPT_LATENCY_SMOOTHING int64 = 5                               // each sample of the accept latency of a follower weighs 1/n in the moving average
 var RETRY_BACKOFF time.Duration = 100                                // backoff time for retry (millisecond)
 var MAX_RETRY_BACKOFF time.Duration = 10000                          // max backoff time for retry (millisecond)
 var REPOSITORY_NAME = "MetadataStore"                                // Forest db name for metadata store
@@ -48,12 +56,47 @@ var CONFIG_ACCEPTED_EPOCH = "AcceptedEpoch"                          // Server C
 var CONFIG_CURRENT_EPOCH = "CurrentEpoch"                            // Server Config Param : CurrentEpoch
 var CONFIG_LAST_LOGGED_TXID = "LastLoggedTxid"                       // Server Config Param : LastLoggedTxid
 var CONFIG_LAST_COMMITTED_TXID = "LastCommittedTxid"                 // Server Config Param : LastCommittedTxid
+var CONFIG_ELECTION_HISTORY = "ElectionHistory"                      // Server Config Param : recent elections of the node
+var CONFIG_MEMBERS = "Members"                                       // Server Config Param : members of the ensemble set by the administrator (replace Host and Peer of the config)
+var CONFIG_LOG_COMPACTED_TXID = "LogCompactedTxid"                   // Server Config Param : the commit log entries up to this txnid are removed
 var CONFIG_MAGIC = "MagicNumber"                                     // Server Config Param : Magic Number
 var CONFIG_MAGIC_VALUE uint64 = 0x0123456789                         // Server Config Param : Magic Number Value
 var MAX_EPOCH uint32 = math.MaxUint32                                // Max value for epoch
 var MAX_COUNTER uint32 = math.MaxUint32                              // Max value for counter
+var COUNTER_ROLLOVER_THRESHOLD uint32 = MAX_COUNTER - 100000         // Leader starts a new epoch once the counter passes this value
+var EPOCH_WRAP_WINDOW uint32 = 1 << 31                               // An epoch is more recent if it is ahead by less than this value (with wrap)
 var BOOTSTRAP_LAST_COMMITTED_TXID Txnid = Txnid(0)                   // Boostrap value of last committed txid
 var BOOTSTRAP_LAST_LOGGED_TXID Txnid = Txnid(0)                      // Boostrap value of last logged txid
 var BOOTSTRAP_CURRENT_EPOCH uint32 = 0                               // Boostrap value of current epoch
 var BOOTSTRAP_ACCEPTED_EPOCH uint32 = 0                              // Boostrap value of accepted epoch
+var PROTOCOL_VERSION_1 uint32 = 1                                    // Protocol version 1 : baseline protocol
+var PROTOCOL_VERSION_2 uint32 = 2                                    // Protocol version 2 : version negotiation, pre-vote
+var PROTOCOL_VERSION_3 uint32 = 3                                    // Protocol version 3 : multiple consensus groups
+var PROTOCOL_VERSION uint32 = PROTOCOL_VERSION_3                     // Highest protocol version supported by this node
+var MIN_PROTOCOL_VERSION uint32 = PROTOCOL_VERSION_1                 // Lowest protocol version supported by this node
 var TCP_KEEP_ALIVE_PERIOD time.Duration = 100 * time.Millisecond     // TCP keep alive period
+var SIMULATION_SETTLE_TIME int = 2                                   // real time given to the goroutines at each simulation step (millisecond)
+var SIMULATION_BASE_PORT int = 21000                                 // first port of the simulated addresses
+var SIMULATION_MAX_STEP int = 100                                    // maximum fake time elapsed at each simulation step (millisecond)
+var TLS_HANDSHAKE_TIMEOUT time.Duration = 5000                       // timeout for TLS handshake with a peer (millisecond)
+var MUX_HANDSHAKE_TIMEOUT time.Duration = 5000                       // timeout for exchanging the protocol version on a shared connection (millisecond)
+var TLS_CERT_VALIDITY time.Duration = 365 * 24 * time.Hour           // validity of the generated certificates
+var AUTH_HANDSHAKE_TIMEOUT time.Duration = 5000                      // timeout for exchanging nonces with a peer (millisecond)
+var MAX_AUTH_FRAME_SIZE = 64 * 1024 * 1024                           // maximum size of an authenticated frame on a stream connection
+var ACL_USER_PATH = "/_acl/user/"                                    // Key prefix of the user records (credentials and access rules)
+var ACL_HASH_ITERATIONS = 1000                                       // number of hash iterations for the password of a user
+var METRICS_PATH = "/metrics"                                        // HTTP path of the metrics on the request port
+var STATUS_PATH = "/status"                                          // HTTP path of the status of the node on the request port
+var HEALTH_PATH = "/healthz"                                         // HTTP path of the liveness of the node on the request port
+var READY_PATH = "/readyz"                                           // HTTP path of the readiness of the node on the request port
+var COMMAND_TIMEOUT time.Duration = 5000                             // timeout for reading a four-letter command and writing the reply (millisecond)
+var WATCH_HISTORY_SIZE = 1000                                        // number of committed changes kept by a node for the watch requests
+var WATCH_TIMEOUT time.Duration = 30000                              // maximum time a watch request waits for a change (millisecond)
+var STATUS_TIMEOUT time.Duration = 1000                              // timeout for getting the status of the leader (millisecond)
+var TRACE_BUFFER_SIZE = 10000                                        // number of spans kept in memory by the default span exporter
+var SLOW_REQUEST_THRESHOLD time.Duration = 100                       // a traced request is slow if it takes longer than this (millisecond)
+var MAX_SLOW_REQUESTS = 100                                          // maximum number of slow requests returned by GetSlowRequests
+var ELECTION_HISTORY_SIZE = 100                                      // number of elections remembered by a node (see NodeStatus)
+var BACKUP_PAGE_SIZE = 1000                                          // maximum number of keys returned by a Backup request
+var MAX_BACKUPS = 10                                                 // maximum number of backups in progress on a node
+var BACKUP_TIMEOUT time.Duration = 60000                             // a backup is cancelled if its next page is not requested in time (millisecond)
@@ -15,10 +15,17 @@
 
 package common
 
-import ()
+import (
+	"strings"
+)
 
 type ErrorCode byte
 
+//
+// The error codes are sent to the peers and the clients (by name), so
+// a new code must be added at the end, and the name of a code must not
+// change.
+//
 const (
 	PROTOCOL_ERROR ErrorCode = iota
 	SERVER_ERROR
@@ -28,6 +35,16 @@ const (
 	ELECTION_ERROR
 	CLIENT_ERROR
 	REPO_ERROR
+	AUTH_ERROR
+	PERMISSION_ERROR       // the client does not have the permission for the request
+	NOT_LEADER_ERROR       // the leader cannot take the request (e.g. stepping down).  Retry the request.
+	NO_QUORUM_ERROR        // there is no quorum (or no leader) to process the request.  Retry the request.
+	KEY_EXISTS_ERROR       // the key already exists
+	KEY_NOT_FOUND_ERROR    // the key does not exist
+	VERSION_MISMATCH_ERROR // the request is not supported by the version of the ensemble
+	TIMEOUT_ERROR          // the request is not done in time.  The outcome is unknown.
+	INVALID_REQUEST_ERROR  // the request is malformed
+	COMPACTED_ERROR        // the changes requested are not kept anymore.  Read the keys again.
 )
 
 type Error struct {
@@ -36,14 +53,25 @@ type Error struct {
 	cause  error
 }
 
+//
+// RecoverableError is returned when a proposal is rejected (e.g. by the
+// EventNotifier), without failing the leader.  The request is aborted
+// with the code given to NewRecoverableError, or with SERVER_ERROR.
+//
 type RecoverableError struct {
-	Reason string
+	Reason  string
+	code    ErrorCode
+	hasCode bool
 }
 
 func (e *RecoverableError) Error() string {
 	return e.Reason 
 }
 
+func NewRecoverableError(code ErrorCode, reason string) *RecoverableError {
+	return &RecoverableError{Reason: reason, code: code, hasCode: true}
+}
+
 func NewError(code ErrorCode, reason string) *Error {
 	return &Error{code: code, reason: reason, cause: nil}
 }
@@ -56,6 +84,18 @@ func (e *Error) IsFatal() bool {
 	return e.code == FATAL_ERROR
 }
 
+func (e *Error) Code() ErrorCode {
+	return e.code
+}
+
+func (e *Error) Reason() string {
+	return e.reason
+}
+
+func (e *Error) Cause() error {
+	return e.cause
+}
+
 func (e *Error) Error() string {
 	if e.cause != nil {
 		return codeToStr(e.code) + " : " + e.reason + " : " + e.cause.Error()
@@ -71,11 +111,158 @@ func codeToStr(code ErrorCode) string {
 		return "Server Error"
 	case SERVER_CONFIG_ERROR:
 		return "Server Config Error"
+	case FATAL_ERROR:
+		return "Fatal Error"
+	case ARG_ERROR:
+		return "Argument Error"
+	case ELECTION_ERROR:
+		return "Election Error"
+	case CLIENT_ERROR:
+		return "Client Error"
+	case REPO_ERROR:
+		return "Repository Error"
+	case AUTH_ERROR:
+		return "Authentication Error"
+	case PERMISSION_ERROR:
+		return "Permission Error"
+	case NOT_LEADER_ERROR:
+		return "Not Leader Error"
+	case NO_QUORUM_ERROR:
+		return "No Quorum Error"
+	case KEY_EXISTS_ERROR:
+		return "Key Exists Error"
+	case KEY_NOT_FOUND_ERROR:
+		return "Key Not Found Error"
+	case VERSION_MISMATCH_ERROR:
+		return "Version Mismatch Error"
+	case TIMEOUT_ERROR:
+		return "Timeout Error"
+	case INVALID_REQUEST_ERROR:
+		return "Invalid Request Error"
+	case COMPACTED_ERROR:
+		return "Compacted Error"
 	}
 
 	return "Undefined Error"
 }
 
+//
+// Return the name of the code.  The name is sent to the peers
+// and the clients.
+//
+func (code ErrorCode) String() string {
+	switch code {
+	case PROTOCOL_ERROR:
+		return "protocol"
+	case SERVER_ERROR:
+		return "server"
+	case SERVER_CONFIG_ERROR:
+		return "server-config"
+	case FATAL_ERROR:
+		return "fatal"
+	case ARG_ERROR:
+		return "argument"
+	case ELECTION_ERROR:
+		return "election"
+	case CLIENT_ERROR:
+		return "client"
+	case REPO_ERROR:
+		return "repository"
+	case AUTH_ERROR:
+		return "authentication"
+	case PERMISSION_ERROR:
+		return "permission-denied"
+	case NOT_LEADER_ERROR:
+		return "not-leader"
+	case NO_QUORUM_ERROR:
+		return "no-quorum"
+	case KEY_EXISTS_ERROR:
+		return "key-exists"
+	case KEY_NOT_FOUND_ERROR:
+		return "key-not-found"
+	case VERSION_MISMATCH_ERROR:
+		return "version-mismatch"
+	case TIMEOUT_ERROR:
+		return "timeout"
+	case INVALID_REQUEST_ERROR:
+		return "invalid-request"
+	case COMPACTED_ERROR:
+		return "compacted"
+	}
+
+	return "undefined"
+}
+
+//
+// Return the code of the given name.  Return false if the name
+// is unknown (e.g. a code added by a newer version).
+//
+func GetErrorCodeByName(name string) (ErrorCode, bool) {
+
+	for code := PROTOCOL_ERROR; code <= COMPACTED_ERROR; code++ {
+		if code.String() == name {
+			return code, true
+		}
+	}
+	return SERVER_ERROR, false
+}
+
+//
+// Return the code of the error.  An error that is not an Error
+// is a SERVER_ERROR.
+//
+func GetErrorCode(err error) ErrorCode {
+
+	switch e := err.(type) {
+	case *Error:
+		return e.code
+	case *RecoverableError:
+		if e.hasCode {
+			return e.code
+		}
+	}
+	return SERVER_ERROR
+}
+
+//
+// Return the reason of the error (without the code).
+//
+func GetErrorReason(err error) string {
+
+	if e, ok := err.(*Error); ok {
+		if e.cause != nil {
+			return e.reason + " : " + e.cause.Error()
+		}
+		return e.reason
+	}
+	return err.Error()
+}
+
+//
+// Rebuild the Error from an error returned by the server to a remote
+// client.  The RPC layer only carries the message of the error, which
+// starts with the description of the code.  An error without a known
+// code is a SERVER_ERROR.
+//
+func ParseError(err error) *Error {
+
+	if err == nil {
+		return nil
+	}
+
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
+	msg := err.Error()
+	for code := PROTOCOL_ERROR; code <= COMPACTED_ERROR; code++ {
+		if prefix := codeToStr(code) + " : "; strings.HasPrefix(msg, prefix) {
+			return NewError(code, msg[len(prefix):])
+		}
+	}
+	return NewError(SERVER_ERROR, msg)
+}
+
 func Debug() bool {
-	return false
+	return IsLogEnabled(LOG_TRACE)
 }
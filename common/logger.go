@@ -0,0 +1,295 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+type LogLevel int32
+
+const (
+	LOG_ERROR LogLevel = iota // the node cannot make progress without intervention
+	LOG_WARN                  // a failure that the protocol recovers from (e.g. lost peer)
+	LOG_INFO                  // state change (e.g. election, new epoch, new follower)
+	LOG_DEBUG                 // every message, proposal and key
+	LOG_TRACE                 // diagnostic stack on close
+)
+
+//
+// A structured field of a log event (e.g. the txnid of a proposal).
+//
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+//
+// Logger receives the log events of a server.  The events are filtered by
+// the log level before reaching the logger, so the logger does not pay for
+// the events it would discard.  A logger must be safe for concurrent use.
+//
+type Logger interface {
+	Log(level LogLevel, msg string, fields []LogField)
+}
+
+//
+// NodeLogger sends the log events of a server to the logger of the server,
+// at the log level of the server.  A nil NodeLogger, or one without logger
+// or level, uses the logger and the level of the process (see SetLogger and
+// SetLogLevel).  The events of the layers shared by the servers (e.g. the
+// transport and the repository) always go to the logger of the process.
+//
+type NodeLogger struct {
+	logger Logger
+	level  int32 // atomic.  -1 if the level of the process applies
+}
+
+//
+// The default logger writes the events to the standard logger.
+//
+type defaultLogger struct {
+}
+
+var gLogger Logger = &defaultLogger{}
+var gLoggerMutex sync.RWMutex
+var gLogLevel int32 = int32(LOG_INFO) // atomic
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Replace the logger of the process.  The logger applies to the servers
+// that do not have their own logger.  Setting a nil logger restores the
+// default logger.
+//
+func SetLogger(logger Logger) {
+	gLoggerMutex.Lock()
+	defer gLoggerMutex.Unlock()
+
+	if logger == nil {
+		logger = &defaultLogger{}
+	}
+	gLogger = logger
+}
+
+func GetLogger() Logger {
+	gLoggerMutex.RLock()
+	defer gLoggerMutex.RUnlock()
+
+	return gLogger
+}
+
+//
+// Set the most verbose level that is logged by the process.  The level
+// applies to the servers that do not have their own level.  The default
+// is LOG_INFO.
+//
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&gLogLevel, int32(level))
+}
+
+func GetLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&gLogLevel))
+}
+
+func IsLogEnabled(level LogLevel) bool {
+	return level <= GetLogLevel()
+}
+
+//
+// Parse the name of a log level (error, warn, info, debug or trace).
+//
+func ParseLogLevel(name string) (LogLevel, error) {
+
+	for level := LOG_ERROR; level <= LOG_TRACE; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return LOG_INFO, NewError(SERVER_CONFIG_ERROR, fmt.Sprintf("Unknown log level %s", name))
+}
+
+func (level LogLevel) String() string {
+	switch level {
+	case LOG_ERROR:
+		return "error"
+	case LOG_WARN:
+		return "warn"
+	case LOG_INFO:
+		return "info"
+	case LOG_DEBUG:
+		return "debug"
+	case LOG_TRACE:
+		return "trace"
+	}
+	return "unknown"
+}
+
+//
+// Log an event with structured fields.
+//
+func Log(level LogLevel, msg string, fields ...LogField) {
+	(*NodeLogger)(nil).Log(level, msg, fields...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	logf(nil, LOG_ERROR, format, args)
+}
+
+func Warnf(format string, args ...interface{}) {
+	logf(nil, LOG_WARN, format, args)
+}
+
+func Infof(format string, args ...interface{}) {
+	logf(nil, LOG_INFO, format, args)
+}
+
+func Debugf(format string, args ...interface{}) {
+	logf(nil, LOG_DEBUG, format, args)
+}
+
+func Tracef(format string, args ...interface{}) {
+	logf(nil, LOG_TRACE, format, args)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Node Logger
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a logger for a server.  If the logger is nil, the events go to the
+// logger of the process.
+//
+func NewNodeLogger(logger Logger) *NodeLogger {
+	return &NodeLogger{logger: logger, level: -1}
+}
+
+func (l *NodeLogger) GetLogger() Logger {
+	if l == nil || l.logger == nil {
+		return GetLogger()
+	}
+	return l.logger
+}
+
+//
+// Set the most verbose level that is logged by the server.
+//
+func (l *NodeLogger) SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *NodeLogger) GetLogLevel() LogLevel {
+	if l == nil {
+		return GetLogLevel()
+	}
+	if level := atomic.LoadInt32(&l.level); level >= 0 {
+		return LogLevel(level)
+	}
+	return GetLogLevel()
+}
+
+func (l *NodeLogger) IsLogEnabled(level LogLevel) bool {
+	return level <= l.GetLogLevel()
+}
+
+func (l *NodeLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if l.IsLogEnabled(level) {
+		l.GetLogger().Log(level, msg, fields)
+	}
+}
+
+func (l *NodeLogger) Errorf(format string, args ...interface{}) {
+	logf(l, LOG_ERROR, format, args)
+}
+
+func (l *NodeLogger) Warnf(format string, args ...interface{}) {
+	logf(l, LOG_WARN, format, args)
+}
+
+func (l *NodeLogger) Infof(format string, args ...interface{}) {
+	logf(l, LOG_INFO, format, args)
+}
+
+func (l *NodeLogger) Debugf(format string, args ...interface{}) {
+	logf(l, LOG_DEBUG, format, args)
+}
+
+func (l *NodeLogger) Tracef(format string, args ...interface{}) {
+	logf(l, LOG_TRACE, format, args)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Log Field
+/////////////////////////////////////////////////////////////////////////////
+
+func NewLogField(key string, value interface{}) LogField {
+	return LogField{Key: key, Value: value}
+}
+
+func LogNode(addr string) LogField {
+	return LogField{Key: "node", Value: addr}
+}
+
+func LogPeer(addr string) LogField {
+	return LogField{Key: "peer", Value: addr}
+}
+
+func LogEpoch(epoch uint32) LogField {
+	return LogField{Key: "epoch", Value: epoch}
+}
+
+func LogTxnid(txnid Txnid) LogField {
+	return LogField{Key: "txnid", Value: uint64(txnid)}
+}
+
+func LogKey(key string) LogField {
+	return LogField{Key: "key", Value: key}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+func logf(l *NodeLogger, level LogLevel, format string, args []interface{}) {
+	if l.IsLogEnabled(level) {
+		l.GetLogger().Log(level, fmt.Sprintf(format, args...), nil)
+	}
+}
+
+func (l *defaultLogger) Log(level LogLevel, msg string, fields []LogField) {
+
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	buf.WriteString(strings.ToUpper(level.String()))
+	buf.WriteString("] ")
+	buf.WriteString(msg)
+	for _, field := range fields {
+		fmt.Fprintf(&buf, " %s=%v", field.Key, field.Value)
+	}
+
+	log.Print(buf.String())
+}
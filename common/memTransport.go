@@ -0,0 +1,357 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////
+
+//
+// MemNetwork is an in-memory Transport.  The peers sharing the same
+// MemNetwork can talk to each other within the same process, without
+// opening any socket.  This allows a whole ensemble to run in a single
+// process (e.g. for testing).
+//
+// The addresses must have the form host:port, since the peers resolve
+// the addresses before using them.  A stream connection is a net.Pipe.
+// A datagram is dropped if there is no receiver or the receiver is full,
+// just like UDP.
+//
+type MemNetwork struct {
+	mutex       sync.Mutex
+	listeners   map[string]*memListener   // key : listening addr
+	packetConns map[string]*memPacketConn // key : local addr
+	nextId      uint64
+}
+
+type memAddr struct {
+	network string
+	addr    string
+}
+
+type memListener struct {
+	laddr   string
+	network *MemNetwork
+	connch  chan net.Conn
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	isClosed bool
+}
+
+type memConn struct {
+	net.Conn
+	laddr net.Addr
+	raddr net.Addr
+}
+
+type memPacketConn struct {
+	laddr   *memAddr
+	network *MemNetwork
+	readch  chan *memPacket
+	closech chan bool
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	isClosed bool
+}
+
+type memPacket struct {
+	data []byte
+	from net.Addr
+}
+
+/////////////////////////////////////////////////
+// MemNetwork
+/////////////////////////////////////////////////
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{listeners: make(map[string]*memListener),
+		packetConns: make(map[string]*memPacketConn)}
+}
+
+//
+// Open a stream connection to the peer listening to the address.
+//
+func (n *MemNetwork) Dial(addr string) (net.Conn, error) {
+
+	raddr, err := net.ResolveTCPAddr(MESSAGE_TRANSPORT_TYPE, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	listener, ok := n.listeners[raddr.String()]
+	n.nextId++
+	id := n.nextId
+	n.mutex.Unlock()
+
+	if !ok {
+		return nil, NewError(SERVER_ERROR, "MemNetwork : Connection refused by "+addr)
+	}
+
+	// Each connection gets a distinct local address, like an ephemeral port.
+	local := &memAddr{network: MESSAGE_TRANSPORT_TYPE, addr: "mem#" + strconv.FormatUint(id, 10)}
+	remote := &memAddr{network: MESSAGE_TRANSPORT_TYPE, addr: raddr.String()}
+
+	client, server := net.Pipe()
+	if !listener.queue(&memConn{Conn: server, laddr: remote, raddr: local}) {
+		client.Close()
+		server.Close()
+		return nil, NewError(SERVER_ERROR, "MemNetwork : Connection refused by "+addr)
+	}
+
+	return &memConn{Conn: client, laddr: local, raddr: remote}, nil
+}
+
+func (n *MemNetwork) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return n.Dial(addr)
+}
+
+//
+// Listen to stream connections on the address.
+//
+func (n *MemNetwork) Listen(laddr string) (ConnListener, error) {
+
+	addr, err := net.ResolveTCPAddr(MESSAGE_TRANSPORT_TYPE, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, ok := n.listeners[addr.String()]; ok {
+		return nil, NewError(SERVER_ERROR, "MemNetwork : Address already in use "+laddr)
+	}
+
+	listener := &memListener{laddr: addr.String(),
+		network:  n,
+		connch:   make(chan net.Conn, MAX_PEERS),
+		isClosed: false}
+	n.listeners[listener.laddr] = listener
+
+	return listener, nil
+}
+
+//
+// Listen to datagrams on the address.
+//
+func (n *MemNetwork) ListenPacket(laddr string) (net.PacketConn, error) {
+
+	addr, err := net.ResolveUDPAddr(ELECTION_TRANSPORT_TYPE, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, ok := n.packetConns[addr.String()]; ok {
+		return nil, NewError(SERVER_ERROR, "MemNetwork : Address already in use "+laddr)
+	}
+
+	conn := &memPacketConn{laddr: &memAddr{network: ELECTION_TRANSPORT_TYPE, addr: addr.String()},
+		network:  n,
+		readch:   make(chan *memPacket, MAX_PROPOSALS*2),
+		closech:  make(chan bool),
+		isClosed: false}
+	n.packetConns[addr.String()] = conn
+
+	return conn, nil
+}
+
+func (n *MemNetwork) getPacketConn(addr string) *memPacketConn {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.packetConns[addr]
+}
+
+/////////////////////////////////////////////////
+// memAddr
+/////////////////////////////////////////////////
+
+func (a *memAddr) Network() string {
+	return a.network
+}
+
+func (a *memAddr) String() string {
+	return a.addr
+}
+
+/////////////////////////////////////////////////
+// memListener
+/////////////////////////////////////////////////
+
+func (l *memListener) ConnChannel() <-chan net.Conn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.isClosed {
+		return (<-chan net.Conn)(l.connch)
+	}
+	return nil
+}
+
+func (l *memListener) Close() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isClosed {
+		return false
+	}
+	l.isClosed = true
+
+	l.network.mutex.Lock()
+	if l.network.listeners[l.laddr] == l {
+		delete(l.network.listeners, l.laddr)
+	}
+	l.network.mutex.Unlock()
+
+	SafeRun("memListener.Close()",
+		func() {
+			close(l.connch)
+		})
+
+	return true
+}
+
+func (l *memListener) queue(conn net.Conn) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isClosed {
+		return false
+	}
+
+	select {
+	case l.connch <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+/////////////////////////////////////////////////
+// memConn
+/////////////////////////////////////////////////
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+/////////////////////////////////////////////////
+// memPacketConn
+/////////////////////////////////////////////////
+
+func (c *memPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+
+	select {
+	case packet := <-c.readch:
+		n := copy(b, packet.data)
+		return n, packet.from, nil
+	case <-c.closech:
+		return 0, nil, NewError(SERVER_ERROR, "MemNetwork : Connection closed")
+	}
+}
+
+//
+// Deliver the datagram to the peer.  The datagram is dropped if
+// the peer is not listening or cannot keep up.
+//
+func (c *memPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+
+	if c.isConnClosed() {
+		return 0, NewError(SERVER_ERROR, "MemNetwork : Connection closed")
+	}
+
+	peer := c.network.getPacketConn(addr.String())
+	if peer != nil {
+		data := make([]byte, len(b))
+		copy(data, b)
+		peer.deliver(&memPacket{data: data, from: c.laddr})
+	}
+
+	return len(b), nil
+}
+
+func (c *memPacketConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isClosed {
+		return nil
+	}
+	c.isClosed = true
+	close(c.closech)
+
+	c.network.mutex.Lock()
+	if c.network.packetConns[c.laddr.addr] == c {
+		delete(c.network.packetConns, c.laddr.addr)
+	}
+	c.network.mutex.Unlock()
+
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *memPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memPacketConn) deliver(packet *memPacket) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isClosed {
+		return
+	}
+
+	select {
+	case c.readch <- packet:
+	default:
+	}
+}
+
+func (c *memPacketConn) isConnClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.isClosed
+}
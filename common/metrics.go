@@ -0,0 +1,473 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////
+
+//
+// MetricsRegistry holds the metrics of the process, and writes them in
+// the Prometheus text format.  A metric has a series for each server of
+// the process, told apart by the labels of the server (see MetricLabels).
+// The metrics of the layers shared by the servers (e.g. the repository)
+// have a single series without labels.
+//
+type MetricsRegistry struct {
+	mutex   sync.Mutex
+	metrics map[string]metric
+}
+
+//
+// The labels of the series of a server.
+//
+type MetricLabels struct {
+	Node  string // message address of the server
+	Group string // consensus group of the server (empty if the node runs a single ensemble)
+}
+
+type metric interface {
+	write(w io.Writer, name string, filter func(labels MetricLabels) bool)
+}
+
+type series interface {
+	write(w io.Writer, name string, labels MetricLabels)
+}
+
+//
+// The series of a metric, by labels.
+//
+type family struct {
+	help  string
+	kind  string // counter, gauge or histogram
+	mutex sync.Mutex
+	all   map[MetricLabels]series
+}
+
+type CounterVec struct {
+	family
+}
+
+type GaugeVec struct {
+	family
+}
+
+type HistogramVec struct {
+	family
+	buckets []float64 // upper bound of each bucket (sorted)
+}
+
+//
+// A counter only goes up.
+//
+type Counter struct {
+	value uint64 // atomic
+}
+
+//
+// A gauge is the sum of the values of its sources (e.g. the length of
+// a channel).  A source is tracked while the object it reads from is
+// alive.
+//
+type Gauge struct {
+	mutex   sync.Mutex
+	sources map[uint64]func() int64
+	nextId  uint64
+}
+
+//
+// A histogram counts the observed values (e.g. latency in seconds) in
+// buckets.
+//
+type Histogram struct {
+	buckets []float64 // upper bound of each bucket (sorted)
+
+	mutex  sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+/////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////
+
+//
+// The registry of the process.  The handler of /metrics writes the
+// series of the node from this registry.
+//
+var Metrics = NewMetricsRegistry()
+
+//
+// Default buckets for latency (in seconds), from 1ms to 10s.
+//
+var LatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{metrics: make(map[string]metric)}
+}
+
+//
+// Return the counter with the given name.  The counter is created if
+// it does not exist yet.
+//
+func (r *MetricsRegistry) NewCounter(name string, help string) *CounterVec {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if c, ok := r.metrics[name].(*CounterVec); ok {
+		return c
+	}
+
+	c := &CounterVec{family: newFamily(help, "counter")}
+	r.metrics[name] = c
+	return c
+}
+
+//
+// Return the gauge with the given name.  The gauge is created if it
+// does not exist yet.
+//
+func (r *MetricsRegistry) NewGauge(name string, help string) *GaugeVec {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if g, ok := r.metrics[name].(*GaugeVec); ok {
+		return g
+	}
+
+	g := &GaugeVec{family: newFamily(help, "gauge")}
+	r.metrics[name] = g
+	return g
+}
+
+//
+// Return the histogram with the given name.  The histogram is created
+// with the buckets if it does not exist yet.
+//
+func (r *MetricsRegistry) NewHistogram(name string, help string, buckets []float64) *HistogramVec {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if h, ok := r.metrics[name].(*HistogramVec); ok {
+		return h
+	}
+
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+
+	h := &HistogramVec{family: newFamily(help, "histogram"), buckets: sorted}
+	r.metrics[name] = h
+	return h
+}
+
+//
+// Write the metrics in the Prometheus text format (version 0.0.4),
+// sorted by name.
+//
+func (r *MetricsRegistry) Write(w io.Writer) error {
+	return r.write(w, func(labels MetricLabels) bool { return true })
+}
+
+//
+// Same as Write, but only with the series of the given node, and the
+// series without labels.
+//
+func (r *MetricsRegistry) WriteNode(w io.Writer, node string) error {
+	return r.write(w, func(labels MetricLabels) bool {
+		return len(labels.Node) == 0 || labels.Node == node
+	})
+}
+
+/////////////////////////////////////////////////
+// Family
+/////////////////////////////////////////////////
+
+//
+// Return the counter of the server with the given labels.
+//
+func (c *CounterVec) With(labels MetricLabels) *Counter {
+	return c.get(labels, func() series { return &Counter{} }).(*Counter)
+}
+
+//
+// Return the gauge of the server with the given labels.
+//
+func (g *GaugeVec) With(labels MetricLabels) *Gauge {
+	return g.get(labels, func() series {
+		return &Gauge{sources: make(map[uint64]func() int64)}
+	}).(*Gauge)
+}
+
+//
+// Return the histogram of the server with the given labels.
+//
+func (h *HistogramVec) With(labels MetricLabels) *Histogram {
+	return h.get(labels, func() series {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*Histogram)
+}
+
+/////////////////////////////////////////////////
+// Counter
+/////////////////////////////////////////////////
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Get() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer, name string, labels MetricLabels) {
+	fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labels, ""), c.Get())
+}
+
+/////////////////////////////////////////////////
+// Gauge
+/////////////////////////////////////////////////
+
+//
+// Add a source to the gauge.  Return the function that removes the
+// source.
+//
+func (g *Gauge) Track(source func() int64) func() {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	id := g.nextId
+	g.nextId++
+	g.sources[id] = source
+
+	return func() {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+
+		delete(g.sources, id)
+	}
+}
+
+func (g *Gauge) Get() int64 {
+
+	g.mutex.Lock()
+	sources := make([]func() int64, 0, len(g.sources))
+	for _, source := range g.sources {
+		sources = append(sources, source)
+	}
+	g.mutex.Unlock()
+
+	var value int64
+	for _, source := range sources {
+		value += source()
+	}
+	return value
+}
+
+func (g *Gauge) write(w io.Writer, name string, labels MetricLabels) {
+	fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labels, ""), g.Get())
+}
+
+/////////////////////////////////////////////////
+// Histogram
+/////////////////////////////////////////////////
+
+func (h *Histogram) Observe(value float64) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+//
+// Observe the time elapsed since start (in seconds).
+//
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.ObserveSinceWithClock(GetClock(), start)
+}
+
+//
+// Observe the time elapsed since start (in seconds), as measured by the
+// clock.
+//
+func (h *Histogram) ObserveSinceWithClock(clock Clock, start time.Time) {
+	h.Observe(clock.Now().Sub(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels MetricLabels) {
+
+	h.mutex.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mutex.Unlock()
+
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labels, formatFloat(bound)), counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labels, "+Inf"), count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels, ""), formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(labels, ""), count)
+}
+
+/////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////
+
+func (r *MetricsRegistry) write(w io.Writer, filter func(labels MetricLabels) bool) error {
+
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make(map[string]metric, len(r.metrics))
+	for name, m := range r.metrics {
+		metrics[name] = m
+	}
+	r.mutex.Unlock()
+
+	sort.Strings(names)
+
+	buf := bufio.NewWriter(w)
+	for _, name := range names {
+		metrics[name].write(buf, name, filter)
+	}
+	return buf.Flush()
+}
+
+func newFamily(help string, kind string) family {
+	return family{help: help, kind: kind, all: make(map[MetricLabels]series)}
+}
+
+//
+// Return the series with the given labels.  The series is created if it
+// does not exist yet.
+//
+func (f *family) get(labels MetricLabels, create func() series) series {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	s, ok := f.all[labels]
+	if !ok {
+		s = create()
+		f.all[labels] = s
+	}
+	return s
+}
+
+//
+// Write the series that pass the filter, sorted by node and group.  The
+// metric is not written if there is no such series.
+//
+func (f *family) write(w io.Writer, name string, filter func(labels MetricLabels) bool) {
+
+	f.mutex.Lock()
+	labels := make([]MetricLabels, 0, len(f.all))
+	for l := range f.all {
+		if filter(l) {
+			labels = append(labels, l)
+		}
+	}
+	all := make(map[MetricLabels]series, len(labels))
+	for _, l := range labels {
+		all[l] = f.all[l]
+	}
+	f.mutex.Unlock()
+
+	if len(labels) == 0 {
+		return
+	}
+
+	sort.Sort(labelsByNode(labels))
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+	for _, l := range labels {
+		all[l].write(w, name, l)
+	}
+}
+
+//
+// Format the labels of a series (with the upper bound of a bucket of a
+// histogram if le is not empty).  Return an empty string if there is no
+// label.
+//
+func formatLabels(labels MetricLabels, le string) string {
+
+	var pairs []string
+	if len(labels.Node) != 0 {
+		pairs = append(pairs, "node="+strconv.Quote(labels.Node))
+	}
+	if len(labels.Group) != 0 {
+		pairs = append(pairs, "group="+strconv.Quote(labels.Group))
+	}
+	if len(le) != 0 {
+		pairs = append(pairs, "le="+strconv.Quote(le))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type labelsByNode []MetricLabels
+
+func (s labelsByNode) Len() int      { return len(s) }
+func (s labelsByNode) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s labelsByNode) Less(i, j int) bool {
+	if s[i].Node != s[j].Node {
+		return s[i].Node < s[j].Node
+	}
+	return s[i].Group < s[j].Group
+}
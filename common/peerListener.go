@@ -16,7 +16,6 @@
 package common
 
 import (
-	"log"
 	"net"
 	"runtime/debug"
 	"sync"
@@ -93,10 +92,10 @@ func (l *PeerListener) Close() bool {
 	if !l.isClosed {
 		l.isClosed = true
 
-		log.Printf("PeerListener.Close(): local address %s", l.naddr)
+		Infof("PeerListener.Close(): local address %s", l.naddr)
 		if Debug() {
-			log.Printf("PeerListener.Close() : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			Tracef("PeerListener.Close() : Diagnostic Stack ...")
+			Tracef("%s", debug.Stack())
 		}
 
 		SafeRun("PeerListener.Close()",
@@ -127,7 +126,7 @@ func (l *PeerListener) Close() bool {
 func (l *PeerListener) listen() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in PeerListener.listen() : %s\n", r)
+			Errorf("panic in PeerListener.listen() : %s", r)
 		}
 
 		// This will close the connection channel
@@ -138,7 +137,7 @@ func (l *PeerListener) listen() {
 		conn, err := l.listener.Accept()
 		if err != nil {
 			// if there is error, just terminate the listener loop.
-			log.Printf("PeerListener.listen(): Error in accepting new connection.  Error = %s. Terminate.", err.Error())
+			Warnf("PeerListener.listen(): Error in accepting new connection.  Error = %s. Terminate.", err.Error())
 			break
 		}
 
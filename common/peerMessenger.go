@@ -16,7 +16,6 @@
 package common
 
 import (
-	"log"
 	"net"
 	"runtime/debug"
 	"sync"
@@ -26,6 +25,21 @@ import (
 // Type Declaration
 /////////////////////////////////////////////////
 
+//
+// Messenger sends packets between peers for leader election.
+// PeerMessenger (UDP) and TCPPeerMessenger (TCP) implement
+// this interface.
+//
+type Messenger interface {
+	DefaultReceiveChannel() <-chan *Message
+	ReceiveChannel(msgName string) <-chan *Message
+	GetLocalAddr() string
+	Close() bool
+	Send(packet Packet, peer net.Addr) bool
+	SendByName(packet Packet, peer string) bool
+	Multicast(packet Packet, peers []net.Addr) bool
+}
+
 //
 // PeerMessenger sends packets between peers.
 //
@@ -65,7 +79,16 @@ type Message struct {
 //
 func NewPeerMessenger(laddr string, splitter map[string]chan *Message) (*PeerMessenger, error) {
 
-	pconn, err := getConn(laddr)
+	return NewPeerMessengerWithTransport(laddr, splitter, NewNetTransport())
+}
+
+//
+// Create a new PeerMessenger sending datagrams over the given transport.
+//
+func NewPeerMessengerWithTransport(laddr string, splitter map[string]chan *Message,
+	transport Transport) (*PeerMessenger, error) {
+
+	pconn, err := transport.ListenPacket(laddr)
 	if err != nil {
 		return nil, err
 	}
@@ -129,10 +152,10 @@ func (p *PeerMessenger) Close() bool {
 
 	if !p.isClosed {
 
-		log.Printf("PeerMessenger.Close() : Local Addr %s", p.GetLocalAddr())
+		Infof("PeerMessenger.Close() : Local Addr %s", p.GetLocalAddr())
 		if Debug() {
-			log.Printf("PeerMessenger.Close() : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			Tracef("PeerMessenger.Close() : Diagnostic Stack ...")
+			Tracef("%s", debug.Stack())
 		}
 
 		p.isClosed = true
@@ -227,7 +250,7 @@ func (p *PeerMessenger) Multicast(packet Packet, peers []net.Addr) bool {
 func (p *PeerMessenger) doSend() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in PeerMessenger.doSend() : %s\n", r)
+			Errorf("panic in PeerMessenger.doSend() : %s", r)
 		}
 
 		// This will close the Send and Receive channel
@@ -238,25 +261,25 @@ func (p *PeerMessenger) doSend() {
 		msg, ok := <-p.sendch
 		if !ok {
 			// channel close.  Terminate the loop.
-			log.Printf("PeerMessenger.doSend() : Send channel closed.  Terminate.")
+			Infof("PeerMessenger.doSend() : Send channel closed.  Terminate.")
 			break
 		}
 
-		log.Printf("PeerMessenger.doSend() : Preparing message %s to Peer %s", msg.Content.Name(), msg.Peer.String())
+		Debugf("PeerMessenger.doSend() : Preparing message %s to Peer %s", msg.Content.Name(), msg.Peer.String())
 		msg.Content.Print()
 
 		serialized, err := Marshall(msg.Content)
 		if err != nil {
-			log.Printf("PeerMessenger.doSend() : Fail to marshall message to Peer %s", msg.Peer.String())
+			Warnf("PeerMessenger.doSend() : Fail to marshall message to Peer %s", msg.Peer.String())
 			continue
 		}
 		size := len(serialized)
 
 		// write the packet
-		log.Printf("PeerMessenger.doSend() : Sending message %s (len %d) to Peer %s", msg.Content.Name(), size, msg.Peer.String())
+		Debugf("PeerMessenger.doSend() : Sending message %s (len %d) to Peer %s", msg.Content.Name(), size, msg.Peer.String())
 		n, err := p.conn.WriteTo(serialized, msg.Peer)
 		if n < size || err != nil {
-			log.Printf("PeerMessenger.doSend() : ecounter error when sending mesasage to Peer %s.  Error = %s",
+			Warnf("PeerMessenger.doSend() : ecounter error when sending mesasage to Peer %s.  Error = %s",
 				msg.Peer.String(), err.Error())
 		}
 	}
@@ -269,7 +292,7 @@ func (p *PeerMessenger) doSend() {
 func (p *PeerMessenger) doReceive() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in PeerMessenger.doReceive() : %s\n", r)
+			Errorf("panic in PeerMessenger.doReceive() : %s", r)
 		}
 
 		// This will close the Send and Receive channel
@@ -282,21 +305,21 @@ func (p *PeerMessenger) doReceive() {
 		buf := make([]byte, MAX_DATAGRAM_SIZE)
 		n, peer, err := p.conn.ReadFrom(buf)
 		if err != nil {
-			log.Printf("PeerMessenger.doRecieve() : ecounter error when received mesasage from Peer.  Error = %s. Terminate.",
+			Warnf("PeerMessenger.doRecieve() : ecounter error when received mesasage from Peer.  Error = %s. Terminate.",
 				err.Error())
 			return
 		}
-		log.Printf("PeerMessenger.doRecieve() : Receiving message from Peer %s, bytes read %d", peer.String(), n)
+		Debugf("PeerMessenger.doRecieve() : Receiving message from Peer %s, bytes read %d", peer.String(), n)
 
 		// unmarshall the content and put it in the channel
 		// skip the first 8 bytes (total len)
 		packet, err := UnMarshall(buf[8:n])
 		if err != nil {
-			log.Printf("PeerMessenger.doRecieve() : ecounter error when unmarshalling mesasage from Peer.  Error = %s. Terminate.",
+			Warnf("PeerMessenger.doRecieve() : ecounter error when unmarshalling mesasage from Peer.  Error = %s. Terminate.",
 				err.Error())
 			break
 		}
-		log.Printf("PeerMessenger.doRecieve() : Message decoded.  Packet = %s", packet.Name())
+		Debugf("PeerMessenger.doRecieve() : Message decoded.  Packet = %s", packet.Name())
 		packet.Print()
 
 		// This can block if the reciever of the channel is slow or terminated premauturely (which cause channel to filled up).
@@ -17,7 +17,7 @@ package common
 
 import (
 	"encoding/binary"
-	"log"
+	"io"
 	"net"
 	"runtime/debug"
 	"sync"
@@ -61,6 +61,21 @@ func NewPeerPipe(pconn net.Conn) *PeerPipe {
 	return pipe
 }
 
+//
+// Check that the peer at the other end of the pipe is the given node
+// (host:port).  With TLS, the certificate of the peer must be valid for
+// the host.  A pipe without TLS is not checked, since the connection may
+// not come from the address of the node (e.g. NAT).
+//
+func (p *PeerPipe) VerifyPeerAddr(peer string) error {
+
+	tlsConn, ok := getTLSConn(p.conn)
+	if !ok {
+		return nil
+	}
+	return verifyPeerCertificate(tlsConn, peer)
+}
+
 //
 // Get the net address of the remote peer.
 //
@@ -91,10 +106,10 @@ func (p *PeerPipe) Close() bool {
 
 	if !p.isClosed {
 
-		log.Printf("PeerPipe.Close(): Remote Address %s", p.GetAddr())
+		Infof("PeerPipe.Close(): Remote Address %s", p.GetAddr())
 		if Debug() {
-			log.Printf("PeerPipe.Close() : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			Tracef("PeerPipe.Close() : Diagnostic Stack ...")
+			Tracef("%s", debug.Stack())
 		}
 
 		p.isClosed = true
@@ -143,8 +158,8 @@ func (p *PeerPipe) Send(packet Packet) bool {
 func (p *PeerPipe) doSend() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in PeerPipe.doSend() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			Errorf("panic in PeerPipe.doSend() : %s", r)
+			Errorf("%s", debug.Stack())
 		}
 
 		// This will close the Send and Receive channel
@@ -155,27 +170,27 @@ func (p *PeerPipe) doSend() {
 		packet, ok := <-p.sendch
 		if !ok {
 			// channel close.  Terminate the loop.
-			log.Printf("PeerPipe.doSend() : Send channel closed.  Terminate.")
+			Infof("PeerPipe.doSend() : Send channel closed.  Terminate.")
 			return
 		}
 
-		log.Printf("PeerPipe.doSend() : Prepare to send message %s to Peer %s", packet.Name(), p.GetAddr())
+		Debugf("PeerPipe.doSend() : Prepare to send message %s to Peer %s", packet.Name(), p.GetAddr())
 		packet.Print()
 
 		msg, err := Marshall(packet)
 		if err != nil {
-			log.Printf("PeerPipe.doSend() : Fail to marshall message %s to Peer %s. Terminate.", packet.Name(), p.GetAddr())
+			Warnf("PeerPipe.doSend() : Fail to marshall message %s to Peer %s. Terminate.", packet.Name(), p.GetAddr())
 			return
 		}
 		size := len(msg)
 
 		// write the packet
-		log.Printf("PeerPipe.doSend() : Sending message %s (len %d) to Peer %s", packet.Name(), size, p.GetAddr())
+		Debugf("PeerPipe.doSend() : Sending message %s (len %d) to Peer %s", packet.Name(), size, p.GetAddr())
 		n, err := p.conn.Write(msg)
 		if n < size || err != nil {
 			// Network error. Close the loop.  The pipe will
 			// close and cause subsequent Send() to fail.
-			log.Printf("PeerPipe.doSend() : ecounter error when sending mesasage to Peer %s.  Error = %s.  Terminate.",
+			Warnf("PeerPipe.doSend() : ecounter error when sending mesasage to Peer %s.  Error = %s.  Terminate.",
 				p.GetAddr(), err.Error())
 			return
 		}
@@ -189,8 +204,8 @@ func (p *PeerPipe) doSend() {
 func (p *PeerPipe) doReceive() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in PeerPipe.doReceive() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			Errorf("panic in PeerPipe.doReceive() : %s", r)
+			Errorf("%s", debug.Stack())
 		}
 
 		// This will close the Send and Receive channel
@@ -200,11 +215,11 @@ func (p *PeerPipe) doReceive() {
 	for {
 		// read the size of the packet (uint64)
 		var lenBuf []byte = make([]byte, 8)
-		n, err := p.conn.Read(lenBuf)
-		log.Printf("PeerPipe.doRecieve() : Receiving message from Peer %s, bytes read %d", p.GetAddr(), n)
+		n, err := io.ReadFull(p.conn, lenBuf)
+		Debugf("PeerPipe.doRecieve() : Receiving message from Peer %s, bytes read %d", p.GetAddr(), n)
 		if n < 8 || err != nil {
 			// if encountering an error, kill the pipe.
-			log.Printf("PeerPipe.doRecieve() : ecounter error when received mesasage from Peer.  Error = %s. Kill Pipe.",
+			Infof("PeerPipe.doRecieve() : ecounter error when received mesasage from Peer.  Error = %s. Kill Pipe.",
 				err.Error())
 			return
 		}
@@ -212,23 +227,23 @@ func (p *PeerPipe) doReceive() {
 		// read the content
 		size := binary.BigEndian.Uint64(lenBuf)
 		buf := make([]byte, size)
-		n, err = p.conn.Read(buf)
+		n, err = io.ReadFull(p.conn, buf)
 		if uint64(n) < size || err != nil {
 			// if encountering an error, kill the pipe.
-			log.Printf("PeerPipe.doRecieve() : ecounter error when received mesasage from Peer.  Error = %s. Kill Pipe.",
+			Infof("PeerPipe.doRecieve() : ecounter error when received mesasage from Peer.  Error = %s. Kill Pipe.",
 				err.Error())
 			return
 		}
-		log.Printf("PeerPipe.doRecieve() : Receiving message from Peer %s, bytes read %d", p.GetAddr(), n)
+		Debugf("PeerPipe.doRecieve() : Receiving message from Peer %s, bytes read %d", p.GetAddr(), n)
 
 		// unmarshall the content and put it in the channel
 		packet, err := UnMarshall(buf)
 		if err != nil {
-			log.Printf("PeerPipe.doRecieve() : ecounter error when unmarshalling mesasage from Peer.  Error = %s. Terminate.",
+			Warnf("PeerPipe.doRecieve() : ecounter error when unmarshalling mesasage from Peer.  Error = %s. Terminate.",
 				err.Error())
 			return
 		}
-		log.Printf("PeerPipe.doRecieve() : Message decoded.  Packet = %s", packet.Name())
+		Debugf("PeerPipe.doRecieve() : Message decoded.  Packet = %s", packet.Name())
 		packet.Print()
 
 		// This can block if the reciever of the channel is slow or terminated premauturely (which cause channel to fill up).
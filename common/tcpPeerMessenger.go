@@ -0,0 +1,608 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////
+
+//
+// TCPPeerMessenger sends packets between peers over
+// reliable TCP connections.  It has the same semantics
+// as PeerMessenger, but the packets are sent through a
+// PeerPipe for each peer.  The connection to a peer is
+// established on the first packet sent to the peer, or
+// when the peer connects to this messenger.  In either
+// case, the connection can be used in both directions.
+//
+// When a connection is established, the connecting peer
+// sends its local (listening) address using the same
+// framing as PeerPipe (8 bytes length + content).  This
+// allows the receiving peer to identify the sender by
+// its listening address, rather than the ephemeral port
+// of the connection.  The address must match the host
+// of the connection (or its certificate with TLS), such
+// that a host cannot claim the address of another peer.
+//
+type TCPPeerMessenger struct {
+	laddr     string
+	transport Transport
+	listener  ConnListener
+	receivech chan *Message
+	splitter  map[string]chan *Message
+	senders   map[string]*peerSender // key : peer addr
+	mutex     sync.Mutex
+	isClosed  bool
+}
+
+//
+// peerSender sends packets to a single peer.  Each peer
+// has its own goroutine such that connecting to a slow or
+// dead peer will not block sending to the other peers.
+//
+type peerSender struct {
+	peer      string
+	messenger *TCPPeerMessenger
+	sendch    chan Packet
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	pipe     *PeerPipe
+	isClosed bool
+}
+
+/////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////
+
+//
+// Create a new TCPPeerMessenger.  See NewPeerMessenger() for
+// the use of the splitter.
+//
+func NewTCPPeerMessenger(laddr string, splitter map[string]chan *Message) (*TCPPeerMessenger, error) {
+
+	return NewTCPPeerMessengerWithTransport(laddr, splitter, NewNetTransport())
+}
+
+//
+// Create a new TCPPeerMessenger using the stream connections of
+// the given transport.
+//
+func NewTCPPeerMessengerWithTransport(laddr string, splitter map[string]chan *Message,
+	transport Transport) (*TCPPeerMessenger, error) {
+
+	addrObj, err := net.ResolveTCPAddr(MESSAGE_TRANSPORT_TYPE, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := transport.Listen(addrObj.String())
+	if err != nil {
+		return nil, err
+	}
+
+	messenger := &TCPPeerMessenger{laddr: addrObj.String(),
+		transport: transport,
+		listener:  listener,
+		receivech: make(chan *Message, MAX_PROPOSALS*2),
+		splitter:  splitter,
+		senders:   make(map[string]*peerSender),
+		isClosed:  false}
+
+	go messenger.listen()
+	return messenger, nil
+}
+
+//
+// Return the default receive channel.
+//
+func (p *TCPPeerMessenger) DefaultReceiveChannel() <-chan *Message {
+	return (<-chan *Message)(p.receivech)
+}
+
+//
+// Get the receiving channel for the specific message name. If there is
+// no match, the return the default receiving channel.
+//
+func (p *TCPPeerMessenger) ReceiveChannel(msgName string) <-chan *Message {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ch, ok := p.splitter[msgName]
+	if ok {
+		return (<-chan *Message)(ch)
+	}
+	return (<-chan *Message)(p.receivech)
+}
+
+//
+// Get the local net address.
+//
+func (p *TCPPeerMessenger) GetLocalAddr() string {
+	return p.laddr
+}
+
+//
+// Close the TCPPeerMessenger.  It is safe to call this
+// method multiple times without causing panic.
+//
+func (p *TCPPeerMessenger) Close() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.isClosed {
+
+		Infof("TCPPeerMessenger.Close() : Local Addr %s", p.laddr)
+		if Debug() {
+			Tracef("TCPPeerMessenger.Close() : Diagnostic Stack ...")
+			Tracef("%s", debug.Stack())
+		}
+
+		p.isClosed = true
+
+		SafeRun("TCPPeerMessenger.Close()",
+			func() {
+				p.listener.Close()
+			})
+
+		for _, sender := range p.senders {
+			sender.close()
+		}
+
+		SafeRun("TCPPeerMessenger.Close()",
+			func() {
+				close(p.receivech)
+			})
+
+		if p.splitter != nil {
+			for _, ch := range p.splitter {
+				SafeRun("TCPPeerMessenger.Close()",
+					func() {
+						close(ch)
+					})
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+//
+// Send a packet to the peer. This method will return
+// false if the messenger is already closed.
+//
+func (p *TCPPeerMessenger) Send(packet Packet, peer net.Addr) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.isClosed {
+		p.getSender(peer.String()).send(packet)
+		return true
+	}
+	return false
+}
+
+//
+// Send a packet to the peer. This method will return
+// false if the messenger is already closed or there is
+// error in resolving the peer addr.
+//
+func (p *TCPPeerMessenger) SendByName(packet Packet, peer string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.isClosed {
+		addr, err := net.ResolveTCPAddr(MESSAGE_TRANSPORT_TYPE, peer)
+		if err == nil {
+			p.getSender(addr.String()).send(packet)
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Send a packet to the all the peers. This method will return
+// false if the messenger is already closed.
+//
+func (p *TCPPeerMessenger) Multicast(packet Packet, peers []net.Addr) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.isClosed {
+		for i := range peers {
+			p.getSender(peers[i].String()).send(packet)
+		}
+		return true
+	}
+	return false
+}
+
+/////////////////////////////////////////////////
+// Private Function : TCPPeerMessenger
+/////////////////////////////////////////////////
+
+//
+// Get the sender for the peer.  Create a new one if
+// there is none.  The caller must hold the mutex.
+//
+func (p *TCPPeerMessenger) getSender(peer string) *peerSender {
+
+	sender, ok := p.senders[peer]
+	if !ok {
+		sender = &peerSender{peer: peer,
+			messenger: p,
+			sendch:    make(chan Packet, MAX_PROPOSALS)}
+		p.senders[peer] = sender
+
+		go sender.run()
+	}
+
+	return sender
+}
+
+//
+// Goroutine.  Accept new connection from the peers.
+//
+func (p *TCPPeerMessenger) listen() {
+	defer func() {
+		if r := recover(); r != nil {
+			Errorf("panic in TCPPeerMessenger.listen() : %s", r)
+		}
+
+		// This will close the Send and Receive channel
+		p.Close()
+	}()
+
+	connch := p.listener.ConnChannel()
+	if connch == nil {
+		return
+	}
+
+	for {
+		conn, ok := <-connch
+		if !ok {
+			// channel close.  Terminate the loop.
+			Infof("TCPPeerMessenger.listen() : Listener closed.  Terminate.")
+			return
+		}
+
+		go p.accept(conn)
+	}
+}
+
+//
+// Read the listening address of the connecting peer,
+// and then start receiving packets from the peer.
+//
+func (p *TCPPeerMessenger) accept(conn net.Conn) {
+
+	conn.SetReadDeadline(time.Now().Add(ELECTION_DIAL_TIMEOUT * time.Millisecond))
+	peer, err := readPeerAddr(conn)
+	if err != nil {
+		Warnf("TCPPeerMessenger.accept() : Fail to identify peer %s.  Error = %s.  Close connection.",
+			conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if err := verifyPeerAddr(conn, peer); err != nil {
+		Warnf("TCPPeerMessenger.accept() : Reject connection from %s.  Error = %s.  Close connection.",
+			conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+
+	Infof("TCPPeerMessenger.accept() : Accept connection from peer %s", peer)
+
+	pipe := NewPeerPipe(conn)
+
+	p.mutex.Lock()
+	if p.isClosed {
+		p.mutex.Unlock()
+		pipe.Close()
+		return
+	}
+	// Use this connection to send to the peer as well, unless
+	// there is already a connection to this peer.
+	p.getSender(peer).setPipe(pipe, false)
+	p.mutex.Unlock()
+
+	p.receive(peer, pipe)
+}
+
+//
+// Receive packets from the pipe and forward each packet
+// to the receive channel.  This returns when the pipe
+// is closed.
+//
+func (p *TCPPeerMessenger) receive(peer string, pipe *PeerPipe) {
+	defer func() {
+		if r := recover(); r != nil {
+			Errorf("panic in TCPPeerMessenger.receive() : %s", r)
+		}
+
+		pipe.Close()
+	}()
+
+	addr, err := net.ResolveTCPAddr(MESSAGE_TRANSPORT_TYPE, peer)
+	if err != nil {
+		Warnf("TCPPeerMessenger.receive() : Fail to resolve peer %s.  Error = %s.", peer, err.Error())
+		return
+	}
+
+	for {
+		packet, ok := <-pipe.ReceiveChannel()
+		if !ok {
+			Infof("TCPPeerMessenger.receive() : Connection to peer %s closed.", peer)
+			return
+		}
+
+		p.queue(&Message{Content: packet, Peer: addr})
+	}
+}
+
+//
+// Queue the packet to the recieve channel if
+// the channel has not been closed.
+//
+func (p *TCPPeerMessenger) queue(message *Message) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.isClosed {
+		ch := p.receivech
+		name := message.Content.Name()
+		if p.splitter != nil && p.splitter[name] != nil {
+			ch = p.splitter[name]
+		}
+
+		ch <- message
+	}
+}
+
+/////////////////////////////////////////////////
+// Private Function : peerSender
+/////////////////////////////////////////////////
+
+//
+// Queue a packet for sending.  If the queue is full (e.g. the
+// peer is not reachable), the packet is dropped.  Leader election
+// will resend its vote on timeout.
+//
+func (s *peerSender) send(packet Packet) {
+
+	select {
+	case s.sendch <- packet:
+	default:
+		Warnf("peerSender.send() : Send queue for peer %s is full.  Drop packet %s.", s.peer, packet.Name())
+	}
+}
+
+//
+// Goroutine.  Send the packets to the peer.  Connect
+// to the peer if there is no connection.
+//
+func (s *peerSender) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			Errorf("panic in peerSender.run() : %s", r)
+		}
+	}()
+
+	for {
+		packet, ok := <-s.sendch
+		if !ok {
+			// channel close.  Terminate the loop.
+			return
+		}
+
+		pipe := s.getPipe()
+		if pipe == nil || !pipe.Send(packet) {
+			// The connection may have closed.  Reconnect and try once more.
+			s.clearPipe(pipe)
+			if pipe = s.getPipe(); pipe == nil || !pipe.Send(packet) {
+				Debugf("peerSender.run() : Fail to send packet %s to peer %s.  Drop packet.", packet.Name(), s.peer)
+			}
+		}
+	}
+}
+
+//
+// Get the pipe to the peer.  Connect to the peer
+// if there is no pipe.
+//
+func (s *peerSender) getPipe() *PeerPipe {
+
+	s.mutex.Lock()
+	pipe := s.pipe
+	s.mutex.Unlock()
+
+	if pipe != nil {
+		return pipe
+	}
+
+	conn, err := s.messenger.transport.DialTimeout(s.peer, ELECTION_DIAL_TIMEOUT*time.Millisecond)
+	if err != nil {
+		Debugf("peerSender.getPipe() : Fail to connect to peer %s.  Error = %s", s.peer, err.Error())
+		return nil
+	}
+
+	if err := writePeerAddr(conn, s.messenger.laddr); err != nil {
+		Warnf("peerSender.getPipe() : Fail to identify to peer %s.  Error = %s", s.peer, err.Error())
+		conn.Close()
+		return nil
+	}
+
+	pipe = NewPeerPipe(conn)
+	if !s.setPipe(pipe, true) {
+		pipe.Close()
+		return nil
+	}
+
+	go s.messenger.receive(s.peer, pipe)
+
+	return pipe
+}
+
+//
+// Set the pipe for sending packets to the peer.  If replace is false,
+// only set the pipe if there is none.  Return false if the sender
+// is closed.
+//
+func (s *peerSender) setPipe(pipe *PeerPipe, replace bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.isClosed {
+		return false
+	}
+
+	if s.pipe == nil || replace {
+		s.pipe = pipe
+	}
+	return true
+}
+
+//
+// Forget the pipe if it is the current one.
+//
+func (s *peerSender) clearPipe(pipe *PeerPipe) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pipe == pipe {
+		s.pipe = nil
+	}
+}
+
+//
+// Close the sender and its connection.
+//
+func (s *peerSender) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.isClosed {
+		return
+	}
+	s.isClosed = true
+
+	SafeRun("peerSender.close()",
+		func() {
+			close(s.sendch)
+		})
+
+	if s.pipe != nil {
+		s.pipe.Close()
+	}
+	s.pipe = nil
+}
+
+/////////////////////////////////////////////////
+// Private Function : Handshake
+/////////////////////////////////////////////////
+
+//
+// Send the local address to the peer using the
+// PeerPipe framing (8 bytes length + content).
+//
+func writePeerAddr(conn net.Conn, laddr string) error {
+
+	buf := make([]byte, 8+len(laddr))
+	binary.BigEndian.PutUint64(buf[:8], uint64(len(laddr)))
+	copy(buf[8:], laddr)
+
+	conn.SetWriteDeadline(time.Now().Add(ELECTION_DIAL_TIMEOUT * time.Millisecond))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	_, err := conn.Write(buf)
+	return err
+}
+
+//
+// Read the address of the peer (see writePeerAddr()).
+//
+func readPeerAddr(conn net.Conn) (string, error) {
+
+	lenBuf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return "", err
+	}
+
+	size := binary.BigEndian.Uint64(lenBuf)
+	if size > uint64(MAX_DATAGRAM_SIZE) {
+		return "", NewError(PROTOCOL_ERROR, "Peer address is too long")
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+//
+// Check that the connection comes from the address sent by
+// the peer.  With TLS, the certificate of the peer must be
+// valid for the host of the address.  Otherwise, the host
+// must resolve to the remote IP of the connection.  The
+// connections of an in-memory network do not have an IP,
+// so they are not checked.
+//
+func verifyPeerAddr(conn net.Conn, peer string) error {
+
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return err
+	}
+
+	if tlsConn, ok := getTLSConn(conn); ok {
+		return verifyPeerCertificate(tlsConn, peer)
+	}
+
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+
+	if len(host) != 0 {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			if ip.Equal(remote.IP) {
+				return nil
+			}
+		}
+	}
+
+	return NewError(SERVER_ERROR, "Peer address "+peer+" does not match the remote address "+remote.String())
+}
@@ -0,0 +1,316 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////
+
+//
+// TLSTransport encrypts the stream connections of another transport
+// with TLS.  Both ends of a connection present a certificate signed by
+// the CA of the ensemble (mutual authentication).  In addition, a peer
+// that connects to this node is only accepted if its certificate is
+// valid for one of the hosts of the ensemble.
+//
+// The datagrams (election over UDP) are not encrypted.
+//
+type TLSTransport struct {
+	transport Transport
+	config    *tls.Config
+	hosts     []string
+}
+
+//
+// tlsListener runs the TLS handshake on the connections accepted by
+// another listener, and only hands out the connections of the peers
+// that are authenticated.
+//
+type tlsListener struct {
+	listener  ConnListener
+	transport *TLSTransport
+	connch    chan net.Conn
+	mutex     sync.Mutex
+	isClosed  bool
+}
+
+/////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////
+
+//
+// Create the TLS configuration of a node from PEM files.  The
+// certificate of the node is presented to the peers, and the
+// certificates of the peers must be signed by the CA.
+//
+func NewTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, WrapError(SERVER_CONFIG_ERROR, "Fail to load certificate "+certFile+".", err)
+	}
+
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, WrapError(SERVER_CONFIG_ERROR, "Fail to read CA certificate "+caFile+".", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, NewError(SERVER_CONFIG_ERROR, "No CA certificate found in "+caFile)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert},
+		RootCAs:    pool,
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12}
+
+	return config, nil
+}
+
+//
+// Create a TLS transport on top of the given transport.  The hosts
+// are the hosts (name or IP address) of the members of the ensemble.
+//
+func NewTLSTransport(transport Transport, config *tls.Config, hosts []string) *TLSTransport {
+
+	return &TLSTransport{transport: transport,
+		config: config,
+		hosts:  hosts}
+}
+
+//
+// Open a connection to the peer, and authenticate the peer.  The
+// certificate of the peer must be valid for the host of addr.
+//
+func (t *TLSTransport) Dial(addr string) (net.Conn, error) {
+
+	conn, err := t.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.client(conn, addr)
+}
+
+func (t *TLSTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+
+	conn, err := t.transport.DialTimeout(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return t.client(conn, addr)
+}
+
+func (t *TLSTransport) Listen(laddr string) (ConnListener, error) {
+
+	listener, err := t.transport.Listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	li := &tlsListener{listener: listener,
+		transport: t,
+		connch:    make(chan net.Conn, MAX_PEERS)}
+
+	go li.listen()
+	return li, nil
+}
+
+func (t *TLSTransport) ListenPacket(laddr string) (net.PacketConn, error) {
+	return t.transport.ListenPacket(laddr)
+}
+
+//
+// Check that the certificate of the peer is valid for one of the
+// hosts of the ensemble.  The certificate chain has already been
+// verified against the CA during the handshake.
+//
+func (t *TLSTransport) VerifyPeer(state tls.ConnectionState) error {
+
+	if len(state.PeerCertificates) == 0 {
+		return NewError(SERVER_ERROR, "Peer does not present a certificate")
+	}
+
+	cert := state.PeerCertificates[0]
+	for _, host := range t.hosts {
+		if cert.VerifyHostname(host) == nil {
+			return nil
+		}
+	}
+
+	return NewError(SERVER_ERROR, "Certificate of peer ("+cert.Subject.CommonName+") is not valid for any member of the ensemble")
+}
+
+/////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////
+
+//
+// Run the client side of the handshake.
+//
+func (t *TLSTransport) client(conn net.Conn, addr string) (net.Conn, error) {
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	config := t.config.Clone()
+	config.ServerName = host
+
+	tlsConn := tls.Client(conn, config)
+	if err := handshake(tlsConn); err != nil {
+		tlsConn.Close()
+		return nil, WrapError(SERVER_ERROR, "TLS handshake with peer "+addr+" fails.", err)
+	}
+
+	return tlsConn, nil
+}
+
+//
+// Check that the certificate of the peer is valid for the host of the
+// given address.
+//
+func verifyPeerCertificate(conn *tls.Conn, peer string) error {
+
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return err
+	}
+
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return NewError(SERVER_ERROR, "Peer "+peer+" does not present a certificate")
+	}
+	if err := state.PeerCertificates[0].VerifyHostname(host); err != nil {
+		return WrapError(SERVER_ERROR, "Certificate of peer is not valid for "+peer+".", err)
+	}
+	return nil
+}
+
+//
+// Get the TLS connection under the given connection, if any.  The
+// messages may be authenticated (AuthTransport) on top of TLS.
+//
+func getTLSConn(conn net.Conn) (*tls.Conn, bool) {
+
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return c, true
+	case *authConn:
+		return getTLSConn(c.Conn)
+	}
+	return nil, false
+}
+
+func handshake(conn *tls.Conn) error {
+
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT * time.Millisecond))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+/////////////////////////////////////////////////
+// tlsListener
+/////////////////////////////////////////////////
+
+func (l *tlsListener) ConnChannel() <-chan net.Conn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.isClosed {
+		return (<-chan net.Conn)(l.connch)
+	}
+	return nil
+}
+
+func (l *tlsListener) Close() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.isClosed {
+		l.isClosed = true
+		close(l.connch)
+		l.listener.Close()
+		return true
+	}
+
+	return false
+}
+
+//
+// Goroutine.  Run the handshake on each new connection.  The handshake
+// runs in its own goroutine, such that a slow peer does not hold back
+// the other peers.
+//
+func (l *tlsListener) listen() {
+	defer l.Close()
+
+	connch := l.listener.ConnChannel()
+	if connch == nil {
+		return
+	}
+
+	for conn := range connch {
+		go l.accept(conn)
+	}
+}
+
+func (l *tlsListener) accept(conn net.Conn) {
+
+	tlsConn := tls.Server(conn, l.transport.config)
+	if err := handshake(tlsConn); err != nil {
+		Warnf("TLSTransport.accept() : TLS handshake with %s fails.  Error = %s.", conn.RemoteAddr(), err.Error())
+		tlsConn.Close()
+		return
+	}
+
+	if err := l.transport.VerifyPeer(tlsConn.ConnectionState()); err != nil {
+		Warnf("TLSTransport.accept() : Reject connection from %s.  Error = %s.", conn.RemoteAddr(), err.Error())
+		tlsConn.Close()
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isClosed {
+		tlsConn.Close()
+		return
+	}
+
+	// Do not block while holding the mutex, or Close() would wait for
+	// the consumer of the connections.
+	select {
+	case l.connch <- tlsConn:
+	default:
+		Warnf("TLSTransport.accept() : Too many pending connections.  Close connection from %s.", conn.RemoteAddr())
+		tlsConn.Close()
+	}
+}
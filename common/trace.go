@@ -0,0 +1,320 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// The stages of a client request.  Each node records the stages that it
+// runs, so the spans of a request are spread over the node of the client,
+// the leader and the followers.
+//
+const (
+	SPAN_REQUEST      = "request"      // from the client request to the reply (node of the client)
+	SPAN_INCOMING     = "incoming"     // waiting for the request processor of the node of the client
+	SPAN_NOTIFICATION = "notification" // waiting in the notifications of the leader (request or accept)
+	SPAN_LOG          = "log"          // logging the proposal (leader and followers)
+	SPAN_ACCEPT       = "accept"       // waiting for a quorum of accepts (leader)
+	SPAN_COMMIT       = "commit"       // committing the proposal to the repository (leader and followers)
+)
+
+//
+// A span is a stage of a client request on a node.
+//
+type Span struct {
+	TraceId  uint64
+	Name     string
+	Node     string // node that runs the stage
+	Peer     string // follower that sends the accept (notification of an accept)
+	Txnid    Txnid  // 0 until the leader creates the proposal
+	Key      string
+	Start    time.Time
+	Duration time.Duration
+}
+
+//
+// The spans of a client request known by a node, sorted by start time.
+// The duration is from the start of the first span to the end of the
+// last one.
+//
+type Trace struct {
+	TraceId  uint64
+	Duration time.Duration
+	Spans    []*Span
+}
+
+//
+// SpanExporter receives the spans of a server.  An exporter must be safe
+// for concurrent use, and it must not block.
+//
+type SpanExporter interface {
+	Export(span *Span)
+}
+
+//
+// NodeTracer records the spans of a server to the exporter of the server.
+// A nil NodeTracer, or one without exporter, uses the exporter of the
+// process (see SetSpanExporter).
+//
+type NodeTracer struct {
+	exporter SpanExporter
+	clock    Clock // nil for the clock of the process
+}
+
+//
+// RingExporter keeps the most recent spans in memory.
+//
+type RingExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+	next  int
+	full  bool
+}
+
+var gExporter SpanExporter = NewRingExporter(TRACE_BUFFER_SIZE)
+var gExporterMutex sync.RWMutex
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Replace the span exporter of the process.  The exporter applies to the
+// servers that do not have their own exporter.  Setting a nil exporter
+// disables tracing for these servers.  By default, the spans are kept in a
+// RingExporter of TRACE_BUFFER_SIZE spans.
+//
+func SetSpanExporter(exporter SpanExporter) {
+	gExporterMutex.Lock()
+	defer gExporterMutex.Unlock()
+
+	gExporter = exporter
+}
+
+func GetSpanExporter() SpanExporter {
+	gExporterMutex.RLock()
+	defer gExporterMutex.RUnlock()
+
+	return gExporter
+}
+
+//
+// Return the trace id of a new client request.  Return 0 (not traced)
+// if tracing is disabled.
+//
+func NewTraceId() uint64 {
+	return (*NodeTracer)(nil).NewTraceId()
+}
+
+//
+// Record a stage of a client request, from the start time to now.  This
+// is a no-op if the request is not traced, or if tracing is disabled.
+//
+func RecordSpan(traceId uint64, name string, node string, txnid Txnid, key string, start time.Time) {
+	(*NodeTracer)(nil).RecordSpan(traceId, name, node, txnid, key, start)
+}
+
+func RecordPeerSpan(traceId uint64, name string, node string, peer string, txnid Txnid, key string, start time.Time) {
+	(*NodeTracer)(nil).RecordPeerSpan(traceId, name, node, peer, txnid, key, start)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Node Tracer
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a tracer for a server.  If the exporter is nil, the spans go to
+// the exporter of the process.
+//
+func NewNodeTracer(exporter SpanExporter) *NodeTracer {
+	return &NodeTracer{exporter: exporter}
+}
+
+//
+// Create a tracer for a server that measures the spans with the clock.
+// If the clock is nil, the tracer uses the clock of the process.
+//
+func NewNodeTracerWithClock(clock Clock, exporter SpanExporter) *NodeTracer {
+	return &NodeTracer{exporter: exporter, clock: clock}
+}
+
+func (t *NodeTracer) getClock() Clock {
+	if t == nil || t.clock == nil {
+		return GetClock()
+	}
+	return t.clock
+}
+
+func (t *NodeTracer) GetSpanExporter() SpanExporter {
+	if t == nil || t.exporter == nil {
+		return GetSpanExporter()
+	}
+	return t.exporter
+}
+
+func (t *NodeTracer) NewTraceId() uint64 {
+
+	if t.GetSpanExporter() == nil {
+		return 0
+	}
+
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0
+		}
+		if id := binary.BigEndian.Uint64(buf[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+func (t *NodeTracer) RecordSpan(traceId uint64, name string, node string, txnid Txnid, key string, start time.Time) {
+	t.RecordPeerSpan(traceId, name, node, "", txnid, key, start)
+}
+
+func (t *NodeTracer) RecordPeerSpan(traceId uint64, name string, node string, peer string, txnid Txnid, key string, start time.Time) {
+
+	if traceId == 0 {
+		return
+	}
+
+	exporter := t.GetSpanExporter()
+	if exporter == nil {
+		return
+	}
+
+	exporter.Export(&Span{TraceId: traceId,
+		Name:     name,
+		Node:     node,
+		Peer:     peer,
+		Txnid:    txnid,
+		Key:      key,
+		Start:    start,
+		Duration: t.getClock().Now().Sub(start)})
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Ring Exporter
+/////////////////////////////////////////////////////////////////////////////
+
+func NewRingExporter(size int) *RingExporter {
+	return &RingExporter{spans: make([]*Span, size)}
+}
+
+func (r *RingExporter) Export(span *Span) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.spans) == 0 {
+		return
+	}
+
+	r.spans[r.next] = span
+	r.next = (r.next + 1) % len(r.spans)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+//
+// Return the spans in the buffer, oldest first.
+//
+func (r *RingExporter) GetSpans() []*Span {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.full {
+		return append([]*Span(nil), r.spans[:r.next]...)
+	}
+	return append(append([]*Span(nil), r.spans[r.next:]...), r.spans[:r.next]...)
+}
+
+//
+// Return the traces in the buffer that take at least the threshold, most
+// recent first.  At most limit traces are returned (no limit if 0).
+//
+func (r *RingExporter) GetSlowTraces(threshold time.Duration, limit int) []*Trace {
+	return r.GetNodeSlowTraces("", threshold, limit)
+}
+
+//
+// Same as GetSlowTraces, but only with the spans recorded by the given
+// node.  This is for the servers sharing the same exporter.  All the
+// spans are used if the node is empty.
+//
+func (r *RingExporter) GetNodeSlowTraces(node string, threshold time.Duration, limit int) []*Trace {
+
+	traces := make(map[uint64]*Trace)
+	var order []*Trace // most recent first
+
+	spans := r.GetSpans()
+	for i := len(spans) - 1; i >= 0; i-- {
+		span := spans[i]
+		if len(node) != 0 && span.Node != node {
+			continue
+		}
+		trace, ok := traces[span.TraceId]
+		if !ok {
+			trace = &Trace{TraceId: span.TraceId}
+			traces[span.TraceId] = trace
+			order = append(order, trace)
+		}
+		trace.Spans = append(trace.Spans, span)
+	}
+
+	var result []*Trace
+	for _, trace := range order {
+		sort.Sort(spansByStart(trace.Spans))
+
+		start := trace.Spans[0].Start
+		end := start
+		for _, span := range trace.Spans {
+			if spanEnd := span.Start.Add(span.Duration); spanEnd.After(end) {
+				end = spanEnd
+			}
+		}
+		trace.Duration = end.Sub(start)
+
+		if trace.Duration >= threshold {
+			result = append(result, trace)
+			if limit > 0 && len(result) == limit {
+				break
+			}
+		}
+	}
+	return result
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+type spansByStart []*Span
+
+func (s spansByStart) Len() int           { return len(s) }
+func (s spansByStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
+func (s spansByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,114 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net"
+	"time"
+)
+
+/////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////
+
+//
+// Pipe is a stream messaging channel between two peers (leader and
+// follower, or leader and watcher).  PeerPipe implements Pipe over
+// any net.Conn.
+//
+type Pipe interface {
+	GetAddr() string
+	ReceiveChannel() <-chan Packet
+	Send(packet Packet) bool
+	Close() bool
+}
+
+//
+// A Pipe can implement PeerVerifier to check that the peer at the other
+// end is the node it claims to be (host:port).
+//
+type PeerVerifier interface {
+	VerifyPeerAddr(peer string) error
+}
+
+//
+// Dialer opens a stream connection to a peer.
+//
+type Dialer interface {
+	Dial(addr string) (net.Conn, error)
+}
+
+//
+// Transport provides the network used by the peers:
+// 1) stream connections (Dial, Listen) for the messages between
+//    the leader and the followers, as well as election over TCP.
+// 2) datagram connections (ListenPacket) for election over UDP.
+//
+// NetTransport uses TCP and UDP.  MemNetwork connects the peers
+// within the same process.
+//
+type Transport interface {
+	Dialer
+	DialTimeout(addr string, timeout time.Duration) (net.Conn, error)
+	Listen(laddr string) (ConnListener, error)
+	ListenPacket(laddr string) (net.PacketConn, error)
+}
+
+//
+// NetTransport is the TCP/UDP transport.
+//
+type NetTransport struct {
+}
+
+/////////////////////////////////////////////////
+// NetTransport
+/////////////////////////////////////////////////
+
+func NewNetTransport() *NetTransport {
+	return &NetTransport{}
+}
+
+//
+// Open a TCP connection with keep alive.
+//
+func (t *NetTransport) Dial(addr string) (net.Conn, error) {
+
+	addrObj, err := net.ResolveTCPAddr(MESSAGE_TRANSPORT_TYPE, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTCP(MESSAGE_TRANSPORT_TYPE, nil, addrObj)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(TCP_KEEP_ALIVE_PERIOD)
+	return conn, nil
+}
+
+func (t *NetTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(MESSAGE_TRANSPORT_TYPE, addr, timeout)
+}
+
+func (t *NetTransport) Listen(laddr string) (ConnListener, error) {
+	return StartPeerListener(laddr)
+}
+
+func (t *NetTransport) ListenPacket(laddr string) (net.PacketConn, error) {
+	return getConn(laddr)
+}
@@ -42,7 +42,8 @@ func (t *TxnState) GetNextTxnId() Txnid {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	// Increment the epoch. If the counter overflows, panic.
+	// Increment the epoch. If the counter overflows, panic.  The leader should
+	// have started a new epoch before the counter runs out (see IsCounterExhausting()).
 	if t.counter == uint64(MAX_COUNTER) {
 		panic(fmt.Sprintf("Counter overflows for epoch %d", t.epoch))
 	}
@@ -53,7 +54,7 @@ func (t *TxnState) GetNextTxnId() Txnid {
 
 	// t.curTxnid is initialized using the LastLoggedTxid in the local repository.  So if this node becomes master,
 	// we want to make sure that the new txid is larger than the one that we saw before.
-	if t.curTxnid >= newTxnid {
+	if CompareTxnid(t.curTxnid, newTxnid) != LESS_RECENT {
 		// Assertion.  This is to ensure integrity of the system.  Wrong txnid can result in corruption.
 		panic(fmt.Sprintf("GetNextTxnId(): Assertion: New Txnid %d is smaller than or equal to old txnid %d", newTxnid, t.curTxnid))
 	}
@@ -69,7 +70,7 @@ func (t *TxnState) GetNextTxnId() Txnid {
 // that txid2 is txid1 + 1
 func IsNextInSequence(new, old Txnid) bool {
 
-	if new.GetEpoch() > old.GetEpoch() {
+	if CompareEpoch(uint32(new.GetEpoch()), uint32(old.GetEpoch())) == MORE_RECENT {
 		return true
 	}
 
@@ -86,8 +87,8 @@ func (t *TxnState) SetEpoch(newEpoch uint32) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	if t.epoch >= uint64(newEpoch) {
-		// Assertion.  This is to ensure integrity of the system.  We do not support epoch rollover yet.
+	if CompareEpoch(newEpoch, uint32(t.epoch)) != MORE_RECENT {
+		// Assertion.  This is to ensure integrity of the system.
 		panic(fmt.Sprintf("SetEpoch(): Assertion: New Epoch %d is smaller than or equal to old epoch %d", newEpoch, t.epoch))
 	}
 
@@ -99,11 +100,20 @@ func (t *TxnState) InitCurrentTxnid(txnid Txnid) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	if txnid > t.curTxnid {
+	if CompareTxnid(txnid, t.curTxnid) == MORE_RECENT {
 		t.curTxnid = txnid
 	}
 }
 
+//
+// Return true if the counter of the given txnid has passed the rollover
+// threshold.  The leader should start a new epoch before the counter
+// runs out.
+//
+func IsCounterExhausting(txnid Txnid) bool {
+	return uint32(txnid.GetCounter()) >= COUNTER_ROLLOVER_THRESHOLD
+}
+
 func (id Txnid) GetEpoch() uint64 {
 	v := uint64(id)
 	return (v >> 32)
@@ -121,9 +131,12 @@ func (id Txnid) GetCounter() uint64 {
 // return common.MORE_RECENT if epoch1 is more recent
 // return common.LESS_RECENT if epoch1 is less recent
 //
-// This is just to prepare in the future if we support
-// rolling over the epoch (but it will also require
-// changes to comparing txnid as well).
+// The epoch rolls over from MAX_EPOCH to 1 (0 is reserved for bootstrap).
+// The epochs are compared using serial number arithmetic (RFC 1982):
+// epoch1 is more recent if it is ahead of epoch2 by less than
+// EPOCH_WRAP_WINDOW (half of the epoch space), even if epoch1 has
+// wrapped around.  This assumes that the epochs of the live peers are
+// never that far apart.  The bootstrap epoch is always the least recent.
 //
 func CompareEpoch(epoch1, epoch2 uint32) CompareResult {
 
@@ -131,13 +144,63 @@ func CompareEpoch(epoch1, epoch2 uint32) CompareResult {
 		return EQUAL
 	}
 
-	if epoch1 > epoch2 {
+	if epoch1 == BOOTSTRAP_CURRENT_EPOCH {
+		return LESS_RECENT
+	}
+
+	if epoch2 == BOOTSTRAP_CURRENT_EPOCH {
+		return MORE_RECENT
+	}
+
+	// unsigned arithmetic wraps around
+	if epoch1-epoch2 < EPOCH_WRAP_WINDOW {
 		return MORE_RECENT
 	}
 
 	return LESS_RECENT
 }
 
+//
+// Compare function to compare txnid1 with txnid2.  The epoch of
+// the txnid is compared first (see CompareEpoch()).  If the epoch
+// is the same, then compare the counter.
+//
+// return common.EQUAL if txnid1 is the same as txnid2
+// return common.MORE_RECENT if txnid1 is more recent
+// return common.LESS_RECENT if txnid1 is less recent
+//
+func CompareTxnid(txnid1, txnid2 Txnid) CompareResult {
+
+	result := CompareEpoch(uint32(txnid1.GetEpoch()), uint32(txnid2.GetEpoch()))
+	if result != EQUAL {
+		return result
+	}
+
+	if txnid1.GetCounter() > txnid2.GetCounter() {
+		return MORE_RECENT
+	}
+
+	if txnid1.GetCounter() < txnid2.GetCounter() {
+		return LESS_RECENT
+	}
+
+	return EQUAL
+}
+
+//
+// Return the epoch after the given epoch.  The epoch rolls over
+// from MAX_EPOCH to 1, skipping the bootstrap epoch.
+//
+func NextEpoch(epoch uint32) uint32 {
+
+	if epoch == MAX_EPOCH {
+		Infof("NextEpoch(): Epoch reaches max value %d. Roll over.", epoch)
+		return BOOTSTRAP_CURRENT_EPOCH + 1
+	}
+
+	return epoch + 1
+}
+
 //
 // Compare epoch1 and epoch2.  If epoch1 is equal or more recent, return
 // the next more recent epoch value.   If epoch1 is less recent than
@@ -147,15 +210,7 @@ func CompareAndIncrementEpoch(epoch1, epoch2 uint32) uint32 {
 
 	result := CompareEpoch(epoch1, epoch2)
 	if result == MORE_RECENT || result == EQUAL {
-		if epoch1 != MAX_EPOCH {
-			return epoch1 + 1
-		}
-
-		// TODO : Epoch has reached the max value. If we have a leader
-		// election every second, it will take 135 years to overflow the epoch (32 bits).
-		// Regardless, we should gracefully roll over the epoch eventually in our
-		// implementation.
-		panic("epoch limit is reached")
+		return NextEpoch(epoch1)
 	}
 
 	return epoch2
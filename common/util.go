@@ -16,7 +16,6 @@
 package common
 
 import (
-	"log"
 	"time"
 )
 
@@ -29,7 +28,7 @@ type FuncToRun func()
 func SafeRun(funcName string, f FuncToRun) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in %s() : %s\n", funcName, r)
+			Errorf("panic in %s() : %s", funcName, r)
 		}
 	}()
 
@@ -69,7 +68,7 @@ func (c *Cleanup) Cancel() {
 }
 
 type BackoffTimer struct {
-	timer *time.Timer
+	timer Timer
 
 	duration    time.Duration
 	maxDuration time.Duration
@@ -81,8 +80,14 @@ type BackoffTimer struct {
 func NewBackoffTimer(duration time.Duration,
 	maxDuration time.Duration, factor int) *BackoffTimer {
 
+	return NewBackoffTimerWithClock(GetClock(), duration, maxDuration, factor)
+}
+
+func NewBackoffTimerWithClock(clock Clock, duration time.Duration,
+	maxDuration time.Duration, factor int) *BackoffTimer {
+
 	return &BackoffTimer{
-		timer: time.NewTimer(duration),
+		timer: clock.NewTimer(duration),
 
 		duration:    duration,
 		maxDuration: maxDuration,
@@ -93,7 +98,7 @@ func NewBackoffTimer(duration time.Duration,
 }
 
 func (t *BackoffTimer) GetChannel() <-chan time.Time {
-	return t.timer.C
+	return t.timer.Chan()
 }
 
 func (t *BackoffTimer) Stop() bool {
@@ -115,24 +120,39 @@ func (t *BackoffTimer) Backoff() {
 }
 
 type ResettableTimer struct {
-	d time.Duration
+	d     time.Duration
+	timer Timer
 
-	*time.Timer
+	C <-chan time.Time
 }
 
 func (t *ResettableTimer) Reset() {
-	t.Timer.Reset(t.d)
+	t.timer.Reset(t.d)
+}
+
+func (t *ResettableTimer) Stop() bool {
+	return t.timer.Stop()
 }
 
 func NewResettableTimer(d time.Duration) *ResettableTimer {
+	return NewResettableTimerWithClock(GetClock(), d)
+}
+
+func NewResettableTimerWithClock(clock Clock, d time.Duration) *ResettableTimer {
+	timer := clock.NewTimer(d)
 	return &ResettableTimer{
 		d:     d,
-		Timer: time.NewTimer(d),
+		timer: timer,
+		C:     timer.Chan(),
 	}
 }
 
 func NewStoppedResettableTimer(d time.Duration) *ResettableTimer {
-	timer := NewResettableTimer(d)
+	return NewStoppedResettableTimerWithClock(GetClock(), d)
+}
+
+func NewStoppedResettableTimerWithClock(clock Clock, d time.Duration) *ResettableTimer {
+	timer := NewResettableTimerWithClock(clock, d)
 	timer.Stop()
 	select {
 	case <-timer.C:
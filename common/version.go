@@ -0,0 +1,86 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Protocol Version
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Each node supports a range of protocol versions [MIN_PROTOCOL_VERSION,
+// PROTOCOL_VERSION].  Two nodes can talk to each other if their ranges
+// overlap, and they run at the highest version supported by both.  This
+// allows the nodes of an ensemble to be upgraded one at a time.
+//
+// A peer that does not send its lowest supported version (a node running
+// protocol version 1) only supports the version that it sends.
+//
+func GetVersionRange(minVersion uint32, maxVersion uint32) (uint32, uint32) {
+	if minVersion == 0 || minVersion > maxVersion {
+		minVersion = maxVersion
+	}
+	return minVersion, maxVersion
+}
+
+//
+// Return true if the peer supporting the given range of versions can
+// talk to this node.
+//
+func IsCompatibleVersion(minVersion uint32, maxVersion uint32) bool {
+	_, err := NegotiateVersion(minVersion, maxVersion)
+	return err == nil
+}
+
+//
+// Find the highest version supported by both this node and the peer.
+// Return an error if there is no common version.
+//
+func NegotiateVersion(minVersion uint32, maxVersion uint32) (uint32, error) {
+
+	minVersion, maxVersion = GetVersionRange(minVersion, maxVersion)
+
+	version := PROTOCOL_VERSION
+	if maxVersion < version {
+		version = maxVersion
+	}
+
+	if version < MIN_PROTOCOL_VERSION || version < minVersion {
+		return 0, NewError(PROTOCOL_ERROR,
+			fmt.Sprintf("Incompatible protocol version.  Peer supports version %d to %d.  Local node supports version %d to %d.",
+				minVersion, maxVersion, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION))
+	}
+
+	return version, nil
+}
+
+//
+// Return the protocol version required for sending the message.  A
+// message must only be sent to peers that run at this version or above.
+//
+func GetMessageVersion(name string) uint32 {
+	switch name {
+	case "PreVote", "PreVoteResponse":
+		return PROTOCOL_VERSION_2
+	case "GroupMessage":
+		return PROTOCOL_VERSION_3
+	default:
+		return PROTOCOL_VERSION_1
+	}
+}
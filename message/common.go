@@ -15,12 +15,18 @@
 
 package message
 
-import ()
+import (
+	"github.com/couchbase/gometa/common"
+)
 
 /////////////////////////////////////////////////////////////////////////////
 // Version
 /////////////////////////////////////////////////////////////////////////////
 
 func ProtoVersion() uint32 {
-	return 1
+	return common.PROTOCOL_VERSION
+}
+
+func MinProtoVersion() uint32 {
+	return common.MIN_PROTOCOL_VERSION
 }
@@ -43,7 +43,8 @@ func (f *ConcreteMsgFactory) CreateProposal(txnid uint64,
 	reqId uint64,
 	op uint32,
 	key string,
-	content []byte) protocol.ProposalMsg {
+	content []byte,
+	traceId uint64) protocol.ProposalMsg {
 
 	return &Proposal{Version: proto.Uint32(ProtoVersion()),
 		Txnid:   proto.Uint64(txnid),
@@ -51,39 +52,48 @@ func (f *ConcreteMsgFactory) CreateProposal(txnid uint64,
 		ReqId:   proto.Uint64(reqId),
 		OpCode:  proto.Uint32(op),
 		Key:     proto.String(key),
-		Content: content}
+		Content: content,
+		TraceId: proto.Uint64(traceId)}
 }
 
 func (f *ConcreteMsgFactory) CreateAccept(txnid uint64,
-	fid string) protocol.AcceptMsg {
+	fid string,
+	traceId uint64,
+	committed uint64) protocol.AcceptMsg {
 
 	return &Accept{Version: proto.Uint32(ProtoVersion()),
-		Txnid: proto.Uint64(txnid),
-		Fid:   proto.String(fid)}
+		Txnid:     proto.Uint64(txnid),
+		Fid:       proto.String(fid),
+		TraceId:   proto.Uint64(traceId),
+		Committed: proto.Uint64(committed)}
 }
 
-func (f *ConcreteMsgFactory) CreateCommit(txnid uint64) protocol.CommitMsg {
+func (f *ConcreteMsgFactory) CreateCommit(txnid uint64,
+	traceId uint64) protocol.CommitMsg {
 
 	return &Commit{Version: proto.Uint32(ProtoVersion()),
-		Txnid: proto.Uint64(txnid)}
+		Txnid:   proto.Uint64(txnid),
+		TraceId: proto.Uint64(traceId)}
 }
 
 func (f *ConcreteMsgFactory) CreateAbort(fid string,
-	reqId uint64, err string) protocol.AbortMsg {
+	reqId uint64, errorCode string, err string) protocol.AbortMsg {
 
 	return &Abort{Version: proto.Uint32(ProtoVersion()),
-		Fid:   proto.String(fid),
-		ReqId: proto.Uint64(reqId),
-		Error: proto.String(err)}
+		Fid:       proto.String(fid),
+		ReqId:     proto.Uint64(reqId),
+		Error:     proto.String(err),
+		ErrorCode: proto.String(errorCode)}
 }
 
 func (f *ConcreteMsgFactory) CreateResponse(fid string,
-	reqId uint64, err string) protocol.ResponseMsg {
+	reqId uint64, errorCode string, err string) protocol.ResponseMsg {
 
 	return &Response{Version: proto.Uint32(ProtoVersion()),
-		Fid:   proto.String(fid),
-		ReqId: proto.Uint64(reqId),
-		Error: proto.String(err)}
+		Fid:       proto.String(fid),
+		ReqId:     proto.Uint64(reqId),
+		Error:     proto.String(err),
+		ErrorCode: proto.String(errorCode)}
 }
 
 func (f *ConcreteMsgFactory) CreateVote(round uint64,
@@ -92,7 +102,8 @@ func (f *ConcreteMsgFactory) CreateVote(round uint64,
 	cndId string,
 	loggedTxnId uint64,
 	committedTxnId uint64,
-	solicit bool) protocol.VoteMsg {
+	solicit bool,
+	priority uint32) protocol.VoteMsg {
 
 	return &Vote{Version: proto.Uint32(ProtoVersion()),
 		Round:             proto.Uint64(round),
@@ -101,7 +112,27 @@ func (f *ConcreteMsgFactory) CreateVote(round uint64,
 		CndId:             proto.String(cndId),
 		CndLoggedTxnId:    proto.Uint64(loggedTxnId),
 		CndCommittedTxnId: proto.Uint64(committedTxnId),
-		Solicit:           proto.Bool(solicit)}
+		Solicit:           proto.Bool(solicit),
+		CndPriority:       proto.Uint32(priority),
+		MinVersion:        proto.Uint32(MinProtoVersion())}
+}
+
+func (f *ConcreteMsgFactory) CreatePreVote(round uint64,
+	cndId string) protocol.PreVoteMsg {
+
+	return &PreVote{Version: proto.Uint32(ProtoVersion()),
+		Round: proto.Uint64(round),
+		CndId: proto.String(cndId)}
+}
+
+func (f *ConcreteMsgFactory) CreatePreVoteResponse(round uint64,
+	status uint32,
+	granted bool) protocol.PreVoteResponseMsg {
+
+	return &PreVoteResponse{Version: proto.Uint32(ProtoVersion()),
+		Round:   proto.Uint64(round),
+		Status:  proto.Uint32(status),
+		Granted: proto.Bool(granted)}
 }
 
 func (f *ConcreteMsgFactory) CreateLogEntry(txnid uint64,
@@ -123,13 +154,15 @@ func (f *ConcreteMsgFactory) CreateFollowerInfo(epoch uint32,
 	return &FollowerInfo{Version: proto.Uint32(ProtoVersion()),
 		AcceptedEpoch: proto.Uint32(epoch),
 		Fid:           proto.String(fid),
-		Voting:        proto.Bool(voting)}
+		Voting:        proto.Bool(voting),
+		MinVersion:    proto.Uint32(MinProtoVersion())}
 }
 
 func (f *ConcreteMsgFactory) CreateLeaderInfo(epoch uint32) protocol.LeaderInfoMsg {
 
 	return &LeaderInfo{Version: proto.Uint32(ProtoVersion()),
-		AcceptedEpoch: proto.Uint32(epoch)}
+		AcceptedEpoch: proto.Uint32(epoch),
+		MinVersion:    proto.Uint32(MinProtoVersion())}
 }
 
 func (f *ConcreteMsgFactory) CreateEpochAck(txid uint64, epoch uint32) protocol.EpochAckMsg {
@@ -153,12 +186,22 @@ func (f *ConcreteMsgFactory) CreateNewLeaderAck() protocol.NewLeaderAckMsg {
 func (f *ConcreteMsgFactory) CreateRequest(reqid uint64,
 	opCode uint32,
 	key string,
-	content []byte) protocol.RequestMsg {
+	content []byte,
+	traceId uint64) protocol.RequestMsg {
 
 	return &Request{Version: proto.Uint32(ProtoVersion()),
 		ReqId:   proto.Uint64(reqid),
 		OpCode:  proto.Uint32(opCode),
 		Key:     proto.String(key),
+		Content: content,
+		TraceId: proto.Uint64(traceId)}
+}
+
+func (f *ConcreteMsgFactory) CreateGroupMessage(group string,
+	content []byte) protocol.GroupMessageMsg {
+
+	return &GroupMessage{Version: proto.Uint32(ProtoVersion()),
+		Group:   proto.String(group),
 		Content: content}
 }
 
@@ -171,6 +214,8 @@ func registerMessages() {
 	common.RegisterPacketByName("Accept", &Accept{})
 	common.RegisterPacketByName("Commit", &Commit{})
 	common.RegisterPacketByName("Vote", &Vote{})
+	common.RegisterPacketByName("PreVote", &PreVote{})
+	common.RegisterPacketByName("PreVoteResponse", &PreVoteResponse{})
 	common.RegisterPacketByName("LogEntry", &LogEntry{})
 	common.RegisterPacketByName("FollowerInfo", &FollowerInfo{})
 	common.RegisterPacketByName("LeaderInfo", &LeaderInfo{})
@@ -180,4 +225,5 @@ func registerMessages() {
 	common.RegisterPacketByName("Request", &Request{})
 	common.RegisterPacketByName("Abort", &Abort{})
 	common.RegisterPacketByName("Response", &Response{})
+	common.RegisterPacketByName("GroupMessage", &GroupMessage{})
 }
@@ -17,7 +17,7 @@ package message
 
 import (
 	"code.google.com/p/goprotobuf/proto"
-	"log"
+	"github.com/couchbase/gometa/common"
 	"strconv"
 )
 
@@ -37,12 +37,13 @@ func (req *Proposal) Decode(data []byte) (err error) {
 }
 
 func (req *Proposal) Print() {
-	log.Printf("Proposal Message:")
-	log.Printf("	Txnid  : %d", req.GetTxnid())
-	log.Printf("	Fid    : %s", req.GetFid())
-	log.Printf("	ReqId  : %d", req.GetReqId())
-	log.Printf("	OpCode : %d", req.GetOpCode())
-	log.Printf("	Key    : %s", req.GetKey())
+	common.Debugf("Proposal Message:")
+	common.Debugf("	Txnid  : %d", req.GetTxnid())
+	common.Debugf("	Fid    : %s", req.GetFid())
+	common.Debugf("	ReqId  : %d", req.GetReqId())
+	common.Debugf("	OpCode : %d", req.GetOpCode())
+	common.Debugf("	Key    : %s", req.GetKey())
+	common.Debugf("	Trace  : %d", req.GetTraceId())
 }
 
 //
@@ -61,9 +62,10 @@ func (req *Accept) Decode(data []byte) (err error) {
 }
 
 func (req *Accept) Print() {
-	log.Printf("Accept Message:")
-	log.Printf("	Txnid : %d", req.GetTxnid())
-	log.Printf("	Fid   : %s", req.GetFid())
+	common.Debugf("Accept Message:")
+	common.Debugf("	Txnid : %d", req.GetTxnid())
+	common.Debugf("	Fid   : %s", req.GetFid())
+	common.Debugf("	Trace : %d", req.GetTraceId())
 }
 
 //
@@ -82,8 +84,9 @@ func (req *Commit) Decode(data []byte) (err error) {
 }
 
 func (req *Commit) Print() {
-	log.Printf("Commit Message:")
-	log.Printf("	Txnid : %d", req.GetTxnid())
+	common.Debugf("Commit Message:")
+	common.Debugf("	Txnid : %d", req.GetTxnid())
+	common.Debugf("	Trace : %d", req.GetTraceId())
 }
 
 //
@@ -102,10 +105,11 @@ func (req *Abort) Decode(data []byte) (err error) {
 }
 
 func (req *Abort) Print() {
-	log.Printf("Abort Message:")
-	log.Printf("	Fid    : %s", req.GetFid())
-	log.Printf("	ReqId  : %d", req.GetReqId())
-	log.Printf("	Error : %s", req.GetError())
+	common.Debugf("Abort Message:")
+	common.Debugf("	Fid    : %s", req.GetFid())
+	common.Debugf("	ReqId  : %d", req.GetReqId())
+	common.Debugf("	Error : %s", req.GetError())
+	common.Debugf("	ErrorCode : %s", req.GetErrorCode())
 }
 
 //
@@ -124,10 +128,11 @@ func (req *Response) Decode(data []byte) (err error) {
 }
 
 func (req *Response) Print() {
-	log.Printf("Response Message:")
-	log.Printf("	Fid    : %s", req.GetFid())
-	log.Printf("	ReqId  : %d", req.GetReqId())
-	log.Printf("	Error : %s", req.GetError())
+	common.Debugf("Response Message:")
+	common.Debugf("	Fid    : %s", req.GetFid())
+	common.Debugf("	ReqId  : %d", req.GetReqId())
+	common.Debugf("	Error : %s", req.GetError())
+	common.Debugf("	ErrorCode : %s", req.GetErrorCode())
 }
 
 //
@@ -146,14 +151,59 @@ func (req *Vote) Decode(data []byte) (err error) {
 }
 
 func (req *Vote) Print() {
-	log.Printf("Vote Message:")
-	log.Printf("	Round           : %d", req.GetRound())
-	log.Printf("	Status          : %d", req.GetStatus())
-	log.Printf("	Epoch           : %d", req.GetEpoch())
-	log.Printf("	Candidate Id    : %s", req.GetCndId())
-	log.Printf("	Logged TxnId    : %d", req.GetCndLoggedTxnId())
-	log.Printf("	Committed TxnId : %d", req.GetCndCommittedTxnId())
-	log.Printf("	SolicitOnly     : %s", strconv.FormatBool(req.GetSolicit()))
+	common.Debugf("Vote Message:")
+	common.Debugf("	Round           : %d", req.GetRound())
+	common.Debugf("	Status          : %d", req.GetStatus())
+	common.Debugf("	Epoch           : %d", req.GetEpoch())
+	common.Debugf("	Candidate Id    : %s", req.GetCndId())
+	common.Debugf("	Logged TxnId    : %d", req.GetCndLoggedTxnId())
+	common.Debugf("	Committed TxnId : %d", req.GetCndCommittedTxnId())
+	common.Debugf("	SolicitOnly     : %s", strconv.FormatBool(req.GetSolicit()))
+	common.Debugf("	Priority        : %d", req.GetCndPriority())
+	common.Debugf("	Version         : %d - %d", req.GetMinVersion(), req.GetVersion())
+}
+
+//
+// PreVote - implement Packet interface
+//
+func (req *PreVote) Name() string {
+	return "PreVote"
+}
+
+func (req *PreVote) Encode() (data []byte, err error) {
+	return proto.Marshal(req)
+}
+
+func (req *PreVote) Decode(data []byte) (err error) {
+	return proto.Unmarshal(data, req)
+}
+
+func (req *PreVote) Print() {
+	common.Debugf("PreVote Message:")
+	common.Debugf("	Round        : %d", req.GetRound())
+	common.Debugf("	Candidate Id : %s", req.GetCndId())
+}
+
+//
+// PreVoteResponse - implement Packet interface
+//
+func (req *PreVoteResponse) Name() string {
+	return "PreVoteResponse"
+}
+
+func (req *PreVoteResponse) Encode() (data []byte, err error) {
+	return proto.Marshal(req)
+}
+
+func (req *PreVoteResponse) Decode(data []byte) (err error) {
+	return proto.Unmarshal(data, req)
+}
+
+func (req *PreVoteResponse) Print() {
+	common.Debugf("PreVoteResponse Message:")
+	common.Debugf("	Round   : %d", req.GetRound())
+	common.Debugf("	Status  : %d", req.GetStatus())
+	common.Debugf("	Granted : %s", strconv.FormatBool(req.GetGranted()))
 }
 
 //
@@ -172,10 +222,10 @@ func (req *LogEntry) Decode(data []byte) (err error) {
 }
 
 func (req *LogEntry) Print() {
-	log.Printf("LogEntry Message:")
-	log.Printf("	Txnid  : %d", req.GetTxnid())
-	log.Printf("	Key    : %s", req.GetKey())
-	log.Printf("	OpCode : %d", req.GetOpCode())
+	common.Debugf("LogEntry Message:")
+	common.Debugf("	Txnid  : %d", req.GetTxnid())
+	common.Debugf("	Key    : %s", req.GetKey())
+	common.Debugf("	OpCode : %d", req.GetOpCode())
 }
 
 //
@@ -194,9 +244,10 @@ func (req *FollowerInfo) Decode(data []byte) (err error) {
 }
 
 func (req *FollowerInfo) Print() {
-	log.Printf("FollowerInfo Message:")
-	log.Printf("	AcceptedEpoch : %d", req.GetAcceptedEpoch())
-	log.Printf("	Voting        : %s", strconv.FormatBool(req.GetVoting()))
+	common.Debugf("FollowerInfo Message:")
+	common.Debugf("	AcceptedEpoch : %d", req.GetAcceptedEpoch())
+	common.Debugf("	Voting        : %s", strconv.FormatBool(req.GetVoting()))
+	common.Debugf("	Version       : %d - %d", req.GetMinVersion(), req.GetVersion())
 }
 
 //
@@ -215,9 +266,9 @@ func (req *EpochAck) Decode(data []byte) (err error) {
 }
 
 func (req *EpochAck) Print() {
-	log.Printf("EpochAck Message:")
-	log.Printf("	LastLoggedTxid : %d", req.GetLastLoggedTxid())
-	log.Printf("	CurrentEpoch : %d", req.GetCurrentEpoch())
+	common.Debugf("EpochAck Message:")
+	common.Debugf("	LastLoggedTxid : %d", req.GetLastLoggedTxid())
+	common.Debugf("	CurrentEpoch : %d", req.GetCurrentEpoch())
 }
 
 //
@@ -236,8 +287,9 @@ func (req *LeaderInfo) Decode(data []byte) (err error) {
 }
 
 func (req *LeaderInfo) Print() {
-	log.Printf("LeaderInfo Message:")
-	log.Printf("	AcceptedEpoch : %d", req.GetAcceptedEpoch())
+	common.Debugf("LeaderInfo Message:")
+	common.Debugf("	AcceptedEpoch : %d", req.GetAcceptedEpoch())
+	common.Debugf("	Version       : %d - %d", req.GetMinVersion(), req.GetVersion())
 }
 
 //
@@ -256,8 +308,8 @@ func (req *NewLeader) Decode(data []byte) (err error) {
 }
 
 func (req *NewLeader) Print() {
-	log.Printf("NewLeader Message:")
-	log.Printf("	CurrentEpoch : %d", req.GetCurrentEpoch())
+	common.Debugf("NewLeader Message:")
+	common.Debugf("	CurrentEpoch : %d", req.GetCurrentEpoch())
 }
 
 //
@@ -276,7 +328,7 @@ func (req *NewLeaderAck) Decode(data []byte) (err error) {
 }
 
 func (req *NewLeaderAck) Print() {
-	log.Printf("NewLeaderAck Message: No field to print")
+	common.Debugf("NewLeaderAck Message: No field to print")
 }
 
 //
@@ -295,8 +347,30 @@ func (req *Request) Decode(data []byte) (err error) {
 }
 
 func (req *Request) Print() {
-	log.Printf("Request Message:")
-	log.Printf("	ReqId  : %d", req.GetReqId())
-	log.Printf("	OpCode : %d", req.GetOpCode())
-	log.Printf("	Key    : %s", req.GetKey())
+	common.Debugf("Request Message:")
+	common.Debugf("	ReqId  : %d", req.GetReqId())
+	common.Debugf("	OpCode : %d", req.GetOpCode())
+	common.Debugf("	Key    : %s", req.GetKey())
+	common.Debugf("	Trace  : %d", req.GetTraceId())
+}
+
+//
+// GroupMessage - implement Packet interface
+//
+func (req *GroupMessage) Name() string {
+	return "GroupMessage"
+}
+
+func (req *GroupMessage) Encode() (data []byte, err error) {
+	return proto.Marshal(req)
+}
+
+func (req *GroupMessage) Decode(data []byte) (err error) {
+	return proto.Unmarshal(data, req)
+}
+
+func (req *GroupMessage) Print() {
+	common.Debugf("GroupMessage Message:")
+	common.Debugf("	Group   : %s", req.GetGroup())
+	common.Debugf("	Content : %d bytes", len(req.GetContent()))
 }
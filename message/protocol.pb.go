@@ -13,6 +13,8 @@ It has these top-level messages:
 	Accept
 	Commit
 	Vote
+	PreVote
+	PreVoteResponse
 	FollowerInfo
 	EpochAck
 	LeaderInfo
@@ -22,6 +24,7 @@ It has these top-level messages:
 	Request
 	Abort
 	Response
+	GroupMessage
 */
 package message
 
@@ -40,6 +43,7 @@ type Proposal struct {
 	OpCode           *uint32 `protobuf:"varint,5,req,name=opCode" json:"opCode,omitempty"`
 	Key              *string `protobuf:"bytes,6,req,name=key" json:"key,omitempty"`
 	Content          []byte  `protobuf:"bytes,7,req,name=content" json:"content,omitempty"`
+	TraceId          *uint64 `protobuf:"varint,8,opt,name=traceId" json:"traceId,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -96,10 +100,19 @@ func (m *Proposal) GetContent() []byte {
 	return nil
 }
 
+func (m *Proposal) GetTraceId() uint64 {
+	if m != nil && m.TraceId != nil {
+		return *m.TraceId
+	}
+	return 0
+}
+
 type Accept struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
 	Txnid            *uint64 `protobuf:"varint,2,req,name=txnid" json:"txnid,omitempty"`
 	Fid              *string `protobuf:"bytes,3,req,name=fid" json:"fid,omitempty"`
+	TraceId          *uint64 `protobuf:"varint,4,opt,name=traceId" json:"traceId,omitempty"`
+	Committed        *uint64 `protobuf:"varint,5,opt,name=committed" json:"committed,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -128,9 +141,24 @@ func (m *Accept) GetFid() string {
 	return ""
 }
 
+func (m *Accept) GetTraceId() uint64 {
+	if m != nil && m.TraceId != nil {
+		return *m.TraceId
+	}
+	return 0
+}
+
+func (m *Accept) GetCommitted() uint64 {
+	if m != nil && m.Committed != nil {
+		return *m.Committed
+	}
+	return 0
+}
+
 type Commit struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
 	Txnid            *uint64 `protobuf:"varint,2,req,name=txnid" json:"txnid,omitempty"`
+	TraceId          *uint64 `protobuf:"varint,3,opt,name=traceId" json:"traceId,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -152,6 +180,13 @@ func (m *Commit) GetTxnid() uint64 {
 	return 0
 }
 
+func (m *Commit) GetTraceId() uint64 {
+	if m != nil && m.TraceId != nil {
+		return *m.TraceId
+	}
+	return 0
+}
+
 type Vote struct {
 	Version           *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
 	Round             *uint64 `protobuf:"varint,2,req,name=round" json:"round,omitempty"`
@@ -161,6 +196,8 @@ type Vote struct {
 	CndLoggedTxnId    *uint64 `protobuf:"varint,6,req,name=cndLoggedTxnId" json:"cndLoggedTxnId,omitempty"`
 	CndCommittedTxnId *uint64 `protobuf:"varint,7,req,name=cndCommittedTxnId" json:"cndCommittedTxnId,omitempty"`
 	Solicit           *bool   `protobuf:"varint,8,req,name=solicit" json:"solicit,omitempty"`
+	CndPriority       *uint32 `protobuf:"varint,9,opt,name=cndPriority,def=0" json:"cndPriority,omitempty"`
+	MinVersion        *uint32 `protobuf:"varint,10,opt,name=minVersion" json:"minVersion,omitempty"`
 	XXX_unrecognized  []byte  `json:"-"`
 }
 
@@ -168,6 +205,8 @@ func (m *Vote) Reset()         { *m = Vote{} }
 func (m *Vote) String() string { return proto.CompactTextString(m) }
 func (*Vote) ProtoMessage()    {}
 
+const Default_Vote_CndPriority uint32 = 0
+
 func (m *Vote) GetVersion() uint32 {
 	if m != nil && m.Version != nil {
 		return *m.Version
@@ -224,11 +263,98 @@ func (m *Vote) GetSolicit() bool {
 	return false
 }
 
+func (m *Vote) GetCndPriority() uint32 {
+	if m != nil && m.CndPriority != nil {
+		return *m.CndPriority
+	}
+	return Default_Vote_CndPriority
+}
+
+func (m *Vote) GetMinVersion() uint32 {
+	if m != nil && m.MinVersion != nil {
+		return *m.MinVersion
+	}
+	return 0
+}
+
+type PreVote struct {
+	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
+	Round            *uint64 `protobuf:"varint,2,req,name=round" json:"round,omitempty"`
+	CndId            *string `protobuf:"bytes,3,req,name=cndId" json:"cndId,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *PreVote) Reset()         { *m = PreVote{} }
+func (m *PreVote) String() string { return proto.CompactTextString(m) }
+func (*PreVote) ProtoMessage()    {}
+
+func (m *PreVote) GetVersion() uint32 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *PreVote) GetRound() uint64 {
+	if m != nil && m.Round != nil {
+		return *m.Round
+	}
+	return 0
+}
+
+func (m *PreVote) GetCndId() string {
+	if m != nil && m.CndId != nil {
+		return *m.CndId
+	}
+	return ""
+}
+
+type PreVoteResponse struct {
+	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
+	Round            *uint64 `protobuf:"varint,2,req,name=round" json:"round,omitempty"`
+	Status           *uint32 `protobuf:"varint,3,req,name=status" json:"status,omitempty"`
+	Granted          *bool   `protobuf:"varint,4,req,name=granted" json:"granted,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *PreVoteResponse) Reset()         { *m = PreVoteResponse{} }
+func (m *PreVoteResponse) String() string { return proto.CompactTextString(m) }
+func (*PreVoteResponse) ProtoMessage()    {}
+
+func (m *PreVoteResponse) GetVersion() uint32 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *PreVoteResponse) GetRound() uint64 {
+	if m != nil && m.Round != nil {
+		return *m.Round
+	}
+	return 0
+}
+
+func (m *PreVoteResponse) GetStatus() uint32 {
+	if m != nil && m.Status != nil {
+		return *m.Status
+	}
+	return 0
+}
+
+func (m *PreVoteResponse) GetGranted() bool {
+	if m != nil && m.Granted != nil {
+		return *m.Granted
+	}
+	return false
+}
+
 type FollowerInfo struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
 	AcceptedEpoch    *uint32 `protobuf:"varint,2,req,name=acceptedEpoch" json:"acceptedEpoch,omitempty"`
 	Fid              *string `protobuf:"bytes,3,req,name=fid" json:"fid,omitempty"`
 	Voting           *bool   `protobuf:"varint,4,req,name=voting" json:"voting,omitempty"`
+	MinVersion       *uint32 `protobuf:"varint,5,opt,name=minVersion" json:"minVersion,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -264,6 +390,13 @@ func (m *FollowerInfo) GetVoting() bool {
 	return false
 }
 
+func (m *FollowerInfo) GetMinVersion() uint32 {
+	if m != nil && m.MinVersion != nil {
+		return *m.MinVersion
+	}
+	return 0
+}
+
 type EpochAck struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
 	LastLoggedTxid   *uint64 `protobuf:"varint,2,req,name=lastLoggedTxid" json:"lastLoggedTxid,omitempty"`
@@ -299,6 +432,7 @@ func (m *EpochAck) GetCurrentEpoch() uint32 {
 type LeaderInfo struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
 	AcceptedEpoch    *uint32 `protobuf:"varint,2,req,name=acceptedEpoch" json:"acceptedEpoch,omitempty"`
+	MinVersion       *uint32 `protobuf:"varint,3,opt,name=minVersion" json:"minVersion,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -320,6 +454,13 @@ func (m *LeaderInfo) GetAcceptedEpoch() uint32 {
 	return 0
 }
 
+func (m *LeaderInfo) GetMinVersion() uint32 {
+	if m != nil && m.MinVersion != nil {
+		return *m.MinVersion
+	}
+	return 0
+}
+
 type NewLeader struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
 	CurrentEpoch     *uint32 `protobuf:"varint,2,req,name=currentEpoch" json:"currentEpoch,omitempty"`
@@ -414,6 +555,7 @@ type Request struct {
 	OpCode           *uint32 `protobuf:"varint,3,req,name=opCode" json:"opCode,omitempty"`
 	Key              *string `protobuf:"bytes,4,req,name=key" json:"key,omitempty"`
 	Content          []byte  `protobuf:"bytes,5,req,name=content" json:"content,omitempty"`
+	TraceId          *uint64 `protobuf:"varint,6,opt,name=traceId" json:"traceId,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -456,11 +598,19 @@ func (m *Request) GetContent() []byte {
 	return nil
 }
 
+func (m *Request) GetTraceId() uint64 {
+	if m != nil && m.TraceId != nil {
+		return *m.TraceId
+	}
+	return 0
+}
+
 type Abort struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
 	ReqId            *uint64 `protobuf:"varint,2,req,name=reqId" json:"reqId,omitempty"`
 	Fid              *string `protobuf:"bytes,3,req,name=fid" json:"fid,omitempty"`
 	Error            *string `protobuf:"bytes,4,opt,name=error" json:"error,omitempty"`
+	ErrorCode        *string `protobuf:"bytes,5,opt,name=errorCode" json:"errorCode,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -496,11 +646,19 @@ func (m *Abort) GetError() string {
 	return ""
 }
 
+func (m *Abort) GetErrorCode() string {
+	if m != nil && m.ErrorCode != nil {
+		return *m.ErrorCode
+	}
+	return ""
+}
+
 type Response struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
 	ReqId            *uint64 `protobuf:"varint,2,req,name=reqId" json:"reqId,omitempty"`
 	Fid              *string `protobuf:"bytes,3,req,name=fid" json:"fid,omitempty"`
 	Error            *string `protobuf:"bytes,4,opt,name=error" json:"error,omitempty"`
+	ErrorCode        *string `protobuf:"bytes,5,opt,name=errorCode" json:"errorCode,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -536,5 +694,44 @@ func (m *Response) GetError() string {
 	return ""
 }
 
+func (m *Response) GetErrorCode() string {
+	if m != nil && m.ErrorCode != nil {
+		return *m.ErrorCode
+	}
+	return ""
+}
+
+type GroupMessage struct {
+	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
+	Group            *string `protobuf:"bytes,2,req,name=group" json:"group,omitempty"`
+	Content          []byte  `protobuf:"bytes,3,req,name=content" json:"content,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *GroupMessage) Reset()         { *m = GroupMessage{} }
+func (m *GroupMessage) String() string { return proto.CompactTextString(m) }
+func (*GroupMessage) ProtoMessage()    {}
+
+func (m *GroupMessage) GetVersion() uint32 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *GroupMessage) GetGroup() string {
+	if m != nil && m.Group != nil {
+		return *m.Group
+	}
+	return ""
+}
+
+func (m *GroupMessage) GetContent() []byte {
+	if m != nil {
+		return m.Content
+	}
+	return nil
+}
+
 func init() {
 }
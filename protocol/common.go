@@ -18,6 +18,7 @@ package protocol
 import (
 	"github.com/couchbase/gometa/common"
 	"sync"
+	"time"
 )
 
 /////////////////////////////////////////////////////////////////////////////
@@ -45,6 +46,41 @@ const (
 	WATCHING
 )
 
+func (s PeerStatus) String() string {
+	switch s {
+	case ELECTING:
+		return "electing"
+	case LEADING:
+		return "leading"
+	case FOLLOWING:
+		return "following"
+	case WATCHING:
+		return "watching"
+	}
+	return "unknown"
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// ExitReason
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Why a node stops leading or following, or why an election has no winner.
+//
+type ExitReason string
+
+const (
+	EXIT_KILLED       ExitReason = "killed"       // the server is terminated
+	EXIT_LOST_QUORUM  ExitReason = "lost quorum"  // the leader no longer has a quorum of followers
+	EXIT_NO_QUORUM    ExitReason = "no quorum"    // the leader times out waiting for a quorum of followers
+	EXIT_PIPE_ERROR   ExitReason = "pipe error"   // the connection between the leader and a follower fails
+	EXIT_SYNC_ERROR   ExitReason = "sync error"   // the follower fails to synchronize with the leader
+	EXIT_STEPPED_DOWN ExitReason = "stepped down" // the leader steps down (e.g. new epoch or leadership transfer)
+	EXIT_NO_WINNER    ExitReason = "no winner"    // the election ends without a winner
+	EXIT_ERROR        ExitReason = "error"        // any other error
+	EXIT_UNKNOWN      ExitReason = "unknown"      // the node stops before it knows the reason (e.g. crash)
+)
+
 /////////////////////////////////////////////////////////////////////////////
 // ActionHandler
 /////////////////////////////////////////////////////////////////////////////
@@ -56,6 +92,19 @@ type ActionHandler interface {
 	//
 	GetEnsembleSize() uint64
 
+	// Clock of the protocol timers of this host
+	GetClock() common.Clock
+
+	// Logger of this host (nil for the logger of the process)
+	GetLogger() *common.NodeLogger
+
+	// Tracer of the client requests on this host (nil for the exporter
+	// of the process)
+	GetTracer() *common.NodeTracer
+
+	// Labels of the metrics of this host
+	GetMetricLabels() common.MetricLabels
+
 	//
 	// The following API are used during election
 	//
@@ -67,6 +116,10 @@ type ActionHandler interface {
 
 	GetQuorumVerifier() QuorumVerifier
 
+	// Election priority of this host.  A higher value is more preferred
+	// as the leader.
+	GetPriority() uint32
+
 	// Current Epoch is set during leader/followr discovery phase.
 	// It is the current epoch (term) of the leader.
 	GetCurrentEpoch() (uint32, error)
@@ -94,17 +147,46 @@ type ActionHandler interface {
 
 	GetFollowerId() string
 
+	// Election priority of the given follower (follower id)
+	GetFollowerPriority(fid string) uint32
+
+	// Policy for the followers that fall behind the leader (nil if the
+	// leader does not check for slow followers)
+	GetSlowFollowerPolicy() *SlowFollowerPolicy
+
 	LogProposal(proposal ProposalMsg) error
 
 	Commit(txid common.Txnid) error
 }
 
+/////////////////////////////////////////////////////////////////////////////
+// SlowFollowerPolicy
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// The leader reports a follower as slow when the follower has more than
+// MaxLag proposals that it has not accepted, or when its accept latency
+// is above MaxLatency.  A threshold of 0 disables the check.  If Disconnect
+// is set, the leader closes the connection of a slow follower, such that
+// the follower re-synchronizes with the leader.
+//
+type SlowFollowerPolicy struct {
+	MaxLag     int
+	MaxLatency uint64 // millisecond
+	Disconnect bool
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // QuorumVerifier
 /////////////////////////////////////////////////////////////////////////////
 
+//
+// The QuorumVerifier tells if the given voters form a quorum.  A voter is
+// identified by its election (UDP) address during election, and by its
+// follower id (message address) afterwards.
+//
 type QuorumVerifier interface {
-	HasQuorum(count int) bool
+	HasQuorum(voters []string) bool
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -112,16 +194,20 @@ type QuorumVerifier interface {
 /////////////////////////////////////////////////////////////////////////////
 
 type MsgFactory interface {
-	CreateProposal(txnid uint64, fid string, reqId uint64, op uint32, key string, content []byte) ProposalMsg
+	CreateProposal(txnid uint64, fid string, reqId uint64, op uint32, key string, content []byte, traceId uint64) ProposalMsg
 
-	CreateAccept(txnid uint64, fid string) AcceptMsg
+	CreateAccept(txnid uint64, fid string, traceId uint64, committed uint64) AcceptMsg
 
-	CreateCommit(txnid uint64) CommitMsg
+	CreateCommit(txnid uint64, traceId uint64) CommitMsg
 
-	CreateAbort(fid string, reqId uint64, err string) AbortMsg
+	CreateAbort(fid string, reqId uint64, errorCode string, err string) AbortMsg
 
 	CreateVote(round uint64, status uint32, epoch uint32, cndId string, cndLoggedTxnId uint64,
-		cndCommittedTxnId uint64, solicit bool) VoteMsg
+		cndCommittedTxnId uint64, solicit bool, cndPriority uint32) VoteMsg
+
+	CreatePreVote(round uint64, cndId string) PreVoteMsg
+
+	CreatePreVoteResponse(round uint64, status uint32, granted bool) PreVoteResponseMsg
 
 	CreateFollowerInfo(epoch uint32, fid string, voting bool) FollowerInfoMsg
 
@@ -135,9 +221,11 @@ type MsgFactory interface {
 
 	CreateLogEntry(txnid uint64, opCode uint32, key string, content []byte) LogEntryMsg
 
-	CreateRequest(id uint64, opCode uint32, key string, content []byte) RequestMsg
+	CreateRequest(id uint64, opCode uint32, key string, content []byte, traceId uint64) RequestMsg
+
+	CreateResponse(fid string, reqId uint64, errorCode string, err string) ResponseMsg
 
-	CreateResponse(fid string, reqId uint64, err string) ResponseMsg
+	CreateGroupMessage(group string, content []byte) GroupMessageMsg
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -152,17 +240,21 @@ type ProposalMsg interface {
 	GetOpCode() uint32
 	GetKey() string
 	GetContent() []byte
+	GetTraceId() uint64
 }
 
 type AcceptMsg interface {
 	common.Packet
 	GetTxnid() uint64
 	GetFid() string
+	GetTraceId() uint64
+	GetCommitted() uint64
 }
 
 type CommitMsg interface {
 	common.Packet
 	GetTxnid() uint64
+	GetTraceId() uint64
 }
 
 type AbortMsg interface {
@@ -170,6 +262,7 @@ type AbortMsg interface {
 	GetFid() string
 	GetReqId() uint64
 	GetError() string
+	GetErrorCode() string
 }
 
 type RequestMsg interface {
@@ -178,6 +271,7 @@ type RequestMsg interface {
 	GetOpCode() uint32
 	GetKey() string
 	GetContent() []byte
+	GetTraceId() uint64
 }
 
 type ResponseMsg interface {
@@ -185,6 +279,7 @@ type ResponseMsg interface {
 	GetFid() string
 	GetReqId() uint64
 	GetError() string
+	GetErrorCode() string
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -200,6 +295,32 @@ type VoteMsg interface {
 	GetCndLoggedTxnId() uint64
 	GetCndCommittedTxnId() uint64
 	GetSolicit() bool
+	GetCndPriority() uint32
+	GetVersion() uint32
+	GetMinVersion() uint32
+}
+
+type PreVoteMsg interface {
+	common.Packet
+	GetRound() uint64
+	GetCndId() string
+}
+
+type PreVoteResponseMsg interface {
+	common.Packet
+	GetRound() uint64
+	GetStatus() uint32
+	GetGranted() bool
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Message for multiple consensus groups
+/////////////////////////////////////////////////////////////////////////////
+
+type GroupMessageMsg interface {
+	common.Packet
+	GetGroup() string
+	GetContent() []byte
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -211,11 +332,15 @@ type FollowerInfoMsg interface {
 	GetAcceptedEpoch() uint32
 	GetFid() string
 	GetVoting() bool
+	GetVersion() uint32
+	GetMinVersion() uint32
 }
 
 type LeaderInfoMsg interface {
 	common.Packet
 	GetAcceptedEpoch() uint32
+	GetVersion() uint32
+	GetMinVersion() uint32
 }
 
 type EpochAckMsg interface {
@@ -250,6 +375,7 @@ type RequestHandle struct {
 	Err     error
 	Mutex   sync.Mutex
 	CondVar *sync.Cond
+	Queued  time.Time // when the client request is queued (see common.SPAN_INCOMING)
 }
 
 type RequestMgr interface {
@@ -257,7 +383,95 @@ type RequestMgr interface {
 	AddPendingRequest(handle *RequestHandle)
 }
 
+//
+// A RequestMgr can implement LeaderTracker to be told about the leader
+// while this node is leading (e.g. to report the status of the leader).
+// SetLeader(nil) is called once the leader terminates.
+//
+type LeaderTracker interface {
+	SetLeader(leader *Leader)
+}
+
+//
+// A RequestMgr can implement ExitTracker to be told why this node stops
+// leading or following.
+//
+type ExitTracker interface {
+	SetExitReason(reason ExitReason)
+}
+
+func setExitReason(ss RequestMgr, reason ExitReason) {
+	if tracker, ok := ss.(ExitTracker); ok {
+		tracker.SetExitReason(reason)
+	}
+}
+
+//
+// A RequestMgr can implement ReadyTracker to be told when this node can
+// serve the client requests: the leader has a quorum of followers, or the
+// follower is synchronized with the leader.  SetReady(false) is called once
+// the node stops leading or following.
+//
+type ReadyTracker interface {
+	SetReady(ready bool)
+}
+
+func setReady(ss RequestMgr, ready bool) {
+	if tracker, ok := ss.(ReadyTracker); ok {
+		tracker.SetReady(ready)
+	}
+}
+
+//
+// A RequestMgr can implement HandoverTracker to keep the handovers of the
+// leadership across the elections, so that the leader backs off if a
+// handover to a higher priority follower does not move the leadership.
+//
+type HandoverTracker interface {
+	GetHandoverState() *HandoverState
+}
+
+func getHandoverState(ss RequestMgr) *HandoverState {
+	if tracker, ok := ss.(HandoverTracker); ok {
+		return tracker.GetHandoverState()
+	}
+	return nil
+}
+
 type CustomRequestHandler interface {
 	OnNewRequest(fid string, request RequestMsg)
 	GetResponseChannel() <-chan common.Packet
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// Abort and Response
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// An abort (or a response) is handed to the ActionHandler as a proposal
+// with opcode OPCODE_ABORT (or OPCODE_RESPONSE).  The key of the proposal
+// is the error message, and the content is the name of the error code.
+//
+func NewAbortProposal(factory MsgFactory, opCode common.OpCode, fid string, reqId uint64,
+	errorCode string, err string) ProposalMsg {
+
+	return factory.CreateProposal(0, fid, reqId, uint32(opCode), err, []byte(errorCode), 0)
+}
+
+//
+// Return the error of an abort (or a response) proposal, or nil if the
+// request is successful.  The error has the code sent by the leader, or
+// SERVER_ERROR if the leader does not send a known code.
+//
+func GetProposalError(proposal ProposalMsg) error {
+
+	if len(proposal.GetKey()) == 0 {
+		return nil
+	}
+
+	code, ok := common.GetErrorCodeByName(string(proposal.GetContent()))
+	if !ok {
+		code = common.SERVER_ERROR
+	}
+	return common.NewError(code, proposal.GetKey())
+}
@@ -18,7 +18,6 @@ package protocol
 import (
 	"fmt"
 	"github.com/couchbase/gometa/common"
-	"log"
 	"runtime/debug"
 	"sync"
 	"time"
@@ -30,7 +29,7 @@ import (
 
 type LeaderSyncProxy struct {
 	state         *ConsentState
-	follower      *common.PeerPipe
+	follower      common.Pipe
 	handler       ActionHandler
 	factory       MsgFactory
 	followerState *followerState
@@ -43,7 +42,7 @@ type LeaderSyncProxy struct {
 }
 
 type FollowerSyncProxy struct {
-	leader  *common.PeerPipe
+	leader  common.Pipe
 	handler ActionHandler
 	factory MsgFactory
 	state   *followerState
@@ -68,7 +67,7 @@ type ConsentState struct {
 	newLeaderAckCond  *sync.Cond
 	newLeaderAckMutex sync.Mutex
 
-	ensembleSize uint64
+	verifier QuorumVerifier
 }
 
 type followerState struct {
@@ -76,6 +75,9 @@ type followerState struct {
 	lastLoggedTxid common.Txnid
 	fid            string
 	voting         bool
+	version        uint32       // protocol version negotiated with the peer
+	syncedTxid     common.Txnid // last txnid logged by the follower once synchronized
+	committedTxid  common.Txnid // last txnid committed by the follower once synchronized
 }
 
 type LeaderStageCode uint16
@@ -123,7 +125,7 @@ const (
 // established, if the node looses majority of followers, the server should abort and go through re-election again
 // with a new ConsentState.
 //
-func NewConsentState(sid string, epoch uint32, ensemble uint64) *ConsentState {
+func NewConsentState(sid string, epoch uint32, verifier QuorumVerifier) *ConsentState {
 
 	epoch = common.CompareAndIncrementEpoch(epoch, 0) // increment epoch to next value
 
@@ -132,7 +134,7 @@ func NewConsentState(sid string, epoch uint32, ensemble uint64) *ConsentState {
 		acceptedEpochSet: make(map[string]uint32),
 		ackEpochSet:      make(map[string]string),
 		newLeaderAckSet:  make(map[string]string),
-		ensembleSize:     ensemble}
+		verifier:         verifier}
 
 	state.acceptedEpochCond = sync.NewCond(&state.acceptedEpochMutex)
 	state.ackEpochCond = sync.NewCond(&state.ackEpochMutex)
@@ -151,7 +153,7 @@ func (s *ConsentState) voteAcceptedEpoch(voter string, newEpoch uint32, voting b
 	defer s.acceptedEpochCond.L.Unlock()
 
 	// Reach quorum. Just Return
-	if len(s.acceptedEpochSet) > int(s.ensembleSize/2) {
+	if s.verifier.HasQuorum(epochVoters(s.acceptedEpochSet)) {
 		return s.acceptedEpoch, true
 	}
 
@@ -161,7 +163,7 @@ func (s *ConsentState) voteAcceptedEpoch(voter string, newEpoch uint32, voting b
 		// This function can panic if we exceed epoch limit
 		s.acceptedEpoch = common.CompareAndIncrementEpoch(newEpoch, s.acceptedEpoch)
 
-		if len(s.acceptedEpochSet) > int(s.ensembleSize/2) {
+		if s.verifier.HasQuorum(epochVoters(s.acceptedEpochSet)) {
 			// reach quorum. Notify
 			s.acceptedEpochCond.Broadcast()
 			return s.acceptedEpoch, true
@@ -175,7 +177,7 @@ func (s *ConsentState) voteAcceptedEpoch(voter string, newEpoch uint32, voting b
 	// remove the voter after reaching quorum.  In these
 	// cases, return false.
 	s.acceptedEpochCond.Wait()
-	return s.acceptedEpoch, len(s.acceptedEpochSet) > int(s.ensembleSize/2)
+	return s.acceptedEpoch, s.verifier.HasQuorum(epochVoters(s.acceptedEpochSet))
 }
 
 func (s *ConsentState) removeAcceptedEpoch(voter string) {
@@ -190,14 +192,14 @@ func (s *ConsentState) voteEpochAck(voter string, voting bool) bool {
 	defer s.ackEpochCond.L.Unlock()
 
 	// Reach quorum. Just Return
-	if len(s.ackEpochSet) > int(s.ensembleSize/2) {
+	if s.verifier.HasQuorum(ackVoters(s.ackEpochSet)) {
 		return true
 	}
 
 	if voting {
 		s.ackEpochSet[voter] = voter
 
-		if len(s.ackEpochSet) > int(s.ensembleSize/2) {
+		if s.verifier.HasQuorum(ackVoters(s.ackEpochSet)) {
 			// reach quorum. Notify
 			s.ackEpochCond.Broadcast()
 			return true
@@ -211,7 +213,7 @@ func (s *ConsentState) voteEpochAck(voter string, voting bool) bool {
 	// remove the voter after reaching quorum.  In these
 	// cases, return false.
 	s.ackEpochCond.Wait()
-	return len(s.ackEpochSet) > int(s.ensembleSize/2)
+	return s.verifier.HasQuorum(ackVoters(s.ackEpochSet))
 }
 
 func (s *ConsentState) removeEpochAck(voter string) {
@@ -226,14 +228,14 @@ func (s *ConsentState) voteNewLeaderAck(voter string, voting bool) bool {
 	defer s.newLeaderAckCond.L.Unlock()
 
 	// Reach quorum. Just Return
-	if len(s.newLeaderAckSet) > int(s.ensembleSize/2) {
+	if s.verifier.HasQuorum(ackVoters(s.newLeaderAckSet)) {
 		return true
 	}
 
 	if voting {
 		s.newLeaderAckSet[voter] = voter
 
-		if len(s.newLeaderAckSet) > int(s.ensembleSize/2) {
+		if s.verifier.HasQuorum(ackVoters(s.newLeaderAckSet)) {
 			// reach quorum. Notify
 			s.newLeaderAckCond.Broadcast()
 			return true
@@ -247,7 +249,7 @@ func (s *ConsentState) voteNewLeaderAck(voter string, voting bool) bool {
 	// remove the voter after reaching quorum.  In these
 	// cases, return false.
 	s.newLeaderAckCond.Wait()
-	return len(s.newLeaderAckSet) > int(s.ensembleSize/2)
+	return s.verifier.HasQuorum(ackVoters(s.newLeaderAckSet))
 }
 
 func (s *ConsentState) removeNewLeaderAck(voter string) {
@@ -257,6 +259,28 @@ func (s *ConsentState) removeNewLeaderAck(voter string) {
 	delete(s.newLeaderAckSet, voter)
 }
 
+//
+// Return the voters who have voted for the accepted epoch
+//
+func epochVoters(set map[string]uint32) []string {
+	voters := make([]string, 0, len(set))
+	for voter := range set {
+		voters = append(voters, voter)
+	}
+	return voters
+}
+
+//
+// Return the voters who have acknowledged (epoch or new leader)
+//
+func ackVoters(set map[string]string) []string {
+	voters := make([]string, 0, len(set))
+	for voter := range set {
+		voters = append(voters, voter)
+	}
+	return voters
+}
+
 func (s *ConsentState) Terminate() {
 	s.acceptedEpochCond.L.Lock()
 	s.acceptedEpochCond.Broadcast()
@@ -289,7 +313,7 @@ func (s *ConsentState) Terminate() {
 //
 func NewLeaderSyncProxy(leader *Leader,
 	state *ConsentState,
-	follower *common.PeerPipe,
+	follower common.Pipe,
 	handler ActionHandler,
 	factory MsgFactory) *LeaderSyncProxy {
 
@@ -328,9 +352,9 @@ func (l *LeaderSyncProxy) Start(o *observer) bool {
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in LeaderSyncProxy.Start() : %s\n", r)
-			log.Printf("LeaderSyncProxy.Start() terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			l.handler.GetLogger().Errorf("panic in LeaderSyncProxy.Start() : %s", r)
+			l.handler.GetLogger().Errorf("LeaderSyncProxy.Start() terminates : Diagnostic Stack ...")
+			l.handler.GetLogger().Errorf("%s", debug.Stack())
 
 			l.abort() // ensure proper cleanup and unblock caller
 		}
@@ -338,7 +362,7 @@ func (l *LeaderSyncProxy) Start(o *observer) bool {
 		l.close()
 	}()
 
-	timeout := time.After(common.SYNC_TIMEOUT * time.Millisecond)
+	timeout := l.handler.GetClock().After(common.SYNC_TIMEOUT * time.Millisecond)
 
 	// spawn a go-routine to perform synchronziation.  Do not close donech2, just
 	// let it garbage collect when the go-routine is done.	 Make sure using
@@ -355,10 +379,10 @@ func (l *LeaderSyncProxy) Start(o *observer) bool {
 		l.donech <- success
 		return success
 	case <-timeout:
-		log.Printf("LeaderSyncProxy.Start(): Synchronization timeout for peer (TCP %s). Terminate.", l.follower.GetAddr())
+		l.handler.GetLogger().Warnf("LeaderSyncProxy.Start(): Synchronization timeout for peer (TCP %s). Terminate.", l.follower.GetAddr())
 		l.abort()
 	case <-l.killch:
-		log.Printf("LeaderSyncProxy.Start(): Receive kill signal for peer (TCP %s).  Terminate.", l.follower.GetAddr())
+		l.handler.GetLogger().Infof("LeaderSyncProxy.Start(): Receive kill signal for peer (TCP %s).  Terminate.", l.follower.GetAddr())
 		l.abort()
 	}
 
@@ -401,6 +425,16 @@ func (l *LeaderSyncProxy) GetFid() string {
 	return ""
 }
 
+//
+// Return the protocol version negotiated with the follower
+//
+func (l *LeaderSyncProxy) GetProtocolVersion() uint32 {
+	if l.followerState != nil {
+		return l.followerState.version
+	}
+	return common.MIN_PROTOCOL_VERSION
+}
+
 //
 // Can the follower vote?
 //
@@ -465,14 +499,15 @@ func (l *LeaderSyncProxy) execute(donech chan bool, o *observer) {
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in LeaderSyncProxy.execute() : %s\n", r)
-			log.Printf("LeaderSyncProxy.execute() terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			l.handler.GetLogger().Errorf("panic in LeaderSyncProxy.execute() : %s", r)
+			l.handler.GetLogger().Errorf("LeaderSyncProxy.execute() terminates : Diagnostic Stack ...")
+			l.handler.GetLogger().Errorf("%s", debug.Stack())
 
 			donech <- false // unblock caller
 		}
 	}()
 
+	start := l.handler.GetClock().Now()
 	var stage LeaderStageCode = UPDATE_ACCEPTED_EPOCH_AFTER_QUORUM
 
 	for stage != LEADER_SYNC_DONE {
@@ -481,7 +516,7 @@ func (l *LeaderSyncProxy) execute(donech chan bool, o *observer) {
 			{
 				err := l.updateAcceptedEpochAfterQuorum()
 				if err != nil {
-					log.Printf("LeaderSyncProxy.updateAcceptEpochAfterQuorum(): Error encountered = %s", err.Error())
+					l.handler.GetLogger().Warnf("LeaderSyncProxy.updateAcceptEpochAfterQuorum(): Error encountered = %s", err.Error())
 					safeSend("LeaderSyncProxy:execute()", donech, false)
 					return
 				}
@@ -491,7 +526,7 @@ func (l *LeaderSyncProxy) execute(donech chan bool, o *observer) {
 			{
 				err := l.notifyNewEpoch()
 				if err != nil {
-					log.Printf("LeaderSyncProxy.notifyNewEpoch(): Error encountered = %s", err.Error())
+					l.handler.GetLogger().Warnf("LeaderSyncProxy.notifyNewEpoch(): Error encountered = %s", err.Error())
 					safeSend("LeaderSyncProxy:execute()", donech, false)
 					return
 				}
@@ -501,7 +536,7 @@ func (l *LeaderSyncProxy) execute(donech chan bool, o *observer) {
 			{
 				err := l.updateCurrentEpochAfterQuorum()
 				if err != nil {
-					log.Printf("LeaderSyncProxy.updateCurrentEpochAfterQuorum(): Error encountered = %s", err.Error())
+					l.handler.GetLogger().Warnf("LeaderSyncProxy.updateCurrentEpochAfterQuorum(): Error encountered = %s", err.Error())
 					safeSend("LeaderSyncProxy:execute()", donech, false)
 					return
 				}
@@ -511,7 +546,7 @@ func (l *LeaderSyncProxy) execute(donech chan bool, o *observer) {
 			{
 				err := l.syncWithLeader(o)
 				if err != nil {
-					log.Printf("LeaderSyncProxy.syncWithLeader(): Error encountered = %s", err.Error())
+					l.handler.GetLogger().Warnf("LeaderSyncProxy.syncWithLeader(): Error encountered = %s", err.Error())
 					safeSend("LeaderSyncProxy:execute()", donech, false)
 					return
 				}
@@ -521,7 +556,7 @@ func (l *LeaderSyncProxy) execute(donech chan bool, o *observer) {
 			{
 				err := l.declareNewLeaderAfterQuorum()
 				if err != nil {
-					log.Printf("LeaderSyncProxy.declareNewLeaderAfterQuorum(): Error encountered = %s", err.Error())
+					l.handler.GetLogger().Warnf("LeaderSyncProxy.declareNewLeaderAfterQuorum(): Error encountered = %s", err.Error())
 					safeSend("LeaderSyncProxy:execute()", donech, false)
 					return
 				}
@@ -530,13 +565,15 @@ func (l *LeaderSyncProxy) execute(donech chan bool, o *observer) {
 		}
 	}
 
+	syncDuration.With(l.handler.GetMetricLabels()).ObserveSinceWithClock(l.handler.GetClock(), start)
+
 	// Use SafeReturn just to be sure, even though donech should not be closed
 	safeSend("LeaderSyncProxy:execute()", donech, true)
 }
 
 func (l *LeaderSyncProxy) updateAcceptedEpochAfterQuorum() error {
 
-	log.Printf("LeaderSyncProxy.updateAcceptedEpochAfterQuroum()")
+	l.handler.GetLogger().Debugf("LeaderSyncProxy.updateAcceptedEpochAfterQuroum()")
 
 	// Get my follower's vote for the accepted epoch
 	packet, err := listen("FollowerInfo", l.follower)
@@ -550,8 +587,26 @@ func (l *LeaderSyncProxy) updateAcceptedEpochAfterQuorum() error {
 	fid := info.GetFid()
 	voting := info.GetVoting()
 
+	// Refuse the follower if it is not the node it claims to be (e.g. its
+	// certificate is not valid for the host of its id).
+	if verifier, ok := l.follower.(common.PeerVerifier); ok {
+		if err := verifier.VerifyPeerAddr(fid); err != nil {
+			return common.WrapError(common.PROTOCOL_ERROR,
+				fmt.Sprintf("LeaderSyncProxy.updateAcceptedEpochAfterQuorum(): Refuse follower %s", fid), err)
+		}
+	}
+
+	// Refuse the follower if it cannot talk to me.  The follower will
+	// retry (and fail) until it is upgraded or downgraded.
+	version, err := common.NegotiateVersion(info.GetMinVersion(), info.GetVersion())
+	if err != nil {
+		return common.WrapError(common.PROTOCOL_ERROR,
+			fmt.Sprintf("LeaderSyncProxy.updateAcceptedEpochAfterQuorum(): Refuse follower %s", fid), err)
+	}
+	l.handler.GetLogger().Infof("LeaderSyncProxy.updateAcceptedEpochAfterQuorum(): Follower %s runs at protocol version %d", fid, version)
+
 	// initialize the follower state
-	l.followerState = &followerState{lastLoggedTxid: 0, currentEpoch: 0, fid: fid, voting: voting}
+	l.followerState = &followerState{lastLoggedTxid: 0, currentEpoch: 0, fid: fid, voting: voting, version: version}
 
 	// update my vote and wait for epoch to reach quorum
 	newEpoch, ok := l.state.voteAcceptedEpoch(l.GetFid(), epoch, l.followerState.voting)
@@ -572,7 +627,7 @@ func (l *LeaderSyncProxy) updateAcceptedEpochAfterQuorum() error {
 
 func (l *LeaderSyncProxy) notifyNewEpoch() error {
 
-	log.Printf("LeaderSyncProxy.notifyNewEpoch()")
+	l.handler.GetLogger().Debugf("LeaderSyncProxy.notifyNewEpoch()")
 
 	epoch, err := l.handler.GetAcceptedEpoch()
 	if err != nil {
@@ -584,7 +639,7 @@ func (l *LeaderSyncProxy) notifyNewEpoch() error {
 
 func (l *LeaderSyncProxy) updateCurrentEpochAfterQuorum() error {
 
-	log.Printf("LeaderSyncProxy.updateCurrentEpochAfterQuorum()")
+	l.handler.GetLogger().Debugf("LeaderSyncProxy.updateCurrentEpochAfterQuorum()")
 
 	// Get my follower's vote for the epoch ack
 	packet, err := listen("EpochAck", l.follower)
@@ -623,7 +678,7 @@ func (l *LeaderSyncProxy) updateCurrentEpochAfterQuorum() error {
 
 func (l *LeaderSyncProxy) declareNewLeaderAfterQuorum() error {
 
-	log.Printf("LeaderSyncProxy.declareNewLeaderAfterQuorum()")
+	l.handler.GetLogger().Debugf("LeaderSyncProxy.declareNewLeaderAfterQuorum()")
 
 	// return the new epoch to the follower
 	epoch, err := l.handler.GetCurrentEpoch()
@@ -645,6 +700,9 @@ func (l *LeaderSyncProxy) declareNewLeaderAfterQuorum() error {
 	// TODO : Verify the ack
 	ack = ack // TODO : just to get around compile error
 
+	// The follower has logged and committed the entries sent during synchronization.
+	l.leader.updateSynchronized(l.followerState.fid, l.followerState.syncedTxid, l.followerState.committedTxid)
+
 	// update my vote and wait for quorum of ack from followers
 	ok := l.state.voteNewLeaderAck(l.GetFid(), l.followerState.voting)
 	if !ok {
@@ -657,7 +715,7 @@ func (l *LeaderSyncProxy) declareNewLeaderAfterQuorum() error {
 
 func (l *LeaderSyncProxy) syncWithLeader(o *observer) error {
 
-	log.Printf("LeaderSyncProxy.syncWithLeader()")
+	l.handler.GetLogger().Debugf("LeaderSyncProxy.syncWithLeader()")
 
 	// Figure out the data that needs to be read from commit log.
 	// The start key is the last logged txid from the follower
@@ -680,10 +738,22 @@ func (l *LeaderSyncProxy) syncWithLeader(o *observer) error {
 	}
 
 	// Third, stream the trailer with the committed txid
-	if err = l.sendTrailer(); err != nil {
+	lastCommittedTxid, err := l.sendTrailer()
+	if err != nil {
 		return err
 	}
 
+	// The follower logs the entries up to the last one sent, and commits
+	// them up to the committed txid in the trailer (before NewLeaderAck).
+	if common.CompareTxnid(lastSeen, startTxid) == common.MORE_RECENT {
+		startTxid = lastSeen
+	}
+	l.followerState.syncedTxid = startTxid
+	l.followerState.committedTxid = lastCommittedTxid
+	if common.CompareTxnid(lastCommittedTxid, startTxid) == common.MORE_RECENT {
+		l.followerState.committedTxid = startTxid
+	}
+
 	// Forth, if lastSeen matches first entry in observer, remove
 	// that entry since it has been sent.
 	packet := o.peekFirst()
@@ -727,7 +797,7 @@ func (l *LeaderSyncProxy) sendHeader() error {
 //
 func (l *LeaderSyncProxy) sendEntriesInCommittedLog(startTxid, endTxid common.Txnid, o *observer) (common.Txnid, error) {
 
-	log.Printf("LeaderSyncProxy.sendEntriesInCommittedLog(): startTxid %d endTxid %d observer first txid %d",
+	l.handler.GetLogger().Infof("LeaderSyncProxy.sendEntriesInCommittedLog(): startTxid %d endTxid %d observer first txid %d",
 		startTxid, endTxid, l.firstTxnIdInObserver(o))
 
 	var lastSeen common.Txnid = common.BOOTSTRAP_LAST_LOGGED_TXID
@@ -754,6 +824,7 @@ func (l *LeaderSyncProxy) sendEntriesInCommittedLog(startTxid, endTxid common.Tx
 			}
 
 			lastSeen = common.Txnid(entry.GetTxnid())
+			syncEntriesStreamed.With(l.handler.GetMetricLabels()).Inc()
 
 			// we found the committed entries matches what's in observer queue
 			if l.hasSeenEntryInObserver(o, common.Txnid(entry.GetTxnid())) {
@@ -773,13 +844,13 @@ func (l *LeaderSyncProxy) sendEntriesInCommittedLog(startTxid, endTxid common.Tx
 }
 
 //
-// Send the trailer with the last committed txid
+// Send the trailer with the last committed txid.  Return the txid sent.
 //
-func (l *LeaderSyncProxy) sendTrailer() (err error) {
+func (l *LeaderSyncProxy) sendTrailer() (common.Txnid, error) {
 
 	lastCommittedTxid, err := l.handler.GetLastCommittedTxid()
 	if err != nil {
-		return err
+		return common.Txnid(0), err
 	}
 
 	msg := l.factory.CreateLogEntry(
@@ -788,7 +859,7 @@ func (l *LeaderSyncProxy) sendTrailer() (err error) {
 		"StreamEnd",
 		([]byte)("StreamEnd"))
 
-	return send(msg, l.follower)
+	return lastCommittedTxid, send(msg, l.follower)
 }
 
 //
@@ -797,7 +868,7 @@ func (l *LeaderSyncProxy) sendTrailer() (err error) {
 func (l *LeaderSyncProxy) hasSeenEntryInObserver(o *observer, lastSeen common.Txnid) bool {
 
 	txnid := l.firstTxnIdInObserver(o)
-	return txnid != common.BOOTSTRAP_LAST_LOGGED_TXID && txnid <= lastSeen
+	return txnid != common.BOOTSTRAP_LAST_LOGGED_TXID && common.CompareTxnid(txnid, lastSeen) != common.MORE_RECENT
 }
 
 //
@@ -837,7 +908,7 @@ func (l *LeaderSyncProxy) getPacketTxnId(packet common.Packet) common.Txnid {
 // 1) Leader : The leader is a PeerPipe (TCP connection).    This is
 //    used to exchange messages with the leader node.
 //
-func NewFollowerSyncProxy(leader *common.PeerPipe,
+func NewFollowerSyncProxy(leader common.Pipe,
 	handler ActionHandler,
 	factory MsgFactory,
 	voting bool) *FollowerSyncProxy {
@@ -878,9 +949,9 @@ func (f *FollowerSyncProxy) Start() bool {
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in FollowerSyncProxy.Start() : %s\n", r)
-			log.Printf("FollowerSyncProxy.Start() terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			f.handler.GetLogger().Errorf("panic in FollowerSyncProxy.Start() : %s", r)
+			f.handler.GetLogger().Errorf("FollowerSyncProxy.Start() terminates : Diagnostic Stack ...")
+			f.handler.GetLogger().Errorf("%s", debug.Stack())
 
 			f.abort() // ensure proper cleanup and unblock caller
 		}
@@ -888,7 +959,7 @@ func (f *FollowerSyncProxy) Start() bool {
 		f.close()
 	}()
 
-	timeout := time.After(common.SYNC_TIMEOUT * time.Millisecond)
+	timeout := f.handler.GetClock().After(common.SYNC_TIMEOUT * time.Millisecond)
 
 	// spawn a go-routine to perform synchronziation.  Do not close donech2, just
 	// let it garbage collect when the go-routine is done.	 Make sure using
@@ -904,10 +975,10 @@ func (f *FollowerSyncProxy) Start() bool {
 		f.donech <- success
 		return success
 	case <-timeout:
-		log.Printf("FollowerSyncProxy.Start(): Synchronization timeout for peer %s. Terminate.", f.leader.GetAddr())
+		f.handler.GetLogger().Warnf("FollowerSyncProxy.Start(): Synchronization timeout for peer %s. Terminate.", f.leader.GetAddr())
 		f.abort()
 	case <-f.killch:
-		log.Printf("FollowerSyncProxy.Start(): Receive kill signal for peer %s.  Terminate.", f.leader.GetAddr())
+		f.handler.GetLogger().Infof("FollowerSyncProxy.Start(): Receive kill signal for peer %s.  Terminate.", f.leader.GetAddr())
 		f.abort()
 	}
 
@@ -975,9 +1046,9 @@ func (l *FollowerSyncProxy) execute(donech chan bool) {
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in FollowerSyncProxy.execute() : %s\n", r)
-			log.Printf("FollowerSyncProxy.execute() terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			l.handler.GetLogger().Errorf("panic in FollowerSyncProxy.execute() : %s", r)
+			l.handler.GetLogger().Errorf("FollowerSyncProxy.execute() terminates : Diagnostic Stack ...")
+			l.handler.GetLogger().Errorf("%s", debug.Stack())
 
 			donech <- false // unblock caller
 		}
@@ -991,7 +1062,7 @@ func (l *FollowerSyncProxy) execute(donech chan bool) {
 			{
 				err := l.sendFollowerInfo()
 				if err != nil {
-					log.Printf("FollowerSyncProxy.sendFollowerInfo(): Error encountered = %s", err.Error())
+					l.handler.GetLogger().Warnf("FollowerSyncProxy.sendFollowerInfo(): Error encountered = %s", err.Error())
 					safeSend("FollowerSyncProxy:execute()", donech, false)
 					return
 				}
@@ -1001,7 +1072,7 @@ func (l *FollowerSyncProxy) execute(donech chan bool) {
 			{
 				err := l.receiveAndUpdateAcceptedEpoch()
 				if err != nil {
-					log.Printf("FollowerSyncProxy.receiveAndUpdateAcceptedEpoch(): Error encountered = %s", err.Error())
+					l.handler.GetLogger().Warnf("FollowerSyncProxy.receiveAndUpdateAcceptedEpoch(): Error encountered = %s", err.Error())
 					safeSend("FollowerSyncProxy:execute()", donech, false)
 					return
 				}
@@ -1011,7 +1082,7 @@ func (l *FollowerSyncProxy) execute(donech chan bool) {
 			{
 				err := l.syncReceive()
 				if err != nil {
-					log.Printf("FollowerSyncProxy.syncReceive(): Error encountered = %s", err.Error())
+					l.handler.GetLogger().Warnf("FollowerSyncProxy.syncReceive(): Error encountered = %s", err.Error())
 					safeSend("FollowerSyncProxy:execute()", donech, false)
 					return
 				}
@@ -1021,7 +1092,7 @@ func (l *FollowerSyncProxy) execute(donech chan bool) {
 			{
 				err := l.receiveAndUpdateCurrentEpoch()
 				if err != nil {
-					log.Printf("FollowerSyncProxy.receiveAndUpdateCurrentEpoch(): Error encountered = %s", err.Error())
+					l.handler.GetLogger().Warnf("FollowerSyncProxy.receiveAndUpdateCurrentEpoch(): Error encountered = %s", err.Error())
 					safeSend("FollowerSyncProxy:execute()", donech, false)
 					return
 				}
@@ -1035,7 +1106,7 @@ func (l *FollowerSyncProxy) execute(donech chan bool) {
 
 func (l *FollowerSyncProxy) sendFollowerInfo() error {
 
-	log.Printf("FollowerSyncProxy.sendFollowerInfo()")
+	l.handler.GetLogger().Debugf("FollowerSyncProxy.sendFollowerInfo()")
 
 	// Send my accepted epoch to the leader for voting (don't send current epoch)
 	epoch, err := l.handler.GetAcceptedEpoch()
@@ -1048,7 +1119,7 @@ func (l *FollowerSyncProxy) sendFollowerInfo() error {
 
 func (l *FollowerSyncProxy) receiveAndUpdateAcceptedEpoch() error {
 
-	log.Printf("FollowerSyncProxy.receiveAndUpdateAcceptedEpoch()")
+	l.handler.GetLogger().Debugf("FollowerSyncProxy.receiveAndUpdateAcceptedEpoch()")
 
 	// Get the accepted epoch from the leader.   This epoch
 	// is already being voted on by multiple followers (the highest
@@ -1065,11 +1136,21 @@ func (l *FollowerSyncProxy) receiveAndUpdateAcceptedEpoch() error {
 		return err
 	}
 
+	// Stop following the leader if it cannot talk to me.
+	version, err := common.NegotiateVersion(info.GetMinVersion(), info.GetVersion())
+	if err != nil {
+		return common.WrapError(common.PROTOCOL_ERROR,
+			fmt.Sprintf("FollowerSyncProxy.receiveAndUpdateAcceptedEpoch(): Refuse leader %s", l.leader.GetAddr()), err)
+	}
+	l.state.version = version
+	l.handler.GetLogger().Infof("FollowerSyncProxy.receiveAndUpdateAcceptedEpoch(): Leader %s runs at protocol version %d",
+		l.leader.GetAddr(), version)
+
 	acceptedEpoch, err := l.handler.GetAcceptedEpoch()
 	if err != nil {
 		return err
 	}
-	if epoch > acceptedEpoch {
+	if common.CompareEpoch(epoch, acceptedEpoch) == common.MORE_RECENT {
 		// Update the accepted epoch based on the quorum result.   This function
 		// will perform update only if the new epoch is larger than existing value.
 		// Once the accepted epoch is updated, it will not be reset even if the
@@ -1112,7 +1193,7 @@ func (l *FollowerSyncProxy) receiveAndUpdateAcceptedEpoch() error {
 
 func (l *FollowerSyncProxy) receiveAndUpdateCurrentEpoch() error {
 
-	log.Printf("FollowerSyncProxy.receiveAndUpdateCurrentEpoch()")
+	l.handler.GetLogger().Debugf("FollowerSyncProxy.receiveAndUpdateCurrentEpoch()")
 
 	// Get the accepted epoch from the leader.   This epoch
 	// is already being voted on by multiple followers (the highest
@@ -1149,7 +1230,7 @@ func (l *FollowerSyncProxy) receiveAndUpdateCurrentEpoch() error {
 
 func (l *FollowerSyncProxy) syncReceive() error {
 
-	log.Printf("FollowerSyncProxy.syncReceive()")
+	l.handler.GetLogger().Debugf("FollowerSyncProxy.syncReceive()")
 
 	lastCommittedFromLeader := common.BOOTSTRAP_LAST_COMMITTED_TXID
 	pendingCommit := make([]LogEntryMsg, 0, common.MAX_PROPOSALS)
@@ -1165,8 +1246,14 @@ func (l *FollowerSyncProxy) syncReceive() error {
 
 		// If this is the first one, skip
 		if entry.GetOpCode() == uint32(common.OPCODE_STREAM_BEGIN_MARKER) {
-			log.Printf("LeaderSyncProxy.syncReceive(). Receive stream_begin.  Txid : %d", lastTxnid)
+			l.handler.GetLogger().Log(common.LOG_INFO, "FollowerSyncProxy.syncReceive(): Receive stream_begin", common.LogTxnid(lastTxnid))
 			lastCommittedFromLeader = lastTxnid
+
+			// The streamed entries come after the entries already logged by this follower.
+			// So commit the logged entries first.
+			if err := l.commitLoggedEntries(lastCommittedFromLeader); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -1174,12 +1261,12 @@ func (l *FollowerSyncProxy) syncReceive() error {
 		// message has a more recent lastCommitedTxid from the leader which is retreievd after
 		// the last log entry is sent.
 		if entry.GetOpCode() == uint32(common.OPCODE_STREAM_END_MARKER) {
-			log.Printf("LeaderSyncProxy.syncReceive(). Receive stream_end.  Txid : %d", lastTxnid)
+			l.handler.GetLogger().Log(common.LOG_INFO, "FollowerSyncProxy.syncReceive(): Receive stream_end", common.LogTxnid(lastTxnid))
 			lastCommittedFromLeader = lastTxnid
 
 			// write any log entry that has not been logged.
 			for _, entry := range pendingCommit {
-				toCommit := entry.GetTxnid() <= uint64(lastCommittedFromLeader)
+				toCommit := common.CompareTxnid(common.Txnid(entry.GetTxnid()), lastCommittedFromLeader) != common.MORE_RECENT
 
 				if err := l.handler.LogAndCommit(common.Txnid(entry.GetTxnid()),
 					entry.GetOpCode(),
@@ -1195,7 +1282,7 @@ func (l *FollowerSyncProxy) syncReceive() error {
 
 		// write the new log entry.  If the txid is less than the last known committed txid
 		// from the leader, then commit the entry. Otherwise, keep it in a pending list.
-		toCommit := lastTxnid <= lastCommittedFromLeader
+		toCommit := common.CompareTxnid(lastTxnid, lastCommittedFromLeader) != common.MORE_RECENT
 		if toCommit {
 			// This call needs to be atomic to ensure that the commit log and the data store
 			// are updated transactionally.  This ensures that if the follower crashes, the
@@ -1215,11 +1302,59 @@ func (l *FollowerSyncProxy) syncReceive() error {
 	return nil
 }
 
+//
+// Commit the entries that this follower has logged, but not committed, before
+// synchronization (e.g. the previous leader fails before its commit reaches
+// this follower).  The leader does not stream these entries again, since they
+// are not more recent than the last logged txid of this follower.
+//
+func (l *FollowerSyncProxy) commitLoggedEntries(lastCommittedFromLeader common.Txnid) error {
+
+	lastCommitted, err := l.handler.GetLastCommittedTxid()
+	if err != nil {
+		return err
+	}
+
+	if common.CompareTxnid(lastCommittedFromLeader, lastCommitted) != common.MORE_RECENT {
+		return nil
+	}
+
+	logChan, errChan, killch, err := l.handler.GetCommitedEntries(lastCommitted, lastCommittedFromLeader)
+	if logChan == nil || errChan == nil || err != nil {
+		return err
+	}
+
+	// Collect the entries before committing, so the log is not
+	// updated while being iterated.
+	entries := make([]LogEntryMsg, 0, common.MAX_PROPOSALS)
+	for entry := range logChan {
+		if common.CompareTxnid(common.Txnid(entry.GetTxnid()), lastCommittedFromLeader) == common.MORE_RECENT {
+			killch <- true
+			break
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, entry := range entries {
+		l.handler.GetLogger().Debugf("FollowerSyncProxy.commitLoggedEntries(): Commit logged entry.  Txid : %d", entry.GetTxnid())
+
+		if err := l.handler.LogAndCommit(common.Txnid(entry.GetTxnid()),
+			entry.GetOpCode(),
+			entry.GetKey(),
+			entry.GetContent(),
+			true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Private Function
 /////////////////////////////////////////////////////////////////////////////
 
-func listen(name string, pipe *common.PeerPipe) (common.Packet, error) {
+func listen(name string, pipe common.Pipe) (common.Packet, error) {
 
 	reqch := pipe.ReceiveChannel()
 	req, ok := <-reqch
@@ -1235,9 +1370,9 @@ func listen(name string, pipe *common.PeerPipe) (common.Packet, error) {
 	return req, nil
 }
 
-func send(packet common.Packet, pipe *common.PeerPipe) error {
+func send(packet common.Packet, pipe common.Pipe) error {
 
-	log.Printf("SyncProxy.send(): sending packet %s to peer (TCP %s)", packet.Name(), pipe.GetAddr())
+	common.Debugf("SyncProxy.send(): sending packet %s to peer (TCP %s)", packet.Name(), pipe.GetAddr())
 	if !pipe.Send(packet) {
 		return common.NewError(common.SERVER_ERROR, fmt.Sprintf("SyncProxy.listen(): Fail to send packet %s to peer (TCP %s)",
 			packet.Name(), pipe.GetAddr()))
@@ -17,9 +17,9 @@ package protocol
 
 import (
 	"github.com/couchbase/gometa/common"
-	"log"
 	"net"
 	"runtime/debug"
+	"sort"
 	"sync"
 	"time"
 )
@@ -36,7 +36,7 @@ import (
 // 3) poll worker - recieve votes from other voters and determine if majority is reached
 //
 type ElectionSite struct {
-	messenger *common.PeerMessenger
+	messenger common.Messenger
 	master    *ballotMaster
 	worker    *pollWorker
 
@@ -45,6 +45,7 @@ type ElectionSite struct {
 	fullEnsemble []string
 	factory      MsgFactory
 	handler      ActionHandler
+	state        *ElectionState
 
 	mutex    sync.Mutex
 	isClosed bool
@@ -59,7 +60,18 @@ type ballotResult struct {
 
 type Ballot struct {
 	result   *ballotResult
-	resultch chan bool // should only be closed by pollWorker
+	resultch chan bool      // should only be closed by pollWorker
+	votes    map[string]int // number of votes received from each voter (key : voter UDP address)
+}
+
+//
+// A preBallot asks the peers if they would join a new round started
+// by this node, before the node actually starts the new round.
+//
+type preBallot struct {
+	round    uint64
+	granted  map[string]bool // the map key is voter UDP address
+	resultch chan bool       // should only be closed by pollWorker
 }
 
 type ballotMaster struct {
@@ -73,15 +85,21 @@ type ballotMaster struct {
 }
 
 type pollWorker struct {
-	site     *ElectionSite
-	ballot   *Ballot
-	listench chan *Ballot
-	killch   chan bool
+	site        *ElectionSite
+	ballot      *Ballot
+	preBallot   *preBallot
+	listench    chan *Ballot
+	prelistench chan *preBallot
+	killch      chan bool
 }
 
 //
-// The election round is incremented for every new election being run in
-// this process.    If there is an ensemble of peers are running election,
+// ElectionState is the state of leader election that is remembered across
+// the elections of a node.  Each node should use its own ElectionState for
+// all its elections.
+//
+// The election round is incremented for every new election being run by
+// this node.    If there is an ensemble of peers are running election,
 // these peers will need to be in the same round in order to achieve quorum.
 // Essentially, if a peer joins an electing ensemble, it can either join
 // the current round of voting or start a new round.  If it start a new round,
@@ -90,14 +108,46 @@ type pollWorker struct {
 // The sycnhronization (recovery) phase will double check if a quorum of followers
 // agree to the leader before the algorithm is fully converged.
 //
-var gElectionRound uint64 = 0
+// The protocol version of the peers is learned from their votes, such that a
+// new message type is used during election only after every peer is known to
+// support it.
+//
+type ElectionState struct {
+	mutex        sync.Mutex
+	round        uint64
+	peerVersions map[string]uint32 // key : voter UDP address, value : protocol version learned from votes
+	last         *ElectionResult   // outcome of the last election
+}
+
+//
+// The outcome of an election run by this node.
+//
+type ElectionResult struct {
+	Start      time.Time // when the ballot is cast
+	Duration   time.Duration
+	FirstRound uint64      // round of the initial ballot
+	Round      uint64      // round of the ballot when the election ends
+	Winner     string      // election address of the winner (empty if the election fails)
+	Votes      []*PeerVote // sorted by voter
+}
+
+//
+// The votes of a peer (or of this node) during an election.
+//
+type PeerVote struct {
+	Voter     string // election address of the voter
+	Received  int    // number of votes received from the voter
+	Candidate string // candidate of the vote counted for the ballot (empty if no vote is counted)
+	Round     uint64 // round of the vote counted for the ballot
+}
 
 /////////////////////////////////////////////////////////////////////////////
 // ElectionSite (Public API)
 /////////////////////////////////////////////////////////////////////////////
 
 //
-// Create ElectionSite
+// Create ElectionSite.  The votes are sent using the default
+// election transport (common.ELECTION_TRANSPORT_TYPE).
 //
 func CreateElectionSite(laddr string,
 	peers []string,
@@ -105,33 +155,104 @@ func CreateElectionSite(laddr string,
 	handler ActionHandler,
 	solicitOnly bool) (election *ElectionSite, err error) {
 
+	return CreateElectionSiteWithTransport(laddr, peers, factory, handler, solicitOnly, common.ELECTION_TRANSPORT_TYPE)
+}
+
+//
+// Create ElectionSite using the given transport ("udp" or "tcp") for
+// sending votes.  All the peers in the ensemble must use the same transport.
+//
+func CreateElectionSiteWithTransport(laddr string,
+	peers []string,
+	factory MsgFactory,
+	handler ActionHandler,
+	solicitOnly bool,
+	transport string) (election *ElectionSite, err error) {
+
+	return CreateElectionSiteWithState(laddr, peers, factory, handler, solicitOnly, transport, NewElectionState())
+}
+
+//
+// Create ElectionSite with the election state remembered from the
+// previous elections of this node.
+//
+func CreateElectionSiteWithState(laddr string,
+	peers []string,
+	factory MsgFactory,
+	handler ActionHandler,
+	solicitOnly bool,
+	transport string,
+	state *ElectionState) (election *ElectionSite, err error) {
+
 	// create a full ensemble (including the local host)
 	en, fullEn, err := cloneEnsemble(peers, laddr)
 	if err != nil {
 		return nil, err
 	}
 
-	election = &ElectionSite{isClosed: false,
-		factory:      factory,
-		handler:      handler,
-		ensemble:     en,
-		fullEnsemble: fullEn,
-		solicitOnly:  solicitOnly}
-
 	// Create a new messenger
-	election.messenger, err = newMessenger(laddr)
+	messenger, err := NewElectionMessenger(laddr, transport)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a new ballot master
-	election.master = newBallotMaster(election)
+	return createElectionSite(messenger, en, fullEn, factory, handler, solicitOnly, state), nil
+}
 
-	// Create a new poll worker.  This will start the
-	// goroutine for the pollWorker.
-	election.worker = startPollWorker(election)
+//
+// Create ElectionSite that sends votes through the given messenger.  This
+// allows multiple consensus groups on the same node to share a single
+// messenger (see MessengerDemux).  The messenger is closed when the
+// ElectionSite is closed.
+//
+func CreateElectionSiteWithMessenger(messenger common.Messenger,
+	peers []string,
+	factory MsgFactory,
+	handler ActionHandler,
+	solicitOnly bool,
+	state *ElectionState) (election *ElectionSite, err error) {
 
-	return election, nil
+	// create a full ensemble (including the local host)
+	en, fullEn, err := cloneEnsemble(peers, messenger.GetLocalAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	return createElectionSite(messenger, en, fullEn, factory, handler, solicitOnly, state), nil
+}
+
+//
+// Create a messenger for sending votes using the given transport
+// ("udp" or "tcp").
+//
+func NewElectionMessenger(laddr string, transport string) (common.Messenger, error) {
+
+	return NewElectionMessengerWithTransport(laddr, transport, common.NewNetTransport())
+}
+
+//
+// Create a messenger for sending votes over the given network.  The
+// kind of transport ("udp" or "tcp") tells whether the votes are
+// sent as datagrams or over stream connections.
+//
+func NewElectionMessengerWithTransport(laddr string, kind string, transport common.Transport) (common.Messenger, error) {
+
+	switch kind {
+	case "tcp":
+		messenger, err := common.NewTCPPeerMessengerWithTransport(laddr, nil, transport)
+		if err != nil {
+			return nil, err
+		}
+		return messenger, nil
+	case "", "udp":
+		messenger, err := common.NewPeerMessengerWithTransport(laddr, nil, transport)
+		if err != nil {
+			return nil, err
+		}
+		return messenger, nil
+	}
+
+	return nil, common.NewError(common.ARG_ERROR, "Unknown election transport "+kind)
 }
 
 //
@@ -165,8 +286,8 @@ func (e *ElectionSite) Close() {
 
 	if !e.isClosed {
 		if common.Debug() {
-			log.Printf("ElectionSite.Close() : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			e.handler.GetLogger().Tracef("ElectionSite.Close() : Diagnostic Stack ...")
+			e.handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 
 		e.isClosed = true
@@ -243,11 +364,28 @@ func (s *ElectionSite) createVoteFromCurState() VoteMsg {
 		s.messenger.GetLocalAddr(), // this is localhost UDP port
 		uint64(lastLoggedTxid),
 		uint64(lastCommittedTxid),
-		s.solicitOnly)
+		s.solicitOnly,
+		s.handler.GetPriority())
 
 	return vote
 }
 
+//
+// Tell if the vote is for a candidate of an older epoch than my current
+// epoch (which is persisted).  The round and the epoch are authenticated
+// with the rest of the vote (see common.AuthTransport), but the rounds
+// restart with the node, so a vote recorded in an earlier election can
+// have a round as recent as mine.  The epoch does not go back.
+//
+func (s *ElectionSite) isStaleVote(vote VoteMsg) bool {
+
+	epoch, err := s.handler.GetCurrentEpoch()
+	if err != nil {
+		return false
+	}
+	return common.CompareEpoch(vote.GetEpoch(), epoch) == common.LESS_RECENT
+}
+
 //
 // Tell if a particular voter is in the ensemble
 //
@@ -260,6 +398,45 @@ func (s *ElectionSite) inEnsemble(voter net.Addr) bool {
 	return false
 }
 
+//
+// Check if the voter runs a protocol version compatible with mine.  If so,
+// remember the version that the voter runs with me.
+//
+func (s *ElectionSite) acceptVersion(voter net.Addr, vote VoteMsg) bool {
+
+	version, err := common.NegotiateVersion(vote.GetMinVersion(), vote.GetVersion())
+	if err != nil {
+		s.handler.GetLogger().Warnf("ElectionSite.acceptVersion(): Refuse vote from %s.  Error = %s", voter.String(), err.Error())
+		return false
+	}
+
+	s.state.setPeerVersion(voter.String(), version)
+	return true
+}
+
+//
+// Return true if every peer in the ensemble is known to support the
+// message.  A peer that has not voted yet is assumed to run the lowest
+// protocol version.
+//
+func (s *ElectionSite) isMessageEnabled(name string) bool {
+
+	required := common.GetMessageVersion(name)
+	if required <= common.MIN_PROTOCOL_VERSION {
+		return true
+	}
+	if required > common.PROTOCOL_VERSION {
+		return false
+	}
+
+	for _, peer := range s.ensemble {
+		if s.state.getPeerVersion(peer.String()) < required {
+			return false
+		}
+	}
+	return true
+}
+
 //
 // Create an ensemble for voting
 //
@@ -282,6 +459,63 @@ func cloneEnsemble(peers []string, laddr string) ([]net.Addr, []string, error) {
 	return en, fullEn, nil
 }
 
+/////////////////////////////////////////////////////////////////////////////
+// ElectionState
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a new ElectionState for a node that has not run any election.
+//
+func NewElectionState() *ElectionState {
+	return &ElectionState{round: 0,
+		peerVersions: make(map[string]uint32)}
+}
+
+func (s *ElectionState) getRound() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.round
+}
+
+func (s *ElectionState) setRound(round uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.round = round
+}
+
+func (s *ElectionState) getPeerVersion(peer string) uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.peerVersions[peer]
+}
+
+func (s *ElectionState) setPeerVersion(peer string, version uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.peerVersions[peer] = version
+}
+
+//
+// Return the outcome of the last election (nil if there is no election).
+//
+func (s *ElectionState) GetLastElection() *ElectionResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.last
+}
+
+func (s *ElectionState) setLastElection(result *ElectionResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.last = result
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // ballotMaster
 /////////////////////////////////////////////////////////////////////////////
@@ -293,7 +527,7 @@ func newBallotMaster(site *ElectionSite) *ballotMaster {
 
 	master := &ballotMaster{site: site,
 		winner: nil,
-		round:  gElectionRound,
+		round:  site.state.getRound(),
 		inProg: false}
 
 	return master
@@ -311,7 +545,7 @@ func (b *ballotMaster) castBallot(winnerch chan string) {
 	// successful.
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in ballotMaster.castBallot() : %s\n", r)
+			b.site.handler.GetLogger().Errorf("panic in ballotMaster.castBallot() : %s", r)
 			common.SafeRun("ballotMaster.castBallot()",
 				func() {
 					b.site.Close()
@@ -327,18 +561,40 @@ func (b *ballotMaster) castBallot(winnerch chan string) {
 			})
 	}()
 
+	// A watcher does not take part in the election.
+	start := b.site.handler.GetClock().Now()
+	if !b.site.solicitOnly {
+		electionsStarted.With(b.site.handler.GetMetricLabels()).Inc()
+	}
+
 	// create a channel to receive the ballot result
 	// should only be closed by Poll Worker.  Make
 	// if buffered so the sender won't block.
 	resultch := make(chan bool, 1)
 
+	// Before starting a new round, ask the peers if they would join it.
+	// If a quorum of peers does not agree (e.g. there is an active leader),
+	// then cast the ballot in the current round.  A peer that rejoins the
+	// network can then learn about the active leader without dragging the
+	// ensemble into a new round.  A watcher never disrupts the ensemble,
+	// so it does not need to ask.
+	newRound := b.site.solicitOnly || !b.site.isMessageEnabled("PreVote") || b.runPreVote()
+
 	// Create a new ballot
-	ballot := b.createInitialBallot(resultch)
+	ballot := b.createInitialBallot(resultch, newRound)
+	firstRound := ballot.result.proposed.GetRound()
 
 	// Tell the worker to observe this ballot.  This forces
 	// the worker to start collecting new ballot result.
 	b.site.worker.observe(ballot)
 
+	// The site may have been closed during the pre-vote.  If the worker
+	// has already terminated, nobody would close this ballot.
+	if b.site.IsClosed() {
+		b.site.state.setLastElection(b.createElectionResult(nil, start, firstRound, false))
+		return
+	}
+
 	// let the peer to know about this ballot.  It is expected
 	// that the peer will reply with a vote.
 	b.site.messenger.Multicast(ballot.result.proposed, b.site.ensemble)
@@ -349,6 +605,10 @@ func (b *ballotMaster) castBallot(winnerch chan string) {
 		success = false
 	}
 
+	// The worker no longer updates the ballot once the result is sent
+	// (or the channel is closed).
+	b.site.state.setLastElection(b.createElectionResult(ballot, start, firstRound, success))
+
 	// Announce the winner
 	if success {
 		winner, ok := b.GetWinner()
@@ -356,7 +616,15 @@ func (b *ballotMaster) castBallot(winnerch chan string) {
 			common.SafeRun("ballotMaster.castBallot()",
 				func() {
 					// Remember the last round.
-					gElectionRound = b.round
+					b.site.state.setRound(b.round)
+
+					if !b.site.solicitOnly {
+						electionDuration.With(b.site.handler.GetMetricLabels()).ObserveSinceWithClock(b.site.handler.GetClock(), start)
+						if winner == b.site.messenger.GetLocalAddr() {
+							electionsWon.With(b.site.handler.GetMetricLabels()).Inc()
+						}
+					}
+
 					// Announce the result
 					winnerch <- winner
 				})
@@ -364,6 +632,53 @@ func (b *ballotMaster) castBallot(winnerch chan string) {
 	}
 }
 
+//
+// Create the outcome of an election.  The ballot must be done, or nil if
+// it is not cast.
+//
+func (b *ballotMaster) createElectionResult(ballot *Ballot, start time.Time, firstRound uint64,
+	success bool) *ElectionResult {
+
+	result := &ElectionResult{Start: start,
+		Duration:   b.site.handler.GetClock().Now().Sub(start),
+		FirstRound: firstRound,
+		Round:      firstRound}
+
+	if success {
+		result.Winner, _ = b.GetWinner()
+	}
+
+	if ballot == nil {
+		return result
+	}
+	result.Round = ballot.result.proposed.GetRound()
+
+	votes := make(map[string]*PeerVote)
+	getVote := func(voter string) *PeerVote {
+		vote, ok := votes[voter]
+		if !ok {
+			vote = &PeerVote{Voter: voter}
+			votes[voter] = vote
+			result.Votes = append(result.Votes, vote)
+		}
+		return vote
+	}
+
+	for voter, count := range ballot.votes {
+		getVote(voter).Received = count
+	}
+	for _, counted := range []map[string]VoteMsg{ballot.result.activePeers, ballot.result.receivedVotes} {
+		for voter, msg := range counted {
+			vote := getVote(voter)
+			vote.Candidate = msg.GetCndId()
+			vote.Round = msg.GetRound()
+		}
+	}
+
+	sort.Sort(peerVotesByVoter(result.Votes))
+	return result
+}
+
 //
 // close the ballot master.
 //
@@ -401,24 +716,65 @@ func (b *ballotMaster) getNextRound() uint64 {
 }
 
 //
-// Create a ballot
+// Create a ballot.  If newRound is false, the ballot is cast
+// in the current round.
 //
-func (b *ballotMaster) createInitialBallot(resultch chan bool) *Ballot {
+func (b *ballotMaster) createInitialBallot(resultch chan bool, newRound bool) *Ballot {
 
 	result := &ballotResult{winningEpoch: 0,
 		receivedVotes: make(map[string]VoteMsg),
 		activePeers:   make(map[string]VoteMsg)}
 
 	ballot := &Ballot{result: result,
-		resultch: resultch}
+		resultch: resultch,
+		votes:    make(map[string]int)}
 
-	b.getNextRound()
+	if newRound {
+		b.getNextRound()
+	}
 	newVote := b.site.createVoteFromCurState()
 	ballot.updateProposed(newVote, b.site)
 
 	return ballot
 }
 
+//
+// Ask the peers if they would join a new round started by me.
+// Return true if a quorum of peers (including myself) agrees
+// before the pre-vote times out.
+//
+func (b *ballotMaster) runPreVote() bool {
+
+	// create a channel to receive the pre-vote result.  Make it
+	// buffered so the pollWorker won't block if the pre-vote
+	// has timed out.
+	resultch := make(chan bool, 1)
+
+	pre := &preBallot{round: b.getCurrentRound() + 1,
+		granted:  make(map[string]bool),
+		resultch: resultch}
+
+	// I always agree to my own round
+	pre.granted[b.site.messenger.GetLocalAddr()] = true
+
+	// Tell the worker to collect the pre-vote responses.
+	b.site.worker.observePreVote(pre)
+
+	msg := b.site.factory.CreatePreVote(pre.round, b.site.messenger.GetLocalAddr())
+	b.site.messenger.Multicast(msg, b.site.ensemble)
+
+	timeout := b.site.handler.GetClock().After(common.PREVOTE_TIMEOUT * time.Millisecond)
+
+	select {
+	case success, ok := <-resultch:
+		return ok && success
+	case <-timeout:
+		b.site.handler.GetLogger().Infof("ballotMaster.runPreVote(): Pre-vote for round %d does not reach quorum.  Stay in current round.", pre.round)
+	}
+
+	return false
+}
+
 //
 // Copy a winning vote.  This function is called when
 // there is no active ballot going on.
@@ -438,7 +794,8 @@ func (b *ballotMaster) cloneWinningVote() VoteMsg {
 			b.winner.proposed.GetCndId(),
 			b.winner.proposed.GetCndLoggedTxnId(),
 			b.winner.proposed.GetCndCommittedTxnId(),
-			b.site.solicitOnly)
+			b.site.solicitOnly,
+			b.winner.proposed.GetCndPriority())
 	}
 
 	return nil
@@ -551,9 +908,11 @@ func (b *Ballot) resetAndUpdateProposed(proposed VoteMsg, site *ElectionSite) {
 func startPollWorker(site *ElectionSite) *pollWorker {
 
 	worker := &pollWorker{site: site,
-		ballot:   nil,
-		killch:   make(chan bool, 1),    // make sure sender won't block
-		listench: make(chan *Ballot, 1)} // make sure sender won't block
+		ballot:      nil,
+		preBallot:   nil,
+		killch:      make(chan bool, 1),       // make sure sender won't block
+		listench:    make(chan *Ballot, 1),    // make sure sender won't block
+		prelistench: make(chan *preBallot, 1)} // make sure sender won't block
 
 	go worker.listen()
 
@@ -570,6 +929,13 @@ func (w *pollWorker) observe(ballot *Ballot) {
 	w.listench <- ballot
 }
 
+//
+// Notify the pollWorker that there is a new pre-vote.
+//
+func (w *pollWorker) observePreVote(pre *preBallot) {
+	w.prelistench <- pre
+}
+
 //
 // Close the pollWorker
 //
@@ -594,7 +960,7 @@ func (w *pollWorker) listen() {
 	// won't get blocked forever.
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in pollWorker.listen() : %s\n", r)
+			w.site.handler.GetLogger().Errorf("panic in pollWorker.listen() : %s", r)
 		}
 
 		// make sure we close the ElectionSite first such that
@@ -614,19 +980,27 @@ func (w *pollWorker) listen() {
 					w.ballot = nil
 				}
 			})
+
+		common.SafeRun("pollWorker.listen()",
+			func() {
+				if w.preBallot != nil {
+					close(w.preBallot.resultch)
+					w.preBallot = nil
+				}
+			})
 	}()
 
 	// Get the channel for receiving votes from the peer.
 	reqch := w.site.messenger.DefaultReceiveChannel()
 
-	timeout := common.NewBackoffTimer(
+	timeout := common.NewBackoffTimerWithClock(w.site.handler.GetClock(),
 		common.BALLOT_TIMEOUT*time.Millisecond,
 		common.BALLOT_MAX_TIMEOUT*time.Millisecond,
 		2,
 	)
 
 	inFinalize := false
-	finalizeTimer := common.NewStoppedResettableTimer(common.BALLOT_FINALIZE_WAIT * time.Millisecond)
+	finalizeTimer := common.NewStoppedResettableTimerWithClock(w.site.handler.GetClock(), common.BALLOT_FINALIZE_WAIT*time.Millisecond)
 
 	for {
 		select {
@@ -641,6 +1015,10 @@ func (w *pollWorker) listen() {
 					w.site.master.setWinner(w.ballot.result)
 					w.ballot.resultch <- true
 					w.ballot = nil
+
+					// The finalize timer may still be running for the previous ballot.
+					inFinalize = false
+					finalizeTimer.Stop()
 				} else {
 					// There is a new ballot.
 					timeout.Reset()
@@ -648,6 +1026,12 @@ func (w *pollWorker) listen() {
 					finalizeTimer.Stop()
 				}
 			}
+		case w.preBallot = <-w.prelistench: // prelistench should never close
+			{
+				// See if we reach quorum already.  This should only happen
+				// if there is only one server in the ensemble.
+				w.checkPreVoteQuorum()
+			}
 		// Receiving a vote
 		case msg, ok := <-reqch:
 			{
@@ -655,11 +1039,21 @@ func (w *pollWorker) listen() {
 					return
 				}
 
+				// Pre-vote messages are not part of the ballot.
+				if w.handlePreVote(msg) {
+					continue
+				}
+
 				// Receive a new vote.  The voter is identified by its UDP port,
 				// which must remain the same during the election phase.
 				vote := msg.Content.(VoteMsg)
 				voter := msg.Peer
 
+				// Refuse the vote if the voter cannot talk to me.
+				if !w.site.acceptVersion(voter, vote) {
+					continue
+				}
+
 				// If I am receiving a vote that just for soliciting my response,
 				// then respond with my winning vote only after I am confirmed as
 				// either a leader or follower.  This ensure that the watcher will
@@ -688,7 +1082,18 @@ func (w *pollWorker) listen() {
 					continue
 				}
 
+				// A vote for a candidate of an older epoch than my current epoch
+				// is not counted, and does not change my round: the candidate
+				// cannot win against my own repository, and the vote may be
+				// replayed from an earlier election (see isStaleVote).  Send my
+				// vote back, such that a voter that is behind can catch up.
+				if w.site.isStaleVote(vote) {
+					w.site.messenger.Send(w.cloneProposedVote(), voter)
+					continue
+				}
+
 				timeout.Reset()
+				w.ballot.votes[voter.String()]++
 
 				proposed := w.cloneProposedVote()
 				if w.handleVote(voter, vote) {
@@ -709,6 +1114,11 @@ func (w *pollWorker) listen() {
 			}
 		case <-finalizeTimer.C:
 			{
+				inFinalize = false
+				if w.ballot == nil {
+					continue
+				}
+
 				// we achieve quorum, set the winner.
 				// setting the winner and usetting the ballot
 				// should be done together.
@@ -752,6 +1162,79 @@ func (w *pollWorker) respondInquiry(voter net.Addr, vote VoteMsg) {
 	}
 }
 
+//
+// Handle a pre-vote request or response.  Return false if the
+// message is not a pre-vote message.
+//
+func (w *pollWorker) handlePreVote(msg *common.Message) bool {
+
+	switch msg.Content.Name() {
+	case "PreVote":
+		if w.site.inEnsemble(msg.Peer) {
+			w.respondPreVote(msg.Peer, msg.Content.(PreVoteMsg))
+		}
+		return true
+	case "PreVoteResponse":
+		if w.site.inEnsemble(msg.Peer) {
+			w.acceptPreVoteResponse(msg.Peer, msg.Content.(PreVoteResponseMsg))
+		}
+		return true
+	}
+
+	return false
+}
+
+//
+// Tell the candidate if I would join a new round started by it.  If I
+// am leading or following, there is an active leader known to me.  Refuse
+// the pre-vote such that the candidate will not drag the ensemble into a
+// new round.
+//
+func (w *pollWorker) respondPreVote(voter net.Addr, pre PreVoteMsg) {
+
+	status := w.site.handler.GetStatus()
+	granted := status != LEADING && status != FOLLOWING
+
+	msg := w.site.factory.CreatePreVoteResponse(pre.GetRound(), uint32(status), granted)
+	w.site.messenger.Send(msg, voter)
+}
+
+//
+// Count the response for the outstanding pre-vote.
+//
+func (w *pollWorker) acceptPreVoteResponse(voter net.Addr, resp PreVoteResponseMsg) {
+
+	// Ignore the response if it is not for the outstanding pre-vote.
+	if w.preBallot == nil || w.preBallot.round != resp.GetRound() {
+		return
+	}
+
+	if resp.GetGranted() {
+		w.preBallot.granted[voter.String()] = true
+		w.checkPreVoteQuorum()
+	}
+}
+
+//
+// Announce the pre-vote result if it has reached quorum.
+//
+func (w *pollWorker) checkPreVoteQuorum() {
+
+	if w.preBallot == nil {
+		return
+	}
+
+	voters := make([]string, 0, len(w.preBallot.granted))
+	for voter := range w.preBallot.granted {
+		voters = append(voters, voter)
+	}
+
+	if w.site.handler.GetQuorumVerifier().HasQuorum(voters) {
+		w.preBallot.resultch <- true
+		w.preBallot = nil
+	}
+}
+
 //
 // Handle a new vote.
 //
@@ -884,8 +1367,11 @@ func (w *pollWorker) handleVoteForActivePeer(voter net.Addr, vote VoteMsg) bool
 
 	// Check the quorum only for the active peers.   In this case, the vote
 	// can have a different round than mime.   There may already be an established
-	// ensemble and I am merely trying to join them.
-	if w.checkQuorum(w.ballot.result.activePeers, vote) && w.certifyLeader(vote) {
+	// ensemble and I am merely trying to join them.  My own vote counts as well,
+	// since I will follow the leader once I accept the vote.  Otherwise, I cannot
+	// rejoin after the members change, until a quorum of the new members (without
+	// me) is active (see Server.setMembers).
+	if w.checkQuorum(w.addLocalVote(w.ballot.result.activePeers, vote), vote) && w.certifyLeader(vote) {
 
 		w.ballot.updateProposed(vote, w.site)
 		return true
@@ -917,7 +1403,21 @@ func (w *pollWorker) compareRound(vote VoteMsg) common.CompareResult {
 //
 func (w *pollWorker) compareVote(vote1, vote2 VoteMsg) common.CompareResult {
 
-	// Vote with the larger epoch always is larger
+	// Vote with the larger epoch is larger.  The priority is not used in
+	// the epoch comparison, even if both candidates have logged the same
+	// txnid:
+	// 1) A candidate with an older epoch may have logged proposals that
+	//    are not in the history established by the newer epoch.  Electing
+	//    it could commit these proposals.
+	// 2) The order of the votes would not be transitive (e.g. A with epoch
+	//    6, txnid X; B with epoch 5, txnid X and a higher priority; D with
+	//    epoch 5, txnid Z > X gives A > D > B > A), and the ballots may
+	//    never converge.
+	// Once the followers are synchronized with the leader, they have the
+	// same epoch, so the priority decides among the caught-up candidates of
+	// the next election.  The leader hands over to a caught-up follower
+	// with a higher priority (see Leader.findPreferredLeader), so a
+	// preferred candidate that loses on its epoch leads once it catches up.
 	result := common.CompareEpoch(vote1.GetEpoch(), vote2.GetEpoch())
 
 	if result == common.MORE_RECENT {
@@ -930,11 +1430,13 @@ func (w *pollWorker) compareVote(vote1, vote2 VoteMsg) common.CompareResult {
 
 	// If a candidate has a larger logged txid, it means the candidate
 	// has processed more proposals.   This vote is larger.
-	if vote1.GetCndLoggedTxnId() > vote2.GetCndLoggedTxnId() {
+	result = common.CompareTxnid(common.Txnid(vote1.GetCndLoggedTxnId()), common.Txnid(vote2.GetCndLoggedTxnId()))
+
+	if result == common.MORE_RECENT {
 		return common.GREATER
 	}
 
-	if vote1.GetCndLoggedTxnId() < vote2.GetCndLoggedTxnId() {
+	if result == common.LESS_RECENT {
 		return common.LESSER
 	}
 
@@ -942,14 +1444,22 @@ func (w *pollWorker) compareVote(vote1, vote2 VoteMsg) common.CompareResult {
 	// the other one. But if a candidate has a larger committed txid,
 	// it means this candidate also has processed more commit messages from the
 	// previous leader.   This vote is larger.
-	if vote1.GetCndCommittedTxnId() > vote2.GetCndCommittedTxnId() {
+	result = common.CompareTxnid(common.Txnid(vote1.GetCndCommittedTxnId()), common.Txnid(vote2.GetCndCommittedTxnId()))
+
+	if result == common.MORE_RECENT {
 		return common.GREATER
 	}
 
-	if vote1.GetCndCommittedTxnId() < vote2.GetCndCommittedTxnId() {
+	if result == common.LESS_RECENT {
 		return common.LESSER
 	}
 
+	// Both candidates are equally caught-up.  Prefer the candidate
+	// with the higher priority.
+	if result := w.comparePriority(vote1, vote2); result != common.EQUAL {
+		return result
+	}
+
 	// All else is equal (e.g. during inital system startup -- repository is emtpy),
 	// use the ip address.
 	if vote1.GetCndId() > vote2.GetCndId() {
@@ -963,6 +1473,22 @@ func (w *pollWorker) compareVote(vote1, vote2 VoteMsg) common.CompareResult {
 	return common.EQUAL
 }
 
+//
+// Compare the candidate priority of two votes.
+//
+func (w *pollWorker) comparePriority(vote1, vote2 VoteMsg) common.CompareResult {
+
+	if vote1.GetCndPriority() > vote2.GetCndPriority() {
+		return common.GREATER
+	}
+
+	if vote1.GetCndPriority() < vote2.GetCndPriority() {
+		return common.LESSER
+	}
+
+	return common.EQUAL
+}
+
 //
 // Compare the given vote with currennt state (epoch, lastLoggedTxnid)
 //
@@ -1003,21 +1529,39 @@ func (w *pollWorker) acceptAndCheckQuorum(voter net.Addr, vote VoteMsg) bool {
 //
 func (w *pollWorker) checkQuorum(votes map[string]VoteMsg, candidate VoteMsg) bool {
 
-	count := 0
-	for _, vote := range votes {
+	voters := make([]string, 0, len(votes))
+	for voter, vote := range votes {
 		if PeerStatus(vote.GetStatus()) == ELECTING ||
 			PeerStatus(candidate.GetStatus()) == ELECTING {
 			if w.compareVote(vote, candidate) == common.EQUAL &&
 				vote.GetRound() == candidate.GetRound() {
-				count++
+				voters = append(voters, voter)
 			}
 		} else if vote.GetCndId() == candidate.GetCndId() &&
 			vote.GetEpoch() == candidate.GetEpoch() {
-			count++
+			voters = append(voters, voter)
 		}
 	}
 
-	return w.site.handler.GetQuorumVerifier().HasQuorum(count)
+	return w.site.handler.GetQuorumVerifier().HasQuorum(voters)
+}
+
+//
+// Return the votes with my vote for the candidate, unless I am the candidate.
+//
+func (w *pollWorker) addLocalVote(votes map[string]VoteMsg, candidate VoteMsg) map[string]VoteMsg {
+
+	local := w.site.messenger.GetLocalAddr()
+	if candidate.GetCndId() == local {
+		return votes
+	}
+
+	result := make(map[string]VoteMsg, len(votes)+1)
+	for voter, vote := range votes {
+		result[voter] = vote
+	}
+	result[local] = candidate
+	return result
 }
 
 //
@@ -1034,7 +1578,8 @@ func (w *pollWorker) cloneProposedVote() VoteMsg {
 		w.ballot.result.proposed.GetCndId(),
 		w.ballot.result.proposed.GetCndLoggedTxnId(),
 		w.ballot.result.proposed.GetCndCommittedTxnId(),
-		w.site.solicitOnly)
+		w.site.solicitOnly,
+		w.ballot.result.proposed.GetCndPriority())
 }
 
 //
@@ -1060,12 +1605,35 @@ func (w *pollWorker) certifyLeader(vote VoteMsg) bool {
 // Private Function
 /////////////////////////////////////////////////////////////////////////////
 
-func newMessenger(laddr string) (*common.PeerMessenger, error) {
+func createElectionSite(messenger common.Messenger,
+	en []net.Addr,
+	fullEn []string,
+	factory MsgFactory,
+	handler ActionHandler,
+	solicitOnly bool,
+	state *ElectionState) *ElectionSite {
 
-	messenger, err := common.NewPeerMessenger(laddr, nil)
-	if err != nil {
-		return nil, err
-	}
+	election := &ElectionSite{isClosed: false,
+		messenger:    messenger,
+		factory:      factory,
+		handler:      handler,
+		ensemble:     en,
+		fullEnsemble: fullEn,
+		solicitOnly:  solicitOnly,
+		state:        state}
 
-	return messenger, nil
+	// Create a new ballot master
+	election.master = newBallotMaster(election)
+
+	// Create a new poll worker.  This will start the
+	// goroutine for the pollWorker.
+	election.worker = startPollWorker(election)
+
+	return election
 }
+
+type peerVotesByVoter []*PeerVote
+
+func (v peerVotesByVoter) Len() int           { return len(v) }
+func (v peerVotesByVoter) Less(i, j int) bool { return v[i].Voter < v[j].Voter }
+func (v peerVotesByVoter) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
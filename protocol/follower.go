@@ -18,7 +18,6 @@ package protocol
 import (
 	"fmt"
 	"github.com/couchbase/gometa/common"
-	"log"
 	"runtime/debug"
 	"sync"
 )
@@ -29,7 +28,7 @@ import (
 
 type Follower struct {
 	kind     PeerRole
-	pipe     *common.PeerPipe
+	pipe     common.Pipe
 	pendings []ProposalMsg
 	handler  ActionHandler
 	factory  MsgFactory
@@ -51,7 +50,7 @@ type Follower struct {
 // to leader.
 //
 func NewFollower(kind PeerRole,
-	pipe *common.PeerPipe,
+	pipe common.Pipe,
 	handler ActionHandler,
 	factory MsgFactory) *Follower {
 
@@ -90,7 +89,7 @@ func (f *Follower) GetFollowerId() string {
 // Forward the request to the leader
 //
 func (f *Follower) ForwardRequest(request RequestMsg) bool {
-	log.Printf("Follower.ForwardRequest(): Follower %s forward request to leader (TCP %s)",
+	f.handler.GetLogger().Debugf("Follower.ForwardRequest(): Follower %s forward request to leader (TCP %s)",
 		f.GetFollowerId(), f.pipe.GetAddr())
 	return f.pipe.Send(request)
 
@@ -130,11 +129,11 @@ func (f *Follower) startListener() {
 	defer func() {
 
 		if r := recover(); r != nil {
-			log.Printf("panic in Follower.startListener() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			f.handler.GetLogger().Errorf("panic in Follower.startListener() : %s", r)
+			f.handler.GetLogger().Errorf("%s", debug.Stack())
 		} else if common.Debug() {
-			log.Printf("Follower.startListener() terminates: Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			f.handler.GetLogger().Tracef("Follower.startListener() terminates: Diagnostic Stack ...")
+			f.handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 
 		common.SafeRun("Follower.startListener()",
@@ -153,12 +152,12 @@ func (f *Follower) startListener() {
 				err := f.handleMessage(msg.(common.Packet))
 				if err != nil {
 					// If there is an error, terminate
-					log.Printf("Follower.startListener(): There is an error in handling leader message.  Error = %s.  Terminate.",
+					f.handler.GetLogger().Warnf("Follower.startListener(): There is an error in handling leader message.  Error = %s.  Terminate.",
 						err.Error())
 					return
 				}
 			} else {
-				log.Printf("Follower.startListener(): message channel closed.  Terminate.")
+				f.handler.GetLogger().Infof("Follower.startListener(): message channel closed.  Terminate.")
 				return
 			}
 		case <-f.killch:
@@ -192,7 +191,7 @@ func (f *Follower) handleMessage(msg common.Packet) (err error) {
 	case ResponseMsg:
 		err = f.handleResponse(request)
 	default:
-		log.Printf("Follower.handleMessage(): unrecognized message %s.  Ignore.", msg.Name())
+		f.handler.GetLogger().Warnf("Follower.handleMessage(): unrecognized message %s.  Ignore.", msg.Name())
 	}
 	return err
 }
@@ -204,17 +203,19 @@ func (f *Follower) handleProposal(msg ProposalMsg) error {
 	// TODO : Check if the txnid is the next one (last txnid + 1)
 
 	// Call service to log the proposal
+	start := f.handler.GetClock().Now()
 	err := f.handler.LogProposal(msg)
 	if err != nil {
 		return err
 	}
+	f.handler.GetTracer().RecordSpan(msg.GetTraceId(), common.SPAN_LOG, f.GetFollowerId(), common.Txnid(msg.GetTxnid()), msg.GetKey(), start)
 
 	// Add to pending list
 	f.pendings = append(f.pendings, msg)
 
 	// Send Accept Message only if I am a follower (not watcher)
 	if f.kind == FOLLOWER {
-		return f.sendAccept(common.Txnid(msg.GetTxnid()), f.GetFollowerId())
+		return f.sendAccept(common.Txnid(msg.GetTxnid()), f.GetFollowerId(), msg.GetTraceId())
 	}
 
 	return nil
@@ -235,7 +236,7 @@ func (f *Follower) handleCommit(msg CommitMsg) error {
 		// All commits are processed sequentially to ensure serializability.
 		p := f.pendings[0]
 		if p == nil || p.GetTxnid() != msg.GetTxnid() {
-			log.Printf("Proposal must committed in sequential order for the same leader term. "+
+			f.handler.GetLogger().Errorf("Proposal must committed in sequential order for the same leader term. "+
 				"Found out-of-order commit. Last proposal txid %d, commit msg %d", p.GetTxnid(), msg.GetTxnid())
 
 			return common.NewError(common.PROTOCOL_ERROR,
@@ -248,13 +249,22 @@ func (f *Follower) handleCommit(msg CommitMsg) error {
 	}
 
 	// commit
+	start := f.handler.GetClock().Now()
 	err := f.handler.Commit(common.Txnid(msg.GetTxnid()))
 	if err != nil {
 		return err
 	}
+	f.handler.GetTracer().RecordSpan(msg.GetTraceId(), common.SPAN_COMMIT, f.GetFollowerId(), common.Txnid(msg.GetTxnid()), "", start)
 
 	// TODO: do we need to update election site?  I don't think so, but need to double check.
 
+	// Once every proposal is committed, tell the leader how far this follower
+	// has committed.  The leader hands over the leadership only to a follower
+	// that has committed every proposal (see Leader.findPreferredLeader()).
+	if f.kind == FOLLOWER && len(f.pendings) == 0 {
+		return f.sendAccept(common.Txnid(msg.GetTxnid()), f.GetFollowerId(), 0)
+	}
+
 	return nil
 }
 
@@ -264,7 +274,7 @@ func (f *Follower) handleCommit(msg CommitMsg) error {
 func (f *Follower) handleAbort(msg AbortMsg) error {
 
 	// TODO : Add a new function to ActionHandler for Abort
-	p := f.factory.CreateProposal(0, msg.GetFid(), msg.GetReqId(), uint32(common.OPCODE_ABORT), msg.GetError(), nil)
+	p := NewAbortProposal(f.factory, common.OPCODE_ABORT, msg.GetFid(), msg.GetReqId(), msg.GetErrorCode(), msg.GetError())
 	f.handler.LogProposal(p)
 	return nil
 }
@@ -275,16 +285,21 @@ func (f *Follower) handleAbort(msg AbortMsg) error {
 func (f *Follower) handleResponse(msg ResponseMsg) error {
 
 	// TODO : Add a new function to ActionHandler for Abort
-	p := f.factory.CreateProposal(0, msg.GetFid(), msg.GetReqId(), uint32(common.OPCODE_RESPONSE), msg.GetError(), nil)
+	p := NewAbortProposal(f.factory, common.OPCODE_RESPONSE, msg.GetFid(), msg.GetReqId(), msg.GetErrorCode(), msg.GetError())
 	f.handler.LogProposal(p)
 	return nil
 }
 
 //
-// Send accept message to the leader.
+// Send accept message to the leader.  The accept also carries the last
+// txnid committed by the follower.
 //
-func (f *Follower) sendAccept(txnid common.Txnid, fid string) error {
-	accept := f.factory.CreateAccept(uint64(txnid), fid)
+func (f *Follower) sendAccept(txnid common.Txnid, fid string, traceId uint64) error {
+	committed, err := f.handler.GetLastCommittedTxid()
+	if err != nil {
+		committed = common.Txnid(0)
+	}
+	accept := f.factory.CreateAccept(uint64(txnid), fid, traceId, uint64(committed))
 
 	// Send the message to the leader through a reliable protocol (TCP).
 	success := f.pipe.Send(accept)
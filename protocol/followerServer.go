@@ -18,8 +18,6 @@ package protocol
 import (
 	"fmt"
 	"github.com/couchbase/gometa/common"
-	"log"
-	"net"
 	"runtime/debug"
 )
 
@@ -53,26 +51,43 @@ func RunFollowerServer(naddr string,
 	factory MsgFactory,
 	killch <-chan bool) (err error) {
 
+	return RunFollowerServerWithDialer(naddr, leader, ss, handler, factory, killch, common.NewNetTransport())
+}
+
+//
+// Create a new FollowerServer that connects to the leader using the
+// given dialer (e.g. a Transport, or a ConnMux when the connections
+// are shared among consensus groups).
+//
+func RunFollowerServerWithDialer(naddr string,
+	leader string,
+	ss RequestMgr,
+	handler ActionHandler,
+	factory MsgFactory,
+	killch <-chan bool,
+	dialer common.Dialer) (err error) {
+
 	// Catch panic at the main entry point for FollowerServer
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in RunFollowerServer() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			handler.GetLogger().Errorf("panic in RunFollowerServer() : %s", r)
+			handler.GetLogger().Errorf("%s", debug.Stack())
 			err = r.(error)
 		} else if common.Debug() {
-			log.Printf("RunFollowerServer terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			handler.GetLogger().Tracef("RunFollowerServer terminates : Diagnostic Stack ...")
+			handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 	}()
 
 	// create connection to leader
-	conn, err := createConnection(leader)
+	conn, err := dialer.Dial(leader)
 	if err != nil {
+		setExitReason(ss, EXIT_PIPE_ERROR)
 		return err
 	}
 
 	pipe := common.NewPeerPipe(conn)
-	log.Printf("FollowerServer.RunFollowerServer() : Follower %s successfully "+
+	handler.GetLogger().Infof("FollowerServer.RunFollowerServer() : Follower %s successfully "+
 		"created TCP connection to leader %s, local address %s", naddr, leader, conn.LocalAddr())
 
 	// close the connection to the leader. If connection is closed,
@@ -89,10 +104,14 @@ func RunFollowerServer(naddr string,
 
 	// run server after synchronization
 	if success {
+		getHandoverState(ss).followed()
+		setReady(ss, true)
+		defer setReady(ss, false)
 		runFollower(pipe, ss, handler, factory, killch)
-		log.Printf("FollowerServer.RunFollowerServer() : Follower Server %s terminate", naddr)
+		handler.GetLogger().Infof("FollowerServer.RunFollowerServer() : Follower Server %s terminate", naddr)
 		err = nil
 	} else {
+		setExitReason(ss, EXIT_SYNC_ERROR)
 		err = common.NewError(common.SERVER_ERROR, fmt.Sprintf("Follower %s fail to synchronized with leader %s",
 			naddr, leader))
 	}
@@ -108,13 +127,13 @@ func RunFollowerServer(naddr string,
 // Synchronize with the leader.
 //
 func syncWithLeader(naddr string,
-	pipe *common.PeerPipe,
+	pipe common.Pipe,
 	handler ActionHandler,
 	factory MsgFactory,
 	killch <-chan bool) bool {
 
-	log.Printf("FollowerServer.syncWithLeader(): Follower %s start synchronization with leader (TCP %s)",
-		naddr, pipe.GetAddr())
+	handler.GetLogger().Log(common.LOG_INFO, "FollowerServer.syncWithLeader(): Start synchronization with leader",
+		common.LogNode(naddr), common.LogPeer(pipe.GetAddr()))
 	proxy := NewFollowerSyncProxy(pipe, handler, factory, true)
 	donech := proxy.GetDoneChannel()
 	go proxy.Start()
@@ -124,14 +143,14 @@ func syncWithLeader(naddr string,
 	select {
 	case success := <-donech:
 		if success {
-			log.Printf("FollowerServer.syncWithLeader(): Follower %s done synchronization with leader (TCP %s)",
-				naddr, pipe.GetAddr())
+			handler.GetLogger().Log(common.LOG_INFO, "FollowerServer.syncWithLeader(): Done synchronization with leader",
+				common.LogNode(naddr), common.LogPeer(pipe.GetAddr()))
 		}
 		return success
 	case <-killch:
 		// simply return. The pipe will eventually be closed and
 		// cause FollowerSyncProxy to err out.
-		log.Printf("FollowerServer.syncWithLeader(): Recieve kill singal.  Synchronization with leader (TCP %s) terminated.",
+		handler.GetLogger().Infof("FollowerServer.syncWithLeader(): Recieve kill singal.  Synchronization with leader (TCP %s) terminated.",
 			pipe.GetAddr())
 	}
 
@@ -141,7 +160,7 @@ func syncWithLeader(naddr string,
 //
 // Run Follower Protocol
 //
-func runFollower(pipe *common.PeerPipe,
+func runFollower(pipe common.Pipe,
 	ss RequestMgr,
 	handler ActionHandler,
 	factory MsgFactory,
@@ -154,7 +173,7 @@ func runFollower(pipe *common.PeerPipe,
 	server.state = newFollowerState(ss)
 
 	// Create a follower.  The follower will start a go-rountine, listening to messages coming from leader.
-	log.Printf("FollowerServer.runFollower(): Start Follower Protocol")
+	handler.GetLogger().Infof("FollowerServer.runFollower(): Start Follower Protocol")
 	server.follower = NewFollower(FOLLOWER, pipe, handler, factory)
 	donech := server.follower.Start()
 	defer server.follower.Terminate()
@@ -171,7 +190,7 @@ func (s *FollowerServer) processRequest(handler ActionHandler,
 	killch <-chan bool,
 	donech <-chan bool) {
 
-	log.Printf("FollowerServer.processRequest(): Ready to process request")
+	handler.GetLogger().Infof("FollowerServer.processRequest(): Ready to process request")
 
 	incomings := s.state.requestMgr.GetRequestChannel()
 	for {
@@ -179,24 +198,30 @@ func (s *FollowerServer) processRequest(handler ActionHandler,
 		case handle, ok := <-incomings:
 			if ok {
 				// move request to pending queue (waiting for proposal)
+				handler.GetTracer().RecordSpan(handle.Request.GetTraceId(), common.SPAN_INCOMING, handler.GetFollowerId(),
+					common.Txnid(0), handle.Request.GetKey(), handle.Queued)
 				s.state.requestMgr.AddPendingRequest(handle)
 
 				// forward the request to the leader
 				if !s.follower.ForwardRequest(handle.Request) {
-					log.Printf("FollowerServer.processRequest(): fail to send client request to leader. Terminate.")
+					handler.GetLogger().Warnf("FollowerServer.processRequest(): fail to send client request to leader. Terminate.")
+					setExitReason(s.state.requestMgr, EXIT_PIPE_ERROR)
 					return
 				}
 			} else {
-				log.Printf("FollowerServer.processRequest(): channel for receiving client request is closed. Terminate.")
+				handler.GetLogger().Infof("FollowerServer.processRequest(): channel for receiving client request is closed. Terminate.")
+				setExitReason(s.state.requestMgr, EXIT_KILLED)
 				return
 			}
 		case <-killch:
 			// server is being explicitly terminated.  Terminate the follower go-rountine as well.
-			log.Printf("FollowerServer.processRequest(): receive kill signal. Terminate.")
+			handler.GetLogger().Infof("FollowerServer.processRequest(): receive kill signal. Terminate.")
+			setExitReason(s.state.requestMgr, EXIT_KILLED)
 			return
 		case <-donech:
 			// follower is done.  Just return.
-			log.Printf("FollowerServer.processRequest(): Follower go-routine terminates. Terminate.")
+			handler.GetLogger().Infof("FollowerServer.processRequest(): Follower go-routine terminates. Terminate.")
+			setExitReason(s.state.requestMgr, EXIT_PIPE_ERROR)
 			return
 		}
 	}
@@ -210,24 +235,3 @@ func newFollowerState(ss RequestMgr) *FollowerState {
 	state := &FollowerState{requestMgr: ss}
 	return state
 }
-
-//
-// Create a connection
-//
-func createConnection(leader string) (net.Conn, error) {
-
-	leaderAddr, err := net.ResolveTCPAddr("tcp", leader)
-	if err != nil {
-		return nil, err
-	}
-
-	conn, err := net.DialTCP("tcp", nil, leaderAddr)
-	if err != nil {
-		return nil, err
-	}
-
-	conn.SetKeepAlive(true)
-	conn.SetKeepAlivePeriod(common.TCP_KEEP_ALIVE_PERIOD)
-
-	return conn, nil
-}
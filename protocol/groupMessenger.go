@@ -0,0 +1,373 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"github.com/couchbase/gometa/common"
+	"net"
+	"sync"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// MessengerDemux shares a single messenger among the consensus groups
+// hosted by a node.  Each group gets its own GroupMessenger.  The packets
+// sent through a GroupMessenger are enclosed in a GroupMessage, and the
+// GroupMessage received from the peers are dispatched to the
+// GroupMessenger of the same group.
+//
+// The demux remembers the protocol version of the votes received from
+// each peer.  A GroupMessage is not sent to a peer that runs at a version
+// older than GetMessageVersion("GroupMessage"), since the peer cannot
+// decode it.
+//
+type MessengerDemux struct {
+	messenger common.Messenger
+	factory   MsgFactory
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	groups   map[string]*GroupMessenger
+	versions map[string]uint32 // key : peer addr, value : negotiated protocol version
+	isClosed bool
+}
+
+//
+// GroupMessenger implements common.Messenger for a single group.  Closing
+// a GroupMessenger does not close the shared messenger.
+//
+type GroupMessenger struct {
+	group     string
+	demux     *MessengerDemux
+	receivech chan *common.Message
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	isClosed bool
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// MessengerDemux
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a new MessengerDemux.  The demux takes ownership of the
+// messenger and closes it when the demux is closed.
+//
+func NewMessengerDemux(messenger common.Messenger, factory MsgFactory) *MessengerDemux {
+
+	demux := &MessengerDemux{messenger: messenger,
+		factory:  factory,
+		groups:   make(map[string]*GroupMessenger),
+		versions: make(map[string]uint32),
+		isClosed: false}
+
+	go demux.dispatch()
+	return demux
+}
+
+//
+// Create a messenger for the group.  There can only be one open
+// messenger for each group.
+//
+func (d *MessengerDemux) NewGroupMessenger(group string) (*GroupMessenger, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.isClosed {
+		return nil, common.NewError(common.SERVER_ERROR, "MessengerDemux is closed")
+	}
+
+	if _, ok := d.groups[group]; ok {
+		return nil, common.NewError(common.SERVER_ERROR, "MessengerDemux : Messenger already exists for group "+group)
+	}
+
+	messenger := &GroupMessenger{group: group,
+		demux:     d,
+		receivech: make(chan *common.Message, common.MAX_PROPOSALS*2),
+		isClosed:  false}
+	d.groups[group] = messenger
+
+	return messenger, nil
+}
+
+//
+// Close the demux and the shared messenger.
+//
+func (d *MessengerDemux) Close() bool {
+	d.mutex.Lock()
+	if d.isClosed {
+		d.mutex.Unlock()
+		return false
+	}
+	d.isClosed = true
+	d.mutex.Unlock()
+
+	// dispatch() closes the group messengers once the receive
+	// channel of the shared messenger is closed.
+	return d.messenger.Close()
+}
+
+//
+// Goroutine.  Dispatch the GroupMessage to the messenger of the group.
+//
+func (d *MessengerDemux) dispatch() {
+	defer func() {
+		if r := recover(); r != nil {
+			common.Errorf("panic in MessengerDemux.dispatch() : %s", r)
+		}
+
+		d.closeAll()
+	}()
+
+	reqch := d.messenger.DefaultReceiveChannel()
+	for {
+		msg, ok := <-reqch
+		if !ok {
+			return
+		}
+
+		envelope, ok := msg.Content.(GroupMessageMsg)
+		if !ok {
+			// A peer running an older protocol does not know about groups.
+			if vote, ok := msg.Content.(VoteMsg); ok {
+				d.setPeerVersion(msg.Peer.String(), vote)
+			}
+			common.Warnf("MessengerDemux.dispatch() : Receive message %s without group from %s.  Ignore.",
+				msg.Content.Name(), msg.Peer.String())
+			continue
+		}
+
+		packet, err := common.UnMarshall(envelope.GetContent())
+		if err != nil {
+			common.Warnf("MessengerDemux.dispatch() : Fail to unmarshall message for group %s from %s.  Error = %s",
+				envelope.GetGroup(), msg.Peer.String(), err.Error())
+			continue
+		}
+
+		if vote, ok := packet.(VoteMsg); ok {
+			d.setPeerVersion(msg.Peer.String(), vote)
+		}
+
+		d.mutex.Lock()
+		messenger, ok := d.groups[envelope.GetGroup()]
+		d.mutex.Unlock()
+
+		// Drop the message if the group is not listening.  The peers
+		// will retransmit.
+		if ok {
+			messenger.queue(&common.Message{Content: packet, Peer: msg.Peer})
+		}
+	}
+}
+
+func (d *MessengerDemux) remove(messenger *GroupMessenger) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.groups[messenger.group] == messenger {
+		delete(d.groups, messenger.group)
+	}
+}
+
+func (d *MessengerDemux) closeAll() {
+	d.mutex.Lock()
+	d.isClosed = true
+	groups := make([]*GroupMessenger, 0, len(d.groups))
+	for _, messenger := range d.groups {
+		groups = append(groups, messenger)
+	}
+	d.mutex.Unlock()
+
+	for _, messenger := range groups {
+		messenger.Close()
+	}
+}
+
+//
+// Remember the protocol version negotiated with the peer of the vote.
+//
+func (d *MessengerDemux) setPeerVersion(peer string, vote VoteMsg) {
+
+	version, err := common.NegotiateVersion(vote.GetMinVersion(), vote.GetVersion())
+	if err != nil {
+		version = 0
+	}
+
+	d.mutex.Lock()
+	old, ok := d.versions[peer]
+	d.versions[peer] = version
+	d.mutex.Unlock()
+
+	if required := common.GetMessageVersion("GroupMessage"); version < required && (!ok || old != version) {
+		common.Warnf("MessengerDemux.setPeerVersion() : Peer %s runs at protocol version %d.  Consensus groups "+
+			"require protocol version %d.  Do not send to the peer.", peer, version, required)
+	}
+}
+
+//
+// Return true if the peer can decode a GroupMessage.  A peer that has
+// not voted yet is assumed to support it, since the peer may only be
+// waiting for a vote.
+//
+func (d *MessengerDemux) isGroupEnabled(peer string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	version, ok := d.versions[peer]
+	return !ok || version >= common.GetMessageVersion("GroupMessage")
+}
+
+//
+// Enclose the packet in a GroupMessage.
+//
+func (d *MessengerDemux) wrap(group string, packet common.Packet) (common.Packet, error) {
+
+	payload, err := common.Marshall(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	// skip the total length
+	return d.factory.CreateGroupMessage(group, payload[8:]), nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// GroupMessenger - implement common.Messenger
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *GroupMessenger) DefaultReceiveChannel() <-chan *common.Message {
+	return m.receivech
+}
+
+func (m *GroupMessenger) ReceiveChannel(msgName string) <-chan *common.Message {
+	return m.receivech
+}
+
+func (m *GroupMessenger) GetLocalAddr() string {
+	return m.demux.messenger.GetLocalAddr()
+}
+
+//
+// Close the GroupMessenger.  It is safe to call this
+// method multiple times without causing panic.
+//
+func (m *GroupMessenger) Close() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.isClosed {
+		return false
+	}
+	m.isClosed = true
+
+	m.demux.remove(m)
+
+	common.SafeRun("GroupMessenger.Close()",
+		func() {
+			close(m.receivech)
+		})
+
+	return true
+}
+
+func (m *GroupMessenger) Send(packet common.Packet, peer net.Addr) bool {
+
+	if !m.demux.isGroupEnabled(peer.String()) {
+		return false
+	}
+
+	envelope, ok := m.wrap(packet)
+	if !ok {
+		return false
+	}
+	return m.demux.messenger.Send(envelope, peer)
+}
+
+func (m *GroupMessenger) SendByName(packet common.Packet, peer string) bool {
+
+	addr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil || !m.demux.isGroupEnabled(addr.String()) {
+		return false
+	}
+
+	envelope, ok := m.wrap(packet)
+	if !ok {
+		return false
+	}
+	return m.demux.messenger.SendByName(envelope, peer)
+}
+
+func (m *GroupMessenger) Multicast(packet common.Packet, peers []net.Addr) bool {
+
+	enabled := make([]net.Addr, 0, len(peers))
+	for _, peer := range peers {
+		if m.demux.isGroupEnabled(peer.String()) {
+			enabled = append(enabled, peer)
+		}
+	}
+
+	envelope, ok := m.wrap(packet)
+	if !ok {
+		return false
+	}
+	return m.demux.messenger.Multicast(envelope, enabled)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// GroupMessenger - Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+func (m *GroupMessenger) wrap(packet common.Packet) (common.Packet, bool) {
+
+	if m.isMessengerClosed() {
+		return nil, false
+	}
+
+	envelope, err := m.demux.wrap(m.group, packet)
+	if err != nil {
+		common.Warnf("GroupMessenger.wrap() : Fail to marshall message %s for group %s.  Error = %s",
+			packet.Name(), m.group, err.Error())
+		return nil, false
+	}
+	return envelope, true
+}
+
+func (m *GroupMessenger) queue(msg *common.Message) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.isClosed {
+		return
+	}
+
+	select {
+	case m.receivech <- msg:
+	default:
+		common.Warnf("GroupMessenger.queue() : Receive channel for group %s is full.  Drop message %s.",
+			m.group, msg.Content.Name())
+	}
+}
+
+func (m *GroupMessenger) isMessengerClosed() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.isClosed
+}
@@ -18,9 +18,9 @@ package protocol
 import (
 	"fmt"
 	"github.com/couchbase/gometa/common"
-	"log"
 	"runtime/debug"
 	"sync"
+	"time"
 )
 
 /////////////////////////////////////////////////
@@ -66,31 +66,109 @@ type Leader struct {
 	factory    MsgFactory
 	reqHandler CustomRequestHandler
 
-	notifications chan *notification
-	lastCommitted common.Txnid
-	quorums       map[common.Txnid][]string
-	proposals     map[common.Txnid]ProposalMsg
+	notifications   chan *notification
+	lastCommitted   common.Txnid
+	quorums         map[common.Txnid][]string
+	proposals       map[common.Txnid]ProposalMsg
+	timings         map[common.Txnid]*proposalTiming
+	newEpochPending bool // txnid counter is running out
+	untrackMetrics  []func()
 
 	// mutex protected variable
-	mutex     sync.Mutex
-	followers map[string]*messageListener
-	watchers  map[string]*messageListener
-	observers map[string]*observer
-	isClosed  bool
-	changech  chan bool // notify membership of active followers have changed
+	mutex            sync.Mutex
+	followers        map[string]*messageListener
+	watchers         map[string]*messageListener
+	observers        map[string]*observer
+	progress         map[string]*followerProgress // key : follower id
+	lastAccepted     map[string]common.Txnid      // key : follower id.  Kept after the follower is disconnected.
+	lastCommittedBy  map[string]common.Txnid      // key : follower id, value : last txnid committed by the follower
+	followerVersions map[string]uint32            // key : follower id, value : negotiated protocol version
+	watcherVersions  map[string]uint32            // key : watcher id, value : negotiated protocol version
+	isClosed         bool
+	changech         chan bool // notify membership of active followers have changed
+	statusch         chan chan *LeaderStatus
+	transferch       chan string
+	transferTo       string         // follower to transfer the leadership to (see TransferLeadership)
+	transferDeadline time.Time      // the transfer is given up after this time
+	handover         *HandoverState // nil if the handovers are not tracked across the elections
+}
+
+//
+// The status of the leader, as seen by the leader.
+//
+type LeaderStatus struct {
+	LastCommitted common.Txnid
+	Proposals     int // outstanding proposals
+	Followers     []*PeerProgress
+	Watchers      []*PeerProgress
+}
+
+//
+// The progress of a follower or watcher.  A watcher does not accept the
+// proposals, so its last accepted txnid and its lag are not known.
+//
+type PeerProgress struct {
+	Fid           string
+	Version       uint32        // negotiated protocol version
+	LastAccepted  common.Txnid  // last txnid acknowledged by the peer
+	Lag           int           // proposals sent to the peer but not yet accepted (-1 if not known)
+	LastSent      time.Time     // last time a proposal is sent to the peer
+	AcceptLatency time.Duration // moving average of the time for the peer to accept a proposal
+	Slow          bool          // the peer is reported as slow (see SlowFollowerPolicy)
 }
 
 type messageListener struct {
 	fid    string
-	pipe   *common.PeerPipe
+	pipe   common.Pipe
 	leader *Leader
 	killch chan bool
 }
 
+//
+// The times at which a proposal is created and sent to the followers.
+//
+type proposalTiming struct {
+	created time.Time
+	sent    time.Time
+}
+
+//
+// The proposals sent to a follower that the follower has not accepted
+// yet, and how long the follower takes to accept a proposal.
+//
+type followerProgress struct {
+	pending        []sentProposal // oldest first
+	lastSent       time.Time
+	latency        time.Duration // moving average
+	isSlow         bool
+	isDisconnected bool
+}
+
+type sentProposal struct {
+	txnid common.Txnid
+	sent  time.Time
+}
+
 type notification struct {
 	// follower message
-	fid     string
-	payload common.Packet
+	fid      string
+	payload  common.Packet
+	received time.Time
+}
+
+//
+// The handovers of the leadership to a higher priority follower (see
+// Leader.findPreferredLeader()).  It is kept across the elections (see
+// HandoverTracker).  If this node is elected again right after it steps
+// down, the handover has not moved the leadership, and the next handover
+// waits for a backoff.  Otherwise, the leader would step down every
+// LEADER_PRIORITY_CHECK_INTERVAL.
+//
+type HandoverState struct {
+	mutex       sync.Mutex
+	steppedDown time.Time // last time the leader steps down to hand over the leadership (zero if none)
+	failures    int       // handovers in a row that have not moved the leadership
+	next        time.Time // the leadership is not handed over before this time
 }
 
 /////////////////////////////////////////////////
@@ -105,17 +183,25 @@ func NewLeader(naddr string,
 	factory MsgFactory) (leader *Leader, err error) {
 
 	leader = &Leader{naddr: naddr,
-		followers:     make(map[string]*messageListener),
-		watchers:      make(map[string]*messageListener),
-		observers:     make(map[string]*observer),
-		quorums:       make(map[common.Txnid][]string),
-		proposals:     make(map[common.Txnid]ProposalMsg),
-		notifications: make(chan *notification, common.MAX_PROPOSALS),
-		handler:       handler,
-		factory:       factory,
-		isClosed:      false,
-		reqHandler:    nil,
-		changech:      make(chan bool, common.MAX_PEERS)} // make it buffered so sender won't block
+		followers:        make(map[string]*messageListener),
+		watchers:         make(map[string]*messageListener),
+		observers:        make(map[string]*observer),
+		progress:         make(map[string]*followerProgress),
+		quorums:          make(map[common.Txnid][]string),
+		proposals:        make(map[common.Txnid]ProposalMsg),
+		timings:          make(map[common.Txnid]*proposalTiming),
+		lastAccepted:     make(map[string]common.Txnid),
+		lastCommittedBy:  make(map[string]common.Txnid),
+		followerVersions: make(map[string]uint32),
+		watcherVersions:  make(map[string]uint32),
+		notifications:    make(chan *notification, common.MAX_PROPOSALS),
+		handler:          handler,
+		factory:          factory,
+		isClosed:         false,
+		reqHandler:       nil,
+		changech:         make(chan bool, common.MAX_PEERS), // make it buffered so sender won't block
+		statusch:         make(chan chan *LeaderStatus),
+		transferch:       make(chan string)}
 
 	// This is initialized to the lastCommitted in repository. Subsequent commit() will update this
 	// field to the latest committed txnid. This field is used for ensuring the commit order is preserved.
@@ -125,6 +211,8 @@ func NewLeader(naddr string,
 		return nil, err
 	}
 
+	leader.trackMetrics()
+
 	// start a listener go-routine.  This will be closed when the leader terminate.
 	go leader.listen()
 
@@ -137,17 +225,25 @@ func NewLeaderWithCustomHandler(naddr string,
 	reqHandler CustomRequestHandler) (leader *Leader, err error) {
 
 	leader = &Leader{naddr: naddr,
-		followers:     make(map[string]*messageListener),
-		watchers:      make(map[string]*messageListener),
-		observers:     make(map[string]*observer),
-		quorums:       make(map[common.Txnid][]string),
-		proposals:     make(map[common.Txnid]ProposalMsg),
-		notifications: make(chan *notification, common.MAX_PROPOSALS),
-		handler:       handler,
-		factory:       factory,
-		isClosed:      false,
-		reqHandler:    reqHandler,
-		changech:      make(chan bool, common.MAX_PEERS)} // make it buffered so sender won't block
+		followers:        make(map[string]*messageListener),
+		watchers:         make(map[string]*messageListener),
+		observers:        make(map[string]*observer),
+		progress:         make(map[string]*followerProgress),
+		quorums:          make(map[common.Txnid][]string),
+		proposals:        make(map[common.Txnid]ProposalMsg),
+		timings:          make(map[common.Txnid]*proposalTiming),
+		lastAccepted:     make(map[string]common.Txnid),
+		lastCommittedBy:  make(map[string]common.Txnid),
+		followerVersions: make(map[string]uint32),
+		watcherVersions:  make(map[string]uint32),
+		notifications:    make(chan *notification, common.MAX_PROPOSALS),
+		handler:          handler,
+		factory:          factory,
+		isClosed:         false,
+		reqHandler:       reqHandler,
+		changech:         make(chan bool, common.MAX_PEERS), // make it buffered so sender won't block
+		statusch:         make(chan chan *LeaderStatus),
+		transferch:       make(chan string)}
 
 	// This is initialized to the lastCommitted in repository. Subsequent commit() will update this
 	// field to the latest committed txnid. This field is used for ensuring the commit order is preserved.
@@ -157,6 +253,8 @@ func NewLeaderWithCustomHandler(naddr string,
 		return nil, err
 	}
 
+	leader.trackMetrics()
+
 	// start a listener go-routine.  This will be closed when the leader terminate.
 	go leader.listen()
 
@@ -184,6 +282,13 @@ func (l *Leader) Terminate() {
 			func() {
 				close(l.notifications)
 			})
+
+		for _, untrack := range l.untrackMetrics {
+			untrack()
+		}
+
+		// notify the leader server that the leader is gone
+		l.changech <- true
 	}
 }
 
@@ -220,12 +325,123 @@ func (l *Leader) GetActiveEnsembleSize() int {
 	return len(l.followers) + 1
 }
 
+//
+// Get the current ensemble of the leader.  It is the follower id
+// of the followers, including the leader itself.
+//
+func (l *Leader) GetActiveEnsemble() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	ensemble := make([]string, 0, len(l.followers)+1)
+	ensemble = append(ensemble, l.GetFollowerId())
+	for fid := range l.followers {
+		ensemble = append(ensemble, fid)
+	}
+	return ensemble
+}
+
+//
+// Remember the protocol version negotiated with a follower or watcher.
+// This should be called after the peer has synchronized with the leader,
+// but before adding the peer to the leader.  The version is remembered
+// even if the peer disconnects, since the peer can only change its version
+// by restarting, and it will then synchronize again.
+//
+func (l *Leader) SetPeerVersion(fid string, version uint32, voting bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if voting {
+		l.followerVersions[fid] = version
+	} else {
+		l.watcherVersions[fid] = version
+	}
+}
+
+//
+// Get the protocol version that the ensemble runs at.  This is the
+// minimum version among the leader, the followers and the watchers.  If
+// some of the followers have not synchronized with the leader, their
+// version is unknown, and the ensemble runs at the lowest version.
+//
+func (l *Leader) GetEnsembleVersion() uint32 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if uint64(len(l.followerVersions))+1 < l.handler.GetEnsembleSize() {
+		return common.MIN_PROTOCOL_VERSION
+	}
+
+	version := common.PROTOCOL_VERSION
+	for _, v := range l.followerVersions {
+		if v < version {
+			version = v
+		}
+	}
+	for _, v := range l.watcherVersions {
+		if v < version {
+			version = v
+		}
+	}
+	return version
+}
+
+//
+// Get the status of the leader.  The status is taken by the goroutine
+// that processes the messages of the leader, such that it is consistent
+// with the outstanding proposals.
+//
+func (l *Leader) GetStatus() (*LeaderStatus, error) {
+
+	if l.IsClosed() {
+		return nil, common.NewError(common.NOT_LEADER_ERROR, "Leader is terminated.")
+	}
+
+	replych := make(chan *LeaderStatus, 1)
+	select {
+	case l.statusch <- replych:
+		return <-replych, nil
+	case <-l.handler.GetClock().After(common.STATUS_TIMEOUT * time.Millisecond):
+		return nil, common.NewError(common.TIMEOUT_ERROR, "Timeout in getting the status of the leader.")
+	}
+}
+
+//
+// Step down once the follower has accepted every proposal, such that the
+// follower can be elected as leader.  The follower must have the highest
+// priority in the next election (see ActionHandler.GetPriority), since the
+// followers are equally caught-up.  The transfer is given up if the
+// follower does not catch up within LEADERSHIP_TRANSFER_TIMEOUT.
+//
+func (l *Leader) TransferLeadership(fid string) error {
+
+	l.mutex.Lock()
+	isClosed := l.isClosed
+	_, ok := l.followers[fid]
+	l.mutex.Unlock()
+
+	if isClosed {
+		return common.NewError(common.NOT_LEADER_ERROR, "Leader is terminated.")
+	}
+	if !ok {
+		return common.NewError(common.INVALID_REQUEST_ERROR, "Peer "+fid+" is not a follower of the leader.")
+	}
+
+	select {
+	case l.transferch <- fid:
+		return nil
+	case <-l.handler.GetClock().After(common.STATUS_TIMEOUT * time.Millisecond):
+		return common.NewError(common.TIMEOUT_ERROR, "Timeout in transferring the leadership.")
+	}
+}
+
 //
 // Add a watcher. If the leader is terminated, the pipe between leader
 // and watcher will also be closed.
 //
 func (l *Leader) AddWatcher(fid string,
-	peer *common.PeerPipe,
+	peer common.Pipe,
 	o *observer) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
@@ -240,10 +456,10 @@ func (l *Leader) AddWatcher(fid string,
 		switch request := packet.(type) {
 		case ProposalMsg:
 			txid := common.Txnid(request.GetTxnid())
-			log.Printf("Leader.AddWatcher() : send observer's packet %s, txid %d", packet.Name(), txid)
+			l.handler.GetLogger().Debugf("Leader.AddWatcher() : send observer's packet %s, txid %d", packet.Name(), txid)
 		case CommitMsg:
 			txid := common.Txnid(request.GetTxnid())
-			log.Printf("Leader.AddWatcher() : send observer's packet %s, txid %d", packet.Name(), txid)
+			l.handler.GetLogger().Debugf("Leader.AddWatcher() : send observer's packet %s, txid %d", packet.Name(), txid)
 		}
 
 		peer.Send(packet)
@@ -258,7 +474,7 @@ func (l *Leader) AddWatcher(fid string,
 
 	// kill the old message listener
 	if ok && oldListener != nil {
-		log.Printf("Leader.AddWatcher() : old Listener found for watcher %s.  Terminating old listener", fid)
+		l.handler.GetLogger().Infof("Leader.AddWatcher() : old Listener found for watcher %s.  Terminating old listener", fid)
 		oldListener.terminate()
 	}
 }
@@ -269,7 +485,7 @@ func (l *Leader) AddWatcher(fid string,
 // and follower will also be closed.
 //
 func (l *Leader) AddFollower(fid string,
-	peer *common.PeerPipe,
+	peer common.Pipe,
 	o *observer) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
@@ -284,10 +500,10 @@ func (l *Leader) AddFollower(fid string,
 		switch request := packet.(type) {
 		case ProposalMsg:
 			txid := common.Txnid(request.GetTxnid())
-			log.Printf("Leader.AddFollower() : send observer's packet %s, txid %d", packet.Name(), txid)
+			l.handler.GetLogger().Debugf("Leader.AddFollower() : send observer's packet %s, txid %d", packet.Name(), txid)
 		case CommitMsg:
 			txid := common.Txnid(request.GetTxnid())
-			log.Printf("Leader.AddFollower() : send observer's packet %s, txid %d", packet.Name(), txid)
+			l.handler.GetLogger().Debugf("Leader.AddFollower() : send observer's packet %s, txid %d", packet.Name(), txid)
 		}
 
 		peer.Send(packet)
@@ -298,11 +514,12 @@ func (l *Leader) AddFollower(fid string,
 
 	listener := newListener(fid, peer, l)
 	l.followers[fid] = listener
+	l.progress[fid] = &followerProgress{}
 	go listener.start()
 
 	// kill the old message listener
 	if ok && oldListener != nil {
-		log.Printf("Leader.AddFollower() : old Listener found for follower %s.  Terminating old listener", fid)
+		l.handler.GetLogger().Infof("Leader.AddFollower() : old Listener found for follower %s.  Terminating old listener", fid)
 		oldListener.terminate()
 	} else {
 		// notify a brand new follower (not just replacing an existing one)
@@ -316,6 +533,19 @@ func (l *Leader) GetFollowerId() string {
 	return l.handler.GetFollowerId()
 }
 
+//
+// Return the last txnid logged by the follower, as known by the leader.
+// The follower may be disconnected.  Return false if the follower has not
+// synchronized with the leader.
+//
+func (l *Leader) GetLastAccepted(fid string) (common.Txnid, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	txnid, ok := l.lastAccepted[fid]
+	return txnid, ok
+}
+
 /////////////////////////////////////////////////////////
 // Leader - Public Function : Observer
 /////////////////////////////////////////////////////////
@@ -341,12 +571,12 @@ func (l *Leader) RemoveObserver(id string) {
 }
 
 func (l *Leader) QueueRequest(fid string, req common.Packet) {
-	n := &notification{fid: fid, payload: req}
+	n := &notification{fid: fid, payload: req, received: l.handler.GetClock().Now()}
 	l.notifications <- n
 }
 
 func (l *Leader) QueueResponse(req common.Packet) {
-	n := &notification{fid: l.GetFollowerId(), payload: req}
+	n := &notification{fid: l.GetFollowerId(), payload: req, received: l.handler.GetClock().Now()}
 	l.notifications <- n
 }
 
@@ -355,7 +585,7 @@ func (l *Leader) QueueResponse(req common.Packet) {
 /////////////////////////////////////////////////
 
 // Create a new listener
-func newListener(fid string, pipe *common.PeerPipe, leader *Leader) *messageListener {
+func newListener(fid string, pipe common.Pipe, leader *Leader) *messageListener {
 
 	return &messageListener{fid: fid,
 		pipe:   pipe,
@@ -375,11 +605,11 @@ func (l *messageListener) start() {
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in messageListener.start() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			l.leader.handler.GetLogger().Errorf("panic in messageListener.start() : %s", r)
+			l.leader.handler.GetLogger().Errorf("%s", debug.Stack())
 		} else if common.Debug() {
-			log.Printf("leader's messageListener.start() terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			l.leader.handler.GetLogger().Tracef("leader's messageListener.start() terminates : Diagnostic Stack ...")
+			l.leader.handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 
 		common.SafeRun("messageListener.start()",
@@ -393,7 +623,7 @@ func (l *messageListener) start() {
 			})
 	}()
 
-	log.Printf("messageListener.start(): start listening to message from peer %s", l.fid)
+	l.leader.handler.GetLogger().Infof("messageListener.start(): start listening to message from peer %s", l.fid)
 	reqch := l.pipe.ReceiveChannel()
 
 	for {
@@ -405,11 +635,11 @@ func (l *messageListener) start() {
 				l.leader.QueueRequest(l.fid, req)
 			} else {
 				// The channel is closed.  Need to shutdown the listener.
-				log.Printf("messageListener.start(): message channel closed. Remove peer %s as follower.", l.fid)
+				l.leader.handler.GetLogger().Infof("messageListener.start(): message channel closed. Remove peer %s as follower.", l.fid)
 				return
 			}
 		case <-l.killch:
-			log.Printf("messageListener.start(): Listener for %s receive kill signal. Terminate.", l.fid)
+			l.leader.handler.GetLogger().Infof("messageListener.start(): Listener for %s receive kill signal. Terminate.", l.fid)
 			return
 
 		}
@@ -435,6 +665,7 @@ func (l *Leader) removeListener(peer *messageListener) {
 	defer l.mutex.Unlock()
 
 	delete(l.followers, peer.fid)
+	delete(l.progress, peer.fid)
 
 	l.changech <- true
 }
@@ -449,11 +680,11 @@ func (l *Leader) removeListener(peer *messageListener) {
 func (l *Leader) listen() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in Leader.listen() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			l.handler.GetLogger().Errorf("panic in Leader.listen() : %s", r)
+			l.handler.GetLogger().Errorf("%s", debug.Stack())
 		} else if common.Debug() {
-			log.Printf("Leader.listen() terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			l.handler.GetLogger().Tracef("Leader.listen() terminates : Diagnostic Stack ...")
+			l.handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 
 		common.SafeRun("Leader.listen()",
@@ -462,32 +693,95 @@ func (l *Leader) listen() {
 			})
 	}()
 
-	log.Printf("Leader.listen(): start listening to message for leader")
+	l.handler.GetLogger().Infof("Leader.listen(): start listening to message for leader")
+
+	ticker := l.handler.GetClock().NewTicker(common.LEADER_PRIORITY_CHECK_INTERVAL * time.Millisecond)
+	defer ticker.Stop()
+
+	slowTicker := l.handler.GetClock().NewTicker(common.SLOW_FOLLOWER_CHECK_INTERVAL * time.Millisecond)
+	defer slowTicker.Stop()
 
 	for {
 		select {
 		case msg, ok := <-l.notifications:
 			if ok {
 				if !l.IsClosed() {
+					l.traceNotification(msg)
 					err := l.handleMessage(msg.payload, msg.fid)
 					if err != nil {
-						log.Printf("Leader.listen(): Encounter error when processing message %s. Error %s. Terminate",
+						l.handler.GetLogger().Warnf("Leader.listen(): Encounter error when processing message %s. Error %s. Terminate",
 							msg.fid, err.Error())
 						return
 					}
+
+					// The txnid counter is running out for this epoch.  Once there is no
+					// outstanding proposal, step down.  The followers will re-sync with
+					// the new leader, which will start a new epoch (and reset the counter).
+					if l.newEpochPending && len(l.proposals) == 0 {
+						l.handler.GetLogger().Infof("Leader.listen(): Txnid counter is running out. Step down to start a new epoch.")
+						return
+					}
+
+					if l.isTransferReady() {
+						l.handler.GetLogger().Infof("Leader.listen(): Follower %s is caught-up. Step down to transfer leadership.", l.transferTo)
+						return
+					}
 				} else {
-					log.Printf("Leader.listen(): Leader is closed. Terminate message processing loop.")
+					l.handler.GetLogger().Infof("Leader.listen(): Leader is closed. Terminate message processing loop.")
 					return
 				}
 			} else {
 				// The channel is closed.
-				log.Printf("Leader.listen(): message channel closed. Terminate message processing loop for leader.")
+				l.handler.GetLogger().Infof("Leader.listen(): message channel closed. Terminate message processing loop for leader.")
+				return
+			}
+		case replych := <-l.statusch:
+			replych <- l.getStatus()
+		case fid := <-l.transferch:
+			l.handler.GetLogger().Infof("Leader.listen(): Transfer leadership to follower %s", fid)
+			l.transferTo = fid
+			l.transferDeadline = l.handler.GetClock().Now().Add(common.LEADERSHIP_TRANSFER_TIMEOUT * time.Millisecond)
+			if l.isTransferReady() {
+				l.handler.GetLogger().Infof("Leader.listen(): Follower %s is caught-up. Step down to transfer leadership.", fid)
+				return
+			}
+		case <-slowTicker.Chan():
+			l.checkSlowFollowers()
+		case <-ticker.Chan():
+			if len(l.transferTo) != 0 && l.handler.GetClock().Now().After(l.transferDeadline) {
+				l.handler.GetLogger().Warnf("Leader.listen(): Follower %s does not catch up in time. Give up leadership transfer.", l.transferTo)
+				l.transferTo = ""
+			}
+
+			// If there is a caught-up follower with a higher priority, step down.
+			// The followers will go back to election, and the follower with the
+			// higher priority will win since it is as caught-up as this leader.
+			if fid, ok := l.findPreferredLeader(); ok {
+				l.handler.GetLogger().Infof("Leader.listen(): Follower %s has higher priority and is caught-up. "+
+					"Step down to transfer leadership.", fid)
+				l.recordHandover()
 				return
 			}
 		}
 	}
 }
 
+//
+// Record the time that a traced request (or an accept of a traced
+// proposal) waits in the notifications.
+//
+func (l *Leader) traceNotification(msg *notification) {
+
+	switch request := msg.payload.(type) {
+	case RequestMsg:
+		l.handler.GetTracer().RecordPeerSpan(request.GetTraceId(), common.SPAN_NOTIFICATION, l.GetFollowerId(), msg.fid,
+			common.Txnid(0), request.GetKey(), msg.received)
+	case AcceptMsg:
+		l.handler.GetTracer().RecordPeerSpan(request.GetTraceId(), common.SPAN_NOTIFICATION, l.GetFollowerId(), msg.fid,
+			common.Txnid(request.GetTxnid()), "", msg.received)
+	}
+}
+
 //
 // Handle an incoming message based on its type.  All incoming messages from followers are processed serially
 // (by Leader.listen()).  Therefore, the order of corresponding outbound messages (proposal, commit) will be placed
@@ -505,8 +799,9 @@ func (l *Leader) handleMessage(msg common.Packet, follower string) (err error) {
 			if l.reqHandler != nil {
 				l.reqHandler.OnNewRequest(follower, request)
 			} else {
-				log.Printf("Leader.handleMessage(): No custom request handler registered to handle custom request.")
-				response := l.factory.CreateResponse(follower, request.GetReqId(), "No custom request handler")
+				l.handler.GetLogger().Warnf("Leader.handleMessage(): No custom request handler registered to handle custom request.")
+				response := l.factory.CreateResponse(follower, request.GetReqId(),
+					common.INVALID_REQUEST_ERROR.String(), "No custom request handler")
 				l.sendResponse(response)
 			}
 		} else {
@@ -518,7 +813,7 @@ func (l *Leader) handleMessage(msg common.Packet, follower string) (err error) {
 		l.sendResponse(request)
 	default:
 		// TODO: Should throw exception.  There is a possiblity that there is another leader.
-		log.Printf("Leader.handleMessage(): Leader unable to process message of type %s. Ignore message.", request.Name())
+		l.handler.GetLogger().Warnf("Leader.handleMessage(): Leader unable to process message of type %s. Ignore message.", request.Name())
 	}
 	return err
 }
@@ -532,13 +827,27 @@ func (l *Leader) handleMessage(msg common.Packet, follower string) (err error) {
 //
 func (l *Leader) createProposal(host string, req RequestMsg) error {
 
-	// This should be the only place to call GetNextTxnId().  This function
-	// can panic if the txnid overflows.   In this case, this should terminate
-	// the leader and forces a new election for getting a new epoch. ZK has the
-	// same behavior.
+	// If the txnid counter is running out, do not create new proposal.  The
+	// leader will step down once the outstanding proposals are done.
+	if l.newEpochPending {
+		l.sendAbort(host, req.GetReqId(),
+			common.NewError(common.NOT_LEADER_ERROR, "Leader is starting a new epoch.  Retry the request."))
+		return nil
+	}
+
+	// This should be the only place to call GetNextTxnId().  The leader
+	// stops creating proposal well before the counter overflows (see above).
 	txnid := l.handler.GetNextTxnId()
-	log.Printf("Leader.createProposal(): New Proposal : Txnid %d (Epoch %d, Counter %d)",
-		txnid, txnid.GetEpoch(), txnid.GetCounter())
+	l.handler.GetLogger().Log(common.LOG_DEBUG, "Leader.createProposal(): New proposal", common.LogTxnid(txnid), common.LogEpoch(uint32(txnid.GetEpoch())))
+
+	if common.IsCounterExhausting(txnid) {
+		l.handler.GetLogger().Infof("Leader.createProposal(): Txnid counter for epoch %d is running out.  Will start a new epoch.",
+			txnid.GetEpoch())
+		l.newEpochPending = true
+	}
+
+	proposalsCreated.With(l.handler.GetMetricLabels()).Inc()
+	l.timings[txnid] = &proposalTiming{created: l.handler.GetClock().Now()}
 
 	// Create a new proposal
 	proposal := l.factory.CreateProposal(uint64(txnid),
@@ -546,7 +855,8 @@ func (l *Leader) createProposal(host string, req RequestMsg) error {
 		req.GetReqId(),
 		req.GetOpCode(),
 		req.GetKey(),
-		req.GetContent())
+		req.GetContent(),
+		req.GetTraceId())
 
 	return l.newProposal(proposal)
 }
@@ -558,12 +868,16 @@ func (l *Leader) newProposal(proposal ProposalMsg) error {
 
 	// Call out to log the proposal.  Always do this first before
 	// sending to followers.
+	start := l.handler.GetClock().Now()
 	err := l.handler.LogProposal(proposal)
+	l.handler.GetTracer().RecordSpan(proposal.GetTraceId(), common.SPAN_LOG, l.GetFollowerId(),
+		common.Txnid(proposal.GetTxnid()), proposal.GetKey(), start)
 	if err != nil {
 		if _, ok := err.(*common.RecoverableError); ok {
 			/// update the last committed to advacne the txnid.
 			l.lastCommitted = common.Txnid(proposal.GetTxnid())
-			l.sendAbort(proposal.GetFid(), proposal.GetReqId(), err.Error())
+			delete(l.timings, l.lastCommitted)
+			l.sendAbort(proposal.GetFid(), proposal.GetReqId(), err)
 			return nil
 		}
 
@@ -582,6 +896,9 @@ func (l *Leader) newProposal(proposal ProposalMsg) error {
 
 	// Send the proposal to follower
 	l.sendProposal(proposal)
+	if timing, ok := l.timings[common.Txnid(proposal.GetTxnid())]; ok {
+		timing.sent = l.handler.GetClock().Now()
+	}
 
 	// check if proposal has quorum (if ensembleSize <= 2).  Make sure that this
 	// is after sendProposal() so that we can still send proposal to follower BEFORE
@@ -599,6 +916,168 @@ func (l *Leader) newProposal(proposal ProposalMsg) error {
 	return nil
 }
 
+//
+// Return the status of the leader.  This must be called by Leader.listen().
+//
+func (l *Leader) getStatus() *LeaderStatus {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	status := &LeaderStatus{LastCommitted: l.lastCommitted,
+		Proposals: len(l.proposals)}
+
+	now := l.handler.GetClock().Now()
+	for fid := range l.followers {
+		p := l.getProgress(fid)
+		status.Followers = append(status.Followers, &PeerProgress{Fid: fid,
+			Version:       l.followerVersions[fid],
+			LastAccepted:  l.lastAccepted[fid],
+			Lag:           len(p.pending),
+			LastSent:      p.lastSent,
+			AcceptLatency: p.getLatency(now),
+			Slow:          p.isSlow})
+	}
+
+	for fid := range l.watchers {
+		status.Watchers = append(status.Watchers, &PeerProgress{Fid: fid,
+			Version: l.watcherVersions[fid],
+			Lag:     -1})
+	}
+
+	return status
+}
+
+//
+// Report the followers that fall behind the leader, according to the
+// SlowFollowerPolicy.  A slow follower is disconnected if required by the
+// policy.  This must be called by Leader.listen().
+//
+func (l *Leader) checkSlowFollowers() {
+
+	policy := l.handler.GetSlowFollowerPolicy()
+	if policy == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.handler.GetClock().Now()
+	for fid, listener := range l.followers {
+		p := l.getProgress(fid)
+		lag := len(p.pending)
+		latency := p.getLatency(now)
+
+		slow := (policy.MaxLag > 0 && lag > policy.MaxLag) ||
+			(policy.MaxLatency > 0 && latency > time.Duration(policy.MaxLatency)*time.Millisecond)
+
+		if !slow {
+			if p.isSlow {
+				l.handler.GetLogger().Log(common.LOG_INFO, "Leader.checkSlowFollowers() : Follower has caught up", common.LogPeer(fid))
+				p.isSlow = false
+			}
+			continue
+		}
+
+		if !p.isSlow {
+			l.handler.GetLogger().Log(common.LOG_WARN, "Leader.checkSlowFollowers() : Follower is slow",
+				common.LogPeer(fid), common.NewLogField("lag", lag), common.NewLogField("latency", latency))
+			slowFollowers.With(l.handler.GetMetricLabels()).Inc()
+			p.isSlow = true
+		}
+
+		if policy.Disconnect && !p.isDisconnected {
+			l.handler.GetLogger().Log(common.LOG_WARN, "Leader.checkSlowFollowers() : Disconnect slow follower.  The follower will re-synchronize.",
+				common.LogPeer(fid))
+			p.isDisconnected = true
+			listener.terminate()
+		}
+	}
+}
+
+//
+// Return the progress of the follower.  The caller must hold the mutex.
+//
+func (l *Leader) getProgress(fid string) *followerProgress {
+
+	p, ok := l.progress[fid]
+	if !ok {
+		p = &followerProgress{}
+		l.progress[fid] = p
+	}
+	return p
+}
+
+//
+// Remember that the proposal is sent to the follower.  If the follower
+// does not accept the proposals, only the latest ones are remembered.
+//
+func (p *followerProgress) sent(txnid common.Txnid, now time.Time) {
+
+	if len(p.pending) >= common.MAX_PROPOSALS {
+		p.pending = p.pending[1:]
+	}
+	p.pending = append(p.pending, sentProposal{txnid: txnid, sent: now})
+	p.lastSent = now
+}
+
+//
+// The follower has accepted the proposal.  Since the follower accepts
+// the proposals in order, the proposals sent before are accepted as well.
+//
+func (p *followerProgress) accepted(txnid common.Txnid, now time.Time) {
+
+	for len(p.pending) != 0 && common.CompareTxnid(p.pending[0].txnid, txnid) != common.MORE_RECENT {
+		if p.pending[0].txnid == txnid {
+			sample := now.Sub(p.pending[0].sent)
+			if p.latency == 0 {
+				p.latency = sample
+			} else {
+				p.latency += (sample - p.latency) / time.Duration(common.ACCEPT_LATENCY_SMOOTHING)
+			}
+		}
+		p.pending = p.pending[1:]
+	}
+}
+
+//
+// Return the accept latency of the follower.  If the oldest proposal
+// that is not accepted yet has been waiting for longer than the moving
+// average, the follower is at least that slow.
+//
+func (p *followerProgress) getLatency(now time.Time) time.Duration {
+
+	if len(p.pending) != 0 {
+		if waiting := now.Sub(p.pending[0].sent); waiting > p.latency {
+			return waiting
+		}
+	}
+	return p.latency
+}
+
+//
+// Track the depth of the queues of the leader.  The queues are no
+// longer tracked once the leader terminates.
+//
+func (l *Leader) trackMetrics() {
+
+	l.untrackMetrics = append(l.untrackMetrics,
+		notificationQueueDepth.With(l.handler.GetMetricLabels()).Track(func() int64 {
+			return int64(len(l.notifications))
+		}),
+		observerQueueDepth.With(l.handler.GetMetricLabels()).Track(func() int64 {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+
+			var depth int64
+			for _, o := range l.observers {
+				depth += int64(len(o.packets))
+			}
+			return depth
+		}))
+}
+
 //
 // send the proposal to the followers
 //
@@ -629,10 +1108,13 @@ func (l *Leader) sendProposal(proposal ProposalMsg) {
 		proposal.GetReqId(),
 		proposal.GetOpCode(),
 		proposal.GetKey(),
-		proposal.GetContent())
+		proposal.GetContent(),
+		proposal.GetTraceId())
 
-	for _, f := range l.followers {
+	now := l.handler.GetClock().Now()
+	for fid, f := range l.followers {
 		f.pipe.Send(msg)
+		l.getProgress(fid).sent(common.Txnid(proposal.GetTxnid()), now)
 	}
 
 	for _, w := range l.watchers {
@@ -647,16 +1129,21 @@ func (l *Leader) sendProposal(proposal ProposalMsg) {
 //
 // send the proposal to the followers
 //
-func (l *Leader) sendAbort(fid string, reqId uint64, err string) {
+func (l *Leader) sendAbort(fid string, reqId uint64, err error) {
+
+	l.handler.GetLogger().Debugf("leader.sendAbort(): Send Abort to %s", fid)
 
-	log.Printf("leader.sendAbort(): Send Abort to %s", fid)
+	proposalsAborted.With(l.handler.GetMetricLabels()).Inc()
+
+	code := common.GetErrorCode(err).String()
+	reason := common.GetErrorReason(err)
 		
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
 	for _, f := range l.followers {
 		if f.fid == fid {
-			msg := l.factory.CreateAbort(fid, reqId, err)
+			msg := l.factory.CreateAbort(fid, reqId, code, reason)
 			f.pipe.Send(msg)
 			return
 		}
@@ -664,14 +1151,14 @@ func (l *Leader) sendAbort(fid string, reqId uint64, err string) {
 
 	for _, w := range l.watchers {
 		if w.fid == fid {
-			msg := l.factory.CreateAbort(fid, reqId, err)
+			msg := l.factory.CreateAbort(fid, reqId, code, reason)
 			w.pipe.Send(msg)
 			return
 		}
 	}
 
 	if l.GetFollowerId() == fid {
-		p := l.factory.CreateProposal(0, fid, reqId, uint32(common.OPCODE_ABORT), err, nil)
+		p := NewAbortProposal(l.factory, common.OPCODE_ABORT, fid, reqId, code, reason)
 		l.handler.LogProposal(p)
 	}
 }
@@ -681,7 +1168,7 @@ func (l *Leader) sendAbort(fid string, reqId uint64, err string) {
 //
 func (l *Leader) sendResponse(msg ResponseMsg) {
 
-	log.Printf("leader.sendResponse(): Send Response to %s", msg.GetFid())
+	l.handler.GetLogger().Debugf("leader.sendResponse(): Send Response to %s", msg.GetFid())
 	
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
@@ -701,7 +1188,7 @@ func (l *Leader) sendResponse(msg ResponseMsg) {
 	}
 
 	if l.GetFollowerId() == msg.GetFid() {
-		p := l.factory.CreateProposal(0, msg.GetFid(), msg.GetReqId(), uint32(common.OPCODE_RESPONSE), msg.GetError(), nil)
+		p := NewAbortProposal(l.factory, common.OPCODE_RESPONSE, msg.GetFid(), msg.GetReqId(), msg.GetErrorCode(), msg.GetError())
 		l.handler.LogProposal(p)
 	}
 }
@@ -720,7 +1207,11 @@ func (l *Leader) handleAccept(msg AcceptMsg) error {
 	// than others.  Therefore, the proposal may be
 	// committed, before the follower can Ack.
 	mtxid := common.Txnid(msg.GetTxnid())
-	if l.lastCommitted >= mtxid {
+
+	// remember how far the follower has caught up
+	l.updateProgress(msg.GetFid(), mtxid, common.Txnid(msg.GetCommitted()))
+
+	if common.CompareTxnid(l.lastCommitted, mtxid) != common.LESS_RECENT {
 		// cleanup.  l.quorums should not have mtxid.
 		// This is just in case since we will never commit
 		// this proposal.
@@ -728,6 +1219,7 @@ func (l *Leader) handleAccept(msg AcceptMsg) error {
 		if ok {
 			delete(l.quorums, mtxid)
 			delete(l.proposals, mtxid)
+			delete(l.timings, mtxid)
 		}
 		return nil
 	}
@@ -747,6 +1239,162 @@ func (l *Leader) handleAccept(msg AcceptMsg) error {
 	return nil
 }
 
+//
+// Update the progress of the follower on accepting the proposal.
+//
+func (l *Leader) updateProgress(fid string, txnid common.Txnid, committed common.Txnid) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.setLastAccepted(fid, txnid)
+	l.setLastCommittedBy(fid, committed)
+
+	if p, ok := l.progress[fid]; ok {
+		p.accepted(txnid, l.handler.GetClock().Now())
+	}
+}
+
+//
+// Remember the entries logged and committed by the follower when it is
+// synchronized with the leader.
+//
+func (l *Leader) updateSynchronized(fid string, txnid common.Txnid, committed common.Txnid) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.setLastAccepted(fid, txnid)
+	l.setLastCommittedBy(fid, committed)
+}
+
+//
+// Remember the last txnid logged by the follower.  The caller must hold
+// the mutex.
+//
+func (l *Leader) setLastAccepted(fid string, txnid common.Txnid) {
+
+	if last, ok := l.lastAccepted[fid]; !ok || common.CompareTxnid(txnid, last) == common.MORE_RECENT {
+		l.lastAccepted[fid] = txnid
+	}
+}
+
+//
+// Remember the last txnid committed by the follower.  The caller must hold
+// the mutex.
+//
+func (l *Leader) setLastCommittedBy(fid string, txnid common.Txnid) {
+
+	if last, ok := l.lastCommittedBy[fid]; !ok || common.CompareTxnid(txnid, last) == common.MORE_RECENT {
+		l.lastCommittedBy[fid] = txnid
+	}
+}
+
+//
+// Tell if the follower has committed every proposal logged by the leader.
+// A follower running an older protocol does not report its committed txnid
+// after synchronization.  The caller must hold the mutex.
+//
+func (l *Leader) hasCommittedAll(fid string) bool {
+
+	lastLogged, err := l.handler.GetLastLoggedTxid()
+	if err != nil {
+		return false
+	}
+
+	txnid, ok := l.lastCommittedBy[fid]
+	return ok && common.CompareTxnid(txnid, lastLogged) != common.LESS_RECENT
+}
+
+//
+// Find a follower that has a higher priority than the leader and has caught
+// up with the leader.  A follower is caught-up if it has committed every
+// proposal logged by the leader and there is no outstanding proposal.  The
+// follower then wins the election since its repository is as recent as the
+// leader's.  If there are multiple such followers, return the one with the
+// highest priority.  No follower is returned while the handover backs off
+// (see HandoverState).
+//
+func (l *Leader) findPreferredLeader() (string, bool) {
+
+	if len(l.proposals) != 0 {
+		return "", false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.handover.isAllowed(l.handler.GetClock().Now()) {
+		return "", false
+	}
+
+	preferred := ""
+	priority := l.handler.GetPriority()
+
+	for fid := range l.followers {
+		if l.handler.GetFollowerPriority(fid) <= priority {
+			continue
+		}
+
+		if l.hasCommittedAll(fid) {
+			preferred = fid
+			priority = l.handler.GetFollowerPriority(fid)
+		}
+	}
+
+	return preferred, len(preferred) != 0
+}
+
+//
+// Tell if the follower of the leadership transfer has accepted and committed
+// every proposal.  This must be called by Leader.listen().
+//
+func (l *Leader) isTransferReady() bool {
+
+	if len(l.transferTo) == 0 || len(l.proposals) != 0 {
+		return false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	p, ok := l.progress[l.transferTo]
+	if !ok || len(p.pending) != 0 {
+		return false
+	}
+
+	return l.hasCommittedAll(l.transferTo)
+}
+
+//
+// Remember that the leader steps down to hand over the leadership to a
+// higher priority follower.
+//
+func (l *Leader) recordHandover() {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.handover.stepDown(l.handler.GetClock().Now())
+}
+
+//
+// Track the handovers across the elections.  If this node is elected right
+// after a handover, the next handover backs off.
+//
+func (l *Leader) setHandover(handover *HandoverState) {
+
+	if failures, backoff := handover.elected(l.handler.GetClock().Now()); failures != 0 {
+		l.handler.GetLogger().Warnf("Leader.setHandover(): Leadership handover has not moved the leadership (%d times in a row). "+
+			"Do not hand over for %v.", failures, backoff)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.handover = handover
+}
+
 //
 // update quorum of proposal
 //
@@ -755,7 +1403,7 @@ func (l *Leader) updateQuorum(txid common.Txnid, fid string) {
 	if l.quorums[txid] == nil {
 		l.quorums[txid] = make([]string, 0, common.MAX_FOLLOWERS)
 	}
-	log.Printf("Leader.updateQuorum: current quorum for txid %d : %d", uint64(txid), len(l.quorums[txid]))
+	l.handler.GetLogger().Debugf("Leader.updateQuorum: current quorum for txid %d : %d", uint64(txid), len(l.quorums[txid]))
 
 	// Just to double check if the follower has already voted on this proposal.
 	var found bool
@@ -771,18 +1419,18 @@ func (l *Leader) updateQuorum(txid common.Txnid, fid string) {
 		l.quorums[txid] = append(l.quorums[txid], fid)
 	}
 
-	log.Printf("Leader.updateQuorum: new quorum for txid %d : %d", uint64(txid), len(l.quorums[txid]))
+	l.handler.GetLogger().Debugf("Leader.updateQuorum: new quorum for txid %d : %d", uint64(txid), len(l.quorums[txid]))
 }
 
 //
 // check if a proposal has reached quorum
 //
 func (l *Leader) hasQuorum(txid common.Txnid) bool {
-	// This uses a simple majority of quorum.  ZK also has a
-	// hierarchy quorums for scalability (servers are put into different
-	// groups and quorums are obtained within a group).
+	// The QuorumVerifier decides if the followers that have accepted the
+	// proposal form a quorum (e.g. simple majority, weighted or hierarchical
+	// quorums).
 
-	log.Printf("Leader.hasQuorum: accepted response for txid %d = %d, ensemble size = %d",
+	l.handler.GetLogger().Debugf("Leader.hasQuorum: accepted response for txid %d = %d, ensemble size = %d",
 		uint64(txid), len(l.quorums[txid]), l.handler.GetEnsembleSize())
 
 	accepted, ok := l.quorums[txid]
@@ -791,7 +1439,7 @@ func (l *Leader) hasQuorum(txid common.Txnid) bool {
 		return false
 	}
 
-	return uint64(len(accepted)) > (l.handler.GetEnsembleSize() / 2)
+	return l.handler.GetQuorumVerifier().HasQuorum(accepted)
 }
 
 //
@@ -808,7 +1456,7 @@ func (l *Leader) commit(txid common.Txnid) error {
 	// a fatal condition due to protocol error.
 	//
 	if !common.IsNextInSequence(txid, l.lastCommitted) {
-		log.Printf("Proposal must committed in sequential order for the same leader term. "+
+		l.handler.GetLogger().Errorf("Proposal must committed in sequential order for the same leader term. "+
 			"Found out-of-order commit. Leader last committed txid %d, commit msg %d", l.lastCommitted, txid)
 
 		return common.NewError(common.PROTOCOL_ERROR,
@@ -816,27 +1464,41 @@ func (l *Leader) commit(txid common.Txnid) error {
 				"Found out-of-order commit. Leader last committed txid %d, commit msg %d", l.lastCommitted, txid))
 	}
 
-	_, ok := l.proposals[txid]
+	proposal, ok := l.proposals[txid]
 	if !ok {
 		return common.NewError(common.SERVER_ERROR,
 			fmt.Sprintf("Cannot find a proposal for the txid %d. Fail to commit the proposal.", txid))
 	}
 
+	timing, hasTiming := l.timings[txid]
+	if hasTiming && !timing.sent.IsZero() {
+		quorumWait.With(l.handler.GetMetricLabels()).ObserveSinceWithClock(l.handler.GetClock(), timing.sent)
+		l.handler.GetTracer().RecordSpan(proposal.GetTraceId(), common.SPAN_ACCEPT, l.GetFollowerId(), txid, proposal.GetKey(), timing.sent)
+	}
+
 	// marking the proposal as committed.  Always do this first before sending to followers.
+	start := l.handler.GetClock().Now()
 	err := l.handler.Commit(txid)
 	if err != nil {
 		return err
 	}
+	l.handler.GetTracer().RecordSpan(proposal.GetTraceId(), common.SPAN_COMMIT, l.GetFollowerId(), txid, proposal.GetKey(), start)
+
+	proposalsCommitted.With(l.handler.GetMetricLabels()).Inc()
+	if hasTiming {
+		proposalLatency.With(l.handler.GetMetricLabels()).ObserveSinceWithClock(l.handler.GetClock(), timing.created)
+	}
 
 	// remove the votes
 	delete(l.quorums, txid)
 	delete(l.proposals, txid)
+	delete(l.timings, txid)
 
 	// Update lastCommitted
 	l.lastCommitted = txid
 
 	// Send the commit to followers
-	l.sendCommit(txid)
+	l.sendCommit(txid, proposal.GetTraceId())
 
 	// TODO: do we need to update election site?  I don't think so, but need to double check.
 
@@ -846,12 +1508,12 @@ func (l *Leader) commit(txid common.Txnid) error {
 //
 // send commit messages to all followers
 //
-func (l *Leader) sendCommit(txnid common.Txnid) error {
+func (l *Leader) sendCommit(txnid common.Txnid, traceId uint64) error {
 
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	msg := l.factory.CreateCommit(uint64(txnid))
+	msg := l.factory.CreateCommit(uint64(txnid), traceId)
 
 	// Send the request to the followers.  See the same
 	// comment as in sendProposal()
@@ -872,3 +1534,87 @@ func (l *Leader) sendCommit(txnid common.Txnid) error {
 
 	return nil
 }
+
+/////////////////////////////////////////////////////////
+// HandoverState
+/////////////////////////////////////////////////////////
+
+//
+// Remember that the leader steps down to hand over the leadership.
+//
+func (h *HandoverState) stepDown(now time.Time) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.steppedDown = now
+}
+
+//
+// This node is elected as the leader.  If it is right after this node steps
+// down to hand over the leadership, the handover has failed, and the next
+// one waits for a backoff which doubles with each failure in a row.  Return
+// the number of failures in a row and the backoff.
+//
+func (h *HandoverState) elected(now time.Time) (int, time.Duration) {
+	if h == nil {
+		return 0, 0
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	steppedDown := h.steppedDown
+	h.steppedDown = time.Time{}
+
+	if steppedDown.IsZero() || now.Sub(steppedDown) >= common.LEADERSHIP_TRANSFER_TIMEOUT*time.Millisecond {
+		h.failures = 0
+		return 0, 0
+	}
+
+	h.failures++
+	backoff := common.LEADER_HANDOVER_BACKOFF * time.Millisecond
+	for i := 1; i < h.failures && backoff < common.MAX_LEADER_HANDOVER_BACKOFF*time.Millisecond; i++ {
+		backoff *= 2
+	}
+	if backoff > common.MAX_LEADER_HANDOVER_BACKOFF*time.Millisecond {
+		backoff = common.MAX_LEADER_HANDOVER_BACKOFF * time.Millisecond
+	}
+	h.next = now.Add(backoff)
+
+	return h.failures, backoff
+}
+
+//
+// This node follows another leader.  The last handover (if any) has moved
+// the leadership.
+//
+func (h *HandoverState) followed() {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.steppedDown = time.Time{}
+	h.failures = 0
+	h.next = time.Time{}
+}
+
+//
+// Tell if the leadership can be handed over at the given time.
+//
+func (h *HandoverState) isAllowed(now time.Time) bool {
+	if h == nil {
+		return true
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return !now.Before(h.next)
+}
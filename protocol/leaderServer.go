@@ -17,7 +17,6 @@ package protocol
 
 import (
 	"github.com/couchbase/gometa/common"
-	"log"
 	"runtime/debug"
 	"sync"
 	"time"
@@ -29,7 +28,7 @@ import (
 
 type LeaderServer struct {
 	leader       *Leader
-	listener     *common.PeerListener
+	listener     common.ConnListener
 	consentState *ConsentState
 	state        *LeaderState
 	handler      ActionHandler
@@ -62,7 +61,7 @@ type ListenerState struct {
 // killch should be unbuffered to ensure the sender won't block
 //
 func RunLeaderServer(naddr string,
-	listener *common.PeerListener,
+	listener common.ConnListener,
 	ss RequestMgr,
 	handler ActionHandler,
 	factory MsgFactory,
@@ -72,24 +71,24 @@ func RunLeaderServer(naddr string,
 }
 
 func RunLeaderServerWithCustomHandler(naddr string,
-	listener *common.PeerListener,
+	listener common.ConnListener,
 	ss RequestMgr,
 	handler ActionHandler,
 	factory MsgFactory,
 	reqHandler CustomRequestHandler,
 	killch <-chan bool) (err error) {
 
-	log.Printf("LeaderServer.RunLeaderServer(): start leader server %s", naddr)
+	handler.GetLogger().Infof("LeaderServer.RunLeaderServer(): start leader server %s", naddr)
 
 	// Catch panic at the main entry point for LeaderServer
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in RunLeaderServer() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			handler.GetLogger().Errorf("panic in RunLeaderServer() : %s", r)
+			handler.GetLogger().Errorf("%s", debug.Stack())
 			err = r.(error)
 		} else if common.Debug() {
-			log.Printf("RunLeaderServer terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			handler.GetLogger().Tracef("RunLeaderServer terminates : Diagnostic Stack ...")
+			handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 	}()
 
@@ -100,13 +99,20 @@ func RunLeaderServerWithCustomHandler(naddr string,
 	}
 	defer leader.Terminate()
 
+	leader.setHandover(getHandoverState(ss))
+
+	if tracker, ok := ss.(LeaderTracker); ok {
+		tracker.SetLeader(leader)
+		defer tracker.SetLeader(nil)
+	}
+	defer setReady(ss, false)
+
 	// create a ConsentState
 	epoch, err := handler.GetAcceptedEpoch()
 	if err != nil {
 		return err
 	}
-	ensembleSize := handler.GetEnsembleSize()
-	consentState := NewConsentState(naddr, epoch, ensembleSize)
+	consentState := NewConsentState(naddr, epoch, handler.GetQuorumVerifier())
 	defer consentState.Terminate()
 
 	// create the leader state
@@ -130,7 +136,7 @@ func RunLeaderServerWithCustomHandler(naddr string,
 	// synchronized with it.
 	err = server.processRequest(killch, listenerState, reqHandler)
 
-	log.Printf("LeaderServer.RunLeaderServer(): leader server %s terminate", naddr)
+	handler.GetLogger().Infof("LeaderServer.RunLeaderServer(): leader server %s terminate", naddr)
 
 	return err
 }
@@ -148,11 +154,11 @@ func (l *LeaderServer) listenFollower(listenerState *ListenerState) {
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in LeaderServer.listenFollower() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			l.handler.GetLogger().Errorf("panic in LeaderServer.listenFollower() : %s", r)
+			l.handler.GetLogger().Errorf("%s", debug.Stack())
 		} else if common.Debug() {
-			log.Printf("LeaderServer.listenFollower() terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			l.handler.GetLogger().Tracef("LeaderServer.listenFollower() terminates : Diagnostic Stack ...")
+			l.handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 
 		common.SafeRun("LeaderServer.listenFollower()",
@@ -176,7 +182,7 @@ func (l *LeaderServer) listenFollower(listenerState *ListenerState) {
 	// for the server to be ready to process request.
 	if l.handler.GetEnsembleSize() == 1 {
 		if err := l.incrementEpoch(); err != nil {
-			log.Printf("LeaderServer.listenFollower(): Error when boostraping leader with ensembleSize=1. Error = %s", err)
+			l.handler.GetLogger().Warnf("LeaderServer.listenFollower(): Error when boostraping leader with ensembleSize=1. Error = %s", err)
 			return
 		}
 
@@ -198,17 +204,17 @@ func (l *LeaderServer) listenFollower(listenerState *ListenerState) {
 				// 2) Even if the leader receives votes from the leader, the leader cannot tell for sure that the follower does
 				//    not change its vote.  Only if the follower connects, the leader can confirm the follower's alliance.
 				//
-				log.Printf("LeaderServer.listenFollower(): Receive connection request from follower %s", conn.RemoteAddr())
+				l.handler.GetLogger().Infof("LeaderServer.listenFollower(): Receive connection request from follower %s", conn.RemoteAddr())
 				if l.registerOutstandingProxy(conn.RemoteAddr().String()) {
 					pipe := common.NewPeerPipe(conn)
 					go l.startProxy(pipe)
 				} else {
-					log.Printf("LeaderServer.listenFollower(): Sync Proxy already running for %s. Ignore new request.", conn.RemoteAddr())
+					l.handler.GetLogger().Infof("LeaderServer.listenFollower(): Sync Proxy already running for %s. Ignore new request.", conn.RemoteAddr())
 					conn.Close()
 				}
 			}
 		case <-listenerState.killch:
-			log.Printf("LeaderServer.listenFollower(): Receive kill signal. Terminate.")
+			l.handler.GetLogger().Infof("LeaderServer.listenFollower(): Receive kill signal. Terminate.")
 			return
 		}
 	}
@@ -218,15 +224,15 @@ func (l *LeaderServer) listenFollower(listenerState *ListenerState) {
 // Start a LeaderSyncProxy to synchornize the leader
 // and follower state.
 //
-func (l *LeaderServer) startProxy(peer *common.PeerPipe) {
+func (l *LeaderServer) startProxy(peer common.Pipe) {
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in LeaderServer.startProxy() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			l.handler.GetLogger().Errorf("panic in LeaderServer.startProxy() : %s", r)
+			l.handler.GetLogger().Errorf("%s", debug.Stack())
 		} else if common.Debug() {
-			log.Printf("LeaderServer.startProxy() : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			l.handler.GetLogger().Tracef("LeaderServer.startProxy() : Diagnostic Stack ...")
+			l.handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 
 		// deregister the proxy with the leader Server upon exit
@@ -234,7 +240,7 @@ func (l *LeaderServer) startProxy(peer *common.PeerPipe) {
 	}()
 
 	// create a proxy that will sycnhronize with the peer.
-	log.Printf("LeaderServer.startProxy(): Start synchronization with follower. Peer TCP connection (%s)", peer.GetAddr())
+	l.handler.GetLogger().Infof("LeaderServer.startProxy(): Start synchronization with follower. Peer TCP connection (%s)", peer.GetAddr())
 	proxy := NewLeaderSyncProxy(l.leader, l.consentState, peer, l.handler, l.factory)
 	donech := proxy.GetDoneChannel()
 
@@ -252,8 +258,8 @@ func (l *LeaderServer) startProxy(peer *common.PeerPipe) {
 	// Get the killch for this go-routine
 	killch := l.getProxyKillChan(peer.GetAddr())
 	if killch == nil {
-		log.Printf("LeaderServer.startProxy(): Cannot find killch for proxy (TCP connection = %s).", peer.GetAddr())
-		log.Printf("LeaderServer.startProxy(): Cannot start follower sync.")
+		l.handler.GetLogger().Warnf("LeaderServer.startProxy(): Cannot find killch for proxy (TCP connection = %s).", peer.GetAddr())
+		l.handler.GetLogger().Warnf("LeaderServer.startProxy(): Cannot start follower sync.")
 		return
 	}
 
@@ -266,25 +272,35 @@ func (l *LeaderServer) startProxy(peer *common.PeerPipe) {
 			// tell the leader to add this follower for processing request.  If there is a follower running already,
 			// AddFollower() will terminate the existing follower instance, and then create a new one.
 			fid := proxy.GetFid()
+			l.leader.SetPeerVersion(fid, proxy.GetProtocolVersion(), proxy.CanFollowerVote())
 			if proxy.CanFollowerVote() {
 				l.leader.AddFollower(fid, peer, o)
-				log.Printf("LeaderServer.startProxy(): Synchronization with follower %s done (TCP conn = %s).  Add follower.",
-					fid, peer.GetAddr())
+				l.handler.GetLogger().Log(common.LOG_INFO, "LeaderServer.startProxy(): Synchronization with follower done.  Add follower.",
+					common.LogPeer(fid), common.NewLogField("conn", peer.GetAddr()))
 
 				// At this point, the follower has voted this server as the leader.
-				// Notify the request processor to start processing new request for this host
-				l.notifyReady()
+				// Notify the request processor to start processing new request for this host,
+				// once there is a quorum of followers.  Otherwise, the request processor
+				// would find that the leader has no quorum, and terminate.
+				if l.handler.GetQuorumVerifier().HasQuorum(l.leader.GetActiveEnsemble()) {
+					l.notifyReady()
+				}
 			} else {
 				l.leader.AddWatcher(fid, peer, o)
-				log.Printf("LeaderServer.startProxy(): Sync with watcher done.  Add Watcher %s (TCP conn = %s)",
-					fid, peer.GetAddr())
+				l.handler.GetLogger().Log(common.LOG_INFO, "LeaderServer.startProxy(): Sync with watcher done.  Add watcher.",
+					common.LogPeer(fid), common.NewLogField("conn", peer.GetAddr()))
 			}
 		} else {
-			log.Printf("LeaderServer:startProxy(): Leader Fail to synchronization with follower (TCP conn = %s)", peer.GetAddr())
+			l.handler.GetLogger().Warnf("LeaderServer:startProxy(): Leader Fail to synchronization with follower (TCP conn = %s)", peer.GetAddr())
+
+			// Close the connection so the follower does not have to wait for
+			// its sync timeout before looking for a new leader.
+			peer.Close()
 		}
 	case <-killch:
-		log.Printf("LeaderServer:startProxy(): Sync proxy is killed while synchronizing with follower (TCP conn == %s)",
+		l.handler.GetLogger().Infof("LeaderServer:startProxy(): Sync proxy is killed while synchronizing with follower (TCP conn == %s)",
 			peer.GetAddr())
+		peer.Close()
 	}
 }
 
@@ -313,7 +329,7 @@ func (l *LeaderServer) incrementEpoch() error {
 
 	epoch = common.CompareAndIncrementEpoch(epoch, epoch)
 
-	log.Printf("LeaderServer.incrementEpoch(): new epoch %d", epoch)
+	l.handler.GetLogger().Log(common.LOG_INFO, "LeaderServer.incrementEpoch(): New epoch", common.LogEpoch(epoch))
 
 	if err := l.handler.NotifyNewAcceptedEpoch(epoch); err != nil {
 		return err
@@ -339,12 +355,12 @@ func (s *LeaderServer) processRequest(killch <-chan bool,
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in LeaderServer.processRequest() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			s.handler.GetLogger().Errorf("panic in LeaderServer.processRequest() : %s", r)
+			s.handler.GetLogger().Errorf("%s", debug.Stack())
 			err = r.(error)
 		} else if common.Debug() {
-			log.Printf("LeaderServer.processRequest() : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			s.handler.GetLogger().Tracef("LeaderServer.processRequest() : Diagnostic Stack ...")
+			s.handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 
 		common.SafeRun("LeaderServer.processRequest()",
@@ -356,6 +372,7 @@ func (s *LeaderServer) processRequest(killch <-chan bool,
 	// start processing loop after I am being confirmed as a leader (there
 	// is a quorum of followers that have sync'ed with me)
 	if !s.waitTillReady() {
+		setExitReason(s.state.requestMgr, EXIT_NO_QUORUM)
 		return common.NewError(common.ELECTION_ERROR,
 			"LeaderServer.processRequest(): Leader times out waiting for quorum of followers. Terminate")
 	}
@@ -363,13 +380,13 @@ func (s *LeaderServer) processRequest(killch <-chan bool,
 	// At this point, the leader has gotten a majority of followers to follow, so it
 	// can proceed.  It is possible that it may loose quorum of followers. But in that
 	// case, the leader will not be able to process any request.
-	log.Printf("LeaderServer.processRequest(): Leader Server is ready to proces request")
+	s.handler.GetLogger().Infof("LeaderServer.processRequest(): Leader Server is ready to proces request")
 
 	// Leader is ready at this time.  This implies that there is a quorum of follower has
 	// followed this leader.  Get the change channel to keep track of  number of followers.
 	// If the leader no longer has quorum, it needs to let go of its leadership.
 	leaderchangech := s.leader.GetEnsembleChangeChannel()
-	ensembleSize := s.handler.GetEnsembleSize()
+	verifier := s.handler.GetQuorumVerifier()
 
 	// notify the request processor to start processing new request
 	incomings := s.state.requestMgr.GetRequestChannel()
@@ -386,13 +403,16 @@ func (s *LeaderServer) processRequest(killch <-chan bool,
 		case handle, ok := <-incomings:
 			if ok {
 				// de-queue the request
+				s.handler.GetTracer().RecordSpan(handle.Request.GetTraceId(), common.SPAN_INCOMING, s.handler.GetFollowerId(),
+					common.Txnid(0), handle.Request.GetKey(), handle.Queued)
 				s.state.requestMgr.AddPendingRequest(handle)
 
 				// forward request to the leader
 				s.leader.QueueRequest(s.leader.GetFollowerId(), handle.Request)
 			} else {
 				// server shutdown.
-				log.Printf("LeaderServer.processRequest(): channel for receiving client request is closed. Terminate.")
+				s.handler.GetLogger().Infof("LeaderServer.processRequest(): channel for receiving client request is closed. Terminate.")
+				setExitReason(s.state.requestMgr, EXIT_KILLED)
 				return nil
 			}
 		case msg, ok := <-outgoings:
@@ -400,23 +420,32 @@ func (s *LeaderServer) processRequest(killch <-chan bool,
 				// forward msg to the leader
 				s.leader.QueueResponse(msg)
 			} else {
-				log.Printf("LeaderServer.processRequest(): channel for receiving custom response is closed. Ignore.")
+				s.handler.GetLogger().Infof("LeaderServer.processRequest(): channel for receiving custom response is closed. Ignore.")
 			}
 		case <-killch:
 			// server shutdown
-			log.Printf("LeaderServer.processRequest(): receive kill signal. Stop Client request processing.")
+			s.handler.GetLogger().Infof("LeaderServer.processRequest(): receive kill signal. Stop Client request processing.")
+			setExitReason(s.state.requestMgr, EXIT_KILLED)
 			return nil
 		case <-listenerState.donech:
 			// listener is down.  Terminate this request processing loop as well.
-			log.Printf("LeaderServer.processRequest(): follower listener terminates. Stop client request processing.")
+			s.handler.GetLogger().Infof("LeaderServer.processRequest(): follower listener terminates. Stop client request processing.")
+			setExitReason(s.state.requestMgr, EXIT_PIPE_ERROR)
 			return nil
 		case <-leaderchangech:
+			// The leader has stepped down (e.g. to start a new epoch or to transfer leadership).
+			if s.leader.IsClosed() {
+				s.handler.GetLogger().Infof("LeaderServer.processRequest(): leader has terminated. Stop client request processing.")
+				setExitReason(s.state.requestMgr, EXIT_STEPPED_DOWN)
+				return nil
+			}
+
 			// Listen to any change to the leader's active ensemble, and to ensure that the leader maintain majority.
 			// The active ensemble is the set of running followers connected to the leader.
-			numFollowers := s.leader.GetActiveEnsembleSize()
-			if numFollowers <= int(ensembleSize/2) {
+			if !verifier.HasQuorum(s.leader.GetActiveEnsemble()) {
 				// leader looses majority of follower.
-				log.Printf("LeaderServer.processRequest(): leader looses majority of follower. Stop client request processing.")
+				s.handler.GetLogger().Warnf("LeaderServer.processRequest(): leader looses majority of follower. Stop client request processing.")
+				setExitReason(s.state.requestMgr, EXIT_LOST_QUORUM)
 				return nil
 			}
 		}
@@ -440,6 +469,7 @@ func (s *LeaderServer) notifyReady() {
 	if !s.state.ready {
 		s.state.ready = true
 		s.state.readych <- true
+		setReady(s.state.requestMgr, true)
 	}
 }
 
@@ -449,14 +479,14 @@ func (s *LeaderServer) notifyReady() {
 //
 func (s *LeaderServer) waitTillReady() bool {
 
-	timeout := time.After(common.LEADER_TIMEOUT * time.Millisecond)
+	timeout := s.handler.GetClock().After(common.LEADER_TIMEOUT * time.Millisecond)
 
 	select {
 	case <-s.state.readych:
 		return true
 
 	case <-timeout:
-		log.Printf("LeaderServer.waitTillReady(): Leader cannot get quorum of followers to follow before timing out. Termiate.")
+		s.handler.GetLogger().Warnf("LeaderServer.waitTillReady(): Leader cannot get quorum of followers to follow before timing out. Termiate.")
 		return false
 	}
 }
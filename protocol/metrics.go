@@ -0,0 +1,55 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"github.com/couchbase/gometa/common"
+)
+
+/////////////////////////////////////////////////
+// Metrics
+/////////////////////////////////////////////////
+
+var (
+	proposalsCreated = common.Metrics.NewCounter("gometa_proposals_created_total",
+		"Number of proposals created by the leader.")
+	proposalsCommitted = common.Metrics.NewCounter("gometa_proposals_committed_total",
+		"Number of proposals committed by the leader.")
+	proposalsAborted = common.Metrics.NewCounter("gometa_proposals_aborted_total",
+		"Number of requests aborted by the leader.")
+	proposalLatency = common.Metrics.NewHistogram("gometa_proposal_commit_latency_seconds",
+		"Time from the creation of a proposal to its commit by the leader.", common.LatencyBuckets)
+	quorumWait = common.Metrics.NewHistogram("gometa_quorum_wait_seconds",
+		"Time from sending a proposal to the followers until a quorum has accepted it.", common.LatencyBuckets)
+	slowFollowers = common.Metrics.NewCounter("gometa_slow_followers_total",
+		"Number of times a follower is reported as slow by the leader.")
+	notificationQueueDepth = common.Metrics.NewGauge("gometa_leader_notification_queue_depth",
+		"Number of messages from the followers waiting to be processed by the leader.")
+	observerQueueDepth = common.Metrics.NewGauge("gometa_observer_queue_depth",
+		"Number of messages queued for the followers that are synchronizing with the leader.")
+
+	electionsStarted = common.Metrics.NewCounter("gometa_elections_started_total",
+		"Number of leader elections started.")
+	electionsWon = common.Metrics.NewCounter("gometa_elections_won_total",
+		"Number of leader elections won by this node.")
+	electionDuration = common.Metrics.NewHistogram("gometa_election_duration_seconds",
+		"Time to elect a leader.", common.LatencyBuckets)
+
+	syncDuration = common.Metrics.NewHistogram("gometa_sync_duration_seconds",
+		"Time for the leader to synchronize a follower.", common.LatencyBuckets)
+	syncEntriesStreamed = common.Metrics.NewCounter("gometa_sync_entries_streamed_total",
+		"Number of committed log entries streamed by the leader to synchronizing followers.")
+)
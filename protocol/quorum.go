@@ -0,0 +1,207 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"github.com/couchbase/gometa/common"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+type QuorumKind string
+
+const (
+	MAJORITY_QUORUM     QuorumKind = "majority"
+	WEIGHTED_QUORUM     QuorumKind = "weighted"
+	HIERARCHICAL_QUORUM QuorumKind = "hierarchical"
+)
+
+//
+// A QuorumMember is a voting member of the ensemble.  A member can be known
+// by more than one identity (e.g. its election address and its message
+// address), since different phases of the protocol identify the voters
+// differently.
+//
+type QuorumMember struct {
+	Ids    []string
+	Weight uint64
+	Group  string
+}
+
+//
+// A simple majority of the voters.  Every voter has the same weight.
+//
+type MajorityQuorumVerifier struct {
+	size uint64
+}
+
+//
+// A majority of the total weight of the ensemble.
+//
+type WeightedQuorumVerifier struct {
+	members map[string]*QuorumMember // key : member identity
+	total   uint64
+}
+
+//
+// A hierarchical quorum (as in ZK).  The members are put into groups.  A
+// quorum requires a (weighted) majority within a majority of the groups.
+//
+type HierarchicalQuorumVerifier struct {
+	members map[string]*QuorumMember // key : member identity
+	groups  map[string]uint64        // key : group name, value : total weight of the group
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a QuorumVerifier based on the kind of quorum.   The members are
+// ignored for MAJORITY_QUORUM.
+//
+func NewQuorumVerifier(kind QuorumKind, ensembleSize uint64, members []*QuorumMember) (QuorumVerifier, error) {
+
+	switch kind {
+	case "", MAJORITY_QUORUM:
+		return NewMajorityQuorumVerifier(ensembleSize), nil
+	case WEIGHTED_QUORUM:
+		return NewWeightedQuorumVerifier(members), nil
+	case HIERARCHICAL_QUORUM:
+		return NewHierarchicalQuorumVerifier(members), nil
+	}
+
+	return nil, common.NewError(common.ARG_ERROR, "Unknown quorum type "+string(kind))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// MajorityQuorumVerifier
+/////////////////////////////////////////////////////////////////////////////
+
+func NewMajorityQuorumVerifier(ensembleSize uint64) *MajorityQuorumVerifier {
+	return &MajorityQuorumVerifier{size: ensembleSize}
+}
+
+func (v *MajorityQuorumVerifier) HasQuorum(voters []string) bool {
+	return uint64(len(uniqueVoters(voters))) > v.size/2
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// WeightedQuorumVerifier
+/////////////////////////////////////////////////////////////////////////////
+
+func NewWeightedQuorumVerifier(members []*QuorumMember) *WeightedQuorumVerifier {
+
+	verifier := &WeightedQuorumVerifier{members: make(map[string]*QuorumMember)}
+
+	for _, member := range members {
+		for _, id := range member.Ids {
+			verifier.members[id] = member
+		}
+		verifier.total += member.Weight
+	}
+
+	return verifier
+}
+
+//
+// Return true if the voters carry more than half of the total weight.
+// Voters that are not a member of the ensemble are not counted.
+//
+func (v *WeightedQuorumVerifier) HasQuorum(voters []string) bool {
+
+	var weight uint64 = 0
+	for member := range findMembers(v.members, voters) {
+		weight += member.Weight
+	}
+
+	return weight > v.total/2
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// HierarchicalQuorumVerifier
+/////////////////////////////////////////////////////////////////////////////
+
+func NewHierarchicalQuorumVerifier(members []*QuorumMember) *HierarchicalQuorumVerifier {
+
+	verifier := &HierarchicalQuorumVerifier{
+		members: make(map[string]*QuorumMember),
+		groups:  make(map[string]uint64)}
+
+	for _, member := range members {
+		for _, id := range member.Ids {
+			verifier.members[id] = member
+		}
+		verifier.groups[member.Group] += member.Weight
+	}
+
+	return verifier
+}
+
+//
+// Return true if the voters carry more than half of the weight within
+// a majority of the groups.  Voters that are not a member of the ensemble
+// are not counted.
+//
+func (v *HierarchicalQuorumVerifier) HasQuorum(voters []string) bool {
+
+	weights := make(map[string]uint64)
+	for member := range findMembers(v.members, voters) {
+		weights[member.Group] += member.Weight
+	}
+
+	count := 0
+	for group, total := range v.groups {
+		if weights[group] > total/2 {
+			count++
+		}
+	}
+
+	return count > len(v.groups)/2
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Remove duplicate voters
+//
+func uniqueVoters(voters []string) map[string]bool {
+
+	result := make(map[string]bool)
+	for _, voter := range voters {
+		result[voter] = true
+	}
+	return result
+}
+
+//
+// Find the members for the voters.  A member is only returned once, even
+// if the member votes with more than one identity.
+//
+func findMembers(members map[string]*QuorumMember, voters []string) map[*QuorumMember]bool {
+
+	result := make(map[*QuorumMember]bool)
+	for _, voter := range voters {
+		if member, ok := members[voter]; ok {
+			result[member] = true
+		}
+	}
+	return result
+}
@@ -17,7 +17,6 @@ package protocol
 
 import (
 	"github.com/couchbase/gometa/common"
-	"log"
 	"runtime/debug"
 	"sync"
 	"time"
@@ -44,13 +43,12 @@ func RunWatcherServerWithRequest(leader string,
 	backoff := common.RETRY_BACKOFF
 	retry := true
 	for retry {
-		if runOnce(leader, requestMgr, handler, factory, killch, readych, once) {
+		if runOnce(leader, common.NewNetTransport(), requestMgr, handler, factory, killch, readych, once) {
 			retry = false
 		}
 
 		if retry {
-			timer := time.NewTimer(backoff * time.Millisecond)
-			<-timer.C
+			<-handler.GetClock().After(backoff * time.Millisecond)
 
 			backoff += backoff
 			if backoff > common.MAX_RETRY_BACKOFF {
@@ -90,22 +88,60 @@ func RunWatcherServerWithElection(host string,
 	killch <-chan bool,
 	readych chan<- bool) {
 
+	RunWatcherServerWithElectionTransport(host, peerUDP, peerTCP, requestMgr, handler, factory,
+		killch, readych, common.ELECTION_TRANSPORT_TYPE)
+}
+
+//
+// Same as RunWatcherServerWithElection, but the election votes are sent
+// using the given transport ("udp" or "tcp").  The transport must match
+// the one used by the peers.
+//
+func RunWatcherServerWithElectionTransport(host string,
+	peerUDP []string,
+	peerTCP []string,
+	requestMgr RequestMgr,
+	handler ActionHandler,
+	factory MsgFactory,
+	killch <-chan bool,
+	readych chan<- bool,
+	transport string) {
+
+	RunWatcherServerWithTransport(host, peerUDP, peerTCP, requestMgr, handler, factory,
+		killch, readych, transport, common.NewNetTransport())
+}
+
+//
+// Same as RunWatcherServerWithElectionTransport, but the watcher connects
+// to the peers through the given network (e.g. TLS).
+//
+func RunWatcherServerWithTransport(host string,
+	peerUDP []string,
+	peerTCP []string,
+	requestMgr RequestMgr,
+	handler ActionHandler,
+	factory MsgFactory,
+	killch <-chan bool,
+	readych chan<- bool,
+	transport string,
+	network common.Transport) {
+
 	var once sync.Once
 	backoff := common.RETRY_BACKOFF
 	retry := true
+	state := NewElectionState()
 	for retry {
-		peer, isKilled := findPeerToConnect(host, peerUDP, peerTCP, factory, handler, killch)
+		peer, isKilled := findPeerToConnect(host, peerUDP, peerTCP, factory, handler, killch, transport, network, state)
 		if isKilled {
 			return
 		}
 
-		if peer != "" && runOnce(peer, requestMgr, handler, factory, killch, readych, once) {
+		if peer != "" && runOnce(peer, network, requestMgr, handler, factory, killch, readych, once) {
 			retry = false
 		}
 
 		if retry {
-			timer := time.NewTimer(backoff * time.Millisecond)
-			<-timer.C
+			<-handler.GetClock().After(backoff * time.Millisecond)
 
 			backoff += backoff
 			if backoff > common.MAX_RETRY_BACKOFF {
@@ -120,6 +156,7 @@ func RunWatcherServerWithElection(host string,
 /////////////////////////////////////////////////////////////////////////////
 
 func runOnce(peer string,
+	dialer common.Dialer,
 	requestMgr RequestMgr,
 	handler ActionHandler,
 	factory MsgFactory,
@@ -130,22 +167,22 @@ func runOnce(peer string,
 	// Catch panic at the main entry point for WatcherServer
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in WatcherServer.runOnce() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			handler.GetLogger().Errorf("panic in WatcherServer.runOnce() : %s", r)
+			handler.GetLogger().Errorf("%s", debug.Stack())
 		} else if common.Debug() {
-			log.Printf("WatcherServer.runOnce() terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			handler.GetLogger().Tracef("WatcherServer.runOnce() terminates : Diagnostic Stack ...")
+			handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 	}()
 
 	// create connection with a peer
-	conn, err := createConnection(peer)
+	conn, err := dialer.Dial(peer)
 	if err != nil {
-		log.Printf("WatcherServer.runOnce() error : %s", err)
+		handler.GetLogger().Warnf("WatcherServer.runOnce() error : %s", err)
 		return false
 	}
 	pipe := common.NewPeerPipe(conn)
-	log.Printf("WatcherServer.runOnce() : Watcher successfully created TCP connection to peer %s", peer)
+	handler.GetLogger().Infof("WatcherServer.runOnce() : Watcher successfully created TCP connection to peer %s", peer)
 
 	// close the connection to the peer. If connection is closed,
 	// sync proxy and watcher will also terminate by err-ing out.
@@ -162,12 +199,12 @@ func runOnce(peer string,
 	// run watcher after synchronization
 	if success {
 		if !runWatcher(pipe, requestMgr, handler, factory, killch, readych, once) {
-			log.Printf("WatcherServer.runOnce() : Watcher terminated unexpectedly.")
+			handler.GetLogger().Infof("WatcherServer.runOnce() : Watcher terminated unexpectedly.")
 			return false
 		}
 
 	} else if !isKilled {
-		log.Printf("WatcherServer.runOnce() : Watcher fail to synchronized with peer %s", peer)
+		handler.GetLogger().Warnf("WatcherServer.runOnce() : Watcher fail to synchronized with peer %s", peer)
 		return false
 	}
 
@@ -181,12 +218,12 @@ func runOnce(peer string,
 //
 // Synchronize with the leader.
 //
-func syncWithPeer(pipe *common.PeerPipe,
+func syncWithPeer(pipe common.Pipe,
 	handler ActionHandler,
 	factory MsgFactory,
 	killch <-chan bool) (success bool, isKilled bool) {
 
-	log.Printf("WatcherServer.syncWithPeer(): Watcher start synchronization with peer (TCP %s)", pipe.GetAddr())
+	handler.GetLogger().Infof("WatcherServer.syncWithPeer(): Watcher start synchronization with peer (TCP %s)", pipe.GetAddr())
 	proxy := NewFollowerSyncProxy(pipe, handler, factory, false)
 	donech := proxy.GetDoneChannel()
 	go proxy.Start()
@@ -196,13 +233,13 @@ func syncWithPeer(pipe *common.PeerPipe,
 	select {
 	case success = <-donech:
 		if success {
-			log.Printf("WatcherServer.syncWithPeer(): Watcher done synchronization with peer (TCP %s)", pipe.GetAddr())
+			handler.GetLogger().Infof("WatcherServer.syncWithPeer(): Watcher done synchronization with peer (TCP %s)", pipe.GetAddr())
 		}
 		return success, false
 	case <-killch:
 		// simply return. The pipe will eventually be closed and
 		// cause WatcherSyncProxy to err out.
-		log.Printf("WatcherServer.syncWithPeer(): Recieve kill singal.  Synchronization with peer (TCP %s) terminated.",
+		handler.GetLogger().Infof("WatcherServer.syncWithPeer(): Recieve kill singal.  Synchronization with peer (TCP %s) terminated.",
 			pipe.GetAddr())
 		return false, true
 	}
@@ -216,22 +253,32 @@ func findPeerToConnect(host string,
 	peerTCP []string,
 	factory MsgFactory,
 	handler ActionHandler,
-	killch <-chan bool) (leader string, isKilled bool) {
+	killch <-chan bool,
+	transport string,
+	network common.Transport,
+	state *ElectionState) (leader string, isKilled bool) {
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in findPeerToConnect() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			handler.GetLogger().Errorf("panic in findPeerToConnect() : %s", r)
+			handler.GetLogger().Errorf("%s", debug.Stack())
 		} else if common.Debug() {
-			log.Printf("findPeerToConnect() terminates : Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			handler.GetLogger().Tracef("findPeerToConnect() terminates : Diagnostic Stack ...")
+			handler.GetLogger().Tracef("%s", debug.Stack())
 		}
 	}()
 
 	// Run master election to figure out who is the leader.  Only connect to leader for now.
-	site, err := CreateElectionSite(host, peerUDP, factory, handler, true)
+	messenger, err := NewElectionMessengerWithTransport(host, transport, network)
+	if err != nil {
+		handler.GetLogger().Warnf("WatcherServer.findPeerToConnect() error : %s", err)
+		return "", false
+	}
+
+	site, err := CreateElectionSiteWithMessenger(messenger, peerUDP, factory, handler, true, state)
 	if err != nil {
-		log.Printf("WatcherServer.findPeerToConnect() error : %s", err)
+		messenger.Close()
+		handler.GetLogger().Warnf("WatcherServer.findPeerToConnect() error : %s", err)
 		return "", false
 	}
 
@@ -244,14 +291,14 @@ func findPeerToConnect(host string,
 
 	resultCh := site.StartElection()
 	if resultCh == nil {
-		log.Printf("WatcherServer.findPeerToConnect: Election Site is in progress or is closed.")
+		handler.GetLogger().Infof("WatcherServer.findPeerToConnect: Election Site is in progress or is closed.")
 		return "", false
 	}
 
 	select {
 	case leader, ok := <-resultCh:
 		if !ok {
-			log.Printf("WatcherServer.findPeerToConnect: Election Fails")
+			handler.GetLogger().Warnf("WatcherServer.findPeerToConnect: Election Fails")
 			return "", false
 		}
 
@@ -261,7 +308,7 @@ func findPeerToConnect(host string,
 			}
 		}
 
-		log.Printf("WatcherServer.findPeerToConnect : Cannot find matching port for peer. Peer UPD port = %s", leader)
+		handler.GetLogger().Warnf("WatcherServer.findPeerToConnect : Cannot find matching port for peer. Peer UPD port = %s", leader)
 		return "", false
 
 	case <-killch:
@@ -276,7 +323,7 @@ func findPeerToConnect(host string,
 //
 // Run Watcher Protocol
 //
-func runWatcher(pipe *common.PeerPipe,
+func runWatcher(pipe common.Pipe,
 	requestMgr RequestMgr,
 	handler ActionHandler,
 	factory MsgFactory,
@@ -285,7 +332,7 @@ func runWatcher(pipe *common.PeerPipe,
 	once sync.Once) (isKilled bool) {
 
 	// Create a watcher.  The watcher will start a go-rountine, listening to messages coming from peer.
-	log.Printf("WatcherServer.runWatcher(): Start Watcher Protocol")
+	handler.GetLogger().Infof("WatcherServer.runWatcher(): Start Watcher Protocol")
 	watcher := NewFollower(WATCHER, pipe, handler, factory)
 	donech := watcher.Start()
 	defer watcher.Terminate()
@@ -309,20 +356,20 @@ func runWatcher(pipe *common.PeerPipe,
 
 				// forward the request to the leader
 				if !watcher.ForwardRequest(handle.Request) {
-					log.Printf("WatcherServer.processRequest(): fail to send client request to leader. Terminate.")
+					handler.GetLogger().Warnf("WatcherServer.processRequest(): fail to send client request to leader. Terminate.")
 					return
 				}
 			} else {
-				log.Printf("WatcherServer.processRequest(): channel for receiving client request is closed. Terminate.")
+				handler.GetLogger().Infof("WatcherServer.processRequest(): channel for receiving client request is closed. Terminate.")
 				return
 			}
 		case <-killch:
 			// server is being explicitly terminated.  Terminate the watcher go-rountine as well.
-			log.Printf("WatcherServer.runTillEnd(): receive kill signal. Terminate.")
+			handler.GetLogger().Infof("WatcherServer.runTillEnd(): receive kill signal. Terminate.")
 			return true
 		case <-donech:
 			// watcher is done.  Just return.
-			log.Printf("WatcherServer.runTillEnd(): Watcher go-routine terminates. Terminate.")
+			handler.GetLogger().Infof("WatcherServer.runTillEnd(): Watcher go-routine terminates. Terminate.")
 			return false
 		}
 	}
@@ -19,7 +19,8 @@ import (
 	"fmt"
 	"github.com/couchbase/gometa/common"
 	"github.com/couchbase/gometa/message"
-	"log"
+	fdb "github.com/couchbaselabs/goforestdb"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -45,11 +46,17 @@ type CommitLog struct {
 	repo    *Repository
 	factory *message.ConcreteMsgFactory
 	mutex   sync.Mutex
+	readers map[*LogIterator]common.Txnid // the start txnid of the open iterators
 }
 
 type LogIterator struct {
-	repo *Repository
-	iter *RepoIterator
+	repo    *Repository
+	iter    *RepoIterator
+	log     *CommitLog
+	start   common.Txnid // the oldest txnid to return
+	wraps   bool         // true if the range continues after the epoch wrap
+	wrapKey string       // end key of the range after the epoch wrap
+	wrapped bool         // true once the iterator is past the epoch wrap
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -61,7 +68,8 @@ type LogIterator struct {
 //
 func NewCommitLog(repo *Repository) *CommitLog {
 	return &CommitLog{repo: repo,
-		factory: message.NewConcreteMsgFactory()}
+		factory: message.NewConcreteMsgFactory(),
+		readers: make(map[*LogIterator]common.Txnid)}
 }
 
 //
@@ -69,6 +77,9 @@ func NewCommitLog(repo *Repository) *CommitLog {
 //
 func (r *CommitLog) Log(txid common.Txnid, op common.OpCode, key string, content []byte) error {
 
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	k := createLogKey(txid)
 	msg := r.factory.CreateLogEntry(uint64(txid), uint32(op), key, content)
 	data, err := common.Marshall(msg)
@@ -107,10 +118,69 @@ func (r *CommitLog) Get(txid common.Txnid) (common.OpCode, string, []byte, error
 //
 func (r *CommitLog) Delete(txid common.Txnid) error {
 
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	k := createLogKey(txid)
 	return r.repo.Delete(k)
 }
 
+//
+// Move the entries logged with the decimal keys of the older versions
+// to the keys of createLogKey.  Return the number of entries moved.
+//
+func (r *CommitLog) Upgrade() (int, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	iter, err := r.repo.NewIterator(common.PREFIX_COMMIT_LOG_PATH, common.PREFIX_COMMIT_LOG_PATH+"\xff")
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make(map[string]string) // key : old key, value : new key
+	values := make(map[string][]byte)
+	for {
+		key, content, err := iter.Next()
+		if err != nil {
+			break
+		}
+
+		entry, err := unmarshall(content)
+		if err != nil {
+			common.Warnf("CommitLog.Upgrade() : Skip invalid log entry %s", key)
+			continue
+		}
+
+		if newKey := createLogKey(common.Txnid(entry.GetTxnid())); newKey != key {
+			keys[key] = newKey
+			values[key] = content
+		}
+	}
+	iter.Close()
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	for key, newKey := range keys {
+		if err := r.repo.SetNoCommit(newKey, values[key]); err != nil {
+			return 0, err
+		}
+		if err := r.repo.DeleteNoCommit(key); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := r.repo.Commit(); err != nil {
+		return 0, err
+	}
+
+	common.Infof("CommitLog.Upgrade() : Move %d entries to the new log keys", len(keys))
+	return len(keys), nil
+}
+
 //
 // Mark a log entry has been committted
 //
@@ -119,19 +189,110 @@ func (r *CommitLog) MarkCommitted(txid common.Txnid) error {
 	return nil
 }
 
+//
+// Remove the entries up to the given txnid (inclusive) from the commit
+// log, and remember the compacted txnid in the server config.  Return the
+// number of entries removed.  The log is not compacted above the start
+// txnid of an open iterator, since a peer synchronizing from the log
+// still needs the entries after it.
+//
+func (r *CommitLog) Compact(txid common.Txnid, config *ServerConfig) (int, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if oldest, ok := r.oldestReader(); ok && common.CompareTxnid(txid, oldest) == common.MORE_RECENT {
+		return 0, common.NewError(common.INVALID_REQUEST_ERROR,
+			fmt.Sprintf("The entries after txnid %d are still needed by a peer synchronizing from the log", uint64(oldest)))
+	}
+
+	// Remember the compacted txnid first.  If the node fails while
+	// removing the entries, the peers do not get a partial log.
+	if err := config.SetLogCompactedTxid(txid); err != nil {
+		return 0, err
+	}
+
+	// The log keys are not ordered by txnid across the epoch wrap (see
+	// createLogKey), so check every entry.
+	iter, err := r.repo.NewIterator(common.PREFIX_COMMIT_LOG_PATH, common.PREFIX_COMMIT_LOG_PATH+"\xff")
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	for {
+		key, _, err := iter.Next()
+		if err != nil {
+			break
+		}
+
+		value, err := parseLogKey(key)
+		if err != nil {
+			common.Warnf("CommitLog.Compact() : Skip invalid log key %s", key)
+			continue
+		}
+
+		if common.CompareTxnid(value, txid) != common.MORE_RECENT {
+			keys = append(keys, key)
+		}
+	}
+	iter.Close()
+
+	for _, key := range keys {
+		if err := r.repo.DeleteNoCommit(key); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := r.repo.Commit(); err != nil {
+		return 0, err
+	}
+
+	common.Infof("CommitLog.Compact() : Remove %d entries up to txnid %d", len(keys), uint64(txid))
+	return len(keys), nil
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // LogIterator Public Function
 /////////////////////////////////////////////////////////////////////////////
 
 //
-// Create a new iterator
+// Create a new iterator.  The log is not compacted above txid1 until the
+// iterator is closed.
+//
+// The log keys are in txnid order, except across the epoch wrap.  If the
+// range wraps, the iterator first returns the entries up to the last
+// key, and then the entries from the first key that are more recent than
+// the start txnid.  If txid1 is the bootstrap value, the iterator starts
+// from the oldest entry of the log.
 //
 func (r *CommitLog) NewIterator(txid1, txid2 common.Txnid) (CommitLogIterator, error) {
 
-	startKey := createLogKey(txid1)
-	endKey := ""    // get everything until the commit log is exhausted
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	start := txid1
+	if start == common.BOOTSTRAP_LAST_LOGGED_TXID {
+		var err error
+		if start, err = r.findOldest(); err != nil {
+			return nil, err
+		}
+	}
+
+	startKey := createLogKey(start)
+	endKey := "" // get everything until the commit log is exhausted
+	wraps := false
+	wrapKey := ""
 	if txid2 != 0 { // if txid2 is not the bootstrap value
-		endKey = createLogKey(txid2)
+		if uint64(txid2) >= uint64(start) {
+			endKey = createLogKey(txid2)
+		} else {
+			wraps = true
+			wrapKey = createLogKey(txid2)
+		}
+	} else if start != 0 {
+		wraps = true
+		wrapKey = createLogKey(start - 1)
 	}
 
 	iter, err := r.repo.NewIterator(startKey, endKey)
@@ -140,8 +301,13 @@ func (r *CommitLog) NewIterator(txid1, txid2 common.Txnid) (CommitLogIterator, e
 	}
 
 	result := &LogIterator{
-		iter: iter,
-		repo: r.repo}
+		iter:    iter,
+		repo:    r.repo,
+		log:     r,
+		start:   start,
+		wraps:   wraps,
+		wrapKey: wrapKey}
+	r.readers[result] = txid1
 
 	return result, nil
 }
@@ -149,27 +315,46 @@ func (r *CommitLog) NewIterator(txid1, txid2 common.Txnid) (CommitLogIterator, e
 // Get value from iterator
 func (i *LogIterator) Next() (txnid common.Txnid, op common.OpCode, key string, content []byte, err error) {
 
-	// TODO: Check if fdb and iterator is closed
-	key, content, err = i.iter.Next()
-	if err != nil {
-		return 0, common.OPCODE_INVALID, "", nil, err
-	}
-
-	// Since actual data is stored in the same repository, make sure
-	// we don't read them.
-	log.Printf("CommitLog.Next() : Iterator read key %s", key)
-	if !strings.HasPrefix(key, common.PREFIX_COMMIT_LOG_PATH) {
-		return 0, common.OPCODE_INVALID, "", nil, common.NewError(common.REPO_ERROR, "Iteration for commit log done")
-	}
-
-	entry, err := unmarshall(content)
-	if err != nil {
-		return 0, common.OPCODE_INVALID, "", nil, err
+	for {
+		// TODO: Check if fdb and iterator is closed
+		var entry *message.LogEntry
+		key, content, err = i.iter.Next()
+		if err == nil {
+			common.Debugf("CommitLog.Next() : Iterator read key %s", key)
+
+			// Since actual data is stored in the same repository, make
+			// sure we don't read them.  The keys are not in txnid order
+			// across the epoch wrap, so an entry older than the start
+			// txnid also ends the keys of the current epoch cycle.
+			if !strings.HasPrefix(key, common.PREFIX_COMMIT_LOG_PATH) {
+				err = fdb.RESULT_ITERATOR_FAIL
+			} else if entry, err = unmarshall(content); err == nil &&
+				common.CompareTxnid(common.Txnid(entry.GetTxnid()), i.start) == common.LESS_RECENT {
+				err = fdb.RESULT_ITERATOR_FAIL
+			}
+		}
+
+		// Continue from the first key after the epoch wrap.
+		if err == fdb.RESULT_ITERATOR_FAIL && i.wraps && !i.wrapped {
+			i.iter.Close()
+			if i.iter, err = i.repo.NewIterator(common.PREFIX_COMMIT_LOG_PATH, i.wrapKey); err != nil {
+				return 0, common.OPCODE_INVALID, "", nil, err
+			}
+			i.wrapped = true
+			continue
+		}
+
+		if err == fdb.RESULT_ITERATOR_FAIL {
+			return 0, common.OPCODE_INVALID, "", nil, common.NewError(common.REPO_ERROR, "Iteration for commit log done")
+		}
+		if err != nil {
+			return 0, common.OPCODE_INVALID, "", nil, err
+		}
+
+		return common.Txnid(entry.GetTxnid()),
+			common.GetOpCodeFromInt(entry.GetOpCode()),
+			entry.GetKey(), entry.GetContent(), nil
 	}
-
-	return common.Txnid(entry.GetTxnid()),
-		common.GetOpCodeFromInt(entry.GetOpCode()),
-		entry.GetKey(), entry.GetContent(), nil
 }
 
 // close iterator
@@ -177,15 +362,104 @@ func (i *LogIterator) Close() {
 
 	// TODO: Check if fdb iterator is closed
 	i.iter.Close()
+
+	i.log.mutex.Lock()
+	defer i.log.mutex.Unlock()
+	delete(i.log.readers, i)
 }
 
 ////////////////////////////////////////////////////////////////////////////
 // Private Function
 /////////////////////////////////////////////////////////////////////////////
 
+//
+// Return the oldest start txnid of the open iterators.  The caller must
+// hold the mutex.
+//
+func (r *CommitLog) oldestReader() (common.Txnid, bool) {
+
+	var oldest common.Txnid
+	found := false
+	for _, txid := range r.readers {
+		if !found || common.CompareTxnid(txid, oldest) == common.LESS_RECENT {
+			oldest = txid
+			found = true
+		}
+	}
+	return oldest, found
+}
+
+//
+// Return the oldest txnid of the log, or the bootstrap value if the log is
+// empty.  If the log wraps, the oldest entry is the first key that is at
+// least half of the epoch space after the first key (see CompareEpoch).
+// The caller must hold the mutex.
+//
+func (r *CommitLog) findOldest() (common.Txnid, error) {
+
+	first, found, err := r.firstAfter(common.BOOTSTRAP_LAST_LOGGED_TXID)
+	if err != nil || !found {
+		return common.BOOTSTRAP_LAST_LOGGED_TXID, err
+	}
+
+	epoch := uint32(first.GetEpoch())
+	if epoch > common.MAX_EPOCH-common.EPOCH_WRAP_WINDOW {
+		return first, nil
+	}
+
+	pivot := common.Txnid(uint64(epoch+common.EPOCH_WRAP_WINDOW) << 32)
+	oldest, found, err := r.firstAfter(pivot)
+	if err != nil || !found {
+		return first, err
+	}
+	return oldest, nil
+}
+
+//
+// Return the txnid of the first key of the log at or after the txnid.
+//
+func (r *CommitLog) firstAfter(txid common.Txnid) (common.Txnid, bool, error) {
+
+	iter, err := r.repo.NewIterator(createLogKey(txid), common.PREFIX_COMMIT_LOG_PATH+"\xff")
+	if err != nil {
+		return 0, false, err
+	}
+	defer iter.Close()
+
+	key, _, err := iter.Next()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	value, err := parseLogKey(key)
+	if err != nil {
+		return 0, false, err
+	}
+	return value, true, nil
+}
+
+//
+// The key is the txnid in fixed-width hexadecimal, so the keys are in
+// txnid order, except that the keys logged after the epoch wrap come
+// first.
+//
 func createLogKey(txid common.Txnid) string {
 
-	return fmt.Sprintf("%s%d", common.PREFIX_COMMIT_LOG_PATH, int64(txid))
+	return fmt.Sprintf("%s%016x", common.PREFIX_COMMIT_LOG_PATH, uint64(txid))
+}
+
+func parseLogKey(key string) (common.Txnid, error) {
+
+	suffix := strings.TrimPrefix(key, common.PREFIX_COMMIT_LOG_PATH)
+	if len(suffix) != 16 {
+		return 0, common.NewError(common.REPO_ERROR, fmt.Sprintf("Invalid log key %s", key))
+	}
+
+	value, err := strconv.ParseUint(suffix, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return common.Txnid(value), nil
 }
 
 func unmarshall(data []byte) (*message.LogEntry, error) {
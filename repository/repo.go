@@ -18,10 +18,17 @@ package repository
 import (
 	"github.com/couchbase/gometa/common"
 	fdb "github.com/couchbaselabs/goforestdb"
-	"log"
 	"sync"
+	"time"
 )
 
+/////////////////////////////////////////////////////////////////////////////
+// Metrics
+/////////////////////////////////////////////////////////////////////////////
+
+var commitLatency = common.Metrics.NewHistogram("gometa_repository_commit_latency_seconds",
+	"Time to commit the forestdb file of a repository.", common.LatencyBuckets)
+
 /////////////////////////////////////////////////////////////////////////////
 // Repository
 /////////////////////////////////////////////////////////////////////////////
@@ -34,8 +41,9 @@ type Repository struct {
 }
 
 type RepoIterator struct {
-	iter *fdb.Iterator
-	db *fdb.KVStore
+	iter     *fdb.Iterator
+	db       *fdb.KVStore
+	snapshot *fdb.KVStore // closed with the iterator (see NewSnapshotIterator)
 }
 
 type Snapshot struct {
@@ -88,7 +96,7 @@ func (r *Repository) Set(key string, content []byte) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	log.Printf("Repo.Set(): key %s, len(content) %d", key, len(content))
+	common.Log(common.LOG_DEBUG, "Repo.Set()", common.LogKey(key), common.NewLogField("len", len(content)))
 
 	//convert key to its collatejson encoded byte representation
 	k, err := CollateString(key)
@@ -102,9 +110,9 @@ func (r *Repository) Set(key string, content []byte) error {
 		return err
 	}
 
-	cerr := r.dbfile.Commit(fdb.COMMIT_NORMAL)
+	cerr := r.commit()
 	if info, err := r.db.Info(); err == nil {
-		log.Printf("Repo.Set(): forestdb seqnum after commit %v", info.LastSeqNum()) 
+		common.Debugf("Repo.Set(): forestdb seqnum after commit %v", info.LastSeqNum())
 	}
 	return cerr
 }
@@ -132,7 +140,7 @@ func (r *Repository) CreateSnapshot(txnid common.Txnid) error {
 
 	r.snapshots = append(r.snapshots, snapshot)
 	
-	log.Printf("Repo.CreateSnapshot(): txnid %v, forestdb seqnum %v", txnid, info.LastSeqNum()) 
+	common.Debugf("Repo.CreateSnapshot(): txnid %v, forestdb seqnum %v", txnid, info.LastSeqNum())
 	return nil
 }
 
@@ -190,7 +198,7 @@ func (r *Repository) SetNoCommit(key string, content []byte) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	log.Printf("Repo.SetNoCommit(): key %s, len(content) %d", key, len(content))
+	common.Log(common.LOG_DEBUG, "Repo.SetNoCommit()", common.LogKey(key), common.NewLogField("len", len(content)))
 
 	//convert key to its collatejson encoded byte representation
 	k, err := CollateString(key)
@@ -214,10 +222,17 @@ func (r *Repository) Get(key string) ([]byte, error) {
 	}
 
 	value, err := r.db.GetKV(k)
-	log.Printf("Repo.Get(): key %s, found=%v", key, err == nil)
+	common.Debugf("Repo.Get(): key %s, found=%v", key, err == nil)
 	return value, err
 }
 
+//
+// Tell if the error is returned by Get for a key that does not exist.
+//
+func IsKeyNotFound(err error) bool {
+	return err == fdb.RESULT_KEY_NOT_FOUND
+}
+
 //
 // Delete from repository
 //
@@ -237,9 +252,9 @@ func (r *Repository) Delete(key string) error {
 		return err
 	}
 
-	cerr := r.dbfile.Commit(fdb.COMMIT_NORMAL)
+	cerr := r.commit()
 	if info, err := r.db.Info(); err == nil {
-		log.Printf("Repo.Delete(): forestdb seqnum after commit %v", info.LastSeqNum()) 
+		common.Debugf("Repo.Delete(): forestdb seqnum after commit %v", info.LastSeqNum())
 	}
 	return cerr
 }
@@ -269,13 +284,24 @@ func (r *Repository) Commit() error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	cerr := r.dbfile.Commit(fdb.COMMIT_NORMAL)
+	cerr := r.commit()
 	if info, err := r.db.Info(); err == nil {
-		log.Printf("Repo.Set(): forestdb seqnum after commit %v", info.LastSeqNum()) 
+		common.Debugf("Repo.Set(): forestdb seqnum after commit %v", info.LastSeqNum())
 	}
 	return cerr
 }
 
+//
+// Commit the forestdb file.  The caller must hold the mutex.
+//
+func (r *Repository) commit() error {
+
+	start := time.Now()
+	defer commitLatency.With(common.MetricLabels{}).ObserveSince(start)
+
+	return r.dbfile.Commit(fdb.COMMIT_NORMAL)
+}
+
 //
 // Close repository.
 //
@@ -323,6 +349,46 @@ func (r *Repository) NewIterator(startKey, endKey string) (*RepoIterator, error)
 	return result, nil
 }
 
+//
+// Create a new iterator on a snapshot of the repository.  The iterator
+// does not see the changes made after it is created.  EndKey is inclusive.
+// If both keys are empty, the iterator returns every key.
+//
+func (r *Repository) NewSnapshotIterator(startKey, endKey string) (*RepoIterator, error) {
+
+	k1, err := CollateString(startKey)
+	if err != nil {
+		return nil, err
+	}
+
+	k2, err := CollateString(endKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	info, err := r.db.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := r.db.SnapshotOpen(info.LastSeqNum())
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := snapshot.IteratorInit(k1, k2, fdb.ITR_NO_DELETES)
+	if err != nil {
+		snapshot.Close()
+		return nil, err
+	}
+
+	common.Debugf("Repo.NewSnapshotIterator(): forestdb seqnum %v", info.LastSeqNum())
+	return &RepoIterator{iter: iter, db: snapshot, snapshot: snapshot}, nil
+}
+
 // Get value from iterator
 func (i *RepoIterator) Next() (key string, content []byte, err error) {
 
@@ -351,6 +417,18 @@ func (i *RepoIterator) Next() (key string, content []byte, err error) {
 	return key, body, nil
 }
 
+// Get value of a key from the store of the iterator.  For an iterator of
+// NewSnapshotIterator, the value is read from the same snapshot.
+func (i *RepoIterator) Get(key string) ([]byte, error) {
+
+	k, err := CollateString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.db.GetKV(k)
+}
+
 // close iterator
 func (i *RepoIterator) Close() {
 	// TODO: Check if fdb iterator is closed
@@ -358,6 +436,10 @@ func (i *RepoIterator) Close() {
 		i.iter.Close()
 		i.iter = nil
 	}
+	if i.snapshot != nil {
+		i.snapshot.Close()
+		i.snapshot = nil
+	}
 }
 
 // This only support ascii.
@@ -93,6 +93,22 @@ func (r *ServerConfig) SetLastCommittedTxid(lastCommittedTxid common.Txnid) erro
 	return nil
 }
 
+//
+// Return the txnid up to which the commit log is compacted, or 0 if
+// the commit log has every entry.
+//
+func (r *ServerConfig) GetLogCompactedTxid() common.Txnid {
+	value, err := r.GetInt(common.CONFIG_LOG_COMPACTED_TXID)
+	if err != nil {
+		return common.Txnid(0)
+	}
+	return common.Txnid(value)
+}
+
+func (r *ServerConfig) SetLogCompactedTxid(txid common.Txnid) error {
+	return r.LogInt(common.CONFIG_LOG_COMPACTED_TXID, uint64(txid))
+}
+
 //
 // Add Entry to server config
 //
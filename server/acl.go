@@ -0,0 +1,215 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/couchbase/gometa/common"
+	"strings"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// The credential of a client.
+//
+type Credential struct {
+	User     string
+	Password string
+}
+
+//
+// An access rule grants a permission on the keys with the given prefix.
+// An empty prefix matches every key.
+//
+type AccessRule struct {
+	Prefix     string
+	Permission string // read, write or admin
+}
+
+//
+// The record of a user.  The record is stored in the repository (as
+// the value of key ACL_USER_PATH + name), so it is replicated to all the
+// nodes like any other key.  The password is not stored, only its
+// salted hash.
+//
+type UserRecord struct {
+	Salt  string // hex
+	Hash  string // hex
+	Rules []AccessRule
+}
+
+type Permission int
+
+const (
+	NO_PERMISSION Permission = iota
+	READ_PERMISSION
+	WRITE_PERMISSION
+	ADMIN_PERMISSION
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create the record of a user with the given password and rules.  The
+// record is the value to set for key UserKey(name).
+//
+func NewUserRecord(password string, rules []AccessRule) ([]byte, error) {
+
+	for _, rule := range rules {
+		if _, err := parsePermission(rule.Permission); err != nil {
+			return nil, err
+		}
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	record := &UserRecord{Salt: hex.EncodeToString(salt),
+		Hash:  hex.EncodeToString(hashPassword(salt, password)),
+		Rules: rules}
+
+	return json.Marshal(record)
+}
+
+//
+// Return the key of the record of a user.
+//
+func UserKey(name string) string {
+	return common.ACL_USER_PATH + name
+}
+
+//
+// Return the permission required by the operation on the key.  The
+// user records can only be read or changed with admin permission.
+//
+func RequiredPermission(opCode common.OpCode, key string) Permission {
+
+	if strings.HasPrefix(key, common.ACL_USER_PATH) {
+		return ADMIN_PERMISSION
+	}
+
+	if opCode == common.OPCODE_GET {
+		return READ_PERMISSION
+	}
+	return WRITE_PERMISSION
+}
+
+//
+// Return the permission granted by the record on the key.  The rules
+// are cumulative: admin implies write, and write implies read.
+//
+func (r *UserRecord) GetPermission(key string) Permission {
+
+	granted := NO_PERMISSION
+	for _, rule := range r.Rules {
+		if strings.HasPrefix(key, rule.Prefix) {
+			if permission, err := parsePermission(rule.Permission); err == nil && permission > granted {
+				granted = permission
+			}
+		}
+	}
+	return granted
+}
+
+func (p Permission) String() string {
+	switch p {
+	case READ_PERMISSION:
+		return "read"
+	case WRITE_PERMISSION:
+		return "write"
+	case ADMIN_PERMISSION:
+		return "admin"
+	}
+	return "none"
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+func parsePermission(s string) (Permission, error) {
+
+	switch strings.ToLower(s) {
+	case "read":
+		return READ_PERMISSION, nil
+	case "write":
+		return WRITE_PERMISSION, nil
+	case "admin":
+		return ADMIN_PERMISSION, nil
+	}
+	return NO_PERMISSION, common.NewError(common.INVALID_REQUEST_ERROR, "Unknown permission '"+s+"'")
+}
+
+func parseUserRecord(content []byte) (*UserRecord, error) {
+
+	record := new(UserRecord)
+	if err := json.Unmarshal(content, record); err != nil {
+		return nil, common.WrapError(common.INVALID_REQUEST_ERROR, "Invalid user record", err)
+	}
+
+	if _, err := hex.DecodeString(record.Salt); err != nil {
+		return nil, common.WrapError(common.INVALID_REQUEST_ERROR, "Invalid salt in user record", err)
+	}
+	if _, err := hex.DecodeString(record.Hash); err != nil {
+		return nil, common.WrapError(common.INVALID_REQUEST_ERROR, "Invalid hash in user record", err)
+	}
+	for _, rule := range record.Rules {
+		if _, err := parsePermission(rule.Permission); err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+//
+// Iterated HMAC-SHA256 of the password, keyed by the salt.
+//
+func hashPassword(salt []byte, password string) []byte {
+
+	hash := []byte(password)
+	for i := 0; i < common.ACL_HASH_ITERATIONS; i++ {
+		h := hmac.New(sha256.New, salt)
+		h.Write(hash)
+		hash = h.Sum(nil)
+	}
+	return hash
+}
+
+func (r *UserRecord) checkPassword(password string) bool {
+
+	salt, _ := hex.DecodeString(r.Salt)
+	hash, _ := hex.DecodeString(r.Hash)
+	return hmac.Equal(hash, hashPassword(salt, password))
+}
+
+func (c *Credential) matches(user string, password string) bool {
+
+	return subtle.ConstantTimeCompare([]byte(c.User), []byte(user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(c.Password), []byte(password)) == 1
+}
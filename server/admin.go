@@ -0,0 +1,754 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	r "github.com/couchbase/gometa/repository"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// A request for the administration of a node.  If the node hosts multiple
+// consensus groups, the operations on the leader, the commit log and the
+// repository must name the group.
+//
+type AdminRequest struct {
+	Group    string
+	Members  []*Node // SetMembers : the new members of the ensemble
+	Target   string  // TransferLeadership : election address of the new leader
+	Txnid    uint64  // CompactLog : remove the log entries up to this txnid (0 for every entry logged by the members)
+	Path     string  // Snapshot : repository file to create in the data directory of the node
+	Backup   uint64  // Backup : id of the backup to continue (0 to start a new backup)
+	User     string  // credential of the administrator, if the ensemble has one
+	Password string
+}
+
+type MembersReply struct {
+	Members []*Node // this node first
+	Leader  string  // election address of the known leader
+}
+
+type AdminReply struct {
+	Txnid uint64 // CompactLog : the log is compacted up to this txnid.  Snapshot : last committed txnid of the copy.
+	Count int    // CompactLog : number of log entries removed
+}
+
+type BackupReply struct {
+	Entries []*Entry
+	Txnid   uint64 // last committed txnid of the backup
+	Backup  uint64 // id of the backup for the next page, or 0 if the backup is done
+}
+
+//
+// A backup in progress.  The pages of a backup are read from the same
+// snapshot of the repository.
+//
+type backupCursor struct {
+	iter     *r.RepoIterator
+	txnid    common.Txnid
+	lastUsed time.Time
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// RequestReceiver
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Return the members of the ensemble known by the node.
+//
+func (s *RequestReceiver) GetMembers(req *AdminRequest, reply **MembersReply) error {
+
+	if err := s.checkAdmin(req, "get the members"); err != nil {
+		return err
+	}
+
+	result := &MembersReply{Members: s.getEnv().GetMembers()}
+	if s.groups == nil || len(req.Group) != 0 {
+		server, err := s.getAdminServer(req.Group)
+		if err != nil {
+			return err
+		}
+		if state := server.getState(); state != nil {
+			result.Leader, _ = state.getLeader()
+		}
+	}
+
+	*reply = result
+	return nil
+}
+
+//
+// Replace the members of the ensemble known by the node, and restart the
+// node with the new members.  The members are kept in the repository, and
+// replace the peers of the config when the node starts.  Every member must
+// be given the same members (see the admin subcommands of the gometa command).
+//
+func (s *RequestReceiver) SetMembers(req *AdminRequest, reply **AdminReply) error {
+
+	if err := s.checkAdmin(req, "set the members"); err != nil {
+		return err
+	}
+
+	if s.groups != nil {
+		return common.NewError(common.INVALID_REQUEST_ERROR,
+			"Cannot change the members of a node hosting multiple consensus groups")
+	}
+
+	if err := s.server.setMembers(req.Members); err != nil {
+		return err
+	}
+
+	*reply = &AdminReply{}
+	return nil
+}
+
+//
+// Prefer the node as the leader in the next election, such that the leader
+// can transfer the leadership to the node (see TransferLeadership).
+//
+func (s *RequestReceiver) AcceptLeadership(req *AdminRequest, reply **AdminReply) error {
+
+	if err := s.checkAdmin(req, "transfer the leadership"); err != nil {
+		return err
+	}
+
+	server, err := s.getAdminServer(req.Group)
+	if err != nil {
+		return err
+	}
+	server.acceptLeadership()
+
+	*reply = &AdminReply{}
+	return nil
+}
+
+//
+// Step down once the target has caught up, such that the target is
+// elected as the leader.  The target must accept the leadership first.
+// Return NOT_LEADER_ERROR if the node is not the leader.
+//
+func (s *RequestReceiver) TransferLeadership(req *AdminRequest, reply **AdminReply) error {
+
+	if err := s.checkAdmin(req, "transfer the leadership"); err != nil {
+		return err
+	}
+
+	server, err := s.getAdminServer(req.Group)
+	if err != nil {
+		return err
+	}
+
+	if err := server.transferLeadership(req.Target); err != nil {
+		return err
+	}
+
+	*reply = &AdminReply{}
+	return nil
+}
+
+//
+// Remove the entries up to the given txnid from the commit log of the
+// leader.  The txnid cannot be more recent than the last committed txnid
+// of the leader, and is capped at the last txnid logged by every member.
+// If the txnid is 0, the log is compacted up to this cap.  A follower
+// refuses the request.  A peer that has not logged the txnid (e.g. a new
+// member) cannot synchronize with the leader anymore.
+//
+func (s *RequestReceiver) CompactLog(req *AdminRequest, reply **AdminReply) error {
+
+	if err := s.checkAdmin(req, "compact the commit log"); err != nil {
+		return err
+	}
+
+	server, err := s.getAdminServer(req.Group)
+	if err != nil {
+		return err
+	}
+
+	txnid, count, err := server.compactLog(common.Txnid(req.Txnid))
+	if err != nil {
+		return err
+	}
+
+	*reply = &AdminReply{Txnid: uint64(txnid), Count: count}
+	return nil
+}
+
+//
+// Copy the repository of the node to a new repository file on the node.
+// The copy can be used as the repository of a new member.
+//
+func (s *RequestReceiver) Snapshot(req *AdminRequest, reply **AdminReply) error {
+
+	if err := s.checkAdmin(req, "take a snapshot"); err != nil {
+		return err
+	}
+
+	server, err := s.getAdminServer(req.Group)
+	if err != nil {
+		return err
+	}
+
+	txnid, err := server.snapshot(req.Path)
+	if err != nil {
+		return err
+	}
+
+	*reply = &AdminReply{Txnid: uint64(txnid)}
+	return nil
+}
+
+//
+// Return a page of the keys (and their values) committed by the node, from
+// a snapshot of the repository.  The first request starts a new backup.
+// The reply has the id of the backup until the last page is returned:
+// request the next page with the id before BACKUP_TIMEOUT.
+//
+func (s *RequestReceiver) Backup(req *AdminRequest, reply **BackupReply) error {
+
+	if err := s.checkAdmin(req, "back up the repository"); err != nil {
+		return err
+	}
+
+	server, err := s.getAdminServer(req.Group)
+	if err != nil {
+		return err
+	}
+
+	result, err := server.backup(req.Backup)
+	if err != nil {
+		return err
+	}
+
+	*reply = result
+	return nil
+}
+
+//
+// Stop the node (e.g. the node is removed from the ensemble).  The node
+// stops after the reply is sent.
+//
+func (s *RequestReceiver) Shutdown(req *AdminRequest, reply **AdminReply) error {
+
+	if err := s.checkAdmin(req, "shut down the node"); err != nil {
+		return err
+	}
+
+	s.getEnv().GetLogger().Infof("RequestReceiver.Shutdown() : Stop the node as requested by the administrator")
+	if s.groups != nil {
+		go s.groups.Stop()
+	} else {
+		go s.server.Stop()
+	}
+
+	*reply = &AdminReply{}
+	return nil
+}
+
+func (s *RequestReceiver) checkAdmin(req *AdminRequest, action string) error {
+
+	if admin := s.getEnv().GetAdmin(); admin != nil && !admin.matches(req.User, req.Password) {
+		return common.NewError(common.AUTH_ERROR, "Only the administrator can "+action)
+	}
+	return nil
+}
+
+//
+// Return the server of the group.  The group must be given if the node
+// hosts multiple consensus groups.
+//
+func (s *RequestReceiver) getAdminServer(group string) (*Server, error) {
+
+	if s.groups == nil {
+		return s.server, nil
+	}
+
+	if len(group) == 0 {
+		return nil, common.NewError(common.INVALID_REQUEST_ERROR,
+			"The node hosts multiple consensus groups.  The group must be given.")
+	}
+
+	server := s.groups.GetGroupServer(group)
+	if server == nil {
+		return nil, common.NewError(common.INVALID_REQUEST_ERROR, "Unknown group "+group)
+	}
+	return server, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Server
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Keep the members in the repository and restart the server with them.
+//
+func (s *Server) setMembers(members []*Node) error {
+
+	env, err := s.env.newMembership(members)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+
+	err = s.withRepository(func() error {
+		return s.srvConfig.LogStr(common.CONFIG_MEMBERS, string(content))
+	})
+	if err != nil {
+		return err
+	}
+
+	s.env.setMembership(env)
+	s.mutex.Lock()
+	s.members = string(content)
+	s.mutex.Unlock()
+
+	s.env.GetLogger().Infof("Server.setMembers() : Members are changed to %s.  Restart the server.", string(content))
+	go s.restart()
+
+	return nil
+}
+
+//
+// Apply the members kept in the repository, if the administrator has
+// changed the members (see setMembers).  This must be called by
+// bootstrap(), after the repository is opened.
+//
+func (s *Server) loadMembers() error {
+
+	content, err := s.srvConfig.GetStr(common.CONFIG_MEMBERS)
+	if err != nil {
+		// The members are not changed.
+		return nil
+	}
+
+	s.mutex.Lock()
+	applied := s.members == content
+	s.mutex.Unlock()
+
+	if applied {
+		return nil
+	}
+
+	var members []*Node
+	if err := json.Unmarshal([]byte(content), &members); err != nil {
+		return common.WrapError(common.SERVER_CONFIG_ERROR, "Fail to read the members from the repository", err)
+	}
+
+	env, err := s.env.newMembership(members)
+	if err != nil {
+		return err
+	}
+	s.env.setMembership(env)
+
+	s.mutex.Lock()
+	s.members = content
+	s.mutex.Unlock()
+
+	s.env.GetLogger().Infof("Server.loadMembers() : Members from the repository %s", content)
+	return nil
+}
+
+//
+// Stop leading or following, and start over (e.g. the members have
+// changed).  Unlike Terminate(), the server keeps running.
+//
+func (s *Server) restart() {
+
+	state := s.getState()
+	if state == nil {
+		return
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.done {
+		return
+	}
+
+	if s.site != nil {
+		s.site.Close()
+		s.site = nil
+	}
+
+	select {
+	case s.skillch <- true: // kill leader/follower server
+	default:
+	}
+}
+
+//
+// Prefer this server as the leader until the transfer of the leadership
+// times out.  The server stays preferred while it is leading.
+//
+func (s *Server) acceptLeadership() {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.preferred = s.env.GetClock().Now().Add(common.LEADERSHIP_TRANSFER_TIMEOUT * time.Millisecond)
+	s.env.GetLogger().Infof("Server.acceptLeadership() : Accept the leadership until %v", s.preferred)
+}
+
+//
+// Tell if this server is preferred as the leader (see acceptLeadership).
+//
+func (s *Server) isPreferred() bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.preferred.IsZero() {
+		return false
+	}
+	return s.isLeading || s.env.GetClock().Now().Before(s.preferred)
+}
+
+//
+// Remember if this server is leading.  Once the server stops leading, it
+// is not preferred anymore.
+//
+func (s *Server) setLeading(leading bool) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.isLeading = leading
+	if !leading {
+		s.preferred = time.Time{}
+	}
+}
+
+func (s *Server) transferLeadership(target string) error {
+
+	state := s.getState()
+	if state == nil {
+		return common.NewError(common.NOT_LEADER_ERROR, "Server is not the leader.")
+	}
+
+	_, leader := state.getLeader()
+	if leader == nil {
+		return common.NewError(common.NOT_LEADER_ERROR, "Server is not the leader.")
+	}
+
+	addr, err := resolveAddr(common.ELECTION_TRANSPORT_TYPE, target)
+	if err != nil {
+		return common.WrapError(common.INVALID_REQUEST_ERROR, "Invalid target "+target, err)
+	}
+
+	fid := s.env.findMatchingPeerTCPAddr(addr.String())
+	if len(fid) == 0 {
+		return common.NewError(common.INVALID_REQUEST_ERROR, "Target "+target+" is not a member of the ensemble.")
+	}
+
+	s.env.GetLogger().Infof("Server.transferLeadership() : Transfer the leadership to %s", target)
+	return leader.TransferLeadership(fid)
+}
+
+//
+// Compact the commit log of the leader up to the txnid.  The log is not
+// compacted above the last txnid logged by any member, since a member
+// behind the compacted log cannot synchronize anymore.  If the txnid is 0,
+// compact the log up to that txnid.  Return the txnid the log is
+// compacted up to, and the number of entries removed.
+//
+func (s *Server) compactLog(txnid common.Txnid) (compacted common.Txnid, count int, err error) {
+
+	state := s.getState()
+	if state == nil {
+		return common.Txnid(0), 0, common.NewError(common.NOT_LEADER_ERROR, "Server is not the leader.")
+	}
+
+	_, leader := state.getLeader()
+	if leader == nil {
+		return common.Txnid(0), 0, common.NewError(common.NOT_LEADER_ERROR, "Server is not the leader.")
+	}
+
+	err = s.withRepository(func() error {
+
+		lastCommitted, err := s.srvConfig.GetLastCommittedTxnId()
+		if err != nil {
+			return err
+		}
+
+		if common.CompareTxnid(txnid, lastCommitted) == common.MORE_RECENT {
+			return common.NewError(common.INVALID_REQUEST_ERROR,
+				fmt.Sprintf("Txnid %d is not committed by the node (last committed txnid %d)", uint64(txnid), uint64(lastCommitted)))
+		}
+
+		bound := lastCommitted
+		for _, fid := range s.env.GetPeerTCPAddr() {
+			accepted, ok := leader.GetLastAccepted(fid)
+			if !ok {
+				s.env.GetLogger().Infof("Server.compactLog() : Member %s has not synchronized with the leader.  The log is not compacted.", fid)
+				accepted = common.Txnid(0)
+			}
+			if common.CompareTxnid(accepted, bound) == common.LESS_RECENT {
+				bound = accepted
+			}
+		}
+
+		if txnid == common.Txnid(0) || common.CompareTxnid(txnid, bound) == common.MORE_RECENT {
+			txnid = bound
+		}
+
+		compacted = s.srvConfig.GetLogCompactedTxid()
+		if common.CompareTxnid(txnid, compacted) != common.MORE_RECENT {
+			return nil
+		}
+
+		count, err = s.log.Compact(txnid, s.srvConfig)
+		if err != nil {
+			return err
+		}
+		compacted = txnid
+		return nil
+	})
+
+	return compacted, count, err
+}
+
+//
+// Copy the repository to a new repository file in the data directory of
+// the node.  The name of the file is relative to the data directory, and
+// cannot be outside of it.  Return the last committed txnid of the copy.
+// The election history of the node is not copied.
+//
+func (s *Server) snapshot(name string) (txnid common.Txnid, err error) {
+
+	path, err := s.getSnapshotPath(name)
+	if err != nil {
+		return common.Txnid(0), err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return common.Txnid(0), common.NewError(common.INVALID_REQUEST_ERROR, "File "+path+" already exists")
+	}
+
+	err = s.withRepository(func() error {
+
+		copy, err := r.OpenRepositoryWithName(path)
+		if err != nil {
+			return err
+		}
+		defer copy.Close()
+
+		txnid, err = s.readSnapshot(func(key string, content []byte) error {
+			if key == common.PREFIX_SERVER_CONFIG_PATH+common.CONFIG_ELECTION_HISTORY {
+				return nil
+			}
+			return copy.SetNoCommit(key, content)
+		})
+		if err != nil {
+			return err
+		}
+
+		return copy.Commit()
+	})
+
+	if err == nil {
+		s.env.GetLogger().Infof("Server.snapshot() : Copy the repository to %s at txnid %d", path, uint64(txnid))
+	}
+	return txnid, err
+}
+
+//
+// Return the path of the snapshot file in the data directory.
+//
+func (s *Server) getSnapshotPath(name string) (string, error) {
+
+	if len(name) == 0 {
+		return "", common.NewError(common.INVALID_REQUEST_ERROR, "Missing path of the snapshot")
+	}
+
+	path := filepath.Clean(name)
+	if filepath.IsAbs(path) || path == "." || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", common.NewError(common.INVALID_REQUEST_ERROR,
+			"The snapshot "+name+" must be a file name relative to the data directory of the node")
+	}
+
+	return filepath.Join(s.env.GetDataDir(), path), nil
+}
+
+//
+// Return the next page of the backup, or start a new backup if the id is
+// 0.  The backups that are not continued in time are cancelled.
+//
+func (s *Server) backup(id uint64) (*BackupReply, error) {
+
+	result := &BackupReply{}
+
+	err := s.withRepository(func() error {
+
+		state := s.state
+		now := s.env.GetClock().Now()
+		for backupId, cursor := range state.backups {
+			if now.Sub(cursor.lastUsed) > common.BACKUP_TIMEOUT*time.Millisecond {
+				cursor.iter.Close()
+				delete(state.backups, backupId)
+			}
+		}
+
+		if id == 0 {
+			if len(state.backups) >= common.MAX_BACKUPS {
+				return common.NewError(common.SERVER_ERROR,
+					fmt.Sprintf("There are already %d backups in progress", len(state.backups)))
+			}
+
+			cursor, err := s.newBackupCursor()
+			if err != nil {
+				return err
+			}
+			id = atomic.AddUint64(&s.backupId, 1)
+			state.backups[id] = cursor
+		}
+
+		cursor, ok := state.backups[id]
+		if !ok {
+			return common.NewError(common.INVALID_REQUEST_ERROR,
+				fmt.Sprintf("Backup %d does not exist (e.g. it is cancelled, or the node restarts)", id))
+		}
+		cursor.lastUsed = now
+		result.Txnid = uint64(cursor.txnid)
+
+		for len(result.Entries) < common.BACKUP_PAGE_SIZE {
+			key, content, err := cursor.iter.Next()
+			if err != nil {
+				cursor.iter.Close()
+				delete(state.backups, id)
+				return nil
+			}
+			result.Entries = append(result.Entries,
+				&Entry{Key: strings.TrimPrefix(key, common.PREFIX_DATA_PATH), Value: content})
+		}
+
+		result.Backup = id
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//
+// Open a snapshot of the keys of the repository, with its last committed
+// txnid.  This must be called by withRepository().
+//
+func (s *Server) newBackupCursor() (*backupCursor, error) {
+
+	iter, err := s.repo.NewSnapshotIterator(common.PREFIX_DATA_PATH, common.PREFIX_DATA_PATH+"\xff")
+	if err != nil {
+		return nil, err
+	}
+
+	txnid := common.Txnid(0)
+	content, err := iter.Get(common.PREFIX_SERVER_CONFIG_PATH + common.CONFIG_LAST_COMMITTED_TXID)
+	if err == nil {
+		var value uint64
+		if _, err := fmt.Sscanf(string(content), "%d", &value); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		txnid = common.Txnid(value)
+	} else if !r.IsKeyNotFound(err) {
+		iter.Close()
+		return nil, err
+	}
+
+	return &backupCursor{iter: iter, txnid: txnid}, nil
+}
+
+//
+// Read every key from a snapshot of the repository.  Return the last
+// committed txnid of the snapshot.  This must be called by withRepository().
+//
+func (s *Server) readSnapshot(f func(key string, content []byte) error) (common.Txnid, error) {
+
+	iter, err := s.repo.NewSnapshotIterator("", "")
+	if err != nil {
+		return common.Txnid(0), err
+	}
+	defer iter.Close()
+
+	txnid := common.Txnid(0)
+	lastCommittedKey := common.PREFIX_SERVER_CONFIG_PATH + common.CONFIG_LAST_COMMITTED_TXID
+
+	for {
+		key, content, err := iter.Next()
+		if err != nil {
+			break
+		}
+
+		if key == lastCommittedKey {
+			var value uint64
+			if _, err := fmt.Sscanf(string(content), "%d", &value); err != nil {
+				return common.Txnid(0), err
+			}
+			txnid = common.Txnid(value)
+		}
+
+		if err := f(key, content); err != nil {
+			return common.Txnid(0), err
+		}
+	}
+
+	return txnid, nil
+}
+
+//
+// Run the function while the repository is open.  The server does not
+// close the repository (e.g. restart) until the function returns.
+//
+func (s *Server) withRepository(f func() error) error {
+
+	state := s.getState()
+	if state == nil || !s.isReady() {
+		return common.NewError(common.NO_QUORUM_ERROR, "Server is not ready. Cannot process new request.")
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.isClosed {
+		return common.NewError(common.SERVER_ERROR, "Server is terminated. Cannot process new request.")
+	}
+	return f()
+}
+
+func (s *Server) getState() *ServerState {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state
+}
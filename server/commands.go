@@ -0,0 +1,409 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/protocol"
+	"io"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////
+
+//
+// CommandListener serves the four-letter commands (e.g. "echo stat | nc
+// host port").  Each connection runs one command.  The reply is a line per
+// value, with the key and the value separated by a tab.
+//
+type CommandListener struct {
+	naddr    string
+	listener net.Listener
+	receiver *RequestReceiver
+
+	mutex    sync.Mutex
+	isClosed bool
+}
+
+//
+// The latency of the client requests of a server.
+//
+type requestStats struct {
+	mutex sync.Mutex
+	count uint64
+	total time.Duration
+	min   time.Duration
+	max   time.Duration
+	clock common.Clock // clock of the server
+}
+
+type commandOutput struct {
+	w      io.Writer
+	prefix string
+}
+
+type command func(r *RequestReceiver, w io.Writer)
+
+//
+// ruok : reply imok if the node is running
+// srvr : status of the node (or of each consensus group), with the latency of the client requests
+//        and the followers and watchers of the leader
+// cons : clients connected to the request port
+// stat : srvr and cons
+// mntr : srvr and the metrics of the process, for monitoring
+//
+var commands = map[string]command{
+	"ruok": runRuok,
+	"srvr": runSrvr,
+	"cons": runCons,
+	"stat": runStat,
+	"mntr": runMntr,
+}
+
+/////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////
+
+//
+// Close the listener.  The commands in progress run to completion.
+//
+func (li *CommandListener) Close() {
+	li.mutex.Lock()
+	defer li.mutex.Unlock()
+
+	if !li.isClosed {
+		li.isClosed = true
+		li.listener.Close()
+	}
+}
+
+/////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////
+
+//
+// Start a new CommandListener.  The commands are served from the given
+// receiver (a server, or the consensus groups of a GroupServer).  If the
+// TLS config is not nil, the listener requires TLS like the request
+// listener, since the commands carry the credential of the administrator.
+//
+func startCommandListener(laddr string, receiver *RequestReceiver, config *tls.Config) (*CommandListener, error) {
+
+	li, err := net.Listen(common.MESSAGE_TRANSPORT_TYPE, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config != nil {
+		config = config.Clone()
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		li = tls.NewListener(li, config)
+	}
+
+	listener := &CommandListener{naddr: laddr,
+		listener: li,
+		receiver: receiver}
+	go listener.listen()
+
+	return listener, nil
+}
+
+//
+// Goroutine.  Accept the connections until the listener is closed.
+//
+func (li *CommandListener) listen() {
+
+	defer func() {
+		if r := recover(); r != nil {
+			li.receiver.getEnv().GetLogger().Errorf("panic in CommandListener.listen() : %s", r)
+			li.receiver.getEnv().GetLogger().Errorf("%s", debug.Stack())
+		}
+	}()
+
+	for {
+		conn, err := li.listener.Accept()
+		if err != nil {
+			li.receiver.getEnv().GetLogger().Infof("CommandListener.listen() : Listener %s terminates : %s", li.naddr, err.Error())
+			return
+		}
+		go li.serve(conn)
+	}
+}
+
+//
+// Run the command sent on the connection.  If the ensemble has an
+// administrator, the commands other than ruok must be followed by the
+// user and the password of the administrator (e.g. "stat admin secret").
+//
+func (li *CommandListener) serve(conn net.Conn) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			li.receiver.getEnv().GetLogger().Errorf("panic in CommandListener.serve() : %s", r)
+			li.receiver.getEnv().GetLogger().Errorf("%s", debug.Stack())
+		}
+		conn.Close()
+	}()
+
+	conn.SetDeadline(time.Now().Add(common.COMMAND_TIMEOUT * time.Millisecond))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		li.receiver.getEnv().GetLogger().Debugf("CommandListener.serve() : Fail to read command from %s : %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+
+	run, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(conn, "error\tUnknown command %s\n", args[0])
+		return
+	}
+
+	if admin := li.receiver.getEnv().GetAdmin(); admin != nil && args[0] != "ruok" {
+		if len(args) != 3 || !admin.matches(args[1], args[2]) {
+			fmt.Fprintf(conn, "error\tOnly the administrator can run the command\n")
+			return
+		}
+	}
+
+	buf := bufio.NewWriter(conn)
+	run(li.receiver, buf)
+	buf.Flush()
+}
+
+/////////////////////////////////////////////////
+// Commands
+/////////////////////////////////////////////////
+
+func runRuok(r *RequestReceiver, w io.Writer) {
+	fmt.Fprintln(w, "imok")
+}
+
+func runSrvr(r *RequestReceiver, w io.Writer) {
+	names, servers := r.getServers()
+	for i, s := range servers {
+		writeServer(&commandOutput{w: w, prefix: names[i]}, s)
+	}
+}
+
+func runCons(r *RequestReceiver, w io.Writer) {
+	writeClients(&commandOutput{w: w}, r.getRequestListener())
+}
+
+func runStat(r *RequestReceiver, w io.Writer) {
+	runSrvr(r, w)
+	runCons(r, w)
+}
+
+//
+// The keys are prefixed with gometa (and the name of the consensus group),
+// followed by the metrics of the node.
+//
+func runMntr(r *RequestReceiver, w io.Writer) {
+
+	names, servers := r.getServers()
+	for i, s := range servers {
+		prefix := "gometa"
+		if len(names[i]) != 0 {
+			prefix += "_" + names[i]
+		}
+		writeServer(&commandOutput{w: w, prefix: prefix}, s)
+	}
+
+	var clients []*ClientInfo
+	if li := r.getRequestListener(); li != nil {
+		clients = li.GetClients()
+	}
+	(&commandOutput{w: w, prefix: "gometa"}).put("clients", len(clients))
+
+	var metrics bytes.Buffer
+	if err := common.Metrics.WriteNode(&metrics, r.getEnv().GetHostTCPAddr()); err != nil {
+		r.getEnv().GetLogger().Warnf("CommandListener.runMntr() : error in writing metrics %s", err.Error())
+		return
+	}
+	for _, line := range strings.Split(metrics.String(), "\n") {
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.LastIndex(line, " "); i > 0 {
+			fmt.Fprintf(w, "%s\t%s\n", line[:i], line[i+1:])
+		}
+	}
+}
+
+//
+// Write the status of the server.
+//
+func writeServer(o *commandOutput, s *Server) {
+
+	status := s.GetNodeStatus()
+	count, min, avg, max := s.stats.get()
+
+	o.put("version", common.PROTOCOL_VERSION)
+	o.put("node", status.Node)
+	o.put("status", status.Status)
+	o.put("ready", s.checkReady() == nil)
+	o.put("leader", status.Leader)
+	o.put("current_epoch", status.CurrentEpoch)
+	o.put("accepted_epoch", status.AcceptedEpoch)
+	o.put("last_logged_txnid", uint64(status.LastLoggedTxnid))
+	o.put("last_committed_txnid", uint64(status.LastCommittedTxnid))
+	o.put("log_compacted_txnid", uint64(status.LogCompactedTxnid))
+	o.put("outstanding_requests", s.getOutstandingRequests())
+	o.put("proposals", status.Proposals)
+	o.put("requests", count)
+	o.put("latency_min_ms", formatMillisecond(min))
+	o.put("latency_avg_ms", formatMillisecond(avg))
+	o.put("latency_max_ms", formatMillisecond(max))
+	o.put("followers", len(status.Followers))
+	for _, peer := range status.Followers {
+		o.put("follower", formatPeer(peer))
+	}
+	o.put("watchers", len(status.Watchers))
+	for _, peer := range status.Watchers {
+		o.put("watcher", formatPeer(peer))
+	}
+}
+
+//
+// Write the clients connected to the request port, oldest first.
+//
+func writeClients(o *commandOutput, li *RequestListener) {
+
+	var clients []*ClientInfo
+	if li != nil {
+		clients = li.GetClients()
+	}
+
+	o.put("clients", len(clients))
+	for _, client := range clients {
+		o.put("client", fmt.Sprintf("%s since=%s received=%d sent=%d",
+			client.Addr, client.Since.Format(time.RFC3339), client.Received, client.Sent))
+	}
+}
+
+func (o *commandOutput) put(key string, value interface{}) {
+	if len(o.prefix) != 0 {
+		key = o.prefix + "_" + key
+	}
+	fmt.Fprintf(o.w, "%s\t%v\n", key, value)
+}
+
+func formatPeer(peer *protocol.PeerProgress) string {
+	return fmt.Sprintf("%s version=%d last_accepted=%d lag=%d latency_ms=%s slow=%v",
+		peer.Fid, peer.Version, uint64(peer.LastAccepted), peer.Lag, formatMillisecond(peer.AcceptLatency), peer.Slow)
+}
+
+func formatMillisecond(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+//
+// Return the servers of the receiver, with the name of their consensus
+// group (sorted by name).  The name is empty if the receiver has a single
+// server.
+//
+func (s *RequestReceiver) getServers() ([]string, []*Server) {
+
+	if s.groups == nil {
+		return []string{""}, []*Server{s.server}
+	}
+
+	s.groups.mutex.Lock()
+	names := make([]string, 0, len(s.groups.servers))
+	for name := range s.groups.servers {
+		names = append(names, name)
+	}
+	s.groups.mutex.Unlock()
+
+	sort.Strings(names)
+
+	var running []string
+	var servers []*Server
+	for _, name := range names {
+		if server := s.groups.GetGroupServer(name); server != nil {
+			running = append(running, name)
+			servers = append(servers, server)
+		}
+	}
+	return running, servers
+}
+
+func (s *RequestReceiver) getRequestListener() *RequestListener {
+
+	if s.groups != nil {
+		return s.groups.reqListener
+	}
+	return s.server.reqListener
+}
+
+/////////////////////////////////////////////////
+// Request Statistics
+/////////////////////////////////////////////////
+
+func newRequestStats(clock common.Clock) *requestStats {
+	return &requestStats{clock: clock}
+}
+
+//
+// Record a client request, from the start time to now.
+//
+func (r *requestStats) observe(start time.Time) {
+
+	latency := r.clock.Now().Sub(start)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.count == 0 || latency < r.min {
+		r.min = latency
+	}
+	if latency > r.max {
+		r.max = latency
+	}
+	r.count++
+	r.total += latency
+}
+
+//
+// Return the number of requests, and their min, average and max latency.
+//
+func (r *requestStats) get() (count uint64, min time.Duration, avg time.Duration, max time.Duration) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.count != 0 {
+		avg = r.total / time.Duration(r.count)
+	}
+	return r.count, r.min, avg, r.max
+}
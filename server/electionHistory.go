@@ -0,0 +1,240 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/protocol"
+	r "github.com/couchbase/gometa/repository"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// An election of the node, and what happens to the node until the next
+// election.
+//
+type ElectionRecord struct {
+	protocol.ElectionResult
+	Status string              // leading or following after the election (empty if the election fails)
+	Epoch  uint32              // current epoch agreed with the leader or the followers (0 until it is agreed)
+	End    time.Time           // when the node stops leading or following (zero if it still is)
+	Reason protocol.ExitReason // why the election fails, or why the node stops leading or following
+	Error  string              // error of the leader or follower server, if any
+}
+
+//
+// The recent elections of a node (at most ELECTION_HISTORY_SIZE), oldest
+// first.  The history is kept in the server config of the repository, so
+// it survives a restart of the node.
+//
+type electionHistory struct {
+	logger  *common.NodeLogger
+	mutex   sync.Mutex
+	records []*ElectionRecord
+	loaded  bool
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Server
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Remember the election that has just ended.
+//
+func (s *Server) recordElection(leader string, ok bool) {
+
+	result := s.election.GetLastElection()
+	if result == nil {
+		return
+	}
+
+	record := &ElectionRecord{ElectionResult: *result}
+	if ok {
+		if leader == s.env.GetHostUDPAddr() {
+			record.Status = protocol.LEADING.String()
+		} else {
+			record.Status = protocol.FOLLOWING.String()
+		}
+	} else if s.IsDone() {
+		record.Reason = protocol.EXIT_KILLED
+	} else {
+		record.Reason = protocol.EXIT_NO_WINNER
+	}
+
+	s.history.add(s.srvConfig, record)
+}
+
+//
+// Remember why the node stops leading or following.
+//
+func (s *Server) recordExit(err error) {
+
+	reason := s.state.getExitReason()
+	if s.IsDone() {
+		reason = protocol.EXIT_KILLED
+	} else if len(reason) == 0 {
+		reason = protocol.EXIT_ERROR
+	}
+
+	s.history.end(s.srvConfig, s.env.GetClock().Now(), reason, err)
+}
+
+//
+// Callback when the current epoch is agreed (see action.EpochTracker)
+//
+func (s *Server) OnNewCurrentEpoch(epoch uint32) {
+	s.history.setEpoch(s.srvConfig, epoch)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// electionHistory
+/////////////////////////////////////////////////////////////////////////////
+
+func newElectionHistory(logger *common.NodeLogger) *electionHistory {
+	return &electionHistory{logger: logger}
+}
+
+//
+// Load the history from the server config, unless it is already loaded.
+//
+func (h *electionHistory) load(config *r.ServerConfig) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.loaded {
+		return
+	}
+	h.loaded = true
+
+	data, err := config.GetStr(common.CONFIG_ELECTION_HISTORY)
+	if err != nil {
+		// The node has not run any election yet.
+		return
+	}
+
+	if err := json.Unmarshal([]byte(data), &h.records); err != nil {
+		h.logger.Warnf("electionHistory.load() : Fail to read the election history : %s", err.Error())
+		h.records = nil
+	}
+}
+
+//
+// Add an election.  If the node has not recorded why it stops leading or
+// following after the last election (e.g. the node crashes), the reason
+// is unknown.
+//
+func (h *electionHistory) add(config *r.ServerConfig, record *ElectionRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if last := h.getActive(); last != nil {
+		last.End = record.Start
+		last.Reason = protocol.EXIT_UNKNOWN
+	}
+
+	h.records = append(h.records, record)
+	if len(h.records) > common.ELECTION_HISTORY_SIZE {
+		h.records = h.records[len(h.records)-common.ELECTION_HISTORY_SIZE:]
+	}
+
+	h.save(config)
+}
+
+//
+// Set the current epoch of the last election.
+//
+func (h *electionHistory) setEpoch(config *r.ServerConfig, epoch uint32) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if last := h.getActive(); last != nil && last.Epoch != epoch {
+		last.Epoch = epoch
+		h.save(config)
+	}
+}
+
+//
+// Set the reason for the node to stop leading or following after the
+// last election, and the time when it stops.
+//
+func (h *electionHistory) end(config *r.ServerConfig, now time.Time, reason protocol.ExitReason, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	last := h.getActive()
+	if last == nil {
+		return
+	}
+
+	last.End = now
+	last.Reason = reason
+	if err != nil {
+		last.Error = err.Error()
+	}
+
+	h.save(config)
+}
+
+//
+// Return a copy of the records, oldest first.
+//
+func (h *electionHistory) getRecords() []*ElectionRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	result := make([]*ElectionRecord, 0, len(h.records))
+	for _, record := range h.records {
+		copy := *record
+		result = append(result, &copy)
+	}
+	return result
+}
+
+//
+// Return the last election if the node is still leading or following
+// after it.
+//
+func (h *electionHistory) getActive() *ElectionRecord {
+
+	if len(h.records) == 0 {
+		return nil
+	}
+
+	last := h.records[len(h.records)-1]
+	if len(last.Status) == 0 || !last.End.IsZero() {
+		return nil
+	}
+	return last
+}
+
+func (h *electionHistory) save(config *r.ServerConfig) {
+
+	data, err := json.Marshal(h.records)
+	if err != nil {
+		h.logger.Warnf("electionHistory.save() : Fail to encode the election history : %s", err.Error())
+		return
+	}
+
+	if err := config.LogStr(common.CONFIG_ELECTION_HISTORY, string(data)); err != nil {
+		h.logger.Warnf("electionHistory.save() : Fail to save the election history : %s", err.Error())
+	}
+}
@@ -16,13 +16,11 @@
 package server
 
 import (
-	"errors"
 	"github.com/couchbase/gometa/action"
 	"github.com/couchbase/gometa/common"
 	"github.com/couchbase/gometa/message"
 	"github.com/couchbase/gometa/protocol"
 	r "github.com/couchbase/gometa/repository"
-	"log"
 	"runtime/debug"
 	"time"
 )
@@ -43,6 +41,7 @@ type EmbeddedServer struct {
 	notifier   action.EventNotifier
 	reqHandler protocol.CustomRequestHandler
 	listener   *common.PeerListener
+	logger     *common.NodeLogger // nil if the server logs to the logger of the process
 	skillch    chan bool
 }
 
@@ -60,15 +59,37 @@ func RunEmbeddedServerWithNotifier(msgAddr string, notifier action.EventNotifier
 	return RunEmbeddedServerWithCustomHandler(msgAddr, notifier, nil)
 }
 
+//
+// Run the embedded server with the logger of the embedder.  Only the events
+// at the given level or below reach the logger.  The logger and the level
+// only apply to this server.  The other servers in the process, and the
+// events that do not belong to a server, keep the logger of the process.
+//
+func RunEmbeddedServerWithLogger(msgAddr string, notifier action.EventNotifier, reqHandler protocol.CustomRequestHandler,
+	logger common.Logger, level common.LogLevel) (*EmbeddedServer, error) {
+
+	nodeLogger := common.NewNodeLogger(logger)
+	nodeLogger.SetLogLevel(level)
+
+	return runEmbeddedServer(msgAddr, notifier, reqHandler, nodeLogger)
+}
+
 func RunEmbeddedServerWithCustomHandler(msgAddr string, notifier action.EventNotifier, reqHandler protocol.CustomRequestHandler) (*EmbeddedServer, error) {
 
+	return runEmbeddedServer(msgAddr, notifier, reqHandler, nil)
+}
+
+func runEmbeddedServer(msgAddr string, notifier action.EventNotifier, reqHandler protocol.CustomRequestHandler,
+	logger *common.NodeLogger) (*EmbeddedServer, error) {
+
 	server := new(EmbeddedServer)
 	server.msgAddr = msgAddr
 	server.notifier = notifier
 	server.reqHandler = reqHandler
+	server.logger = logger
 
 	if err := server.bootstrap(); err != nil {
-		log.Printf("EmbeddedServer.boostrap: error : %v\n", err)
+		logger.Warnf("EmbeddedServer.boostrap: error : %v", err)
 		return nil, err
 	}
 
@@ -137,20 +158,22 @@ func (s *EmbeddedServer) Set(key string, value []byte) error {
 	request := s.factory.CreateRequest(id,
 		uint32(common.OPCODE_SET),
 		key,
-		value)
+		value,
+		s.GetTracer().NewTraceId())
 
-	handle := newRequestHandle(request)
+	handle := newRequestHandle(request, s.GetClock())
 
 	handle.CondVar.L.Lock()
 	defer handle.CondVar.L.Unlock()
 
 	// push the request to a channel
-	log.Printf("Handing new request to server. Key %s", key)
+	s.logger.Debugf("Handing new request to server. Key %s", key)
 	s.state.incomings <- handle
 
 	// This goroutine will wait until the request has been processed.
 	handle.CondVar.Wait()
-	log.Printf("Receive Response for request. Key %s", key)
+	s.logger.Debugf("Receive Response for request. Key %s", key)
+	s.GetTracer().RecordSpan(request.GetTraceId(), common.SPAN_REQUEST, s.GetFollowerId(), common.Txnid(0), key, handle.Queued)
 
 	return handle.Err
 }
@@ -165,20 +188,22 @@ func (s *EmbeddedServer) CustomSet(key string, value []byte) error {
 	request := s.factory.CreateRequest(id,
 		uint32(common.OPCODE_CUSTOM_SET),
 		key,
-		value)
+		value,
+		s.GetTracer().NewTraceId())
 
-	handle := newRequestHandle(request)
+	handle := newRequestHandle(request, s.GetClock())
 
 	handle.CondVar.L.Lock()
 	defer handle.CondVar.L.Unlock()
 
 	// push the request to a channel
-	log.Printf("Handing new request to server. Key %s", key)
+	s.logger.Debugf("Handing new request to server. Key %s", key)
 	s.state.incomings <- handle
 
 	// This goroutine will wait until the request has been processed.
 	handle.CondVar.Wait()
-	log.Printf("Receive Response for request. Key %s", key)
+	s.logger.Debugf("Receive Response for request. Key %s", key)
+	s.GetTracer().RecordSpan(request.GetTraceId(), common.SPAN_REQUEST, s.GetFollowerId(), common.Txnid(0), key, handle.Queued)
 
 	return handle.Err
 }
@@ -193,20 +218,22 @@ func (s *EmbeddedServer) Delete(key string) error {
 	request := s.factory.CreateRequest(id,
 		uint32(common.OPCODE_DELETE),
 		key,
-		[]byte(""))
+		[]byte(""),
+		s.GetTracer().NewTraceId())
 
-	handle := newRequestHandle(request)
+	handle := newRequestHandle(request, s.GetClock())
 
 	handle.CondVar.L.Lock()
 	defer handle.CondVar.L.Unlock()
 
 	// push the request to a channel
-	log.Printf("Handing new request to server. Key %s", key)
+	s.logger.Debugf("Handing new request to server. Key %s", key)
 	s.state.incomings <- handle
 
 	// This goroutine will wait until the request has been processed.
 	handle.CondVar.Wait()
-	log.Printf("Receive Response for request. Key %s", key)
+	s.logger.Debugf("Receive Response for request. Key %s", key)
+	s.GetTracer().RecordSpan(request.GetTraceId(), common.SPAN_REQUEST, s.GetFollowerId(), common.Txnid(0), key, handle.Queued)
 
 	return handle.Err
 }
@@ -243,8 +270,8 @@ func (s *EmbeddedServer) bootstrap() (err error) {
 	defer func() {
 		r := recover()
 		if r != nil {
-			log.Printf("panic in EmbeddedServer.bootstrap() : %s\n", r)
-			log.Printf("%s", debug.Stack())
+			s.logger.Errorf("panic in EmbeddedServer.bootstrap() : %s", r)
+			s.logger.Errorf("%s", debug.Stack())
 		}
 
 		if err != nil || r != nil {
@@ -256,7 +283,7 @@ func (s *EmbeddedServer) bootstrap() (err error) {
 	}()
 
 	// Initialize server state
-	s.state = newServerState()
+	s.state = newServerState(s.GetMetricLabels())
 
 	// Initialize repository service
 	s.repo, err = r.OpenRepository()
@@ -309,7 +336,7 @@ func (s *EmbeddedServer) run() {
 
 			if !s.IsDone() {
 				if err := s.bootstrap(); err != nil {
-					log.Printf("EmbeddedServer.boostrap: error : %v\n", err)
+					s.logger.Warnf("EmbeddedServer.boostrap: error : %v", err)
 				}
 			}
 		} else {
@@ -326,6 +353,9 @@ func (s *EmbeddedServer) cleanupState() {
 	s.state.mutex.Lock()
 	defer s.state.mutex.Unlock()
 
+	s.state.isClosed = true
+	s.state.untrackMetrics()
+
 	common.SafeRun("EmbeddedServer.cleanupState()",
 		func() {
 			if s.listener != nil {
@@ -380,13 +410,13 @@ func (s *EmbeddedServer) cleanupState() {
 //
 func (s *EmbeddedServer) runOnce() {
 
-	log.Printf("EmbeddedServer.runOnce() : Start Running Server")
+	s.logger.Infof("EmbeddedServer.runOnce() : Start Running Server")
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in EmbeddedServer.runOnce() : %v\n", r)
-			log.Printf("Diagnostic Stack ...")
-			log.Printf("%s", debug.Stack())
+			s.logger.Errorf("panic in EmbeddedServer.runOnce() : %v", r)
+			s.logger.Errorf("Diagnostic Stack ...")
+			s.logger.Errorf("%s", debug.Stack())
 		}
 
 		common.SafeRun("EmbeddedServer.cleanupState()",
@@ -402,10 +432,10 @@ func (s *EmbeddedServer) runOnce() {
 		s.state.setStatus(protocol.LEADING)
 		if err := protocol.RunLeaderServerWithCustomHandler(
 			s.msgAddr, s.listener, s.state, s.handler, s.factory, s.reqHandler, s.skillch); err != nil {
-			log.Printf("EmbeddedServer.RunOnce() : Error Encountered From Server : %s", err.Error())
+			s.logger.Warnf("EmbeddedServer.RunOnce() : Error Encountered From Server : %s", err.Error())
 		}
 	} else {
-		log.Printf("EmbeddedServer.RunOnce(): Server has been terminated explicitly. Terminate.")
+		s.logger.Infof("EmbeddedServer.RunOnce(): Server has been terminated explicitly. Terminate.")
 	}
 }
 
@@ -413,8 +443,8 @@ func (s *EmbeddedServer) runOnce() {
 // QuorumVerifier
 /////////////////////////////////////////////////////////////////////////////
 
-func (s *EmbeddedServer) HasQuorum(count int) bool {
-	return count == 1
+func (s *EmbeddedServer) HasQuorum(voters []string) bool {
+	return len(voters) == 1
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -445,11 +475,9 @@ func (s *EmbeddedServer) UpdateStateOnNewProposal(proposal protocol.ProposalMsg)
 			if opCode == common.OPCODE_ABORT || opCode == common.OPCODE_RESPONSE {
 				handle.CondVar.L.Lock()
 				defer handle.CondVar.L.Unlock()
-				
-				if len(proposal.GetKey()) != 0 {
-					handle.Err = errors.New(proposal.GetKey())
-				}
-				
+
+				handle.Err = protocol.GetProposalError(proposal)
+
 				handle.CondVar.Signal()
 			} else {
 				s.state.proposals[common.Txnid(txnid)] = handle
@@ -463,7 +491,7 @@ func (s *EmbeddedServer) UpdateStateOnNewProposal(proposal protocol.ProposalMsg)
 //
 func (s *EmbeddedServer) UpdateStateOnCommit(txnid common.Txnid, key string) {
 
-	log.Printf("EmbeddedServer.UpdateStateOnCommit(): Committing proposal %d key %s.", txnid, key)
+	s.logger.Log(common.LOG_DEBUG, "EmbeddedServer.UpdateStateOnCommit(): Committing proposal", common.LogTxnid(txnid), common.LogKey(key))
 
 	s.state.mutex.Lock()
 	defer s.state.mutex.Unlock()
@@ -474,7 +502,7 @@ func (s *EmbeddedServer) UpdateStateOnCommit(txnid common.Txnid, key string) {
 	handle, ok := s.state.proposals[txnid]
 
 	if ok {
-		log.Printf("EmbeddedServer.UpdateStateOnCommit(): Notify client for proposal %d", txnid)
+		s.logger.Debugf("EmbeddedServer.UpdateStateOnCommit(): Notify client for proposal %d", txnid)
 
 		delete(s.state.proposals, txnid)
 
@@ -501,3 +529,31 @@ func (s *EmbeddedServer) GetEnsembleSize() uint64 {
 func (s *EmbeddedServer) GetFollowerId() string {
 	return s.msgAddr
 }
+
+func (s *EmbeddedServer) GetPriority() uint32 {
+	return 0
+}
+
+func (s *EmbeddedServer) GetFollowerPriority(fid string) uint32 {
+	return 0
+}
+
+func (s *EmbeddedServer) GetSlowFollowerPolicy() *protocol.SlowFollowerPolicy {
+	return nil
+}
+
+func (s *EmbeddedServer) GetClock() common.Clock {
+	return common.GetClock()
+}
+
+func (s *EmbeddedServer) GetLogger() *common.NodeLogger {
+	return s.logger
+}
+
+func (s *EmbeddedServer) GetTracer() *common.NodeTracer {
+	return nil
+}
+
+func (s *EmbeddedServer) GetMetricLabels() common.MetricLabels {
+	return common.MetricLabels{Node: s.msgAddr}
+}
@@ -17,78 +17,476 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	json "encoding/json"
 	"github.com/couchbase/gometa/common"
-	"log"
+	"github.com/couchbase/gometa/protocol"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
 type Env struct {
-	hostUDPAddr     net.Addr
-	hostTCPAddr     net.Addr
-	hostRequestAddr net.Addr
-	peerUDPAddr     []string
-	peerTCPAddr     []string
+	hostUDPAddr       net.Addr
+	hostTCPAddr       net.Addr
+	hostRequestAddr   net.Addr
+	hostAdminAddr     net.Addr // nil unless the node serves the four-letter commands
+	peerUDPAddr       []string
+	peerTCPAddr       []string
+	hostPriority      uint32
+	peerPriority      []uint32
+	verifier          protocol.QuorumVerifier
+	electionTransport string
+	repoName          string
+	groups            []*GroupConfig
+	maxPriority       uint32
+	transport         common.Transport
+	tlsConfig         *tls.Config
+	authTransport     *common.AuthTransport
+	admin             *Credential
+	slowFollower      *protocol.SlowFollowerPolicy
+	readiness         *ReadinessPolicy
+	clock             common.Clock
+	logger            *common.NodeLogger // nil if the node logs to the logger of the process
+	tracer            *common.NodeTracer // nil if the node records its spans to the exporter of the process
+	config            *Config            // nil if the node is configured from the command line
+
+	// The membership can be changed by the administrator while the node
+	// is running (see setMembership).  The peers, the quorum verifier
+	// and the transport are protected by the mutex.
+	mutex sync.Mutex
 }
 
 type Node struct {
 	ElectionAddr string
 	MessageAddr  string
 	RequestAddr  string
+	AdminAddr    string // address for the four-letter commands (optional)
+	Priority     uint32 // election priority. A node with higher priority is preferred as leader.
+	Weight       uint64 // voting weight for weighted or hierarchical quorum (default 1)
+	Group        string // group (e.g. zone) for hierarchical quorum
 }
 
 type Config struct {
-	Host *Node
-	Peer []*Node
+	Host              *Node
+	Peer              []*Node
+	Quorum            string // majority (default), weighted or hierarchical
+	ElectionTransport string // udp (default) or tcp
+	DataDir           string // directory for the repository file (default is current directory)
+	LogLevel          string // error, warn, info (default), debug or trace
+	Groups            []*GroupConfig
+	TLS               *TLSConfig                   // encrypt the connections with TLS (optional)
+	Secret            string                       // secret shared by the ensemble for authenticating the messages (optional)
+	Admin             *Credential                  // administrator of the ensemble.  If set, the clients must authenticate (optional)
+	SlowFollower      *protocol.SlowFollowerPolicy // report (and disconnect) the followers that fall behind the leader (optional)
+	Readiness         *ReadinessPolicy             // when the node is ready to serve the clients (optional)
+	Transport         common.Transport             `json:"-"` // network for the peers (default is TCP/UDP)
+	Logger            common.Logger                `json:"-"` // receiver of the log events of this node (default is the logger of the process)
+	Clock             common.Clock                 `json:"-"` // clock of the protocol timers (default is the process clock)
+	SpanExporter      common.SpanExporter          `json:"-"` // receiver of the spans of this node (default is the exporter of the process)
 }
 
-var gEnv *Env
+//
+// The certificates of a node (PEM files).  The certificate of each
+// node must be signed by the CA, and be valid for the host of the node.
+//
+type TLSConfig struct {
+	CertFile string // certificate of this node
+	KeyFile  string // private key of the certificate
+	CAFile   string // certificate of the CA of the ensemble
+}
+
+//
+// A consensus group hosted by all the nodes.  Each group has its own
+// leader, commit log and repository.
+//
+type GroupConfig struct {
+	Name     string
+	Prefixes []string // keys with these prefixes are handled by this group
+	Leader   string   // ElectionAddr of the preferred leader of this group (optional)
+}
+
+//
+// Read a config file (JSON).  The config is not validated until an Env is
+// created from it.
+//
+func LoadConfig(path string) (*Config, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffer := new(bytes.Buffer)
+	_, err = buffer.ReadFrom(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	err = json.Unmarshal(buffer.Bytes(), &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+//
+// Create a new Env.  If the config file is not specified, the
+// environment is initialized from the command line arguments.
+//
+func NewEnv(config string) (*Env, error) {
 
-func NewEnv(config string) (err error) {
-	gEnv = new(Env)
+	env := new(Env)
 
+	var err error
 	if config == "" {
-		return gEnv.initWithArgs()
+		err = env.initWithArgs()
+	} else {
+		err = env.initWithConfig(config)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+//
+// Create a new Env from the given configuration.
+//
+func NewEnvWithConfig(config *Config) (*Env, error) {
+
+	env := new(Env)
+	if err := env.initWithConfigObj(config); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func (e *Env) GetHostUDPAddr() string {
+	return e.hostUDPAddr.String()
+}
+
+func (e *Env) GetHostTCPAddr() string {
+	return e.hostTCPAddr.String()
+}
+
+func (e *Env) GetHostRequestAddr() string {
+	return e.hostRequestAddr.String()
+}
+
+//
+// Return the address for the four-letter commands, or an empty string
+// if the node does not serve them.
+//
+func (e *Env) GetHostAdminAddr() string {
+	if e.hostAdminAddr == nil {
+		return ""
 	}
+	return e.hostAdminAddr.String()
+}
 
-	return gEnv.initWithConfig(config)
+func (e *Env) GetPeerUDPAddr() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.peerUDPAddr
+}
+
+func (e *Env) GetPeerTCPAddr() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.peerTCPAddr
 }
 
-func GetHostUDPAddr() string {
-	return gEnv.hostUDPAddr.String()
+func (e *Env) GetHostPriority() uint32 {
+	return e.hostPriority
+}
+
+func (e *Env) GetQuorumVerifier() protocol.QuorumVerifier {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.verifier
+}
+
+func (e *Env) GetElectionTransport() string {
+	return e.electionTransport
+}
+
+func (e *Env) GetRepositoryName() string {
+	return e.repoName
+}
+
+//
+// Return the directory of the repository file.
+//
+func (e *Env) GetDataDir() string {
+	return filepath.Dir(e.repoName)
+}
+
+//
+// Return the network used for communicating with the peers.
+//
+func (e *Env) GetTransport() common.Transport {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.transport == nil {
+		return common.NewNetTransport()
+	}
+	return e.transport
+}
+
+//
+// Return the TLS configuration of the node, or nil if TLS is not
+// enabled.
+//
+func (e *Env) GetTLSConfig() *tls.Config {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.tlsConfig
+}
+
+//
+// Return the administrator of the ensemble, or nil if the clients
+// do not need to authenticate.
+//
+func (e *Env) GetAdmin() *Credential {
+	return e.admin
+}
+
+//
+// Return the policy of the leader for the slow followers, or nil if
+// the leader does not check for slow followers.
+//
+func (e *Env) GetSlowFollowerPolicy() *protocol.SlowFollowerPolicy {
+	return e.slowFollower
+}
+
+//
+// Return the clock of the protocol timers of the node.  This is the
+// process clock (see common.SetClock) unless the config has a clock.
+//
+func (e *Env) GetClock() common.Clock {
+	if e.clock == nil {
+		return common.GetClock()
+	}
+	return e.clock
+}
+
+//
+// Return the logger of the node.  The node logs to the logger of the
+// process unless the config has a logger or a log level.
+//
+func (e *Env) GetLogger() *common.NodeLogger {
+	return e.logger
+}
+
+//
+// Return the tracer of the client requests of the node.  The node records
+// its spans to the exporter of the process unless the config has an
+// exporter.
+//
+func (e *Env) GetTracer() *common.NodeTracer {
+	return e.tracer
+}
+
+//
+// Return the rules for the node to be ready (see ReadinessPolicy).
+//
+func (e *Env) GetReadinessPolicy() *ReadinessPolicy {
+	if e.readiness == nil {
+		return &ReadinessPolicy{}
+	}
+	return e.readiness
+}
+
+//
+// Return the number of messages from the peers that are rejected
+// because they cannot be authenticated, or are replayed.
+//
+func (e *Env) GetRejectedMessages() uint64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.authTransport == nil {
+		return 0
+	}
+	return e.authTransport.GetRejected()
+}
+
+//
+// Return the members of the ensemble, starting with this node.  The
+// nodes configured from the command line only have the election and
+// message addresses.
+//
+func (e *Env) GetMembers() []*Node {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.config != nil {
+		return append([]*Node{e.config.Host}, e.config.Peer...)
+	}
+
+	result := []*Node{&Node{ElectionAddr: e.hostUDPAddr.String(),
+		MessageAddr: e.hostTCPAddr.String(),
+		RequestAddr: e.hostRequestAddr.String()}}
+	for i := 0; i < len(e.peerUDPAddr); i++ {
+		result = append(result, &Node{ElectionAddr: e.peerUDPAddr[i], MessageAddr: e.peerTCPAddr[i]})
+	}
+	return result
+}
+
+//
+// Create the environment of the node for the given members.  This node
+// must be one of the members.  The other settings (and the addresses of
+// this node) are kept.
+//
+func (e *Env) newMembership(members []*Node) (*Env, error) {
+
+	e.mutex.Lock()
+	config := e.config
+	e.mutex.Unlock()
+
+	if config == nil {
+		return nil, common.NewError(common.SERVER_CONFIG_ERROR,
+			"Cannot change the members of a node configured from the command line")
+	}
+	if len(e.groups) != 0 {
+		return nil, common.NewError(common.SERVER_CONFIG_ERROR,
+			"Cannot change the members of a node hosting multiple consensus groups")
+	}
+
+	found := false
+	seen := make(map[string]bool)
+	peers := make([]*Node, 0, len(members))
+
+	for _, member := range members {
+		if member == nil {
+			return nil, common.NewError(common.SERVER_CONFIG_ERROR, "Missing member")
+		}
+
+		addr, err := resolveAddr(common.ELECTION_TRANSPORT_TYPE, member.ElectionAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[addr.String()] {
+			return nil, common.NewError(common.SERVER_CONFIG_ERROR, "Duplicate member "+member.ElectionAddr)
+		}
+		seen[addr.String()] = true
+
+		if addr.String() == e.hostUDPAddr.String() {
+			found = true
+		} else {
+			peers = append(peers, member)
+		}
+	}
+
+	if !found {
+		return nil, common.NewError(common.SERVER_CONFIG_ERROR,
+			"Node "+e.hostUDPAddr.String()+" is not one of the members")
+	}
+
+	newConfig := *config
+	newConfig.Peer = peers
+
+	return NewEnvWithConfig(&newConfig)
 }
 
-func GetHostTCPAddr() string {
-	return gEnv.hostTCPAddr.String()
+//
+// Replace the members of the node with the members of the given
+// environment (see newMembership).  The node must be restarted for the
+// change to take effect.
+//
+func (e *Env) setMembership(env *Env) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.peerUDPAddr = env.peerUDPAddr
+	e.peerTCPAddr = env.peerTCPAddr
+	e.peerPriority = env.peerPriority
+	e.verifier = env.verifier
+	e.maxPriority = env.maxPriority
+	e.transport = env.transport
+	e.tlsConfig = env.tlsConfig
+	e.authTransport = env.authTransport
+	e.config = env.config
 }
 
-func GetHostRequestAddr() string {
-	return gEnv.hostRequestAddr.String()
+//
+// Return the consensus groups hosted by this node.  The Leader
+// of each group is resolved to the election address.
+//
+func (e *Env) GetGroups() []*GroupConfig {
+	return e.groups
 }
 
-func GetPeerUDPAddr() []string {
-	return gEnv.peerUDPAddr
+//
+// Return the election priority of the node in the group.  The preferred
+// leader of the group has a higher priority than any other node, such
+// that the leaders of the groups can be spread across the nodes.
+//
+func (e *Env) getGroupPriority(group *GroupConfig, udpAddr string, priority uint32) uint32 {
+	if group != nil && group.Leader == udpAddr {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+
+		return e.maxPriority + 1
+	}
+	return priority
 }
 
-func GetPeerTCPAddr() []string {
-	return gEnv.peerTCPAddr
+//
+// Return the election priority of a node that accepts the leadership
+// from the leader.  This is higher than any other priority.
+//
+func (e *Env) getPreferredPriority() uint32 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.maxPriority + 2
 }
 
-func findMatchingPeerTCPAddr(updAddr string) string {
-	for i := 0; i < len(gEnv.peerUDPAddr); i++ {
-		if gEnv.peerUDPAddr[i] == updAddr {
-			return gEnv.peerTCPAddr[i]
+func (e *Env) findMatchingPeerTCPAddr(updAddr string) string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for i := 0; i < len(e.peerUDPAddr); i++ {
+		if e.peerUDPAddr[i] == updAddr {
+			return e.peerTCPAddr[i]
 		}
 	}
 	return ""
 }
 
-func findMatchingPeerUDPAddr(tcpAddr string) string {
-	for i := 0; i < len(gEnv.peerTCPAddr); i++ {
-		if gEnv.peerTCPAddr[i] == tcpAddr {
-			return gEnv.peerUDPAddr[i]
+func (e *Env) findMatchingPeerPriority(tcpAddr string) uint32 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for i := 0; i < len(e.peerTCPAddr); i++ {
+		if e.peerTCPAddr[i] == tcpAddr && i < len(e.peerPriority) {
+			return e.peerPriority[i]
+		}
+	}
+	return 0
+}
+
+func (e *Env) findMatchingPeerUDPAddr(tcpAddr string) string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for i := 0; i < len(e.peerTCPAddr); i++ {
+		if e.peerTCPAddr[i] == tcpAddr {
+			return e.peerUDPAddr[i]
 		}
 	}
 	return ""
@@ -96,40 +494,62 @@ func findMatchingPeerUDPAddr(tcpAddr string) string {
 
 func (e *Env) initWithConfig(path string) error {
 
-	file, err := os.Open(path)
+	config, err := LoadConfig(path)
 	if err != nil {
 		return err
 	}
 
-	buffer := new(bytes.Buffer)
-	_, err = buffer.ReadFrom(file)
-	if err != nil {
-		return err
+	return e.initWithConfigObj(config)
+}
+
+func (e *Env) initWithConfigObj(config *Config) (err error) {
+
+	e.logger = common.NewNodeLogger(config.Logger)
+	e.tracer = common.NewNodeTracerWithClock(config.Clock, config.SpanExporter)
+
+	if len(config.LogLevel) != 0 {
+		level, err := common.ParseLogLevel(config.LogLevel)
+		if err != nil {
+			return err
+		}
+		e.logger.SetLogLevel(level)
 	}
 
-	var config Config
-	err = json.Unmarshal(buffer.Bytes(), &config)
-	if err != nil {
-		return err
+	if config.Host == nil {
+		return common.NewError(common.SERVER_CONFIG_ERROR, "Missing Host in configuration")
 	}
 
 	if e.hostUDPAddr, err = resolveAddr(common.ELECTION_TRANSPORT_TYPE, config.Host.ElectionAddr); err != nil {
 		return err
 	}
-	log.Printf("Env.initWithConfig(): Host UDP Addr %s", e.hostUDPAddr.String())
+	e.logger.Infof("Env.initWithConfig(): Host UDP Addr %s", e.hostUDPAddr.String())
 
 	if e.hostTCPAddr, err = resolveAddr(common.MESSAGE_TRANSPORT_TYPE, config.Host.MessageAddr); err != nil {
 		return err
 	}
-	log.Printf("Env.initWithConfig(): Host TCP Addr %s", e.hostTCPAddr.String())
+	e.logger.Infof("Env.initWithConfig(): Host TCP Addr %s", e.hostTCPAddr.String())
 
 	if e.hostRequestAddr, err = resolveAddr(common.MESSAGE_TRANSPORT_TYPE, config.Host.RequestAddr); err != nil {
 		return err
 	}
-	log.Printf("Env.initWithConfig(): Host Request Addr %s", e.hostRequestAddr.String())
+	e.logger.Infof("Env.initWithConfig(): Host Request Addr %s", e.hostRequestAddr.String())
+
+	if len(config.Host.AdminAddr) != 0 {
+		if e.hostAdminAddr, err = resolveAddr(common.MESSAGE_TRANSPORT_TYPE, config.Host.AdminAddr); err != nil {
+			return err
+		}
+		e.logger.Infof("Env.initWithConfig(): Host Admin Addr %s", e.hostAdminAddr.String())
+	}
+
+	e.hostPriority = config.Host.Priority
+	e.logger.Infof("Env.initWithConfig(): Host Priority %d", e.hostPriority)
 
 	e.peerUDPAddr = make([]string, 0, len(config.Peer))
 	e.peerTCPAddr = make([]string, 0, len(config.Peer))
+	e.peerPriority = make([]uint32, 0, len(config.Peer))
+
+	members := make([]*protocol.QuorumMember, 0, len(config.Peer)+1)
+	members = append(members, newQuorumMember(e.hostUDPAddr, e.hostTCPAddr, config.Host))
 
 	for _, peer := range config.Peer {
 		udpAddr, err := resolveAddr(common.ELECTION_TRANSPORT_TYPE, peer.ElectionAddr)
@@ -137,19 +557,171 @@ func (e *Env) initWithConfig(path string) error {
 			return err
 		}
 		e.peerUDPAddr = append(e.peerUDPAddr, udpAddr.String())
-		log.Printf("Env.initWithConfig(): Peer UDP Addr %s", udpAddr.String())
+		e.logger.Infof("Env.initWithConfig(): Peer UDP Addr %s", udpAddr.String())
 
 		tcpAddr, err := resolveAddr(common.MESSAGE_TRANSPORT_TYPE, peer.MessageAddr)
 		if err != nil {
 			return err
 		}
 		e.peerTCPAddr = append(e.peerTCPAddr, tcpAddr.String())
-		log.Printf("Env.initWithConfig(): Peer TCP Addr %s", tcpAddr.String())
+		e.logger.Infof("Env.initWithConfig(): Peer TCP Addr %s", tcpAddr.String())
+
+		e.peerPriority = append(e.peerPriority, peer.Priority)
+		e.logger.Infof("Env.initWithConfig(): Peer Priority %d", peer.Priority)
+
+		members = append(members, newQuorumMember(udpAddr, tcpAddr, peer))
+	}
+
+	if e.verifier, err = protocol.NewQuorumVerifier(protocol.QuorumKind(config.Quorum),
+		uint64(len(config.Peer))+1, members); err != nil {
+		return err
+	}
+	e.logger.Infof("Env.initWithConfig(): Quorum %s", config.Quorum)
+
+	switch config.ElectionTransport {
+	case "":
+		e.electionTransport = common.ELECTION_TRANSPORT_TYPE
+	case "udp", "tcp":
+		e.electionTransport = config.ElectionTransport
+	default:
+		return common.NewError(common.ARG_ERROR, "Unknown election transport "+config.ElectionTransport)
 	}
+	e.logger.Infof("Env.initWithConfig(): Election Transport %s", e.electionTransport)
 
+	e.repoName = filepath.Join(config.DataDir, common.REPOSITORY_NAME)
+	e.logger.Infof("Env.initWithConfig(): Repository %s", e.repoName)
+
+	e.maxPriority = e.hostPriority
+	for _, priority := range e.peerPriority {
+		if priority > e.maxPriority {
+			e.maxPriority = priority
+		}
+	}
+
+	if e.groups, err = e.initGroups(config.Groups); err != nil {
+		return err
+	}
+
+	e.transport = config.Transport
+	e.clock = config.Clock
+
+	if config.TLS != nil {
+		if err := e.initTLS(config.TLS); err != nil {
+			return err
+		}
+	}
+
+	if config.Admin != nil {
+		if len(config.Admin.User) == 0 || len(config.Admin.Password) == 0 {
+			return common.NewError(common.SERVER_CONFIG_ERROR, "Admin must have a user and a password")
+		}
+		e.admin = config.Admin
+		e.logger.Infof("Env.initWithConfig(): Client authentication enabled")
+	}
+
+	if config.SlowFollower != nil {
+		if config.SlowFollower.MaxLag < 0 {
+			return common.NewError(common.SERVER_CONFIG_ERROR, "MaxLag of SlowFollower cannot be negative")
+		}
+		e.slowFollower = config.SlowFollower
+		e.logger.Infof("Env.initWithConfig(): Slow follower max lag %d, max latency %d ms, disconnect %v",
+			e.slowFollower.MaxLag, e.slowFollower.MaxLatency, e.slowFollower.Disconnect)
+	}
+
+	if config.Readiness != nil {
+		if config.Readiness.MaxFollowerLag < 0 {
+			return common.NewError(common.SERVER_CONFIG_ERROR, "MaxFollowerLag of Readiness cannot be negative")
+		}
+		e.readiness = config.Readiness
+		e.logger.Infof("Env.initWithConfig(): Readiness leader only %v, max follower lag %d",
+			e.readiness.LeaderOnly, e.readiness.MaxFollowerLag)
+	}
+
+	if len(config.Secret) != 0 {
+		if e.authTransport, err = common.NewAuthTransport(e.GetTransport(), []byte(config.Secret)); err != nil {
+			return err
+		}
+		e.transport = e.authTransport
+		e.logger.Infof("Env.initWithConfig(): Message authentication enabled")
+	}
+
+	e.config = config
 	return nil
 }
 
+//
+// Enable TLS on the connections between the peers.  A peer is only
+// accepted if its certificate is valid for the host of one of the
+// members of the ensemble.
+//
+func (e *Env) initTLS(config *TLSConfig) (err error) {
+
+	if e.tlsConfig, err = common.NewTLSConfig(config.CertFile, config.KeyFile, config.CAFile); err != nil {
+		return err
+	}
+
+	var hosts []string
+	for _, addr := range append([]string{e.hostTCPAddr.String()}, e.peerTCPAddr...) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, host)
+	}
+
+	e.transport = common.NewTLSTransport(e.GetTransport(), e.tlsConfig, hosts)
+	e.logger.Infof("Env.initWithConfig(): TLS enabled with certificate %s and CA %s", config.CertFile, config.CAFile)
+
+	return nil
+}
+
+func (e *Env) initGroups(configs []*GroupConfig) ([]*GroupConfig, error) {
+
+	groups := make([]*GroupConfig, 0, len(configs))
+	names := make(map[string]bool)
+	prefixes := make(map[string]string)
+
+	for _, config := range configs {
+		if config == nil || len(config.Name) == 0 || strings.ContainsAny(config.Name, "/\\") {
+			return nil, common.NewError(common.SERVER_CONFIG_ERROR, "Missing or invalid group name in configuration")
+		}
+
+		if names[config.Name] {
+			return nil, common.NewError(common.SERVER_CONFIG_ERROR, "Duplicate group "+config.Name+" in configuration")
+		}
+		names[config.Name] = true
+
+		for _, prefix := range config.Prefixes {
+			if group, ok := prefixes[prefix]; ok {
+				return nil, common.NewError(common.SERVER_CONFIG_ERROR,
+					"Prefix '"+prefix+"' is used by both group "+group+" and group "+config.Name)
+			}
+			prefixes[prefix] = config.Name
+		}
+
+		group := &GroupConfig{Name: config.Name,
+			Prefixes: append([]string(nil), config.Prefixes...)}
+
+		if len(config.Leader) != 0 {
+			leader, err := resolveAddr(common.ELECTION_TRANSPORT_TYPE, config.Leader)
+			if err != nil {
+				return nil, err
+			}
+			group.Leader = leader.String()
+
+			if group.Leader != e.hostUDPAddr.String() && e.findMatchingPeerTCPAddr(group.Leader) == "" {
+				return nil, common.NewError(common.SERVER_CONFIG_ERROR,
+					"Leader "+config.Leader+" of group "+config.Name+" is not in the ensemble")
+			}
+		}
+
+		e.logger.Infof("Env.initWithConfig(): Group %s Prefixes %v Leader %s", group.Name, group.Prefixes, group.Leader)
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
 func (e *Env) initWithArgs() error {
 	if len(os.Args) < 3 {
 		return common.NewError(common.ARG_ERROR, "Missing command line argument")
@@ -166,6 +738,10 @@ func (e *Env) initWithArgs() error {
 			return err
 		}
 	}
+
+	e.verifier = protocol.NewMajorityQuorumVerifier(uint64(len(e.peerUDPAddr)) + 1)
+	e.electionTransport = common.ELECTION_TRANSPORT_TYPE
+	e.repoName = common.REPOSITORY_NAME
 	return nil
 }
 
@@ -175,19 +751,19 @@ func (e *Env) resolveHostAddr() (err error) {
 	if err != nil {
 		return err
 	}
-	log.Printf("Env.resoleHostAddr(): Host UDP Addr %s", e.hostUDPAddr.String())
+	e.logger.Infof("Env.resoleHostAddr(): Host UDP Addr %s", e.hostUDPAddr.String())
 
 	e.hostTCPAddr, err = resolveAddr(common.MESSAGE_TRANSPORT_TYPE, os.Args[2])
 	if err != nil {
 		return err
 	}
-	log.Printf("Env.resolveHostAddr(): Host TCP Addr %s", e.hostTCPAddr.String())
+	e.logger.Infof("Env.resolveHostAddr(): Host TCP Addr %s", e.hostTCPAddr.String())
 
 	e.hostRequestAddr, err = resolveAddr(common.MESSAGE_TRANSPORT_TYPE, os.Args[3])
 	if err != nil {
 		return err
 	}
-	log.Printf("Env.resolveHostAddr(): Host Request Addr %s", e.hostRequestAddr.String())
+	e.logger.Infof("Env.resolveHostAddr(): Host Request Addr %s", e.hostRequestAddr.String())
 
 	return nil
 }
@@ -204,7 +780,7 @@ func (e *Env) resolvePeerAddr() error {
 		}
 		e.peerUDPAddr = append(e.peerUDPAddr, peer.String())
 		i++
-		log.Printf("Env.resolvePeerAddr(): Peer UDP Addr %s", peer.String())
+		e.logger.Infof("Env.resolvePeerAddr(): Peer UDP Addr %s", peer.String())
 
 		peer, err = resolveAddr(common.MESSAGE_TRANSPORT_TYPE, args[i])
 		if err != nil {
@@ -212,12 +788,29 @@ func (e *Env) resolvePeerAddr() error {
 		}
 		e.peerTCPAddr = append(e.peerTCPAddr, peer.String())
 		i++
-		log.Printf("Env.resolvePeerAddr(): Peer TCP Addr %s", peer.String())
+		e.logger.Infof("Env.resolvePeerAddr(): Peer TCP Addr %s", peer.String())
 	}
 
 	return nil
 }
 
+//
+// Create a quorum member for a node.  The member is identified by both
+// its election address and its message address.
+//
+func newQuorumMember(udpAddr net.Addr, tcpAddr net.Addr, node *Node) *protocol.QuorumMember {
+
+	weight := node.Weight
+	if weight == 0 {
+		weight = 1
+	}
+
+	return &protocol.QuorumMember{
+		Ids:    []string{udpAddr.String(), tcpAddr.String()},
+		Weight: weight,
+		Group:  node.Group}
+}
+
 func resolveAddr(network string, addr string) (addrObj net.Addr, err error) {
 
 	if strings.Contains(network, common.MESSAGE_TRANSPORT_TYPE) {
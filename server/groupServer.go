@@ -0,0 +1,265 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/message"
+	"github.com/couchbase/gometa/protocol"
+	"sync"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// GroupServer hosts multiple consensus groups on a single node.  Each
+// group runs its own election, leader or follower, commit log and
+// repository.  The groups share the peer connections, the election
+// messenger and the request listener.  A client request is routed to
+// the group that owns the key.
+//
+// Every node of the ensemble must be configured with the same groups.
+// The leaders of the groups can be spread across the nodes by giving
+// each group a different preferred leader.
+//
+type GroupServer struct {
+	env         *Env
+	routes      *RoutingTable
+	servers     map[string]*Server // key : group name
+	mux         *common.ConnMux
+	demux       *protocol.MessengerDemux
+	reqListener *RequestListener
+	cmdListener *CommandListener // nil unless the node serves the four-letter commands
+
+	// mutex protected variable
+	mutex     sync.Mutex
+	isStarted bool
+	isStopped bool
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a new GroupServer with the given configuration.  The
+// configuration must have at least one group.
+//
+func NewGroupServer(config *Config) (*GroupServer, error) {
+
+	env, err := NewEnvWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGroupServer(env)
+}
+
+//
+// Start the shared listeners and all the consensus groups.
+//
+func (g *GroupServer) Start() (err error) {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.isStarted || g.isStopped {
+		return common.NewError(common.SERVER_ERROR, "GroupServer has already been started.")
+	}
+	g.isStarted = true
+
+	defer func() {
+		if err != nil {
+			g.cleanup()
+		}
+	}()
+
+	// Start the peer listener before election, so the followers can
+	// connect to this node before it knows that it is the leader.
+	if g.mux, err = common.NewConnMuxWithTransport(g.env.GetHostTCPAddr(), g.env.GetTransport()); err != nil {
+		return common.WrapError(common.SERVER_ERROR, "Fail to start ConnMux.", err)
+	}
+
+	messenger, err := protocol.NewElectionMessengerWithTransport(g.env.GetHostUDPAddr(), g.env.GetElectionTransport(),
+		g.env.GetTransport())
+	if err != nil {
+		return common.WrapError(common.SERVER_ERROR, "Fail to start election messenger.", err)
+	}
+	g.demux = protocol.NewMessengerDemux(messenger, message.NewConcreteMsgFactory())
+
+	for _, config := range g.env.GetGroups() {
+		s := newServer(g.env)
+		s.group = &serverGroup{config: config, mux: g.mux, demux: g.demux}
+		if err = s.Start(); err != nil {
+			return err
+		}
+		g.servers[config.Name] = s
+		g.env.GetLogger().Infof("GroupServer.Start() : Start group %s", config.Name)
+	}
+
+	if g.reqListener, err = startRequestListener(g.env.GetHostRequestAddr(), &RequestReceiver{groups: g}, g.env.GetTLSConfig()); err != nil {
+		return common.WrapError(common.SERVER_ERROR, "Fail to start RequestListener.", err)
+	}
+
+	if addr := g.env.GetHostAdminAddr(); len(addr) != 0 {
+		if g.cmdListener, err = startCommandListener(addr, &RequestReceiver{groups: g}, g.env.GetTLSConfig()); err != nil {
+			return common.WrapError(common.SERVER_ERROR, "Fail to start CommandListener.", err)
+		}
+	}
+
+	return nil
+}
+
+//
+// Stop all the consensus groups and the shared listeners.  This function
+// returns after all the groups have stopped running.
+//
+func (g *GroupServer) Stop() {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.isStopped {
+		return
+	}
+	g.isStopped = true
+
+	g.cleanup()
+}
+
+//
+// Return the server of the group that owns the key.
+//
+func (g *GroupServer) GetServer(key string) (*Server, error) {
+
+	name, ok := g.routes.FindGroup(key)
+	if !ok {
+		return nil, common.NewError(common.INVALID_REQUEST_ERROR, "No consensus group for key "+key)
+	}
+
+	s := g.GetGroupServer(name)
+	if s == nil {
+		return nil, common.NewError(common.SERVER_ERROR, "Consensus group "+name+" is not running")
+	}
+	return s, nil
+}
+
+//
+// Return the server of the group.  Return nil if the group
+// is not running.
+//
+func (g *GroupServer) GetGroupServer(name string) *Server {
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.servers[name]
+}
+
+//
+// Return the routing table for the keys.
+//
+func (g *GroupServer) GetRoutingTable() *RoutingTable {
+	return g.routes
+}
+
+//
+// This is the API for client that is co-located withe gometa server
+// in the same process.
+//
+func (g *GroupServer) NewClientRequest(req *Request, reply **Reply) error {
+
+	receiver := &RequestReceiver{groups: g}
+	return receiver.NewRequest(req, reply)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+func newGroupServer(env *Env) (*GroupServer, error) {
+
+	if len(env.GetGroups()) == 0 {
+		return nil, common.NewError(common.SERVER_CONFIG_ERROR, "No consensus group in configuration")
+	}
+
+	routes := NewRoutingTable()
+	for _, config := range env.GetGroups() {
+		for _, prefix := range config.Prefixes {
+			if err := routes.AddRoute(prefix, config.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &GroupServer{env: env,
+		routes:    routes,
+		servers:   make(map[string]*Server),
+		isStarted: false,
+		isStopped: false}, nil
+}
+
+//
+// Wait until all the consensus groups stop running.
+//
+func (g *GroupServer) wait() {
+
+	g.mutex.Lock()
+	servers := make([]*Server, 0, len(g.servers))
+	for _, s := range g.servers {
+		servers = append(servers, s)
+	}
+	g.mutex.Unlock()
+
+	for _, s := range servers {
+		<-s.donech
+	}
+}
+
+//
+// Stop the groups and release the shared resources.  The caller
+// must hold the mutex.
+//
+func (g *GroupServer) cleanup() {
+
+	if g.reqListener != nil {
+		g.reqListener.Close()
+	}
+
+	if g.cmdListener != nil {
+		g.cmdListener.Close()
+	}
+
+	for _, s := range g.servers {
+		s.Stop()
+	}
+
+	common.SafeRun("GroupServer.cleanup()",
+		func() {
+			if g.demux != nil {
+				g.demux.Close()
+			}
+		})
+
+	common.SafeRun("GroupServer.cleanup()",
+		func() {
+			if g.mux != nil {
+				g.mux.Close()
+			}
+		})
+}
@@ -0,0 +1,213 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/protocol"
+	http "net/http"
+	"sort"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// The rules for a node to be ready (see common.READY_PATH).  A node is not
+// ready while it is electing.  The leader is ready once a quorum of followers
+// has synchronized with it, and as long as it keeps the quorum.  A follower
+// is ready once it has synchronized with the leader, unless LeaderOnly is
+// set.  If MaxFollowerLag is set, a follower that has more than
+// MaxFollowerLag proposals logged but not committed yet is not ready.
+//
+type ReadinessPolicy struct {
+	LeaderOnly     bool // only the leader is ready
+	MaxFollowerLag int  // 0 : a lagging follower is ready
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Server
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Return an error unless the server is running and its repository is open.
+//
+func (s *Server) checkHealth() error {
+
+	s.mutex.Lock()
+	state := s.state
+	handler := s.handler
+	s.mutex.Unlock()
+
+	if state == nil || handler == nil {
+		return common.NewError(common.SERVER_ERROR, "The server is starting")
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.isClosed {
+		return common.NewError(common.SERVER_ERROR, "The repository is closed")
+	}
+	return nil
+}
+
+//
+// Return an error unless the server is ready to serve the clients (see
+// ReadinessPolicy).
+//
+func (s *Server) checkReady() error {
+
+	if err := s.checkHealth(); err != nil {
+		return err
+	}
+
+	policy := s.env.GetReadinessPolicy()
+
+	s.mutex.Lock()
+	state := s.state
+	handler := s.handler
+	s.mutex.Unlock()
+
+	state.mutex.Lock()
+	status := state.status
+	ready := state.ready
+	leader := state.leader
+	var lastLogged, lastCommitted common.Txnid
+	if !state.isClosed {
+		lastLogged, _ = handler.GetLastLoggedTxid()
+		lastCommitted, _ = handler.GetLastCommittedTxid()
+	}
+	state.mutex.Unlock()
+
+	switch status {
+	case protocol.LEADING:
+		if !ready || leader == nil || leader.IsClosed() {
+			return common.NewError(common.NO_QUORUM_ERROR, "The leader does not have a quorum of followers yet")
+		}
+		if !s.HasQuorum(leader.GetActiveEnsemble()) {
+			return common.NewError(common.NO_QUORUM_ERROR, "The leader has lost its quorum of followers")
+		}
+		return nil
+
+	case protocol.FOLLOWING:
+		if !ready {
+			return common.NewError(common.NO_QUORUM_ERROR, "The follower is not synchronized with the leader")
+		}
+		if policy.LeaderOnly {
+			return common.NewError(common.NOT_LEADER_ERROR, "Only the leader is ready")
+		}
+		if lag := getFollowerLag(lastLogged, lastCommitted); policy.MaxFollowerLag > 0 && lag > uint64(policy.MaxFollowerLag) {
+			return common.NewError(common.SERVER_ERROR,
+				fmt.Sprintf("The follower has %d proposals that are not committed", lag))
+		}
+		return nil
+	}
+
+	return common.NewError(common.NO_QUORUM_ERROR, "The node is "+status.String())
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// GroupServer
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Return the error of each consensus group, sorted by group name.  A
+// group without error is not in the result.
+//
+func (g *GroupServer) checkGroups(check func(s *Server) error) []string {
+
+	g.mutex.Lock()
+	names := make([]string, 0, len(g.servers))
+	for name := range g.servers {
+		names = append(names, name)
+	}
+	g.mutex.Unlock()
+
+	sort.Strings(names)
+
+	var result []string
+	for _, name := range names {
+		if s := g.GetGroupServer(name); s != nil {
+			if err := check(s); err != nil {
+				result = append(result, name+" : "+err.Error())
+			}
+		}
+	}
+	return result
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Tell if the node is alive : the server is running and its repository is
+// open.  If the node hosts multiple consensus groups, every group must be
+// alive.
+//
+func (s *RequestReceiver) serveHealth(w http.ResponseWriter, r *http.Request) {
+	s.serveCheck(w, (*Server).checkHealth)
+}
+
+//
+// Tell if the node can serve the clients (see ReadinessPolicy).  If the
+// node hosts multiple consensus groups, every group must be ready.
+//
+func (s *RequestReceiver) serveReady(w http.ResponseWriter, r *http.Request) {
+	s.serveCheck(w, (*Server).checkReady)
+}
+
+//
+// Reply with 200 if the check succeeds, or with 503 and the reason.
+//
+func (s *RequestReceiver) serveCheck(w http.ResponseWriter, check func(s *Server) error) {
+
+	var errs []string
+	if s.groups != nil {
+		errs = s.groups.checkGroups(check)
+	} else if err := check(s.server); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(errs) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, err := range errs {
+			fmt.Fprintln(w, err)
+		}
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+//
+// Return the number of proposals logged by the follower but not committed
+// yet.  The proposals logged in a new epoch are not committed in an older
+// epoch.
+//
+func getFollowerLag(lastLogged, lastCommitted common.Txnid) uint64 {
+
+	if lastLogged <= lastCommitted {
+		return 0
+	}
+	if lastLogged.GetEpoch() != lastCommitted.GetEpoch() {
+		return lastLogged.GetCounter()
+	}
+	return lastLogged.GetCounter() - lastCommitted.GetCounter()
+}
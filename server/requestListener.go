@@ -16,13 +16,18 @@
 package server
 
 import (
+	"bufio"
+	"crypto/tls"
 	"fmt"
 	"github.com/couchbase/gometa/common"
-	"log"
+	"io"
 	"net"
 	http "net/http"
 	rpc "net/rpc"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,26 +38,61 @@ import (
 type RequestListener struct {
 	naddr    string
 	listener net.Listener
+	mux      *http.ServeMux
+	clock    common.Clock // clock of the server, for the connection times
 
 	mutex    sync.Mutex
 	isClosed bool
+	clients  map[*clientConn]bool
+}
+
+//
+// A connection of a client to the request listener.
+//
+type ClientInfo struct {
+	Addr     string    // address of the client
+	Since    time.Time // when the client connects
+	Received int64     // bytes received from the client
+	Sent     int64     // bytes sent to the client
+}
+
+type clientListener struct {
+	net.Listener
+	owner *RequestListener
+}
+
+type clientConn struct {
+	net.Conn
+	owner    *RequestListener
+	since    time.Time
+	received int64 // atomic
+	sent     int64 // atomic
+	closed   int32 // atomic
 }
 
 type RequestReceiver struct {
 	server *Server
+	groups *GroupServer // route the request to a consensus group if specified
 }
 
 type Request struct {
-	OpCode string
-	Key    string
-	Value  []byte
+	OpCode   string
+	Key      string
+	Value    []byte
+	User     string // credential of the client, if the ensemble has an administrator
+	Password string
 }
 
 type Reply struct {
 	Result []byte
 }
 
-var gHandler *RequestReceiver = nil
+//
+// The default server receives the requests of the co-located client.  It is
+// the first running server in the process.
+//
+var gDefaultServer *Server = nil
+var gDefaultMutex sync.Mutex
 
 /////////////////////////////////////////////////
 // Client Function
@@ -60,15 +100,67 @@ var gHandler *RequestReceiver = nil
 
 //
 // This is the API for client that is co-located withe gometa server
-// in the same process.
+// in the same process.  The request is sent to the default server.
 //
 func NewClientRequest(req *Request, reply **Reply) error {
 
-	if gHandler == nil {
+	gDefaultMutex.Lock()
+	server := gDefaultServer
+	gDefaultMutex.Unlock()
+
+	if server == nil {
 		return common.NewError(common.SERVER_ERROR, "Server is not ready to receive new request.")
 	}
 
-	return gHandler.NewRequest(req, reply)
+	return server.NewClientRequest(req, reply)
+}
+
+//
+// Send the request of a co-located client to this server.  Use this
+// function if more than one server runs in the same process.
+//
+func (s *Server) NewClientRequest(req *Request, reply **Reply) error {
+
+	receiver := &RequestReceiver{server: s}
+	return receiver.NewRequest(req, reply)
+}
+
+//
+// Connect to the request listener of a server.  If config is not nil,
+// the connection is encrypted with TLS, and the certificate of the
+// server is verified against the CA of the config.
+//
+func DialClient(addr string, config *tls.Config) (*rpc.Client, error) {
+
+	if config == nil {
+		return rpc.DialHTTP(common.MESSAGE_TRANSPORT_TYPE, addr)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	config = config.Clone()
+	config.ServerName = host
+
+	conn, err := tls.Dial(common.MESSAGE_TRANSPORT_TYPE, addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Same handshake as rpc.DialHTTP
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.Status != "200 Connected to Go RPC" {
+		conn.Close()
+		return nil, common.NewError(common.CLIENT_ERROR, "Unexpected HTTP response from "+addr+" : "+resp.Status)
+	}
+
+	return rpc.NewClient(conn), nil
 }
 
 /////////////////////////////////////////////////
@@ -79,27 +171,97 @@ func NewClientRequest(req *Request, reply **Reply) error {
 // Start a new RequestListener for listening to new client request.
 // laddr - local network address (host:port)
 //
+// Each listener has its own RPC server and HTTP mux, such that more
+// than one server can run in the same process.
+//
 func StartRequestListener(laddr string, server *Server) (*RequestListener, error) {
 
-	if gHandler == nil {
-		// first time initializatino
-		gHandler = &RequestReceiver{server: server}
-		rpc.Register(gHandler)
-		rpc.HandleHTTP()
-	} else {
-		gHandler.setServer(server)
+	return startRequestListener(laddr, &RequestReceiver{server: server}, server.env.GetTLSConfig())
+}
+
+//
+// If config is not nil, the listener only accepts TLS connections.  A
+// client certificate is verified if the client presents one, but it is
+// not required.
+//
+func startRequestListener(laddr string, receiver *RequestReceiver, config *tls.Config) (*RequestListener, error) {
+
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(receiver); err != nil {
+		return nil, err
 	}
 
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, rpcServer)
+	mux.HandleFunc(common.METRICS_PATH, receiver.serveMetrics)
+	mux.HandleFunc(common.STATUS_PATH, receiver.serveStatus)
+	mux.HandleFunc(common.HEALTH_PATH, receiver.serveHealth)
+	mux.HandleFunc(common.READY_PATH, receiver.serveReady)
+
 	li, err := net.Listen(common.MESSAGE_TRANSPORT_TYPE, laddr)
 	if err != nil {
 		return nil, err
 	}
-	go http.Serve(li, nil)
 
-	listener := &RequestListener{naddr: laddr, listener: li}
+	listener := &RequestListener{naddr: laddr,
+		mux:     mux,
+		clock:   receiver.getEnv().GetClock(),
+		clients: make(map[*clientConn]bool)}
+
+	// Keep track of the clients (see GetClients).  The connections are
+	// tracked below TLS, so the bytes are counted as sent on the wire.
+	li = &clientListener{Listener: li, owner: listener}
+
+	if config != nil {
+		config = config.Clone()
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		li = tls.NewListener(li, config)
+	}
+	listener.listener = li
+	go http.Serve(li, mux)
+
 	return listener, nil
 }
 
+//
+// Write the metrics of the node in the Prometheus text format.  The other
+// servers of the process are not included.
+//
+func (s *RequestReceiver) serveMetrics(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := common.Metrics.WriteNode(w, s.getEnv().GetHostTCPAddr()); err != nil {
+		s.getEnv().GetLogger().Warnf("RequestListener.serveMetrics() : error in writing metrics %s", err.Error())
+	}
+}
+
+//
+// Return the HTTP mux of the listener.  Additional HTTP handlers
+// for this server can be registered on the mux.
+//
+func (li *RequestListener) GetMux() *http.ServeMux {
+	return li.mux
+}
+
+//
+// Return the clients connected to the listener, oldest first.
+//
+func (li *RequestListener) GetClients() []*ClientInfo {
+	li.mutex.Lock()
+	defer li.mutex.Unlock()
+
+	result := make([]*ClientInfo, 0, len(li.clients))
+	for conn := range li.clients {
+		result = append(result, &ClientInfo{Addr: conn.RemoteAddr().String(),
+			Since:    conn.since,
+			Received: atomic.LoadInt64(&conn.received),
+			Sent:     atomic.LoadInt64(&conn.sent)})
+	}
+
+	sort.Sort(clientsBySince(result))
+	return result
+}
+
 //
 // Close the listener.  This does not reclaim the exisiting client conection
 // immediately, but it will stop new connection.
@@ -114,34 +276,37 @@ func (li *RequestListener) Close() {
 	}
 }
 
-//
-// Set the server
-//
-func (s *RequestReceiver) setServer(server *Server) {
-	s.server = server
-}
-
 //
 // Handle a new incoming request
 //
 //func (s *RequestReceiver) NewRequest(message []byte, reply *[]byte) error {
 func (s *RequestReceiver) NewRequest(req *Request, reply **Reply) error {
 
-	if s.server.IsDone() {
+	server, err := s.getServer(req.Key)
+	if err != nil {
+		return err
+	}
+
+	if server.IsDone() {
 		return common.NewError(common.SERVER_ERROR, "Server is terminated. Cannot process new request.")
 	}
+	defer server.stats.observe(server.env.GetClock().Now())
 
-	log.Printf("RequestReceiver.NewRequest(): Receive request from client")
-	log.Printf("RequestReceiver.NewRequest(): opCode %s key %s value %s", req.OpCode, req.Key, req.Value)
+	s.getEnv().GetLogger().Debugf("RequestReceiver.NewRequest(): Receive request from client")
+	s.getEnv().GetLogger().Debugf("RequestReceiver.NewRequest(): opCode %s key %s value %s", req.OpCode, req.Key, req.Value)
 
 	opCode := common.GetOpCode(req.OpCode)
+	if err := s.authorize(req, opCode); err != nil {
+		return err
+	}
+
 	if opCode == common.OPCODE_GET {
 
-		result, err := s.server.GetValue(req.Key)
+		result, err := server.GetValue(req.Key)
 		if err != nil {
 			return err
 		}
-		log.Printf("RequestReceiver.NewRequest(): Receive response from server, len(value) = %d", len(result))
+		s.getEnv().GetLogger().Debugf("RequestReceiver.NewRequest(): Receive response from server, len(value) = %d", len(result))
 
 		*reply = &Reply{Result: result}
 		return nil
@@ -154,29 +319,190 @@ func (s *RequestReceiver) NewRequest(req *Request, reply **Reply) error {
 			req.Value = ([]byte)("")
 		}
 
+		if opCode != common.OPCODE_DELETE && strings.HasPrefix(req.Key, common.ACL_USER_PATH) {
+			if _, err := parseUserRecord(req.Value); err != nil {
+				return err
+			}
+		}
+
 		id := uint64(time.Now().UnixNano())
-		request := s.server.factory.CreateRequest(id,
+		request := server.factory.CreateRequest(id,
 			uint32(common.GetOpCode(req.OpCode)),
 			req.Key,
-			req.Value)
+			req.Value,
+			server.GetTracer().NewTraceId())
 
-		handle := newRequestHandle(request)
+		handle := newRequestHandle(request, server.env.GetClock())
 
 		handle.CondVar.L.Lock()
 		defer handle.CondVar.L.Unlock()
 
 		// push the request to a channel
-		log.Printf("Handing new request to server. Key %s", req.Key)
-		s.server.state.incomings <- handle
+		s.getEnv().GetLogger().Debugf("Handing new request to server. Key %s", req.Key)
+		server.state.incomings <- handle
 
 		// This goroutine will wait until the request has been processed.
 		handle.CondVar.Wait()
-		log.Printf("Receive Response for request. Key %s", req.Key)
+		s.getEnv().GetLogger().Debugf("Receive Response for request. Key %s", req.Key)
+		server.GetTracer().RecordSpan(request.GetTraceId(), common.SPAN_REQUEST, server.GetFollowerId(), common.Txnid(0), req.Key, handle.Queued)
 
 		*reply = &Reply{Result: nil}
 		return handle.Err
 
 	} else {
-		return common.NewError(common.CLIENT_ERROR, fmt.Sprintf("Invalid Op code %s", req.OpCode))
+		return common.NewError(common.INVALID_REQUEST_ERROR, fmt.Sprintf("Invalid Op code %s", req.OpCode))
+	}
+}
+
+//
+// Find the server for the key.  If the receiver serves multiple consensus
+// groups, the key is routed to the group that owns the key.
+//
+func (s *RequestReceiver) getServer(key string) (*Server, error) {
+
+	server := s.server
+	if s.groups != nil {
+		var err error
+		if server, err = s.groups.GetServer(key); err != nil {
+			return nil, err
+		}
+	}
+
+	if !server.isReady() {
+		return nil, common.NewError(common.NO_QUORUM_ERROR, "Server is not ready. Cannot process new request.")
 	}
+	return server, nil
 }
+
+//
+// Authenticate the client, and check that the client has the permission
+// required by the operation on the key.  If the ensemble does not have
+// an administrator, the clients do not need to authenticate.
+//
+func (s *RequestReceiver) authorize(req *Request, opCode common.OpCode) error {
+
+	admin := s.getEnv().GetAdmin()
+	if admin == nil || admin.matches(req.User, req.Password) {
+		return nil
+	}
+
+	if len(req.User) == 0 {
+		return common.NewError(common.AUTH_ERROR, "Missing user.  The ensemble requires client authentication.")
+	}
+
+	record, err := s.getUserRecord(req.User)
+	if err != nil || !record.checkPassword(req.Password) {
+		s.getEnv().GetLogger().Warnf("RequestReceiver.authorize(): Fail to authenticate user %s", req.User)
+		return common.NewError(common.AUTH_ERROR, "Invalid user or password")
+	}
+
+	required := RequiredPermission(opCode, req.Key)
+	if granted := record.GetPermission(req.Key); granted < required {
+		s.getEnv().GetLogger().Warnf("RequestReceiver.authorize(): User %s does not have %s permission on key %s", req.User, required, req.Key)
+		return common.NewError(common.PERMISSION_ERROR,
+			fmt.Sprintf("User %s does not have %s permission on key %s", req.User, required, req.Key))
+	}
+
+	return nil
+}
+
+//
+// Return a function that tells if the client can read a key.  The
+// client must be authenticated with authorize() first.
+//
+func (s *RequestReceiver) getReadFilter(user string, password string) func(key string) bool {
+
+	admin := s.getEnv().GetAdmin()
+	if admin == nil || admin.matches(user, password) {
+		return func(key string) bool { return true }
+	}
+
+	record, err := s.getUserRecord(user)
+	if err != nil {
+		return func(key string) bool { return false }
+	}
+
+	return func(key string) bool {
+		return record.GetPermission(key) >= RequiredPermission(common.OPCODE_GET, key)
+	}
+}
+
+//
+// Read the record of the user from the repository.
+//
+func (s *RequestReceiver) getUserRecord(user string) (*UserRecord, error) {
+
+	key := UserKey(user)
+
+	server, err := s.getServer(key)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := server.GetValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		return nil, common.NewError(common.AUTH_ERROR, "Unknown user "+user)
+	}
+
+	return parseUserRecord(content)
+}
+
+func (s *RequestReceiver) getEnv() *Env {
+
+	if s.groups != nil {
+		return s.groups.env
+	}
+	return s.server.env
+}
+
+/////////////////////////////////////////////////
+// Client Connection
+/////////////////////////////////////////////////
+
+func (l *clientListener) Accept() (net.Conn, error) {
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &clientConn{Conn: conn, owner: l.owner, since: l.owner.clock.Now()}
+
+	l.owner.mutex.Lock()
+	l.owner.clients[client] = true
+	l.owner.mutex.Unlock()
+
+	return client, nil
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+func (c *clientConn) Close() error {
+
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.owner.mutex.Lock()
+		delete(c.owner.clients, c)
+		c.owner.mutex.Unlock()
+	}
+
+	return c.Conn.Close()
+}
+
+type clientsBySince []*ClientInfo
+
+func (c clientsBySince) Len() int           { return len(c) }
+func (c clientsBySince) Less(i, j int) bool { return c[i].Since.Before(c[j].Since) }
+func (c clientsBySince) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,103 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/couchbase/gometa/common"
+	"strings"
+	"sync"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// RoutingTable maps a key to the consensus group that owns the key.  A key
+// is routed to the group with the longest matching prefix.  An empty prefix
+// matches every key, so it can be used for the default group.
+//
+type RoutingTable struct {
+	mutex  sync.RWMutex
+	routes map[string]string // key : prefix, value : group
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+func NewRoutingTable() *RoutingTable {
+	return &RoutingTable{routes: make(map[string]string)}
+}
+
+//
+// Route the keys with the given prefix to the group.
+//
+func (t *RoutingTable) AddRoute(prefix string, group string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if existing, ok := t.routes[prefix]; ok && existing != group {
+		return common.NewError(common.ARG_ERROR, "Prefix '"+prefix+"' is already routed to group "+existing)
+	}
+
+	t.routes[prefix] = group
+	return nil
+}
+
+func (t *RoutingTable) RemoveRoute(prefix string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.routes, prefix)
+}
+
+//
+// Find the group for the key.  Return false if no prefix
+// matches the key.
+//
+func (t *RoutingTable) FindGroup(key string) (string, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	found := false
+	longest := ""
+	group := ""
+
+	for prefix, g := range t.routes {
+		if strings.HasPrefix(key, prefix) && (!found || len(prefix) > len(longest)) {
+			found = true
+			longest = prefix
+			group = g
+		}
+	}
+
+	return group, found
+}
+
+//
+// Return a copy of the routes (prefix to group).
+//
+func (t *RoutingTable) GetRoutes() map[string]string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	routes := make(map[string]string, len(t.routes))
+	for prefix, group := range t.routes {
+		routes[prefix] = group
+	}
+	return routes
+}
@@ -21,7 +21,6 @@ import (
 	"github.com/couchbase/gometa/message"
 	"github.com/couchbase/gometa/protocol"
 	r "github.com/couchbase/gometa/repository"
-	"log"
 	"runtime/debug"
 	"sync"
 	"time"
@@ -31,64 +30,195 @@ import (
 // Type Declaration
 /////////////////////////////////////////////////////////////////////////////
 
+var requestQueueDepth = common.Metrics.NewGauge("gometa_request_queue_depth",
+	"Number of client requests waiting to be sent to the leader.")
+
 type Server struct {
+	env         *Env
 	repo        *r.Repository
 	log         *r.CommitLog
 	srvConfig   *r.ServerConfig
 	txn         *common.TxnState
 	state       *ServerState
 	site        *protocol.ElectionSite
+	election    *protocol.ElectionState
 	factory     protocol.MsgFactory
 	handler     *action.ServerAction
-	listener    *common.PeerListener
+	listener    common.ConnListener
 	reqListener *RequestListener
+	cmdListener *CommandListener // nil unless the node serves the four-letter commands
 	skillch     chan bool
+	group       *serverGroup // nil unless the server runs a consensus group of GroupServer
+	history     *electionHistory
+	stats       *requestStats
+	changes     *changeFeed
+	backupId    uint64 // last id given to a backup (atomic)
+
+	// mutex protected variable
+	mutex     sync.Mutex
+	isStarted bool
+	isStopped bool
+	donech    chan bool // closed when the server stops running
+	members   string    // members applied from the repository (see loadMembers)
+	preferred time.Time // preferred as the leader until then (see acceptLeadership)
+	isLeading bool
+}
+
+//
+// The resources shared by the consensus groups hosted by a node.
+//
+type serverGroup struct {
+	config *GroupConfig
+	mux    *common.ConnMux
+	demux  *protocol.MessengerDemux
 }
 
 type ServerState struct {
-	incomings chan *protocol.RequestHandle
+	incomings      chan *protocol.RequestHandle
+	untrackMetrics func()
+	handover       *protocol.HandoverState // kept across the elections
 
 	// mutex protected variables
-	mutex     sync.Mutex
-	done      bool
-	status    protocol.PeerStatus
-	pendings  map[uint64]*protocol.RequestHandle       // key : request id
-	proposals map[common.Txnid]*protocol.RequestHandle // key : txnid
+	mutex      sync.Mutex
+	done       bool
+	isClosed   bool // the repository is closed
+	status     protocol.PeerStatus
+	exitReason protocol.ExitReason                      // why this node stops leading or following
+	ready      bool                                     // leading with a quorum of followers, or following after synchronization
+	leaderAddr string                                   // election address of the known leader
+	leader     *protocol.Leader                         // nil unless this node is leading
+	pendings   map[uint64]*protocol.RequestHandle       // key : request id
+	proposals  map[common.Txnid]*protocol.RequestHandle // key : txnid
+	backups    map[uint64]*backupCursor                 // key : backup id
 }
 
-var gServer *Server = nil
-
 /////////////////////////////////////////////////////////////////////////////
 // Main Function
 /////////////////////////////////////////////////////////////////////////////
 
+//
+// Run the server with the given config file until it is terminated.  If the
+// config file is not specified, the server is configured from the command
+// line arguments.
+//
 func RunServer(config string) error {
 
-	err := NewEnv(config)
+	env, err := NewEnv(config)
 	if err != nil {
 		return err
 	}
 
-	for {
-		pauseTime := RunOnce()
-		if !gServer.IsDone() {
-			if pauseTime > 0 {
-				// wait before restart
-				time.Sleep(time.Duration(pauseTime) * time.Millisecond)
-			}
-		} else {
-			break
+	// The server runs alone in the process, so the layers shared by the
+	// servers (e.g. the transport) log like the server.
+	common.SetLogger(env.GetLogger().GetLogger())
+	common.SetLogLevel(env.GetLogger().GetLogLevel())
+
+	if len(env.GetGroups()) != 0 {
+		g, err := newGroupServer(env)
+		if err != nil {
+			return err
 		}
+		if err := g.Start(); err != nil {
+			return err
+		}
+		g.wait()
+		return nil
 	}
 
+	s := newServer(env)
+	s.isStarted = true
+	s.run()
+
 	return nil
 }
 
+//
+// Create a new server with the given configuration.  The server does not
+// run until Start() is called.  More than one server can be created in the
+// same process, as long as they use different addresses and data directories.
+//
+func New(config *Config) (*Server, error) {
+
+	env, err := NewEnvWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newServer(env), nil
+}
+
+//
+// Start running the server.  The server runs in its own goroutine until
+// Stop() is called.
+//
+func (s *Server) Start() error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.isStarted || s.isStopped {
+		return common.NewError(common.SERVER_ERROR, "Server has already been started.")
+	}
+	s.isStarted = true
+
+	go s.run()
+	return nil
+}
+
+//
+// Stop the server.  This function returns after the server has stopped
+// running and released its listeners and repository.
+//
+func (s *Server) Stop() {
+
+	s.mutex.Lock()
+	if s.isStopped {
+		s.mutex.Unlock()
+		<-s.donech
+		return
+	}
+	s.isStopped = true
+	isStarted := s.isStarted
+	s.mutex.Unlock()
+
+	if !isStarted {
+		return
+	}
+
+	s.Terminate()
+	<-s.donech
+}
+
 func (s *Server) GetValue(key string) ([]byte, error) {
 
 	return s.handler.Get(key)
 }
 
+//
+// Tell if the server has bootstrapped and can take client requests.
+//
+func (s *Server) isReady() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state != nil && s.handler != nil
+}
+
+//
+// Return the number of client requests that are not done yet.
+//
+func (s *Server) getOutstandingRequests() int {
+
+	s.mutex.Lock()
+	state := s.state
+	s.mutex.Unlock()
+
+	if state == nil {
+		return 0
+	}
+	return state.getOutstandingRequests()
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Server
 /////////////////////////////////////////////////////////////////////////////
@@ -99,15 +229,26 @@ func (s *Server) GetValue(key string) ([]byte, error) {
 func (s *Server) bootstrap() (err error) {
 
 	// Initialize server state
-	s.state = newServerState()
+	s.mutex.Lock()
+	s.state = newServerState(s.GetMetricLabels())
+	s.mutex.Unlock()
 
 	// Initialize repository service
-	s.repo, err = r.OpenRepository()
+	s.repo, err = r.OpenRepositoryWithName(s.getRepositoryName())
 	if err != nil {
 		return err
 	}
 	s.log = r.NewCommitLog(s.repo)
+	if _, err := s.log.Upgrade(); err != nil {
+		return err
+	}
 	s.srvConfig = r.NewServerConfig(s.repo)
+	s.history.load(s.srvConfig)
+
+	// The administrator may have changed the members.
+	if err := s.loadMembers(); err != nil {
+		return err
+	}
 
 	// Create and initialize new txn state.
 	s.txn = common.NewTxnState()
@@ -122,10 +263,19 @@ func (s *Server) bootstrap() (err error) {
 	}
 	s.txn.InitCurrentTxnid(common.Txnid(lastLoggedTxid))
 
+	// The watch requests get the changes committed from now on.
+	lastCommittedTxid, err := s.srvConfig.GetLastCommittedTxnId()
+	if err != nil {
+		return err
+	}
+	s.changes.reset(lastCommittedTxid)
+
 	// Initialize various callback facility for leader election and
 	// voting protocol.
 	s.factory = message.NewConcreteMsgFactory()
+	s.mutex.Lock()
 	s.handler = action.NewServerAction(s.repo, s.log, s.srvConfig, s, s.txn, s.factory, s)
+	s.mutex.Unlock()
 	s.skillch = make(chan bool, 1) // make it buffered to unblock sender
 	s.site = nil
 
@@ -135,46 +285,100 @@ func (s *Server) bootstrap() (err error) {
 	// node knows it is a leader.  By starting the listener now, it allows the
 	// follower to establish the connection and let the leader handles this
 	// connection at a later time (when it is ready to be a leader).
-	s.listener, err = common.StartPeerListener(GetHostTCPAddr())
+	// A consensus group listens on the TCP connections shared with the
+	// other groups.  The client requests are received by the GroupServer.
+	if s.group != nil {
+		if s.listener, err = s.group.mux.Listen(s.group.config.Name); err != nil {
+			return common.WrapError(common.SERVER_ERROR, "Fail to start listener for group "+s.group.config.Name+".", err)
+		}
+		return nil
+	}
+
+	s.listener, err = s.env.GetTransport().Listen(s.env.GetHostTCPAddr())
 	if err != nil {
 		return common.WrapError(common.SERVER_ERROR, "Fail to start PeerListener.", err)
 	}
 
 	// Start a request listener.
-	s.reqListener, err = StartRequestListener(GetHostRequestAddr(), s)
+	s.reqListener, err = StartRequestListener(s.env.GetHostRequestAddr(), s)
 	if err != nil {
 		return common.WrapError(common.SERVER_ERROR, "Fail to start RequestListener.", err)
 	}
 
+	// Start a listener for the four-letter commands.
+	if addr := s.env.GetHostAdminAddr(); len(addr) != 0 {
+		s.cmdListener, err = startCommandListener(addr, &RequestReceiver{server: s}, s.env.GetTLSConfig())
+		if err != nil {
+			return common.WrapError(common.SERVER_ERROR, "Fail to start CommandListener.", err)
+		}
+	}
+
 	return nil
 }
 
+//
+// Return the name of the repository.  Each consensus group has its
+// own repository.
+//
+func (s *Server) getRepositoryName() string {
+	if s.group != nil {
+		return s.env.GetRepositoryName() + "." + s.group.config.Name
+	}
+	return s.env.GetRepositoryName()
+}
+
 //
 // run election
 //
 func (s *Server) runElection() (leader string, err error) {
 
-	host := GetHostUDPAddr()
-	peers := GetPeerUDPAddr()
+	host := s.env.GetHostUDPAddr()
+	peers := s.env.GetPeerUDPAddr()
 
 	// Create an election site to start leader election.
-	log.Printf("Server.runElection(): Local Server %s start election", host)
-	log.Printf("Server.runElection(): Peer in election")
+	s.env.GetLogger().Infof("Server.runElection(): Local Server %s start election", host)
+	s.env.GetLogger().Infof("Server.runElection(): Peer in election")
 	for _, peer := range peers {
-		log.Printf("	peer : %s", peer)
+		s.env.GetLogger().Infof("	peer : %s", peer)
+	}
+
+	var messenger common.Messenger
+	if s.group != nil {
+		s.env.GetLogger().Infof("Server.runElection(): Group %s", s.group.config.Name)
+		messenger, err = s.group.demux.NewGroupMessenger(s.group.config.Name)
+	} else {
+		messenger, err = protocol.NewElectionMessengerWithTransport(host, s.env.GetElectionTransport(),
+			s.env.GetTransport())
+	}
+	if err != nil {
+		return "", err
 	}
 
-	s.site, err = protocol.CreateElectionSite(host, peers, s.factory, s.handler, false)
+	site, err := protocol.CreateElectionSiteWithMessenger(messenger, peers, s.factory, s.handler, false, s.election)
 	if err != nil {
+		messenger.Close()
 		return "", err
 	}
 
+	// Terminate() closes the election site.  If the server is terminated
+	// before the site is set, the site must be closed here.  Otherwise,
+	// the election would never return.
+	s.state.mutex.Lock()
+	if s.state.done {
+		s.state.mutex.Unlock()
+		site.Close()
+		return "", common.NewError(common.SERVER_ERROR, "Server is terminated.")
+	}
+	s.site = site
+	s.state.mutex.Unlock()
+
 	resultCh := s.site.StartElection()
 	if resultCh == nil {
 		return "", common.NewError(common.SERVER_ERROR, "Election Site is in progress or is closed.")
 	}
 
 	leader, ok := <-resultCh // blocked until leader is elected
+	s.recordElection(leader, ok)
 	if !ok {
 		return "", common.NewError(common.SERVER_ERROR, "Election Fails")
 	}
@@ -187,22 +391,32 @@ func (s *Server) runElection() (leader string, err error) {
 //
 func (s *Server) runServer(leader string) (err error) {
 
-	host := GetHostUDPAddr()
+	host := s.env.GetHostUDPAddr()
 
 	// If this host is the leader, then start the leader server.
 	// Otherwise, start the followerServer.
 	if leader == host {
-		log.Printf("Server.runServer() : Local Server %s is elected as leader. Leading ...", leader)
+		s.env.GetLogger().Log(common.LOG_INFO, "Server.runServer() : Local server is elected as leader. Leading ...", common.LogNode(host))
+		s.state.setLeaderAddr(leader)
 		s.state.setStatus(protocol.LEADING)
-		err = protocol.RunLeaderServer(GetHostTCPAddr(), s.listener, s.state, s.handler, s.factory, s.skillch)
+		s.setLeading(true)
+		err = protocol.RunLeaderServer(s.env.GetHostTCPAddr(), s.listener, s.state, s.handler, s.factory, s.skillch)
+		s.setLeading(false)
 	} else {
-		log.Printf("Server.runServer() : Remote Server %s is elected as leader. Following ...", leader)
+		s.env.GetLogger().Log(common.LOG_INFO, "Server.runServer() : Remote server is elected as leader. Following ...",
+			common.LogNode(host), common.LogPeer(leader))
+		s.state.setLeaderAddr(leader)
 		s.state.setStatus(protocol.FOLLOWING)
-		leaderAddr := findMatchingPeerTCPAddr(leader)
+		leaderAddr := s.env.findMatchingPeerTCPAddr(leader)
 		if len(leaderAddr) == 0 {
 			return common.NewError(common.SERVER_ERROR, "Cannot find matching TCP addr for leader "+leader)
 		}
-		err = protocol.RunFollowerServer(GetHostTCPAddr(), leaderAddr, s.state, s.handler, s.factory, s.skillch)
+		var dialer common.Dialer = s.env.GetTransport()
+		if s.group != nil {
+			dialer = s.group.mux.GroupDialer(s.group.config.Name)
+		}
+		err = protocol.RunFollowerServerWithDialer(s.env.GetHostTCPAddr(), leaderAddr, s.state, s.handler,
+			s.factory, s.skillch, dialer)
 	}
 
 	return err
@@ -213,19 +427,32 @@ func (s *Server) runServer(leader string) (err error) {
 //
 func (s *Server) Terminate() {
 
-	s.state.mutex.Lock()
-	defer s.state.mutex.Unlock()
+	s.mutex.Lock()
+	state := s.state
+	s.mutex.Unlock()
 
-	if s.state.done {
+	if state == nil {
 		return
 	}
 
-	s.state.done = true
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
 
-	s.site.Close()
-	s.site = nil
+	if state.done {
+		return
+	}
+
+	state.done = true
+
+	if s.site != nil {
+		s.site.Close()
+		s.site = nil
+	}
 
-	s.skillch <- true // kill leader/follower server
+	select {
+	case s.skillch <- true: // kill leader/follower server
+	default: // the server is being killed already (see restart)
+	}
 }
 
 //
@@ -233,10 +460,23 @@ func (s *Server) Terminate() {
 //
 func (s *Server) IsDone() bool {
 
-	s.state.mutex.Lock()
-	defer s.state.mutex.Unlock()
+	s.mutex.Lock()
+	state := s.state
+	isStopped := s.isStopped
+	s.mutex.Unlock()
+
+	if isStopped {
+		return true
+	}
+
+	if state == nil {
+		return false
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
 
-	return s.state.done
+	return state.done
 }
 
 //
@@ -247,6 +487,9 @@ func (s *Server) cleanupState() {
 	s.state.mutex.Lock()
 	defer s.state.mutex.Unlock()
 
+	s.state.isClosed = true
+	s.state.untrackMetrics()
+
 	common.SafeRun("Server.cleanupState()",
 		func() {
 			if s.listener != nil {
@@ -261,6 +504,21 @@ func (s *Server) cleanupState() {
 			}
 		})
 
+	common.SafeRun("Server.cleanupState()",
+		func() {
+			if s.cmdListener != nil {
+				s.cmdListener.Close()
+			}
+		})
+
+	common.SafeRun("Server.cleanupState()",
+		func() {
+			for id, cursor := range s.state.backups {
+				cursor.iter.Close()
+				delete(s.state.backups, id)
+			}
+		})
+
 	common.SafeRun("Server.cleanupState()",
 		func() {
 			if s.repo != nil {
@@ -310,58 +568,121 @@ func (s *Server) cleanupState() {
 	}
 }
 
+//
+// Create a new server
+//
+func newServer(env *Env) *Server {
+
+	return &Server{env: env,
+		election:  protocol.NewElectionState(),
+		history:   newElectionHistory(env.GetLogger()),
+		stats:     newRequestStats(env.GetClock()),
+		changes:   newChangeFeed(env.GetClock()),
+		isStarted: false,
+		isStopped: false,
+		donech:    make(chan bool)}
+}
+
+//
+// Run the server until it is terminated.  The server is restarted
+// if it stops running due to error.
+//
+func (s *Server) run() {
+
+	defer close(s.donech)
+
+	setDefaultServer(s)
+	defer resetDefaultServer(s)
+
+	for {
+		pauseTime := s.runOnce()
+		if !s.IsDone() {
+			if pauseTime > 0 {
+				// wait before restart
+				s.env.GetClock().Sleep(time.Duration(pauseTime) * time.Millisecond)
+			}
+		} else {
+			break
+		}
+	}
+}
+
+//
+// Make the server the default server if there is none.
+//
+func setDefaultServer(s *Server) {
+	gDefaultMutex.Lock()
+	defer gDefaultMutex.Unlock()
+
+	if gDefaultServer == nil {
+		gDefaultServer = s
+	}
+}
+
+//
+// Clear the default server if it is the given server.
+//
+func resetDefaultServer(s *Server) {
+	gDefaultMutex.Lock()
+	defer gDefaultMutex.Unlock()
+
+	if gDefaultServer == s {
+		gDefaultServer = nil
+	}
+}
+
 //
 // Run the server until it stop.  Will not attempt to re-run.
 //
-func RunOnce() int {
+func (s *Server) runOnce() int {
 
-	log.Printf("Server.RunOnce() : Start Running Server")
+	s.env.GetLogger().Infof("Server.runOnce() : Start Running Server")
 
 	pauseTime := 0
-	gServer = new(Server)
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("panic in Server.runOnce() : %s\n", r)
+			s.env.GetLogger().Errorf("panic in Server.runOnce() : %s", r)
 		}
 
-		log.Printf("RunOnce() terminates : Diagnostic Stack ...")
-		log.Printf("%s", debug.Stack())
+		s.env.GetLogger().Tracef("Server.runOnce() terminates : Diagnostic Stack ...")
+		s.env.GetLogger().Tracef("%s", debug.Stack())
 
 		common.SafeRun("Server.cleanupState()",
 			func() {
-				gServer.cleanupState()
+				s.cleanupState()
 			})
 	}()
 
-	err := gServer.bootstrap()
+	err := s.bootstrap()
 	if err != nil {
 		pauseTime = 200
 	}
 
 	// Check if the server has been terminated explicitly. If so, don't run.
-	if !gServer.IsDone() {
+	if !s.IsDone() {
 
 		// runElection() finishes if there is an error, election result is known or
 		// it being terminated. Unless being killed explicitly, a goroutine
 		// will continue to run to responds to other peer election request
-		leader, err := gServer.runElection()
+		leader, err := s.runElection()
 		if err != nil {
-			log.Printf("Server.RunOnce() : Error Encountered During Election : %s", err.Error())
+			s.env.GetLogger().Warnf("Server.runOnce() : Error Encountered During Election : %s", err.Error())
 			pauseTime = 100
 		} else {
 
 			// Check if the server has been terminated explicitly. If so, don't run.
-			if !gServer.IsDone() {
+			if !s.IsDone() {
 				// runServer() is done if there is an error	or being terminated explicitly (killch)
-				err := gServer.runServer(leader)
+				err := s.runServer(leader)
 				if err != nil {
-					log.Printf("Server.RunOnce() : Error Encountered From Server : %s", err.Error())
+					s.env.GetLogger().Warnf("Server.runOnce() : Error Encountered From Server : %s", err.Error())
 				}
+				s.recordExit(err)
 			}
 		}
 	} else {
-		log.Printf("Server.RunOnce(): Server has been terminated explicitly. Terminate.")
+		s.env.GetLogger().Infof("Server.runOnce(): Server has been terminated explicitly. Terminate.")
 	}
 
 	return pauseTime
@@ -371,9 +692,8 @@ func RunOnce() int {
 // QuorumVerifier
 /////////////////////////////////////////////////////////////////////////////
 
-func (s *Server) HasQuorum(count int) bool {
-	ensembleSz := s.handler.GetEnsembleSize()
-	return count > int(ensembleSz/2)
+func (s *Server) HasQuorum(voters []string) bool {
+	return s.env.GetQuorumVerifier().HasQuorum(voters)
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -383,7 +703,7 @@ func (s *Server) HasQuorum(count int) bool {
 //
 // Create a new ServerState
 //
-func newServerState() *ServerState {
+func newServerState(labels common.MetricLabels) *ServerState {
 
 	incomings := make(chan *protocol.RequestHandle, common.MAX_PROPOSALS)
 	pendings := make(map[uint64]*protocol.RequestHandle)
@@ -391,9 +711,15 @@ func newServerState() *ServerState {
 	state := &ServerState{incomings: incomings,
 		pendings:  pendings,
 		proposals: proposals,
+		backups:   make(map[uint64]*backupCursor),
+		handover:  &protocol.HandoverState{},
 		status:    protocol.ELECTING,
 		done:      false}
 
+	state.untrackMetrics = requestQueueDepth.With(labels).Track(func() int64 {
+		return int64(len(incomings))
+	})
+
 	return state
 }
 
@@ -411,6 +737,75 @@ func (s *ServerState) setStatus(status protocol.PeerStatus) {
 	s.status = status
 }
 
+func (s *ServerState) getExitReason() protocol.ExitReason {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.exitReason
+}
+
+//
+// Remember why this node stops leading or following (see protocol.ExitTracker).
+//
+func (s *ServerState) SetExitReason(reason protocol.ExitReason) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.exitReason = reason
+}
+
+//
+// Remember if this node can serve the client requests (see protocol.ReadyTracker).
+//
+func (s *ServerState) SetReady(ready bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ready = ready
+}
+
+func (s *ServerState) setLeaderAddr(leaderAddr string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.leaderAddr = leaderAddr
+}
+
+func (s *ServerState) getLeader() (string, *protocol.Leader) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.leaderAddr, s.leader
+}
+
+//
+// Remember the leader while this node is leading (see protocol.LeaderTracker).
+//
+func (s *ServerState) SetLeader(leader *protocol.Leader) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.leader = leader
+}
+
+//
+// Keep the handovers of the leadership across the elections (see
+// protocol.HandoverTracker).
+//
+func (s *ServerState) GetHandoverState() *protocol.HandoverState {
+	return s.handover
+}
+
+//
+// Return the number of client requests that are not done yet.
+//
+func (s *ServerState) getOutstandingRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.incomings) + len(s.pendings) + len(s.proposals)
+}
+
 func (s *ServerState) AddPendingRequest(handle *protocol.RequestHandle) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -429,10 +824,10 @@ func (s *ServerState) GetRequestChannel() <-chan *protocol.RequestHandle {
 /////////////////////////////////////////////////////////////////////////////
 
 //
-// Create a new request handle
+// Create a new request handle, queued at the time of the clock
 //
-func newRequestHandle(req protocol.RequestMsg) *protocol.RequestHandle {
-	handle := &protocol.RequestHandle{Request: req, Err: nil}
+func newRequestHandle(req protocol.RequestMsg, clock common.Clock) *protocol.RequestHandle {
+	handle := &protocol.RequestHandle{Request: req, Err: nil, Queued: clock.Now()}
 	handle.CondVar = sync.NewCond(&handle.Mutex)
 	return handle
 }
@@ -449,6 +844,7 @@ func (s *Server) UpdateStateOnNewProposal(proposal protocol.ProposalMsg) {
 	fid := proposal.GetFid()
 	reqId := proposal.GetReqId()
 	txnid := proposal.GetTxnid()
+	opCode := common.OpCode(proposal.GetOpCode())
 
 	// If this host is the one that sends the request to the leader
 	if fid == s.handler.GetFollowerId() {
@@ -460,7 +856,19 @@ func (s *Server) UpdateStateOnNewProposal(proposal protocol.ProposalMsg) {
 		handle, ok := s.state.pendings[reqId]
 		if ok {
 			delete(s.state.pendings, reqId)
-			s.state.proposals[common.Txnid(txnid)] = handle
+
+			// The request is aborted (or done without a proposal).
+			// Notify the waiting goroutine now.
+			if opCode == common.OPCODE_ABORT || opCode == common.OPCODE_RESPONSE {
+				handle.CondVar.L.Lock()
+				defer handle.CondVar.L.Unlock()
+
+				handle.Err = protocol.GetProposalError(proposal)
+
+				handle.CondVar.Signal()
+			} else {
+				s.state.proposals[common.Txnid(txnid)] = handle
+			}
 		}
 	}
 }
@@ -470,7 +878,7 @@ func (s *Server) UpdateStateOnNewProposal(proposal protocol.ProposalMsg) {
 //
 func (s *Server) UpdateStateOnCommit(txnid common.Txnid, key string) {
 
-	log.Printf("Server.UpdateStateOnCommit(): Committing proposal %d key %s.", txnid, key)
+	s.env.GetLogger().Log(common.LOG_DEBUG, "Server.UpdateStateOnCommit(): Committing proposal", common.LogTxnid(txnid), common.LogKey(key))
 
 	s.state.mutex.Lock()
 	defer s.state.mutex.Unlock()
@@ -481,7 +889,7 @@ func (s *Server) UpdateStateOnCommit(txnid common.Txnid, key string) {
 	handle, ok := s.state.proposals[txnid]
 
 	if ok {
-		log.Printf("Server.UpdateStateOnCommit(): Notify client for proposal %d", txnid)
+		s.env.GetLogger().Debugf("Server.UpdateStateOnCommit(): Notify client for proposal %d", txnid)
 
 		delete(s.state.proposals, txnid)
 
@@ -493,7 +901,15 @@ func (s *Server) UpdateStateOnCommit(txnid common.Txnid, key string) {
 }
 
 func (s *Server) GetStatus() protocol.PeerStatus {
-	return s.state.getStatus()
+
+	s.mutex.Lock()
+	state := s.state
+	s.mutex.Unlock()
+
+	if state == nil {
+		return protocol.ELECTING
+	}
+	return state.getStatus()
 }
 
 func (s *Server) UpdateWinningEpoch(epoch uint32) {
@@ -507,17 +923,59 @@ func (s *Server) UpdateWinningEpoch(epoch uint32) {
 }
 
 func (s *Server) GetPeerUDPAddr() []string {
-	return GetPeerUDPAddr()
+	return s.env.GetPeerUDPAddr()
 }
 
 func (s *Server) GetHostTCPAddr() string {
-	return GetHostTCPAddr()
+	return s.env.GetHostTCPAddr()
 }
 
 func (s *Server) GetEnsembleSize() uint64 {
-	return uint64(len(GetPeerUDPAddr())) + 1 // including myself
+	return uint64(len(s.env.GetPeerUDPAddr())) + 1 // including myself
 }
 
 func (s *Server) GetFollowerId() string {
-	return GetHostTCPAddr()
+	return s.env.GetHostTCPAddr()
+}
+
+func (s *Server) GetPriority() uint32 {
+	if s.isPreferred() {
+		return s.env.getPreferredPriority()
+	}
+	if s.group != nil {
+		return s.env.getGroupPriority(s.group.config, s.env.GetHostUDPAddr(), s.env.GetHostPriority())
+	}
+	return s.env.GetHostPriority()
+}
+
+func (s *Server) GetFollowerPriority(fid string) uint32 {
+	if s.group != nil {
+		return s.env.getGroupPriority(s.group.config, s.env.findMatchingPeerUDPAddr(fid),
+			s.env.findMatchingPeerPriority(fid))
+	}
+	return s.env.findMatchingPeerPriority(fid)
+}
+
+func (s *Server) GetSlowFollowerPolicy() *protocol.SlowFollowerPolicy {
+	return s.env.GetSlowFollowerPolicy()
+}
+
+func (s *Server) GetClock() common.Clock {
+	return s.env.GetClock()
+}
+
+func (s *Server) GetLogger() *common.NodeLogger {
+	return s.env.GetLogger()
+}
+
+func (s *Server) GetTracer() *common.NodeTracer {
+	return s.env.GetTracer()
+}
+
+func (s *Server) GetMetricLabels() common.MetricLabels {
+	labels := common.MetricLabels{Node: s.env.GetHostTCPAddr()}
+	if s.group != nil {
+		labels.Group = s.group.config.Name
+	}
+	return labels
 }
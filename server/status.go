@@ -0,0 +1,186 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/protocol"
+	http "net/http"
+	"sort"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// The status of a node, or of a consensus group hosted by the node.
+// The followers, the watchers and the outstanding proposals are only
+// known by the leader.
+//
+type NodeStatus struct {
+	Group              string // empty unless the node hosts multiple consensus groups
+	Node               string // election address of the node
+	Status             string // electing, leading, following or watching
+	Leader             string // election address of the known leader
+	Ready              bool   // the leader has a quorum, or the follower has synchronized
+	CurrentEpoch       uint32
+	AcceptedEpoch      uint32
+	LastLoggedTxnid    common.Txnid
+	LastCommittedTxnid common.Txnid
+	LogCompactedTxnid  common.Txnid // the commit log is compacted up to this txnid
+	Proposals          int          // outstanding proposals
+	Followers          []*protocol.PeerProgress
+	Watchers           []*protocol.PeerProgress
+	Elections          []*ElectionRecord // recent elections of the node, oldest first
+}
+
+type StatusReply struct {
+	Status []*NodeStatus // one per consensus group
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Return the status of the server.
+//
+func (s *Server) GetNodeStatus() *NodeStatus {
+
+	s.mutex.Lock()
+	state := s.state
+	handler := s.handler
+	srvConfig := s.srvConfig
+	s.mutex.Unlock()
+
+	status := &NodeStatus{Node: s.env.GetHostUDPAddr(),
+		Status: protocol.ELECTING.String()}
+	if s.group != nil {
+		status.Group = s.group.config.Name
+	}
+	status.Elections = s.history.getRecords()
+
+	if state == nil || handler == nil {
+		return status
+	}
+
+	// The repository is closed once the server stops running, so read
+	// it while holding the mutex of the state.
+	state.mutex.Lock()
+	status.Status = state.status.String()
+	status.Leader = state.leaderAddr
+	status.Ready = state.ready
+	leader := state.leader
+	if !state.isClosed {
+		status.CurrentEpoch, _ = handler.GetCurrentEpoch()
+		status.AcceptedEpoch, _ = handler.GetAcceptedEpoch()
+		status.LastLoggedTxnid, _ = handler.GetLastLoggedTxid()
+		status.LastCommittedTxnid, _ = handler.GetLastCommittedTxid()
+		status.LogCompactedTxnid = srvConfig.GetLogCompactedTxid()
+	}
+	state.mutex.Unlock()
+
+	if leader != nil {
+		leaderStatus, err := leader.GetStatus()
+		if err != nil {
+			s.env.GetLogger().Warnf("Server.GetNodeStatus() : Fail to get the status of the leader : %s", err.Error())
+			return status
+		}
+
+		status.Proposals = leaderStatus.Proposals
+		status.Followers = leaderStatus.Followers
+		status.Watchers = leaderStatus.Watchers
+	}
+
+	return status
+}
+
+//
+// Return the status of each consensus group, sorted by group name.
+//
+func (g *GroupServer) GetNodeStatus() []*NodeStatus {
+
+	g.mutex.Lock()
+	names := make([]string, 0, len(g.servers))
+	for name := range g.servers {
+		names = append(names, name)
+	}
+	g.mutex.Unlock()
+
+	sort.Strings(names)
+
+	result := make([]*NodeStatus, 0, len(names))
+	for _, name := range names {
+		if s := g.GetGroupServer(name); s != nil {
+			result = append(result, s.GetNodeStatus())
+		}
+	}
+	return result
+}
+
+//
+// Return the status of the node.  If the ensemble has an administrator,
+// only the administrator can get the status.
+//
+func (s *RequestReceiver) GetStatus(req *Request, reply **StatusReply) error {
+
+	if admin := s.getEnv().GetAdmin(); admin != nil && !admin.matches(req.User, req.Password) {
+		return common.NewError(common.AUTH_ERROR, "Only the administrator can get the status of the node")
+	}
+
+	*reply = &StatusReply{Status: s.getNodeStatus()}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+func (s *RequestReceiver) getNodeStatus() []*NodeStatus {
+
+	if s.groups != nil {
+		return s.groups.GetNodeStatus()
+	}
+	return []*NodeStatus{s.server.GetNodeStatus()}
+}
+
+//
+// Write the status of the node in JSON.  If the ensemble has an
+// administrator, the request must carry the credential of the
+// administrator (basic authentication).
+//
+func (s *RequestReceiver) serveStatus(w http.ResponseWriter, r *http.Request) {
+
+	if admin := s.getEnv().GetAdmin(); admin != nil {
+		user, password, _ := r.BasicAuth()
+		if !admin.matches(user, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gometa"`)
+			http.Error(w, "Only the administrator can get the status of the node", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	content, err := json.MarshalIndent(&StatusReply{Status: s.getNodeStatus()}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
@@ -0,0 +1,73 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/couchbase/gometa/common"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+type TraceRequest struct {
+	Threshold time.Duration // only the requests that take at least this long (default is SLOW_REQUEST_THRESHOLD)
+	Limit     int           // maximum number of requests (default is MAX_SLOW_REQUESTS)
+	User      string        // credential of the client, if the ensemble has an administrator
+	Password  string
+}
+
+type TraceReply struct {
+	Traces []*common.Trace // most recent first
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Return the recent slow requests traced by the node.  The node only has
+// the spans that it records: a follower does not have the spans of the
+// leader, and the other way around.  If the ensemble has an administrator,
+// only the administrator can get the requests.
+//
+func (s *RequestReceiver) GetSlowRequests(req *TraceRequest, reply **TraceReply) error {
+
+	env := s.getEnv()
+	if admin := env.GetAdmin(); admin != nil && !admin.matches(req.User, req.Password) {
+		return common.NewError(common.AUTH_ERROR, "Only the administrator can get the slow requests")
+	}
+
+	exporter, ok := env.GetTracer().GetSpanExporter().(*common.RingExporter)
+	if !ok {
+		return common.NewError(common.INVALID_REQUEST_ERROR, "The spans are not kept in memory by this node")
+	}
+
+	threshold := req.Threshold
+	if threshold <= 0 {
+		threshold = common.SLOW_REQUEST_THRESHOLD * time.Millisecond
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > common.MAX_SLOW_REQUESTS {
+		limit = common.MAX_SLOW_REQUESTS
+	}
+
+	// The exporter of the process may have the spans of other servers.
+	*reply = &TraceReply{Traces: exporter.GetNodeSlowTraces(env.GetHostTCPAddr(), threshold, limit)}
+	return nil
+}
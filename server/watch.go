@@ -0,0 +1,301 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"strings"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+type ListRequest struct {
+	Prefix   string
+	User     string // credential of the client, if the ensemble has an administrator
+	Password string
+}
+
+type ListReply struct {
+	Entries []*Entry
+	Txnid   uint64 // last committed txnid before the keys are read (see WatchRequest)
+}
+
+type Entry struct {
+	Key   string
+	Value []byte
+}
+
+//
+// Wait for the changes to the keys with the prefix.  The client sends
+// the next request with Since set to the Txnid of the reply, so that no
+// change is missed.  To follow a prefix from a consistent state, list the
+// keys first and watch from the Txnid of the ListReply (a change can then
+// be seen in both).
+//
+type WatchRequest struct {
+	Prefix   string
+	Since    uint64 // return the changes committed after this txnid (0 : after the request arrives)
+	Timeout  int    // maximum time to wait for a change (millisecond, at most WATCH_TIMEOUT)
+	User     string // credential of the client, if the ensemble has an administrator
+	Password string
+}
+
+//
+// The changes committed after the txnid of the request.  Events is empty if
+// there is no change before the timeout.
+//
+type WatchReply struct {
+	Events []*WatchEvent
+	Txnid  uint64 // txnid for the next request
+}
+
+type WatchEvent struct {
+	Txnid  uint64
+	OpCode string // Add, Set or Delete
+	Key    string
+	Value  []byte // nil if the key is deleted
+}
+
+//
+// The recent changes committed by a server (at most WATCH_HISTORY_SIZE).
+// The feed has every change committed after the start txnid.
+//
+type changeFeed struct {
+	mutex   sync.Mutex
+	events  []*WatchEvent
+	start   common.Txnid
+	last    common.Txnid
+	started bool
+	notify  chan bool    // closed when a change is added
+	clock   common.Clock // clock of the server
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// RequestReceiver
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Return the keys with the prefix (and their values), in key order.  If
+// the client authenticates as a user, the keys that the user cannot read
+// are skipped.  If the node hosts multiple consensus groups, the prefix
+// must be owned by a single group.
+//
+func (s *RequestReceiver) List(req *ListRequest, reply **ListReply) error {
+
+	server, err := s.getServer(req.Prefix)
+	if err != nil {
+		return err
+	}
+
+	if server.IsDone() {
+		return common.NewError(common.SERVER_ERROR, "Server is terminated. Cannot process new request.")
+	}
+
+	if err := s.authorize(&Request{Key: req.Prefix, User: req.User, Password: req.Password}, common.OPCODE_GET); err != nil {
+		return err
+	}
+	canRead := s.getReadFilter(req.User, req.Password)
+
+	txnid, keys, values, err := server.list(req.Prefix)
+	if err != nil {
+		return err
+	}
+
+	result := &ListReply{Txnid: uint64(txnid)}
+	for i, key := range keys {
+		if canRead(key) {
+			result.Entries = append(result.Entries, &Entry{Key: key, Value: values[i]})
+		}
+	}
+
+	*reply = result
+	return nil
+}
+
+//
+// Wait until a change to the keys with the prefix is committed after the
+// txnid of the request, or until the timeout.  Return COMPACTED_ERROR if
+// the node does not have the changes anymore (e.g. the client falls
+// behind, or the node restarts).  The client must then list the keys again.
+//
+func (s *RequestReceiver) Watch(req *WatchRequest, reply **WatchReply) error {
+
+	server, err := s.getServer(req.Prefix)
+	if err != nil {
+		return err
+	}
+
+	if server.IsDone() {
+		return common.NewError(common.SERVER_ERROR, "Server is terminated. Cannot process new request.")
+	}
+
+	if err := s.authorize(&Request{Key: req.Prefix, User: req.User, Password: req.Password}, common.OPCODE_GET); err != nil {
+		return err
+	}
+	canRead := s.getReadFilter(req.User, req.Password)
+
+	timeout := common.WATCH_TIMEOUT * time.Millisecond
+	if req.Timeout > 0 && time.Duration(req.Timeout)*time.Millisecond < timeout {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+
+	events, txnid, err := server.changes.wait(func(key string) bool {
+		return strings.HasPrefix(key, req.Prefix) && canRead(key)
+	}, common.Txnid(req.Since), timeout, server.donech)
+	if err != nil {
+		return err
+	}
+
+	*reply = &WatchReply{Events: events, Txnid: uint64(txnid)}
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Server
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Callback when a change is committed (see action.CommitTracker)
+//
+func (s *Server) OnCommitted(txid common.Txnid, op common.OpCode, key string, content []byte) {
+
+	event := &WatchEvent{Txnid: uint64(txid),
+		OpCode: common.GetOpCodeStr(op),
+		Key:    key,
+		Value:  content}
+	if op == common.OPCODE_DELETE {
+		event.Value = nil
+	}
+
+	s.changes.add(event)
+}
+
+//
+// Return the last committed txnid, and the keys with the prefix with their
+// values.
+//
+func (s *Server) list(prefix string) (common.Txnid, []string, [][]byte, error) {
+
+	txnid, err := s.handler.GetLastCommittedTxid()
+	if err != nil {
+		return common.Txnid(0), nil, nil, err
+	}
+
+	keys, values, err := s.handler.List(prefix)
+	if err != nil {
+		return common.Txnid(0), nil, nil, err
+	}
+	return txnid, keys, values, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// changeFeed
+/////////////////////////////////////////////////////////////////////////////
+
+func newChangeFeed(clock common.Clock) *changeFeed {
+	return &changeFeed{notify: make(chan bool), clock: clock}
+}
+
+//
+// Start the feed from the last committed txnid of the repository.  The
+// changes kept so far are dropped, unless the repository has not changed
+// since (e.g. the server restarts after an error).
+//
+func (f *changeFeed) reset(lastCommitted common.Txnid) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.started && f.last == lastCommitted {
+		return
+	}
+
+	f.started = true
+	f.events = nil
+	f.start = lastCommitted
+	f.last = lastCommitted
+}
+
+func (f *changeFeed) add(event *WatchEvent) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.events = append(f.events, event)
+	f.last = common.Txnid(event.Txnid)
+
+	if len(f.events) > common.WATCH_HISTORY_SIZE {
+		dropped := len(f.events) - common.WATCH_HISTORY_SIZE
+		f.start = common.Txnid(f.events[dropped-1].Txnid)
+		f.events = f.events[dropped:]
+	}
+
+	close(f.notify)
+	f.notify = make(chan bool)
+}
+
+//
+// Wait for the changes committed after the given txnid that match the
+// filter.  Return the changes, and the txnid to wait from next time.
+//
+func (f *changeFeed) wait(match func(key string) bool, since common.Txnid, timeout time.Duration,
+	donech <-chan bool) ([]*WatchEvent, common.Txnid, error) {
+
+	timer := f.clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	f.mutex.Lock()
+	if since == common.Txnid(0) {
+		since = f.last
+	}
+	f.mutex.Unlock()
+
+	for {
+		f.mutex.Lock()
+		if common.CompareTxnid(f.start, since) == common.MORE_RECENT {
+			f.mutex.Unlock()
+			return nil, common.Txnid(0), common.NewError(common.COMPACTED_ERROR,
+				fmt.Sprintf("The changes after txnid %d are not kept anymore", uint64(since)))
+		}
+
+		var result []*WatchEvent
+		for _, event := range f.events {
+			if common.CompareTxnid(common.Txnid(event.Txnid), since) == common.MORE_RECENT && match(event.Key) {
+				result = append(result, event)
+			}
+		}
+		if common.CompareTxnid(f.last, since) == common.MORE_RECENT {
+			since = f.last
+		}
+		notify := f.notify
+		f.mutex.Unlock()
+
+		if len(result) != 0 {
+			return result, since, nil
+		}
+
+		select {
+		case <-notify:
+		case <-timer.Chan():
+			return nil, since, nil
+		case <-donech:
+			return nil, common.Txnid(0), common.NewError(common.SERVER_ERROR, "Server is terminated. Cannot process new request.")
+		}
+	}
+}
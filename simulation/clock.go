@@ -0,0 +1,264 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulation
+
+import (
+	"github.com/couchbase/gometa/common"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// FakeClock implements common.Clock.  The time only moves when the
+// simulation advances the clock.  The timers and tickers fire in the
+// order of their deadline (and then in the order of creation), so the
+// timeouts of the protocol (e.g. BALLOT_TIMEOUT) are reproducible.
+//
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer // active timers
+	nextId uint64
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	id       uint64
+	c        chan time.Time
+	deadline time.Time
+	period   time.Duration // non-zero for a ticker
+	active   bool
+}
+
+type fakeTicker struct {
+	timer *fakeTimer
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// FakeClock
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a new FakeClock starting at the given time.
+//
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start,
+		timers: nil,
+		nextId: 0}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).Chan()
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) common.Timer {
+	return c.newTimer(d, 0)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) common.Ticker {
+	if d <= 0 {
+		panic("FakeClock.NewTicker() : non-positive interval")
+	}
+	return &fakeTicker{timer: c.newTimer(d, d)}
+}
+
+//
+// Move the clock forward by the given duration.  The timers expiring
+// in the meantime fire in order.
+//
+func (c *FakeClock) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
+
+//
+// Move the clock forward to the given time.  The clock never moves
+// backward.
+//
+func (c *FakeClock) AdvanceTo(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for {
+		timer := c.nextTimer()
+		if timer == nil || timer.deadline.After(t) {
+			break
+		}
+
+		if timer.deadline.After(c.now) {
+			c.now = timer.deadline
+		}
+		timer.fire(c.now)
+	}
+
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+//
+// Return the deadline of the next timer to fire.
+//
+func (c *FakeClock) NextDeadline() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	timer := c.nextTimer()
+	if timer == nil {
+		return time.Time{}, false
+	}
+	return timer.deadline, true
+}
+
+//
+// Return the timer with the earliest deadline.  The caller must
+// hold the mutex.
+//
+func (c *FakeClock) nextTimer() *fakeTimer {
+
+	var next *fakeTimer
+	for _, timer := range c.timers {
+		if next == nil ||
+			timer.deadline.Before(next.deadline) ||
+			(timer.deadline.Equal(next.deadline) && timer.id < next.id) {
+			next = timer
+		}
+	}
+	return next
+}
+
+func (c *FakeClock) newTimer(d time.Duration, period time.Duration) *fakeTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nextId++
+	timer := &fakeTimer{clock: c,
+		id:       c.nextId,
+		c:        make(chan time.Time, 1),
+		deadline: c.now.Add(d),
+		period:   period,
+		active:   true}
+	c.timers = append(c.timers, timer)
+
+	return timer
+}
+
+//
+// Remove the timer from the active timers.  The caller must
+// hold the mutex.
+//
+func (c *FakeClock) remove(timer *fakeTimer) {
+	for i, t := range c.timers {
+		if t == timer {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// fakeTimer
+/////////////////////////////////////////////////////////////////////////////
+
+func (t *fakeTimer) Chan() <-chan time.Time {
+	return t.c
+}
+
+//
+// Stop the timer.  A stale expiration is removed from the channel,
+// such that the channel does not fire after Stop() or Reset().
+//
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	wasActive := t.active
+	if t.active {
+		t.active = false
+		t.clock.remove(t)
+	}
+	t.drain()
+
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	wasActive := t.active
+	t.drain()
+	t.deadline = t.clock.now.Add(d)
+	if !t.active {
+		t.active = true
+		t.clock.timers = append(t.clock.timers, t)
+	}
+
+	return wasActive
+}
+
+//
+// Fire the timer.  Like time.Ticker, the tick is dropped if the
+// receiver has not consumed the previous one.  The caller must hold
+// the mutex of the clock.
+//
+func (t *fakeTimer) fire(now time.Time) {
+
+	select {
+	case t.c <- now:
+	default:
+	}
+
+	if t.period > 0 {
+		t.deadline = t.deadline.Add(t.period)
+	} else {
+		t.active = false
+		t.clock.remove(t)
+	}
+}
+
+func (t *fakeTimer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// fakeTicker
+/////////////////////////////////////////////////////////////////////////////
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.timer.Chan()
+}
+
+func (t *fakeTicker) Stop() {
+	t.timer.Stop()
+}
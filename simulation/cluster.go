@@ -0,0 +1,513 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulation
+
+import (
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/protocol"
+	"github.com/couchbase/gometa/server"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Options of a simulated cluster.
+//
+type Options struct {
+	Nodes             int           // number of nodes in the ensemble
+	Seed              int64         // seed of the faults and delays
+	DropRate          float64       // probability that a datagram is dropped
+	MinDelay          time.Duration // minimum delay of a message
+	MaxDelay          time.Duration // maximum delay of a message
+	Settle            time.Duration // real time given to the goroutines at each step
+	MaxStep           time.Duration // maximum (fake) time elapsed at each step
+	ElectionTransport string        // udp (default) or tcp
+	BasePort          int           // first port of the (simulated) addresses
+	Secret            string        // secret for authenticating the messages (optional)
+}
+
+//
+// Cluster runs an ensemble of servers in the current process, on top
+// of a SimNetwork and a FakeClock.  The cluster is driven by a scheduler:
+// at each step, the goroutines of the servers are given a short (real)
+// time to settle, then the messages that are due are delivered.  When no
+// message is due, the fake clock jumps to the next message or timer
+// (by MaxStep at most).  As a result, the timeouts of the protocol fire
+// in a reproducible order, and a scenario runs much faster than on the
+// wall clock.
+//
+// The faults are drawn from a seeded random source, so the same seed
+// gives the same faults for the same sequence of messages.  The
+// interleaving of the goroutines within a step is left to the Go
+// runtime.
+//
+// The fake clock is the clock of the servers of the cluster (see
+// Config.Clock).  The other servers in the process keep their own
+// clock.
+//
+type Cluster struct {
+	options Options
+	clock   *FakeClock
+	network *SimNetwork
+	dataDir string
+	configs []*server.Config
+
+	// mutex protected variable
+	mutex   sync.Mutex
+	servers []*server.Server // nil if the node is down
+}
+
+//
+// The response to a client request.
+//
+type response struct {
+	result []byte
+	err    error
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a new cluster.  The nodes are not started.
+//
+func NewCluster(options Options) (*Cluster, error) {
+
+	if options.Nodes <= 0 {
+		return nil, common.NewError(common.SERVER_CONFIG_ERROR, "Cluster : Number of nodes must be positive")
+	}
+	if options.Settle <= 0 {
+		options.Settle = time.Duration(common.SIMULATION_SETTLE_TIME) * time.Millisecond
+	}
+	if options.MaxStep <= 0 {
+		options.MaxStep = time.Duration(common.SIMULATION_MAX_STEP) * time.Millisecond
+	}
+	if options.BasePort <= 0 {
+		options.BasePort = common.SIMULATION_BASE_PORT
+	}
+
+	dataDir, err := ioutil.TempDir("", "gometa-simulation")
+	if err != nil {
+		return nil, common.WrapError(common.SERVER_ERROR, "Cluster : Fail to create data directory.", err)
+	}
+
+	clock := NewFakeClock(time.Now())
+	network := NewSimNetwork(clock, options.Seed)
+	network.SetDropRate(options.DropRate)
+	network.SetDelay(options.MinDelay, options.MaxDelay)
+
+	c := &Cluster{options: options,
+		clock:   clock,
+		network: network,
+		dataDir: dataDir,
+		configs: make([]*server.Config, options.Nodes),
+		servers: make([]*server.Server, options.Nodes)}
+
+	for i := 0; i < options.Nodes; i++ {
+		c.configs[i] = c.newConfig(i)
+		if err := os.MkdirAll(c.configs[i].DataDir, 0755); err != nil {
+			os.RemoveAll(dataDir)
+			return nil, common.WrapError(common.SERVER_ERROR, "Cluster : Fail to create data directory.", err)
+		}
+	}
+
+	return c, nil
+}
+
+//
+// Start all the nodes.
+//
+func (c *Cluster) Start() error {
+	for i := 0; i < c.options.Nodes; i++ {
+		if err := c.Restart(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Stop all the nodes and remove the data directory.
+//
+func (c *Cluster) Close() {
+	for i := 0; i < c.options.Nodes; i++ {
+		c.Crash(i)
+	}
+	os.RemoveAll(c.dataDir)
+}
+
+//
+// Return the name of the node.
+//
+func (c *Cluster) Node(i int) string {
+	return "n" + strconv.Itoa(i)
+}
+
+func (c *Cluster) GetNetwork() *SimNetwork {
+	return c.network
+}
+
+func (c *Cluster) GetClock() *FakeClock {
+	return c.clock
+}
+
+//
+// Crash the node.  The node is cut from the network before it stops,
+// so it cannot send any more messages.  Its repository is kept, such
+// that it can be restarted.
+//
+func (c *Cluster) Crash(i int) {
+
+	c.mutex.Lock()
+	s := c.servers[i]
+	c.servers[i] = nil
+	c.mutex.Unlock()
+
+	if s == nil {
+		return
+	}
+
+	log.Printf("Cluster.Crash() : Crash node %s", c.Node(i))
+	c.network.Isolate(c.Node(i))
+
+	// The server may be waiting on a timer while it stops, so keep
+	// the clock running.
+	donech := make(chan bool)
+	go func() {
+		s.Stop()
+		close(donech)
+	}()
+
+	for {
+		select {
+		case <-donech:
+			return
+		default:
+			c.Step()
+		}
+	}
+}
+
+//
+// Start (or restart) the node with its original configuration.
+//
+func (c *Cluster) Restart(i int) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.servers[i] != nil {
+		return common.NewError(common.SERVER_ERROR, "Cluster : Node "+c.Node(i)+" is already running")
+	}
+
+	log.Printf("Cluster.Restart() : Start node %s", c.Node(i))
+	c.network.Rejoin(c.Node(i))
+
+	s, err := server.New(c.configs[i])
+	if err != nil {
+		return err
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	c.servers[i] = s
+	return nil
+}
+
+//
+// Return true if the node is running.
+//
+func (c *Cluster) IsRunning(i int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.servers[i] != nil
+}
+
+//
+// Partition the nodes (by index).  The nodes that are not listed form
+// one more partition.
+//
+func (c *Cluster) Partition(groups ...[]int) {
+
+	names := make([][]string, len(groups))
+	for i, group := range groups {
+		for _, node := range group {
+			names[i] = append(names[i], c.Node(node))
+		}
+	}
+
+	log.Printf("Cluster.Partition() : Partition %v", names)
+	c.network.Partition(names...)
+}
+
+func (c *Cluster) Heal() {
+	log.Printf("Cluster.Heal() : Heal partition")
+	c.network.Heal()
+}
+
+//
+// Run a single step of the scheduler.  Return false if there is
+// no message or timer pending.
+//
+func (c *Cluster) Step() bool {
+
+	// Let the goroutines react to the last delivery or timer.
+	time.Sleep(c.options.Settle)
+
+	if c.network.Deliver() > 0 {
+		return true
+	}
+
+	// Nothing is due.  Jump to the next event.
+	next, ok := c.network.NextDelivery()
+	if deadline, found := c.clock.NextDeadline(); found && (!ok || deadline.Before(next)) {
+		next, ok = deadline, true
+	}
+
+	// Do not jump too far ahead of the goroutines.  A goroutine may not
+	// have armed its timer yet (e.g. a node that is starting).
+	if limit := c.clock.Now().Add(c.options.MaxStep); !ok || next.After(limit) {
+		next = limit
+	}
+
+	c.clock.AdvanceTo(next)
+	return ok
+}
+
+//
+// Run the scheduler for the given (fake) duration.
+//
+func (c *Cluster) RunFor(d time.Duration) {
+
+	end := c.clock.Now().Add(d)
+	for c.clock.Now().Before(end) {
+		c.Step()
+	}
+}
+
+//
+// Run the scheduler until the condition holds.  Return false if the
+// condition does not hold within the given (fake) duration.
+//
+func (c *Cluster) RunUntil(cond func() bool, d time.Duration) bool {
+
+	end := c.clock.Now().Add(d)
+	for !cond() {
+		if !c.clock.Now().Before(end) {
+			return false
+		}
+		c.Step()
+	}
+	return true
+}
+
+//
+// Return the status of the node.  A node that is down is ELECTING.
+//
+func (c *Cluster) GetStatus(i int) protocol.PeerStatus {
+
+	c.mutex.Lock()
+	s := c.servers[i]
+	c.mutex.Unlock()
+
+	if s == nil {
+		return protocol.ELECTING
+	}
+	return s.GetStatus()
+}
+
+//
+// Return the nodes that are LEADING.
+//
+func (c *Cluster) Leaders() []int {
+
+	var leaders []int
+	for i := 0; i < c.options.Nodes; i++ {
+		if c.GetStatus(i) == protocol.LEADING {
+			leaders = append(leaders, i)
+		}
+	}
+	return leaders
+}
+
+//
+// Return true if exactly one of the nodes is LEADING and all the
+// other nodes are FOLLOWING.
+//
+func (c *Cluster) IsStable(nodes []int) bool {
+
+	leaders := 0
+	for _, i := range nodes {
+		switch c.GetStatus(i) {
+		case protocol.LEADING:
+			leaders++
+		case protocol.FOLLOWING:
+		default:
+			return false
+		}
+	}
+	return leaders == 1
+}
+
+//
+// Wait until the nodes have a single leader.  Return the leader.
+//
+func (c *Cluster) WaitForLeader(nodes []int, d time.Duration) (int, bool) {
+
+	if !c.RunUntil(func() bool { return c.IsStable(nodes) }, d) {
+		return -1, false
+	}
+
+	for _, i := range nodes {
+		if c.GetStatus(i) == protocol.LEADING {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+//
+// Send a client request to the node, and run the scheduler until the
+// request is done.  The request fails if it does not complete within
+// the given (fake) duration.
+//
+func (c *Cluster) Request(i int, opCode common.OpCode, key string, value []byte, d time.Duration) error {
+
+	respch := c.submit(i, opCode, key, value)
+
+	var resp *response
+	isDone := func() bool {
+		select {
+		case resp = <-respch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if !c.RunUntil(isDone, d) {
+		return common.NewError(common.TIMEOUT_ERROR, "Cluster : Request "+key+" to node "+c.Node(i)+" timed out")
+	}
+	return resp.err
+}
+
+//
+// Set the value of the key through the node.
+//
+func (c *Cluster) Set(i int, key string, value []byte, d time.Duration) error {
+	return c.Request(i, common.OPCODE_SET, key, value, d)
+}
+
+//
+// Read the value of the key from the repository of the node.
+//
+func (c *Cluster) Get(i int, key string) ([]byte, error) {
+
+	c.mutex.Lock()
+	s := c.servers[i]
+	c.mutex.Unlock()
+
+	if s == nil {
+		return nil, common.NewError(common.SERVER_ERROR, "Cluster : Node "+c.Node(i)+" is down")
+	}
+
+	var reply *server.Reply
+	request := &server.Request{OpCode: common.GetOpCodeStr(common.OPCODE_GET), Key: key}
+	if err := s.NewClientRequest(request, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Result, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Send a client request to the node in the background.  The request may
+// never complete (e.g. no quorum), so the response is delivered on a
+// buffered channel.  The goroutine returns once the server terminates
+// the request.
+//
+func (c *Cluster) submit(i int, opCode common.OpCode, key string, value []byte) <-chan *response {
+
+	respch := make(chan *response, 1)
+
+	c.mutex.Lock()
+	s := c.servers[i]
+	c.mutex.Unlock()
+
+	if s == nil {
+		respch <- &response{err: common.NewError(common.SERVER_ERROR, "Cluster : Node "+c.Node(i)+" is down")}
+		return respch
+	}
+
+	go func() {
+		var reply *server.Reply
+		request := &server.Request{OpCode: common.GetOpCodeStr(opCode), Key: key, Value: value}
+		if err := s.NewClientRequest(request, &reply); err != nil {
+			respch <- &response{err: err}
+			return
+		}
+		respch <- &response{result: reply.Result}
+	}()
+
+	return respch
+}
+
+func (c *Cluster) electionAddr(i int) string {
+	return "127.0.0.1:" + strconv.Itoa(c.options.BasePort+i*2)
+}
+
+func (c *Cluster) messageAddr(i int) string {
+	return "127.0.0.1:" + strconv.Itoa(c.options.BasePort+i*2+1)
+}
+
+func (c *Cluster) newConfig(i int) *server.Config {
+
+	config := &server.Config{
+		Host: &server.Node{ElectionAddr: c.electionAddr(i),
+			MessageAddr: c.messageAddr(i),
+			// The client requests are sent in-process.  Let the
+			// system pick a port for the request listener.
+			RequestAddr: "127.0.0.1:0"},
+		ElectionTransport: c.options.ElectionTransport,
+		Secret:            c.options.Secret,
+		DataDir:           filepath.Join(c.dataDir, c.Node(i)),
+		Transport:         c.network.Transport(c.Node(i)),
+		Clock:             c.clock}
+
+	for j := 0; j < c.options.Nodes; j++ {
+		if j != i {
+			config.Peer = append(config.Peer, &server.Node{ElectionAddr: c.electionAddr(j),
+				MessageAddr: c.messageAddr(j)})
+		}
+	}
+
+	return config
+}
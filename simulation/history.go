@@ -0,0 +1,158 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulation
+
+import (
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"math"
+	"sync"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// An operation of a client, as seen by the client.  Call and Return are
+// logical timestamps taken from the history: an operation that returns
+// before another operation is called has a smaller Return than the Call
+// of the other operation.
+//
+type Operation struct {
+	Client  int
+	Node    int
+	OpCode  common.OpCode
+	Key     string
+	Value   []byte // value written (Add, Set) or read (Get)
+	Missing bool   // true if the key does not exist (Get)
+	Ok      bool   // false if the outcome of the operation is unknown
+	Call    int64
+	Return  int64 // math.MaxInt64 if the outcome is unknown
+}
+
+//
+// History records the operations of the clients, from the time they are
+// invoked to the time they complete.  A history can be recorded by many
+// clients concurrently.
+//
+type History struct {
+	mutex      sync.Mutex
+	timestamp  int64
+	operations []*Operation
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+func NewHistory() *History {
+	return &History{}
+}
+
+//
+// Record the invocation of an operation.  The value is the value to
+// write (nil for Get and Delete).
+//
+func (h *History) Invoke(client int, node int, opCode common.OpCode, key string, value []byte) *Operation {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.timestamp++
+	op := &Operation{Client: client,
+		Node:   node,
+		OpCode: opCode,
+		Key:    key,
+		Value:  value,
+		Call:   h.timestamp,
+		Return: math.MaxInt64}
+
+	h.operations = append(h.operations, op)
+	return op
+}
+
+//
+// Record the completion of an operation.  If the operation fails, a
+// write may still be committed later on (e.g. the request is queued
+// by the server until it joins a new leader), so the outcome of the
+// write is unknown.  A read that fails has no effect and is removed
+// from the history, unless the key does not exist.
+//
+func (h *History) Complete(op *Operation, result []byte, err error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if err != nil && op.OpCode == common.OPCODE_GET && common.GetErrorCode(err) == common.KEY_NOT_FOUND_ERROR {
+		op.Missing = true
+		err = nil
+	}
+
+	if err != nil {
+		if op.OpCode == common.OPCODE_GET {
+			for i, other := range h.operations {
+				if other == op {
+					h.operations = append(h.operations[:i], h.operations[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+
+	h.timestamp++
+	op.Ok = true
+	op.Return = h.timestamp
+	if op.OpCode == common.OPCODE_GET {
+		op.Value = result
+	}
+}
+
+//
+// Return a copy of the operations recorded so far.
+//
+func (h *History) Operations() []*Operation {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	result := make([]*Operation, len(h.operations))
+	for i, op := range h.operations {
+		clone := *op
+		result[i] = &clone
+	}
+	return result
+}
+
+func (op *Operation) String() string {
+
+	ret := "unknown"
+	if op.Ok {
+		ret = fmt.Sprintf("%d", op.Return)
+	}
+
+	if op.Missing {
+		return fmt.Sprintf("client %d node %d : %s %s (missing) [%d, %s]",
+			op.Client, op.Node, common.GetOpCodeStr(op.OpCode), op.Key, op.Call, ret)
+	}
+	if op.OpCode == common.OPCODE_DELETE {
+		return fmt.Sprintf("client %d node %d : %s %s [%d, %s]",
+			op.Client, op.Node, common.GetOpCodeStr(op.OpCode), op.Key, op.Call, ret)
+	}
+	return fmt.Sprintf("client %d node %d : %s %s %q [%d, %s]",
+		op.Client, op.Node, common.GetOpCodeStr(op.OpCode), op.Key, op.Value, op.Call, ret)
+}
@@ -0,0 +1,340 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulation
+
+import (
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"log"
+	"sort"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// The state of a key in the register model.
+//
+type registerState struct {
+	exists bool
+	value  string
+}
+
+//
+// An entry of the history being checked.  Each operation has a call
+// entry and a return entry.  The call entry points to its return entry
+// (match).  The entries are kept in a doubly linked list, sorted by
+// time.  An operation is removed from the list (lifted) when it is
+// linearized, and put back (unlifted) when the checker backtracks.
+//
+type entry struct {
+	id    int
+	op    *Operation
+	time  int64
+	match *entry // nil for a return entry
+	prev  *entry
+	next  *entry
+}
+
+//
+// A linearized operation, and the state before the operation.
+//
+type linearized struct {
+	entry *entry
+	state registerState
+}
+
+//
+// The set of the linearized operations.
+//
+type bitset []uint64
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Check that the history is linearizable, for a map where each key is a
+// register.  Since the keys are independent, the history of each key is
+// checked separately.  The writes with an unknown outcome may or may not
+// have taken effect.
+//
+// The checker searches for a linearization with backtracking (Wing & Gong),
+// and skips the sets of linearized operations that have already been
+// explored with the same state (Lowe).  It is exponential in the worst case,
+// so the history should be kept short, with few concurrent operations.
+//
+func CheckLinearizable(ops []*Operation) error {
+
+	byKey := make(map[string][]*Operation)
+	for _, op := range ops {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !checkKey(byKey[key]) {
+			log.Printf("CheckLinearizable() : History of key %s is not linearizable", key)
+			for _, op := range byKey[key] {
+				log.Printf("CheckLinearizable() :    %s", op.String())
+			}
+			return common.NewError(common.SERVER_ERROR,
+				fmt.Sprintf("History of key %s (%d operations) is not linearizable", key, len(byKey[key])))
+		}
+	}
+	return nil
+}
+
+//
+// The servers of gometa answer a read from their local repository, which
+// may lag behind the leader.  A read is only guaranteed to see the state
+// after the last write that the client has completed on the same node
+// (the node commits the write before it replies).  This relaxes the
+// history accordingly: a read is considered to be called when the last
+// completed write of the client on the same node was called.  The writes
+// are left unchanged, so they must still be linearizable.
+//
+func RelaxLocalReads(ops []*Operation) []*Operation {
+
+	sorted := make([]*Operation, len(ops))
+	copy(sorted, ops)
+	sort.Sort(byCall(sorted))
+
+	// Call of the last completed write of each (client, node)
+	type session struct {
+		client int
+		node   int
+	}
+	lastWrite := make(map[session]int64)
+
+	result := make([]*Operation, 0, len(ops))
+	for _, op := range sorted {
+		s := session{client: op.Client, node: op.Node}
+		clone := *op
+
+		if op.OpCode == common.OPCODE_GET {
+			clone.Call = lastWrite[s]
+		} else if op.Ok {
+			lastWrite[s] = op.Call
+		}
+		result = append(result, &clone)
+	}
+
+	return result
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Check the history of a single key.
+//
+func checkKey(ops []*Operation) bool {
+
+	head := makeEntries(ops)
+	linearizedOps := make(bitset, (len(ops)+63)/64)
+	cache := make(map[string][]registerState)
+	var calls []linearized
+
+	state := registerState{}
+	current := head.next
+
+	for head.next != nil {
+		if current.match != nil {
+			// call entry : try to linearize the operation now
+			newState, ok := apply(state, current.op)
+			if ok {
+				newLinearized := linearizedOps.clone().set(current.id)
+				if cacheAdd(cache, newLinearized, newState) {
+					calls = append(calls, linearized{entry: current, state: state})
+					state = newState
+					linearizedOps.set(current.id)
+					lift(current)
+					current = head.next
+					continue
+				}
+			}
+			current = current.next
+
+		} else {
+			// return entry : the operation must be linearized before this
+			// point.  Backtrack.
+			if len(calls) == 0 {
+				return false
+			}
+			top := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+
+			state = top.state
+			linearizedOps.clear(top.entry.id)
+			unlift(top.entry)
+			current = top.entry.next
+		}
+	}
+
+	return true
+}
+
+//
+// Apply the operation on the state.  Return false if the operation
+// cannot happen in this state.
+//
+func apply(state registerState, op *Operation) (registerState, bool) {
+
+	switch op.OpCode {
+	case common.OPCODE_ADD, common.OPCODE_SET:
+		return registerState{exists: true, value: string(op.Value)}, true
+	case common.OPCODE_DELETE:
+		return registerState{}, true
+	case common.OPCODE_GET:
+		if op.Missing {
+			return state, !state.exists
+		}
+		return state, state.exists && state.value == string(op.Value)
+	}
+	return state, false
+}
+
+//
+// Build the linked list of entries.  Return the head of the list
+// (a sentinel).
+//
+func makeEntries(ops []*Operation) *entry {
+
+	var entries []*entry
+	for id, op := range ops {
+		ret := &entry{id: id, op: op, time: op.Return}
+		call := &entry{id: id, op: op, time: op.Call, match: ret}
+		entries = append(entries, call, ret)
+	}
+
+	sort.Sort(byTime(entries))
+
+	head := &entry{id: -1}
+	prev := head
+	for _, e := range entries {
+		e.prev = prev
+		prev.next = e
+		prev = e
+	}
+	return head
+}
+
+//
+// Remove the operation (call and return entries) from the list.
+//
+func lift(call *entry) {
+
+	call.prev.next = call.next
+	call.next.prev = call.prev
+
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+//
+// Put the operation back into the list.  This must be done in the
+// reverse order of lift.
+//
+func unlift(call *entry) {
+
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+
+	call.prev.next = call
+	call.next.prev = call
+}
+
+//
+// Add the (linearized operations, state) pair to the cache.  Return
+// false if the pair has already been explored.
+//
+func cacheAdd(cache map[string][]registerState, linearizedOps bitset, state registerState) bool {
+
+	key := linearizedOps.key()
+	for _, other := range cache[key] {
+		if other == state {
+			return false
+		}
+	}
+	cache[key] = append(cache[key], state)
+	return true
+}
+
+func (b bitset) clone() bitset {
+	result := make(bitset, len(b))
+	copy(result, b)
+	return result
+}
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clear(i int) bitset {
+	b[i/64] &^= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) key() string {
+	buf := make([]byte, 0, len(b)*8)
+	for _, word := range b {
+		for i := uint(0); i < 64; i += 8 {
+			buf = append(buf, byte(word>>i))
+		}
+	}
+	return string(buf)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Sorting
+/////////////////////////////////////////////////////////////////////////////
+
+type byTime []*entry
+
+func (e byTime) Len() int      { return len(e) }
+func (e byTime) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+//
+// If two entries have the same time (e.g. relaxed reads), the calls go
+// first, such that the operations are considered concurrent.
+//
+func (e byTime) Less(i, j int) bool {
+	if e[i].time != e[j].time {
+		return e[i].time < e[j].time
+	}
+	return e[i].match != nil && e[j].match == nil
+}
+
+type byCall []*Operation
+
+func (o byCall) Len() int           { return len(o) }
+func (o byCall) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o byCall) Less(i, j int) bool { return o[i].Call < o[j].Call }
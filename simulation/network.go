@@ -0,0 +1,818 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulation
+
+import (
+	"github.com/couchbase/gometa/common"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// SimNetwork is a fault-injecting network for the nodes of a simulation.
+// Each node talks to the network through its own common.Transport (see
+// Transport()), so the network knows the sender of every message.
+//
+// A message (a datagram or a write on a stream connection) is not handed
+// to the receiver right away.  It is queued with a random delay drawn
+// from a seeded random source, and delivered when the simulation calls
+// Deliver() after the fake clock has reached its delivery time.  Messages
+// are therefore reordered across connections, while the bytes of a stream
+// connection stay in order (like TCP).  Datagrams can also be dropped.
+//
+// The network can be partitioned.  The messages across partitions are
+// dropped, the stream connections across partitions are closed and new
+// connections across partitions are refused.  A node can be isolated
+// from every other node (e.g. when it crashes).
+//
+type SimNetwork struct {
+	clock *FakeClock
+
+	// mutex protected variable
+	mutex       sync.Mutex
+	rand        *rand.Rand
+	dropRate    float64
+	minDelay    time.Duration
+	maxDelay    time.Duration
+	hosts       map[string]string // key : addr, value : node
+	partitions  map[string]int    // key : node, value : partition
+	isolated    map[string]bool   // key : node
+	listeners   map[string]*simListener
+	packetConns map[string]*simPacketConn
+	conns       map[*simConn]bool
+	pending     []*simMessage
+	nextId      uint64
+	delivered   uint64
+	dropped     uint64
+}
+
+//
+// The transport of a single node.
+//
+type nodeTransport struct {
+	network *SimNetwork
+	node    string
+}
+
+type simAddr struct {
+	network string
+	addr    string
+}
+
+type simMessage struct {
+	id        uint64
+	deliverAt time.Time
+	from      string // node
+	to        string // node
+	deliver   func()
+}
+
+type simListener struct {
+	laddr   string
+	node    string
+	network *SimNetwork
+	connch  chan net.Conn
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	isClosed bool
+}
+
+type simConn struct {
+	network   *SimNetwork
+	node      string
+	peerNode  string
+	laddr     net.Addr
+	raddr     net.Addr
+	peer      *simConn
+	lastWrite time.Time // protected by the network mutex
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	buf      []byte
+	isClosed bool
+}
+
+type simPacketConn struct {
+	laddr   *simAddr
+	node    string
+	network *SimNetwork
+	readch  chan *simPacket
+	closech chan bool
+
+	// mutex protected variable
+	mutex    sync.Mutex
+	isClosed bool
+}
+
+type simPacket struct {
+	data []byte
+	from net.Addr
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// SimNetwork
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Create a new network.  The delay of the messages is measured on the
+// given clock, and the random faults are drawn from the given seed.
+//
+func NewSimNetwork(clock *FakeClock, seed int64) *SimNetwork {
+	return &SimNetwork{clock: clock,
+		rand:        rand.New(rand.NewSource(seed)),
+		hosts:       make(map[string]string),
+		partitions:  make(map[string]int),
+		isolated:    make(map[string]bool),
+		listeners:   make(map[string]*simListener),
+		packetConns: make(map[string]*simPacketConn),
+		conns:       make(map[*simConn]bool)}
+}
+
+//
+// Return the transport used by the node.  The addresses that the node
+// listens to are owned by the node.
+//
+func (n *SimNetwork) Transport(node string) common.Transport {
+	return &nodeTransport{network: n, node: node}
+}
+
+//
+// Set the probability that a datagram is dropped.
+//
+func (n *SimNetwork) SetDropRate(rate float64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.dropRate = rate
+}
+
+//
+// Set the range of the delay of the messages.
+//
+func (n *SimNetwork) SetDelay(min time.Duration, max time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if max < min {
+		max = min
+	}
+	n.minDelay = min
+	n.maxDelay = max
+}
+
+//
+// Split the nodes into partitions.  The nodes that are not listed
+// form one more partition.
+//
+func (n *SimNetwork) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	n.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			n.partitions[node] = i + 1
+		}
+	}
+	n.mutex.Unlock()
+
+	n.closeUnreachable()
+}
+
+//
+// Remove all the partitions.
+//
+func (n *SimNetwork) Heal() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.partitions = make(map[string]int)
+}
+
+//
+// Cut the node from every other node.
+//
+func (n *SimNetwork) Isolate(node string) {
+	n.mutex.Lock()
+	n.isolated[node] = true
+	n.mutex.Unlock()
+
+	n.closeUnreachable()
+}
+
+//
+// Reconnect a node that has been isolated.
+//
+func (n *SimNetwork) Rejoin(node string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	delete(n.isolated, node)
+}
+
+//
+// Deliver the messages that are due on the clock, in the order of their
+// delivery time.  Return the number of messages delivered.
+//
+func (n *SimNetwork) Deliver() int {
+
+	now := n.clock.Now()
+
+	n.mutex.Lock()
+	var due []*simMessage
+	remaining := n.pending[:0]
+	for _, msg := range n.pending {
+		if !msg.deliverAt.After(now) {
+			due = append(due, msg)
+		} else {
+			remaining = append(remaining, msg)
+		}
+	}
+	n.pending = remaining
+
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].deliverAt.Equal(due[j].deliverAt) {
+			return due[i].id < due[j].id
+		}
+		return due[i].deliverAt.Before(due[j].deliverAt)
+	})
+	n.mutex.Unlock()
+
+	count := 0
+	for _, msg := range due {
+		// The network may have been partitioned while the
+		// message is in flight.
+		if !n.isReachable(msg.from, msg.to) {
+			n.countDropped()
+			continue
+		}
+		msg.deliver()
+		count++
+	}
+
+	n.mutex.Lock()
+	n.delivered += uint64(count)
+	n.mutex.Unlock()
+
+	return count
+}
+
+//
+// Return the delivery time of the next message in flight.
+//
+func (n *SimNetwork) NextDelivery() (time.Time, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var next time.Time
+	found := false
+	for _, msg := range n.pending {
+		if !found || msg.deliverAt.Before(next) {
+			next = msg.deliverAt
+			found = true
+		}
+	}
+	return next, found
+}
+
+//
+// Return the number of messages delivered and dropped so far.
+//
+func (n *SimNetwork) Stats() (delivered uint64, dropped uint64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.delivered, n.dropped
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// SimNetwork - Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+func (n *SimNetwork) isReachable(from string, to string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.isReachableNoLock(from, to)
+}
+
+func (n *SimNetwork) isReachableNoLock(from string, to string) bool {
+	if from == to {
+		return !n.isolated[from]
+	}
+	return !n.isolated[from] && !n.isolated[to] && n.partitions[from] == n.partitions[to]
+}
+
+//
+// Return the node owning the address.
+//
+func (n *SimNetwork) getNode(addr string) (string, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	node, ok := n.hosts[addr]
+	return node, ok
+}
+
+func (n *SimNetwork) countDropped() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.dropped++
+}
+
+//
+// Return a random delay within the configured range.  The caller
+// must hold the mutex.
+//
+func (n *SimNetwork) randomDelay() time.Duration {
+	if n.maxDelay <= n.minDelay {
+		return n.minDelay
+	}
+	return n.minDelay + time.Duration(n.rand.Int63n(int64(n.maxDelay-n.minDelay)+1))
+}
+
+//
+// Queue a datagram.  The datagram may be dropped.
+//
+func (n *SimNetwork) sendPacket(from string, to string, deliver func()) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if !n.isReachableNoLock(from, to) || n.rand.Float64() < n.dropRate {
+		n.dropped++
+		return
+	}
+
+	n.nextId++
+	n.pending = append(n.pending, &simMessage{id: n.nextId,
+		deliverAt: n.clock.Now().Add(n.randomDelay()),
+		from:      from,
+		to:        to,
+		deliver:   deliver})
+}
+
+//
+// Queue a write on a stream connection.  The write is never dropped,
+// and is never delivered before an earlier write on the same connection.
+//
+func (n *SimNetwork) sendStream(conn *simConn, data []byte) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	deliverAt := n.clock.Now().Add(n.randomDelay())
+	if deliverAt.Before(conn.lastWrite) {
+		deliverAt = conn.lastWrite
+	}
+	conn.lastWrite = deliverAt
+
+	peer := conn.peer
+	n.nextId++
+	n.pending = append(n.pending, &simMessage{id: n.nextId,
+		deliverAt: deliverAt,
+		from:      conn.node,
+		to:        conn.peerNode,
+		deliver:   func() { peer.push(data) }})
+}
+
+//
+// Open a stream connection from the node to the address.
+//
+func (n *SimNetwork) dial(node string, addr string) (net.Conn, error) {
+
+	raddr, err := net.ResolveTCPAddr(common.MESSAGE_TRANSPORT_TYPE, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	listener, ok := n.listeners[raddr.String()]
+	if !ok || !n.isReachableNoLock(node, listener.node) {
+		n.mutex.Unlock()
+		return nil, common.NewError(common.SERVER_ERROR, "SimNetwork : Connection refused by "+addr)
+	}
+
+	// Each connection gets a distinct local address, like an ephemeral port.
+	n.nextId++
+	local := &simAddr{network: common.MESSAGE_TRANSPORT_TYPE, addr: node + "#" + strconv.FormatUint(n.nextId, 10)}
+	remote := &simAddr{network: common.MESSAGE_TRANSPORT_TYPE, addr: raddr.String()}
+
+	client := newSimConn(n, node, listener.node, local, remote)
+	server := newSimConn(n, listener.node, node, remote, local)
+	client.peer = server
+	server.peer = client
+	n.conns[client] = true
+	n.conns[server] = true
+	n.mutex.Unlock()
+
+	if !listener.queue(server) {
+		client.Close()
+		return nil, common.NewError(common.SERVER_ERROR, "SimNetwork : Connection refused by "+addr)
+	}
+
+	return client, nil
+}
+
+func (n *SimNetwork) listen(node string, laddr string) (common.ConnListener, error) {
+
+	addr, err := net.ResolveTCPAddr(common.MESSAGE_TRANSPORT_TYPE, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, ok := n.listeners[addr.String()]; ok {
+		return nil, common.NewError(common.SERVER_ERROR, "SimNetwork : Address already in use "+laddr)
+	}
+
+	listener := &simListener{laddr: addr.String(),
+		node:     node,
+		network:  n,
+		connch:   make(chan net.Conn, common.MAX_PEERS),
+		isClosed: false}
+	n.listeners[listener.laddr] = listener
+	n.hosts[listener.laddr] = node
+
+	return listener, nil
+}
+
+func (n *SimNetwork) listenPacket(node string, laddr string) (net.PacketConn, error) {
+
+	addr, err := net.ResolveUDPAddr(common.ELECTION_TRANSPORT_TYPE, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, ok := n.packetConns[addr.String()]; ok {
+		return nil, common.NewError(common.SERVER_ERROR, "SimNetwork : Address already in use "+laddr)
+	}
+
+	conn := &simPacketConn{laddr: &simAddr{network: common.ELECTION_TRANSPORT_TYPE, addr: addr.String()},
+		node:     node,
+		network:  n,
+		readch:   make(chan *simPacket, common.MAX_PROPOSALS*2),
+		closech:  make(chan bool),
+		isClosed: false}
+	n.packetConns[addr.String()] = conn
+	n.hosts[addr.String()] = node
+
+	return conn, nil
+}
+
+func (n *SimNetwork) getPacketConn(addr string) *simPacketConn {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.packetConns[addr]
+}
+
+//
+// Close the stream connections between nodes that cannot reach
+// each other.
+//
+func (n *SimNetwork) closeUnreachable() {
+
+	n.mutex.Lock()
+	var conns []*simConn
+	for conn := range n.conns {
+		if !n.isReachableNoLock(conn.node, conn.peerNode) {
+			conns = append(conns, conn)
+		}
+	}
+	n.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (n *SimNetwork) removeConn(conn *simConn) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	delete(n.conns, conn)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// nodeTransport - implement common.Transport
+/////////////////////////////////////////////////////////////////////////////
+
+func (t *nodeTransport) Dial(addr string) (net.Conn, error) {
+	return t.network.dial(t.node, addr)
+}
+
+func (t *nodeTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return t.network.dial(t.node, addr)
+}
+
+func (t *nodeTransport) Listen(laddr string) (common.ConnListener, error) {
+	return t.network.listen(t.node, laddr)
+}
+
+func (t *nodeTransport) ListenPacket(laddr string) (net.PacketConn, error) {
+	return t.network.listenPacket(t.node, laddr)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// simAddr
+/////////////////////////////////////////////////////////////////////////////
+
+func (a *simAddr) Network() string {
+	return a.network
+}
+
+func (a *simAddr) String() string {
+	return a.addr
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// simListener
+/////////////////////////////////////////////////////////////////////////////
+
+func (l *simListener) ConnChannel() <-chan net.Conn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.isClosed {
+		return (<-chan net.Conn)(l.connch)
+	}
+	return nil
+}
+
+func (l *simListener) Close() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isClosed {
+		return false
+	}
+	l.isClosed = true
+
+	l.network.mutex.Lock()
+	if l.network.listeners[l.laddr] == l {
+		delete(l.network.listeners, l.laddr)
+	}
+	l.network.mutex.Unlock()
+
+	common.SafeRun("simListener.Close()",
+		func() {
+			close(l.connch)
+		})
+
+	return true
+}
+
+func (l *simListener) queue(conn net.Conn) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isClosed {
+		return false
+	}
+
+	select {
+	case l.connch <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// simConn - implement net.Conn
+/////////////////////////////////////////////////////////////////////////////
+
+func newSimConn(network *SimNetwork, node string, peerNode string, laddr net.Addr, raddr net.Addr) *simConn {
+
+	conn := &simConn{network: network,
+		node:     node,
+		peerNode: peerNode,
+		laddr:    laddr,
+		raddr:    raddr,
+		isClosed: false}
+	conn.cond = sync.NewCond(&conn.mutex)
+
+	return conn
+}
+
+func (c *simConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.buf) == 0 && !c.isClosed {
+		c.cond.Wait()
+	}
+
+	if len(c.buf) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+
+	if c.isConnClosed() {
+		return 0, common.NewError(common.SERVER_ERROR, "SimNetwork : Connection closed")
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.network.sendStream(c, data)
+
+	return len(b), nil
+}
+
+//
+// Close both ends of the connection.  The peer can still read the
+// data that has already been delivered to it.
+//
+func (c *simConn) Close() error {
+	c.close()
+	if c.peer != nil {
+		c.peer.close()
+	}
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *simConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *simConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *simConn) close() {
+	c.mutex.Lock()
+	if c.isClosed {
+		c.mutex.Unlock()
+		return
+	}
+	c.isClosed = true
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+
+	c.network.removeConn(c)
+}
+
+func (c *simConn) push(data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isClosed {
+		return
+	}
+
+	c.buf = append(c.buf, data...)
+	c.cond.Broadcast()
+}
+
+func (c *simConn) isConnClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.isClosed
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// simPacketConn - implement net.PacketConn
+/////////////////////////////////////////////////////////////////////////////
+
+func (c *simPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+
+	select {
+	case packet := <-c.readch:
+		n := copy(b, packet.data)
+		return n, packet.from, nil
+	case <-c.closech:
+		return 0, nil, common.NewError(common.SERVER_ERROR, "SimNetwork : Connection closed")
+	}
+}
+
+//
+// Queue the datagram for the peer.  The datagram is dropped if the peer
+// is unknown, unreachable or not listening when the datagram arrives.
+//
+func (c *simPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+
+	if c.isConnClosed() {
+		return 0, common.NewError(common.SERVER_ERROR, "SimNetwork : Connection closed")
+	}
+
+	to, ok := c.network.getNode(addr.String())
+	if !ok {
+		c.network.countDropped()
+		return len(b), nil
+	}
+
+	packet := &simPacket{data: make([]byte, len(b)), from: c.laddr}
+	copy(packet.data, b)
+
+	raddr := addr.String()
+	c.network.sendPacket(c.node, to,
+		func() {
+			if peer := c.network.getPacketConn(raddr); peer != nil {
+				peer.deliver(packet)
+			}
+		})
+
+	return len(b), nil
+}
+
+func (c *simPacketConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isClosed {
+		return nil
+	}
+	c.isClosed = true
+	close(c.closech)
+
+	c.network.mutex.Lock()
+	if c.network.packetConns[c.laddr.addr] == c {
+		delete(c.network.packetConns, c.laddr.addr)
+	}
+	c.network.mutex.Unlock()
+
+	return nil
+}
+
+func (c *simPacketConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *simPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *simPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *simPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *simPacketConn) deliver(packet *simPacket) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isClosed {
+		return
+	}
+
+	select {
+	case c.readch <- packet:
+	default:
+	}
+}
+
+func (c *simPacketConn) isConnClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.isClosed
+}
@@ -0,0 +1,408 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulation
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/couchbase/gometa/protocol"
+	"log"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// A scenario runs a sequence of faults against a cluster and checks
+// the outcome.
+//
+type Scenario struct {
+	Name  string
+	Nodes int
+	Run   func(c *Cluster) error
+}
+
+//
+// The outcome of a scenario.
+//
+type Result struct {
+	Name      string
+	Seed      int64
+	Err       error
+	Elapsed   time.Duration // fake time
+	Delivered uint64
+	Dropped   uint64
+}
+
+// (fake) time allowed for an election, a request or a resync
+var electionTimeout time.Duration = 60 * time.Second
+var requestTimeout time.Duration = 30 * time.Second
+var workloadTimeout time.Duration = 10 * time.Minute
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Return the scenarios shipped with the harness.
+//
+func Scenarios() []*Scenario {
+	return []*Scenario{
+		&Scenario{Name: "LeaderCrash", Nodes: 3, Run: ScenarioLeaderCrash},
+		&Scenario{Name: "FollowerRejoin", Nodes: 3, Run: ScenarioFollowerRejoin},
+		&Scenario{Name: "SplitBrain", Nodes: 5, Run: ScenarioSplitBrain},
+		&Scenario{Name: "Linearizable", Nodes: 5, Run: ScenarioLinearizable},
+	}
+}
+
+//
+// Run the scenario on a new cluster.  The number of nodes of the
+// options is overridden by the scenario.
+//
+func RunScenario(scenario *Scenario, options Options) *Result {
+
+	options.Nodes = scenario.Nodes
+	result := &Result{Name: scenario.Name, Seed: options.Seed}
+
+	c, err := NewCluster(options)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer c.Close()
+
+	start := c.clock.Now()
+	if err := c.Start(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	log.Printf("RunScenario() : Start scenario %s with seed %d", scenario.Name, options.Seed)
+	result.Err = scenario.Run(c)
+	result.Elapsed = c.clock.Now().Sub(start)
+	result.Delivered, result.Dropped = c.network.Stats()
+
+	return result
+}
+
+//
+// Run all the scenarios with the same options.
+//
+func RunScenarios(options Options) []*Result {
+
+	var results []*Result
+	for _, scenario := range Scenarios() {
+		results = append(results, RunScenario(scenario, options))
+	}
+	return results
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Scenarios
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// The leader crashes after a write.  The remaining nodes elect a new
+// leader, which must have the write.  The old leader then rejoins as
+// a follower and catches up.
+//
+func ScenarioLeaderCrash(c *Cluster) error {
+
+	all := []int{0, 1, 2}
+	leader, ok := c.WaitForLeader(all, electionTimeout)
+	if !ok {
+		return fmt.Errorf("no leader elected: %v", c.statuses())
+	}
+
+	follower := (leader + 1) % 3
+	if err := c.Set(follower, "/k1", []byte("v1"), requestTimeout); err != nil {
+		return fmt.Errorf("write before crash failed: %v", err)
+	}
+
+	c.Crash(leader)
+
+	survivors := except(all, leader)
+	newLeader, ok := c.WaitForLeader(survivors, electionTimeout)
+	if !ok {
+		return fmt.Errorf("no leader elected after crash of %s: %v", c.Node(leader), c.statuses())
+	}
+
+	if err := c.Set(newLeader, "/k2", []byte("v2"), requestTimeout); err != nil {
+		return fmt.Errorf("write after crash failed: %v", err)
+	}
+
+	if err := c.Restart(leader); err != nil {
+		return err
+	}
+	if _, ok := c.WaitForLeader(all, electionTimeout); !ok {
+		return fmt.Errorf("%s did not rejoin: %v", c.Node(leader), c.statuses())
+	}
+
+	return c.waitForValues(all, map[string]string{"/k1": "v1", "/k2": "v2"})
+}
+
+//
+// A follower crashes and misses several writes.  When it restarts,
+// it must synchronize with the leader and get all the writes.
+//
+func ScenarioFollowerRejoin(c *Cluster) error {
+
+	all := []int{0, 1, 2}
+	leader, ok := c.WaitForLeader(all, electionTimeout)
+	if !ok {
+		return fmt.Errorf("no leader elected: %v", c.statuses())
+	}
+
+	follower := (leader + 1) % 3
+	c.Crash(follower)
+
+	expected := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("/rejoin/%d", i)
+		value := fmt.Sprintf("v%d", i)
+		if err := c.Set(leader, key, []byte(value), requestTimeout); err != nil {
+			return fmt.Errorf("write %s while %s is down failed: %v", key, c.Node(follower), err)
+		}
+		expected[key] = value
+	}
+
+	if err := c.Restart(follower); err != nil {
+		return err
+	}
+	if _, ok := c.WaitForLeader(all, electionTimeout); !ok {
+		return fmt.Errorf("%s did not rejoin: %v", c.Node(follower), c.statuses())
+	}
+
+	return c.waitForValues(all, expected)
+}
+
+//
+// The leader is partitioned with one follower, away from the majority.
+// The majority elects a new leader and accepts a write.  A write sent
+// to the minority must not commit while the partition lasts.  Once the
+// partition heals, there must be a single leader, and all the nodes
+// must agree on the value.  The write sent to the minority may still
+// be applied after the partition heals, since the request is queued by
+// the node until it joins a leader.
+//
+func ScenarioSplitBrain(c *Cluster) error {
+
+	all := []int{0, 1, 2, 3, 4}
+	leader, ok := c.WaitForLeader(all, electionTimeout)
+	if !ok {
+		return fmt.Errorf("no leader elected: %v", c.statuses())
+	}
+
+	if err := c.Set(leader, "/brain", []byte("initial"), requestTimeout); err != nil {
+		return fmt.Errorf("write before partition failed: %v", err)
+	}
+
+	minority := []int{leader, (leader + 1) % 5}
+	majority := except(except(all, minority[0]), minority[1])
+	c.Partition(minority, majority)
+
+	newLeader, ok := c.WaitForLeader(majority, electionTimeout)
+	if !ok {
+		return fmt.Errorf("majority %v did not elect a leader: %v", majority, c.statuses())
+	}
+
+	if err := c.Set(newLeader, "/brain", []byte("majority"), requestTimeout); err != nil {
+		return fmt.Errorf("write to majority failed: %v", err)
+	}
+
+	if err := c.Set(minority[1], "/brain", []byte("minority"), requestTimeout); err == nil {
+		return fmt.Errorf("write to minority committed without quorum")
+	}
+	if err := c.waitForValues(majority, map[string]string{"/brain": "majority"}); err != nil {
+		return fmt.Errorf("write to minority is visible in majority: %v", err)
+	}
+
+	c.Heal()
+	if _, ok := c.WaitForLeader(all, electionTimeout); !ok {
+		return fmt.Errorf("no single leader after heal: %v", c.statuses())
+	}
+
+	value, err := c.waitForAgreement(all, "/brain")
+	if err != nil {
+		return err
+	}
+	if value != "majority" && value != "minority" {
+		return fmt.Errorf("unexpected value %q after heal", value)
+	}
+	return nil
+}
+
+//
+// Concurrent clients read and write a few keys through all the nodes,
+// while the leader is partitioned away, and a follower crashes and
+// restarts.  The history of the clients must be linearizable (with
+// the reads relaxed to the guarantee of the local reads).
+//
+func ScenarioLinearizable(c *Cluster) error {
+
+	all := []int{0, 1, 2, 3, 4}
+	leader, ok := c.WaitForLeader(all, electionTimeout)
+	if !ok {
+		return fmt.Errorf("no leader elected: %v", c.statuses())
+	}
+
+	workload := Workload{Clients: 5,
+		Operations: 20,
+		Keys:       3,
+		ReadRatio:  0.5,
+		Timeout:    requestTimeout,
+		Pause:      time.Second}
+
+	history := NewHistory()
+	donech := c.StartWorkload(workload, history)
+
+	c.RunFor(time.Second)
+
+	c.Partition([]int{leader}, except(all, leader))
+	if _, ok := c.WaitForLeader(except(all, leader), electionTimeout); !ok {
+		return fmt.Errorf("majority did not elect a leader: %v", c.statuses())
+	}
+	c.RunFor(time.Second)
+	c.Heal()
+
+	follower := (leader + 2) % 5
+	c.Crash(follower)
+	c.RunFor(time.Second)
+	if err := c.Restart(follower); err != nil {
+		return err
+	}
+
+	isDone := func() bool {
+		select {
+		case <-donech:
+			return true
+		default:
+			return false
+		}
+	}
+	if !c.RunUntil(isDone, workloadTimeout) {
+		return fmt.Errorf("clients did not complete: %v", c.statuses())
+	}
+
+	ops := history.Operations()
+	log.Printf("ScenarioLinearizable() : Check history of %d operations", len(ops))
+	return CheckLinearizable(RelaxLocalReads(ops))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Wait until every node has the expected values.
+//
+func (c *Cluster) waitForValues(nodes []int, expected map[string]string) error {
+
+	var mismatch error
+	check := func() bool {
+		for _, i := range nodes {
+			for key, value := range expected {
+				actual, err := c.Get(i, key)
+				if err != nil {
+					mismatch = fmt.Errorf("%s: read %s failed: %v", c.Node(i), key, err)
+					return false
+				}
+				if !bytes.Equal(actual, []byte(value)) {
+					mismatch = fmt.Errorf("%s: %s = %q, expected %q", c.Node(i), key, actual, value)
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	if !c.RunUntil(check, electionTimeout) {
+		return mismatch
+	}
+	return nil
+}
+
+//
+// Wait until every node has the same value for the key.  Return
+// the value.
+//
+func (c *Cluster) waitForAgreement(nodes []int, key string) (string, error) {
+
+	var value []byte
+	var mismatch error
+	check := func() bool {
+		for n, i := range nodes {
+			actual, err := c.Get(i, key)
+			if err != nil {
+				mismatch = fmt.Errorf("%s: read %s failed: %v", c.Node(i), key, err)
+				return false
+			}
+			if n == 0 {
+				value = actual
+			} else if !bytes.Equal(actual, value) {
+				mismatch = fmt.Errorf("%s: %s = %q, %s: %s = %q", c.Node(nodes[0]), key, value, c.Node(i), key, actual)
+				return false
+			}
+		}
+		return true
+	}
+
+	if !c.RunUntil(check, electionTimeout) {
+		return "", mismatch
+	}
+	return string(value), nil
+}
+
+//
+// Return the status of the nodes for diagnostic.
+//
+func (c *Cluster) statuses() []string {
+
+	var result []string
+	for i := 0; i < c.options.Nodes; i++ {
+		status := "DOWN"
+		if c.IsRunning(i) {
+			status = statusName(c.GetStatus(i))
+		}
+		result = append(result, c.Node(i)+"="+status)
+	}
+	return result
+}
+
+func statusName(status protocol.PeerStatus) string {
+	switch status {
+	case protocol.LEADING:
+		return "LEADING"
+	case protocol.FOLLOWING:
+		return "FOLLOWING"
+	case protocol.WATCHING:
+		return "WATCHING"
+	}
+	return "ELECTING"
+}
+
+func except(nodes []int, excluded int) []int {
+
+	var result []int
+	for _, i := range nodes {
+		if i != excluded {
+			result = append(result, i)
+		}
+	}
+	return result
+}
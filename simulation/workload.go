@@ -0,0 +1,135 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulation
+
+import (
+	"fmt"
+	"github.com/couchbase/gometa/common"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Type Declaration
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// A workload of concurrent clients.  Each client is bound to a node
+// (client i sends its requests to node i modulo the number of nodes),
+// and runs a random sequence of Set and Get on a small set of keys.
+// Each value written is unique, such that a read tells which write
+// it observes.
+//
+type Workload struct {
+	Clients    int           // number of concurrent clients
+	Operations int           // number of operations of each client
+	Keys       int           // number of keys
+	ReadRatio  float64       // probability that an operation is a Get
+	Timeout    time.Duration // (fake) time after which a request is given up
+	Pause      time.Duration // (fake) time a client waits when its node is down
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////////
+
+//
+// Start the clients of the workload in the background, and record
+// their operations in the history.  The clients only make progress while
+// the scheduler runs.  Return a channel that is closed when all the
+// clients are done.
+//
+func (c *Cluster) StartWorkload(w Workload, history *History) <-chan bool {
+
+	donech := make(chan bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.Clients; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			c.runClient(client, w, history)
+		}(i)
+	}
+
+	go func() {
+		wg.Wait()
+		close(donech)
+	}()
+
+	return donech
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////////
+
+func (c *Cluster) runClient(client int, w Workload, history *History) {
+
+	node := client % c.options.Nodes
+	random := rand.New(rand.NewSource(c.options.Seed + int64(client)))
+
+	for n := 0; n < w.Operations; {
+
+		if !c.IsRunning(node) {
+			// A request to a node that is down is not recorded, since it
+			// cannot have any effect.
+			c.clock.Sleep(w.Pause)
+			continue
+		}
+
+		key := fmt.Sprintf("/linearizable/%d", random.Intn(w.Keys))
+		opCode := common.OPCODE_SET
+		var value []byte
+		if random.Float64() < w.ReadRatio {
+			opCode = common.OPCODE_GET
+		} else {
+			value = []byte(fmt.Sprintf("c%d-%d", client, n))
+		}
+
+		op := history.Invoke(client, node, opCode, key, value)
+		result, err := c.call(node, opCode, key, value, w.Timeout)
+		history.Complete(op, result, err)
+
+		if err != nil {
+			log.Printf("Cluster.runClient() : Client %d : %s %s on node %s failed : %v",
+				client, common.GetOpCodeStr(opCode), key, c.Node(node), err)
+		}
+		n++
+	}
+}
+
+//
+// Send a client request to the node, and wait until the request is done
+// or the (fake) timeout fires.  Unlike Request, this does not run the
+// scheduler, so it can be called from any goroutine.
+//
+func (c *Cluster) call(i int, opCode common.OpCode, key string, value []byte, timeout time.Duration) ([]byte, error) {
+
+	respch := c.submit(i, opCode, key, value)
+
+	timer := c.clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-respch:
+		return resp.result, resp.err
+	case <-timer.Chan():
+		return nil, common.NewError(common.TIMEOUT_ERROR, "Cluster : Request "+key+" to node "+c.Node(i)+" timed out")
+	}
+}